@@ -0,0 +1,99 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// IAckQueue is a queue with at-least-once delivery.
+// A popped message is delivered again if it is not acked within the visibility timeout,
+// and goes to the dead letter queue after too many attempts.
+type IAckQueue interface {
+	Push([]byte) error
+
+	// Pop blocks until a message is available, and returns EXIT once ctx is done.
+	Pop() (IDelivery, error)
+}
+
+// IDelivery is a popped message of an IAckQueue
+type IDelivery interface {
+	Data() []byte
+
+	// Attempt is 1 for the first delivery of a message
+	Attempt() int
+
+	Ack() error
+
+	// Nack gives the message back at once, it is not delivered again after the last attempt.
+	Nack() error
+}
+
+const (
+	DefaultAckQueueVisibilityTimeout = 30 * time.Second
+	DefaultAckQueueMaxAttempts       = 5
+)
+
+// DeliveryExpired is returned when a delivery is acked or nacked after its visibility timeout,
+// the message has been given back and may be delivered again.
+var DeliveryExpired = errors.New("DeliveryExpired")
+
+func InitAckQueue(config interface{}) (queue IAckQueue, err error) {
+	switch c := config.(type) {
+	case nil:
+		return nil, fmt.Errorf("Need Config to init ack queue")
+	case *RedisAckQueueConfig:
+		client := &RedisAckQueue{}
+		err = client.Init(c)
+
+		if err != nil {
+			return
+		}
+		return client, nil
+	case *MemoryAckQueueConfig:
+		client := &MemoryAckQueue{}
+		err = client.Init(c)
+
+		if err != nil {
+			return
+		}
+		return client, nil
+	default:
+		return nil, fmt.Errorf("Config is not support %v", config)
+	}
+}
+
+type delivery struct {
+	data    []byte
+	attempt int
+	ack     func() error
+	nack    func() error
+}
+
+func (d *delivery) Data() []byte {
+	return d.data
+}
+
+func (d *delivery) Attempt() int {
+	return d.attempt
+}
+
+func (d *delivery) Ack() error {
+	return d.ack()
+}
+
+func (d *delivery) Nack() error {
+	return d.nack()
+}
+
+func ackQueueDefaults(visibilityTimeout time.Duration, maxAttempts int) (time.Duration, int) {
+	if visibilityTimeout <= 0 {
+		visibilityTimeout = DefaultAckQueueVisibilityTimeout
+	}
+
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultAckQueueMaxAttempts
+	}
+
+	return visibilityTimeout, maxAttempts
+}
@@ -0,0 +1,204 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+// ackQueueBehaviorSuite is the behavior every IAckQueue implementation must have
+type ackQueueBehaviorSuite struct {
+	suite.Suite
+	newConfig func(name string, ctx context.Context, deadLetterQueue IQueue) interface{}
+
+	ctx             context.Context
+	cancel          context.CancelFunc
+	queue           IAckQueue
+	deadLetterQueue IQueue
+}
+
+func (s *ackQueueBehaviorSuite) SetupTest() {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	name := fmt.Sprintf("NSK_TEST_ACK_QUEUE_%d", time.Now().UnixNano())
+
+	deadLetterQueue, err := InitQueue(&MemoryQueueConfig{Name: name + ":dead", Ctx: s.ctx})
+	s.Nil(err)
+	s.deadLetterQueue = deadLetterQueue
+
+	queue, err := InitAckQueue(s.newConfig(name, s.ctx, deadLetterQueue))
+	s.Nil(err)
+	s.queue = queue
+}
+
+func (s *ackQueueBehaviorSuite) TearDownTest() {
+	s.cancel()
+}
+
+func (s *ackQueueBehaviorSuite) pop() IDelivery {
+	d, err := s.queue.Pop()
+	s.Nil(err)
+
+	return d
+}
+
+func (s *ackQueueBehaviorSuite) TestAck() {
+	s.Nil(s.queue.Push([]byte("1")))
+	s.Nil(s.queue.Push([]byte("2")))
+
+	d := s.pop()
+	s.Equal("1", string(d.Data()))
+	s.Equal(1, d.Attempt())
+	s.Nil(d.Ack())
+	s.Equal(DeliveryExpired, d.Ack())
+
+	d = s.pop()
+	s.Equal("2", string(d.Data()))
+	s.Nil(d.Ack())
+
+	// nothing is delivered again after the visibility timeout
+	done := make(chan error)
+	go func() {
+		_, err := s.queue.Pop()
+		done <- err
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	s.cancel()
+	s.Equal(EXIT, <-done)
+}
+
+func (s *ackQueueBehaviorSuite) TestRedeliveryAfterVisibilityTimeout() {
+	s.Nil(s.queue.Push([]byte("hello")))
+
+	first := s.pop()
+	s.Equal(1, first.Attempt())
+
+	start := time.Now()
+	second := s.pop()
+	s.True(time.Since(start) >= 100*time.Millisecond)
+	s.Equal("hello", string(second.Data()))
+	s.Equal(2, second.Attempt())
+
+	// the first delivery can't be acked any more
+	s.Equal(DeliveryExpired, first.Ack())
+	s.Nil(second.Ack())
+}
+
+func (s *ackQueueBehaviorSuite) TestNackAndDeadLetter() {
+	s.Nil(s.queue.Push([]byte("poison")))
+
+	d := s.pop()
+	s.Nil(d.Nack())
+	s.Equal(DeliveryExpired, d.Ack())
+
+	d = s.pop()
+	s.Equal("poison", string(d.Data()))
+	s.Equal(2, d.Attempt())
+
+	// the last attempt goes to the dead letter queue
+	s.Nil(d.Nack())
+
+	msg, err := s.deadLetterQueue.Pop()
+	s.Nil(err)
+	s.Equal("poison", string(msg))
+}
+
+func TestMemoryAckQueue(t *testing.T) {
+	suite.Run(t, &ackQueueBehaviorSuite{newConfig: func(name string, ctx context.Context, deadLetterQueue IQueue) interface{} {
+		return &MemoryAckQueueConfig{
+			Name:              name,
+			Ctx:               ctx,
+			VisibilityTimeout: 200 * time.Millisecond,
+			MaxAttempts:       2,
+			DeadLetterQueue:   deadLetterQueue,
+		}
+	}})
+}
+
+func TestRedisAckQueue(t *testing.T) {
+	client := testRedisClient(t)
+
+	suite.Run(t, &ackQueueBehaviorSuite{newConfig: redisAckQueueConfig(client)})
+}
+
+func TestRedisAckQueueOnMiniredis(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	// the behavior suite runs with the checks of stream entries
+	suite.Run(t, &redisAckQueueTestSuite{
+		ackQueueBehaviorSuite: ackQueueBehaviorSuite{newConfig: redisAckQueueConfig(client)},
+		client:                client,
+	})
+}
+
+// redisAckQueueTestSuite checks entries of the stream which are not written by RedisAckQueue
+type redisAckQueueTestSuite struct {
+	ackQueueBehaviorSuite
+	client *redis.Client
+}
+
+func (s *redisAckQueueTestSuite) name() string {
+	return s.queue.(*RedisAckQueue).name
+}
+
+func (s *redisAckQueueTestSuite) TestInvalidEntryIsDeadLettered() {
+	s.Nil(s.client.XAdd(&redis.XAddArgs{Stream: s.name(), Values: map[string]interface{}{"foo": "bar"}}).Err())
+	s.Nil(s.queue.Push([]byte("valid")))
+
+	d := s.pop()
+	s.Equal("valid", string(d.Data()))
+	s.Nil(d.Ack())
+
+	msg, err := s.deadLetterQueue.Pop()
+	s.Nil(err)
+	s.Equal(`{"foo":"bar"}`, string(msg))
+}
+
+func (s *redisAckQueueTestSuite) TestInvalidPendingEntryIsDeadLettered() {
+	s.Nil(s.client.XAdd(&redis.XAddArgs{Stream: s.name(), Values: map[string]interface{}{"data": "foreign"}}).Err())
+
+	// another consumer reads it and never acks it
+	s.Nil(s.client.XReadGroup(&redis.XReadGroupArgs{
+		Group:    DefaultRedisAckQueueGroup,
+		Consumer: "other",
+		Streams:  []string{s.name(), ">"},
+		Count:    1,
+	}).Err())
+
+	s.Nil(s.queue.Push([]byte("valid")))
+
+	// the claim after the visibility timeout moves it away instead of failing every Pop
+	time.Sleep(250 * time.Millisecond)
+
+	d := s.pop()
+	s.Equal("valid", string(d.Data()))
+	s.Nil(d.Ack())
+
+	msg, err := s.deadLetterQueue.Pop()
+	s.Nil(err)
+	s.Equal("foreign", string(msg))
+}
+
+func redisAckQueueConfig(client *redis.Client) func(name string, ctx context.Context, deadLetterQueue IQueue) interface{} {
+	return func(name string, ctx context.Context, deadLetterQueue IQueue) interface{} {
+		return &RedisAckQueueConfig{
+			Name:              name,
+			Ctx:               ctx,
+			Client:            client,
+			VisibilityTimeout: 200 * time.Millisecond,
+			MaxAttempts:       2,
+			DeadLetterQueue:   deadLetterQueue,
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"fmt"
+)
+
+// IPusher is the producer side of IQueue and IBus
+type IPusher interface {
+	Push([]byte) error
+}
+
+// IBus is a broadcast message bus, every subscription receives every message pushed after it is made.
+// Unlike IQueue, a message is not kept for subscribers which are gone or too slow,
+// consumers use sequences in messages to find out what they missed.
+type IBus interface {
+	// Push publishes the message to all subscriptions
+	Push([]byte) error
+
+	Subscribe() (ISubscription, error)
+}
+
+// ISubscription receives messages of an IBus, Pop returns EXIT once ctx is done or it is closed.
+type ISubscription interface {
+	IQueue
+
+	Close() error
+}
+
+const DefaultBusBufferSize = 1024
+
+func InitBus(config interface{}) (bus IBus, err error) {
+	switch c := config.(type) {
+	case nil:
+		return nil, fmt.Errorf("Need Config to init bus")
+	case *RedisBusConfig:
+		client := &RedisBus{}
+		err = client.Init(c)
+
+		if err != nil {
+			return
+		}
+		return client, nil
+	case *MemoryBusConfig:
+		client := &MemoryBus{}
+		err = client.Init(c)
+
+		if err != nil {
+			return
+		}
+		return client, nil
+	default:
+		return nil, fmt.Errorf("Config is not support %v", config)
+	}
+}
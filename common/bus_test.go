@@ -0,0 +1,106 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+// busBehaviorSuite is the behavior every IBus implementation must have
+type busBehaviorSuite struct {
+	suite.Suite
+	newConfig func(name string, ctx context.Context) interface{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	bus    IBus
+}
+
+func (s *busBehaviorSuite) SetupTest() {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	bus, err := InitBus(s.newConfig(fmt.Sprintf("NSK_TEST_BUS_%d", time.Now().UnixNano()), s.ctx))
+	s.Nil(err)
+	s.bus = bus
+}
+
+func (s *busBehaviorSuite) TearDownTest() {
+	s.cancel()
+}
+
+func (s *busBehaviorSuite) TestEverySubscriptionReceivesEveryMessage() {
+	sub1, err := s.bus.Subscribe()
+	s.Nil(err)
+	sub2, err := s.bus.Subscribe()
+	s.Nil(err)
+
+	for i := 0; i < 3; i++ {
+		s.Nil(s.bus.Push([]byte(fmt.Sprintf("msg-%d", i))))
+	}
+
+	for _, sub := range []ISubscription{sub1, sub2} {
+		for i := 0; i < 3; i++ {
+			msg, err := sub.Pop()
+			s.Nil(err)
+			s.Equal(fmt.Sprintf("msg-%d", i), string(msg))
+		}
+	}
+}
+
+func (s *busBehaviorSuite) TestPopExits() {
+	sub1, _ := s.bus.Subscribe()
+	sub2, _ := s.bus.Subscribe()
+
+	s.Nil(sub1.Close())
+	_, err := sub1.Pop()
+	s.Equal(EXIT, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := sub2.Pop()
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	s.cancel()
+
+	select {
+	case err := <-done:
+		s.Equal(EXIT, err)
+	case <-time.After(3 * time.Second):
+		s.Fail("pop is still blocked after cancel")
+	}
+}
+
+func TestMemoryBus(t *testing.T) {
+	suite.Run(t, &busBehaviorSuite{newConfig: func(name string, ctx context.Context) interface{} {
+		return &MemoryBusConfig{Name: name, Ctx: ctx}
+	}})
+}
+
+func TestRedisBus(t *testing.T) {
+	client := testRedisClient(t)
+
+	suite.Run(t, &busBehaviorSuite{newConfig: func(name string, ctx context.Context) interface{} {
+		return &RedisBusConfig{Channel: name, Ctx: ctx, Client: client}
+	}})
+}
+
+func TestMemoryBusDropsForSlowSubscription(t *testing.T) {
+	bus, _ := InitBus(&MemoryBusConfig{Name: fmt.Sprintf("NSK_TEST_SLOW_BUS_%d", time.Now().UnixNano()), BufferSize: 1})
+	sub, _ := bus.Subscribe()
+	defer sub.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := bus.Push([]byte(fmt.Sprintf("msg-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg, _ := sub.Pop()
+	if string(msg) != "msg-0" {
+		t.Fatalf("expected msg-0, got %s", msg)
+	}
+}
@@ -0,0 +1,237 @@
+package common
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type CandleInterval string
+
+const (
+	CandleInterval1m  CandleInterval = "1m"
+	CandleInterval5m  CandleInterval = "5m"
+	CandleInterval15m CandleInterval = "15m"
+	CandleInterval1h  CandleInterval = "1h"
+	CandleInterval4h  CandleInterval = "4h"
+	CandleInterval1d  CandleInterval = "1d"
+)
+
+var CandleIntervals = []CandleInterval{
+	CandleInterval1m,
+	CandleInterval5m,
+	CandleInterval15m,
+	CandleInterval1h,
+	CandleInterval4h,
+	CandleInterval1d,
+}
+
+var candleIntervalSeconds = map[CandleInterval]uint64{
+	CandleInterval1m:  60,
+	CandleInterval5m:  5 * 60,
+	CandleInterval15m: 15 * 60,
+	CandleInterval1h:  60 * 60,
+	CandleInterval4h:  4 * 60 * 60,
+	CandleInterval1d:  24 * 60 * 60,
+}
+
+func ParseCandleInterval(s string) (CandleInterval, error) {
+	interval := CandleInterval(s)
+	if _, ok := candleIntervalSeconds[interval]; !ok {
+		return "", fmt.Errorf("invalid candle interval %q", s)
+	}
+
+	return interval, nil
+}
+
+func (i CandleInterval) Seconds() uint64 {
+	return candleIntervalSeconds[i]
+}
+
+// OpenTime returns the open time of the bar containing timestamp, bars are aligned to UTC
+func (i CandleInterval) OpenTime(timestamp uint64) uint64 {
+	return timestamp - timestamp%i.Seconds()
+}
+
+// Candle is one OHLCV bar, OpenTime is in seconds.
+// Volume is in the base token, QuoteVolume in the quote token.
+// A bar without trades has the close of the previous bar as all its prices.
+type Candle struct {
+	MarketID    string          `json:"marketID"`
+	Interval    CandleInterval  `json:"interval"`
+	OpenTime    uint64          `json:"openTime"`
+	Open        decimal.Decimal `json:"open"`
+	High        decimal.Decimal `json:"high"`
+	Low         decimal.Decimal `json:"low"`
+	Close       decimal.Decimal `json:"close"`
+	Volume      decimal.Decimal `json:"volume"`
+	QuoteVolume decimal.Decimal `json:"quoteVolume"`
+	Trades      int             `json:"trades"`
+}
+
+func emptyCandle(marketID string, interval CandleInterval, openTime uint64, price decimal.Decimal) *Candle {
+	return &Candle{
+		MarketID: marketID,
+		Interval: interval,
+		OpenTime: openTime,
+		Open:     price,
+		High:     price,
+		Low:      price,
+		Close:    price,
+	}
+}
+
+func (c *Candle) addTrade(price, amount decimal.Decimal) {
+	if c.Trades == 0 {
+		c.Open, c.High, c.Low = price, price, price
+	}
+
+	if price.GreaterThan(c.High) {
+		c.High = price
+	}
+
+	if price.LessThan(c.Low) {
+		c.Low = price
+	}
+
+	c.Close = price
+	c.Volume = c.Volume.Add(amount)
+	c.QuoteVolume = c.QuoteVolume.Add(amount.Mul(price))
+	c.Trades = c.Trades + 1
+}
+
+func (c *Candle) Copy() *Candle {
+	res := *c
+	return &res
+}
+
+// FillCandleGaps adds empty bars between the candles and after the last one until to.
+// candles must be of the same market and interval, oldest first.
+func FillCandleGaps(candles []*Candle, interval CandleInterval, to uint64) []*Candle {
+	if len(candles) == 0 {
+		return candles
+	}
+
+	res := make([]*Candle, 0, len(candles))
+	step := interval.Seconds()
+	last := interval.OpenTime(to)
+
+	for i, candle := range candles {
+		res = append(res, candle)
+
+		end := last
+		if i+1 < len(candles) {
+			end = candles[i+1].OpenTime - step
+		}
+
+		for openTime := candle.OpenTime + step; openTime <= end; openTime = openTime + step {
+			res = append(res, emptyCandle(candle.MarketID, interval, openTime, candle.Close))
+		}
+	}
+
+	return res
+}
+
+// CandleStore keeps the bars with trades, empty bars are not saved
+type CandleStore interface {
+	// SaveCandle inserts the bar or replaces the bar with the same market, interval and open time
+	SaveCandle(candle *Candle) error
+
+	// GetCandles returns at most limit of the latest bars whose open time is in [from, to], oldest first
+	GetCandles(marketID string, interval CandleInterval, from, to uint64, limit int) ([]*Candle, error)
+}
+
+type MemoryCandleStore struct {
+	lock    sync.RWMutex
+	candles map[string][]*Candle
+}
+
+func NewMemoryCandleStore() *MemoryCandleStore {
+	return &MemoryCandleStore{candles: make(map[string][]*Candle)}
+}
+
+func (s *MemoryCandleStore) SaveCandle(candle *Candle) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := candleStoreKey(candle.MarketID, candle.Interval)
+	candles := s.candles[key]
+
+	i := sort.Search(len(candles), func(i int) bool { return candles[i].OpenTime >= candle.OpenTime })
+	if i < len(candles) && candles[i].OpenTime == candle.OpenTime {
+		candles[i] = candle.Copy()
+		return nil
+	}
+
+	candles = append(candles, nil)
+	copy(candles[i+1:], candles[i:])
+	candles[i] = candle.Copy()
+	s.candles[key] = candles
+
+	return nil
+}
+
+func (s *MemoryCandleStore) GetCandles(marketID string, interval CandleInterval, from, to uint64, limit int) ([]*Candle, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	candles := s.candles[candleStoreKey(marketID, interval)]
+
+	start := sort.Search(len(candles), func(i int) bool { return candles[i].OpenTime >= from })
+	end := sort.Search(len(candles), func(i int) bool { return candles[i].OpenTime > to })
+
+	if limit > 0 && end-start > limit {
+		start = end - limit
+	}
+
+	res := make([]*Candle, 0, end-start)
+	for _, candle := range candles[start:end] {
+		res = append(res, candle.Copy())
+	}
+
+	return res, nil
+}
+
+func candleStoreKey(marketID string, interval CandleInterval) string {
+	return marketID + "#" + string(interval)
+}
+
+const CandleChannelPrefix = "Candles"
+
+const WsTypeCandleUpdate = "candleUpdate"
+
+type WebsocketCandleUpdatePayload struct {
+	Type   string  `json:"type"`
+	Candle *Candle `json:"candle"`
+}
+
+func GetCandleChannelID(marketID string, interval CandleInterval) string {
+	return fmt.Sprintf("%s#%s#%s", CandleChannelPrefix, marketID, interval)
+}
+
+// ParseCandleChannelID returns the market and interval of a candles channel
+func ParseCandleChannelID(channelID string) (marketID string, interval CandleInterval, err error) {
+	parts := strings.Split(channelID, "#")
+	if len(parts) != 3 || parts[0] != CandleChannelPrefix || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid candles channel %q", channelID)
+	}
+
+	interval, err = ParseCandleInterval(parts[2])
+	if err != nil {
+		return "", "", err
+	}
+
+	return parts[1], interval, nil
+}
+
+func CandleUpdateMessage(candle *Candle) WebSocketMessage {
+	return WebSocketMessage{
+		ChannelID: GetCandleChannelID(candle.MarketID, candle.Interval),
+		Payload: &WebsocketCandleUpdatePayload{
+			Type:   WsTypeCandleUpdate,
+			Candle: candle,
+		},
+	}
+}
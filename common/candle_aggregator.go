@@ -0,0 +1,162 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+	"sync"
+)
+
+// DefaultCandleHistoryLimit is the number of bars sent to a new subscriber of a candles channel
+const DefaultCandleHistoryLimit = 500
+
+// CandleAggregator builds bars of each interval from trades and saves them to the store.
+// The current bar of each market and interval is kept in memory, it is loaded from the store the first time the market trades.
+type CandleAggregator struct {
+	store     CandleStore
+	intervals []CandleInterval
+
+	lock    sync.Mutex
+	current map[string]*Candle
+}
+
+// NewCandleAggregator builds bars of all CandleIntervals if no interval is given
+func NewCandleAggregator(store CandleStore, intervals ...CandleInterval) *CandleAggregator {
+	if len(intervals) == 0 {
+		intervals = CandleIntervals
+	}
+
+	return &CandleAggregator{
+		store:     store,
+		intervals: intervals,
+		current:   make(map[string]*Candle),
+	}
+}
+
+// AddTrade counts the trade in the bar of each interval and returns a candleUpdate message for each changed bar.
+// A trade older than the current bar is counted in the current bar.
+func (a *CandleAggregator) AddTrade(marketID string, price, amount decimal.Decimal, timestamp uint64) (msgs []WebSocketMessage, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, interval := range a.intervals {
+		candle, loadErr := a.bar(marketID, interval, interval.OpenTime(timestamp))
+		if loadErr != nil {
+			return msgs, loadErr
+		}
+
+		candle.addTrade(price, amount)
+
+		if err = a.store.SaveCandle(candle); err != nil {
+			return msgs, err
+		}
+
+		msgs = append(msgs, CandleUpdateMessage(candle.Copy()))
+	}
+
+	return msgs, nil
+}
+
+// AddMatchResult adds a trade at the maker price for each item which is not canceled
+func (a *CandleAggregator) AddMatchResult(matchResult *MatchResult, timestamp uint64) (msgs []WebSocketMessage, err error) {
+	for _, item := range matchResult.MatchItems {
+		if item.MatchShouldBeCanceled {
+			continue
+		}
+
+		itemMsgs, err := a.AddTrade(matchResult.TakerOrder.MarketID, item.MakerOrder.Price, item.MatchedAmount, timestamp)
+		msgs = append(msgs, itemMsgs...)
+
+		if err != nil {
+			return msgs, err
+		}
+	}
+
+	return msgs, nil
+}
+
+// Tick starts an empty bar for each interval which has passed without trades, so live charts move on.
+// It should be called at least once a minute.
+func (a *CandleAggregator) Tick(now uint64) (msgs []WebSocketMessage) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for key, candle := range a.current {
+		openTime := candle.Interval.OpenTime(now)
+		if candle.OpenTime >= openTime {
+			continue
+		}
+
+		next := emptyCandle(candle.MarketID, candle.Interval, openTime, candle.Close)
+		a.current[key] = next
+
+		msgs = append(msgs, CandleUpdateMessage(next.Copy()))
+	}
+
+	return msgs
+}
+
+// Candles returns at most limit of the latest bars until to, empty bars included
+func (a *CandleAggregator) Candles(marketID string, interval CandleInterval, to uint64, limit int) ([]*Candle, error) {
+	if limit <= 0 {
+		limit = DefaultCandleHistoryLimit
+	}
+
+	step := interval.Seconds()
+	last := interval.OpenTime(to)
+
+	var from uint64
+	if last > uint64(limit-1)*step {
+		from = last - uint64(limit-1)*step
+	}
+
+	candles, err := a.store.GetCandles(marketID, interval, from, last, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// the bar before the range gives the prices of empty bars at its start
+	if from > 0 && (len(candles) == 0 || candles[0].OpenTime > from) {
+		previous, err := a.store.GetCandles(marketID, interval, 0, from-1, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(previous) > 0 {
+			candles = append(previous, candles...)
+		}
+	}
+
+	candles = FillCandleGaps(candles, interval, to)
+
+	for len(candles) > 0 && candles[0].OpenTime < from {
+		candles = candles[1:]
+	}
+
+	return candles, nil
+}
+
+// bar returns the current bar of the market and interval, a new bar is started if openTime is after it
+func (a *CandleAggregator) bar(marketID string, interval CandleInterval, openTime uint64) (*Candle, error) {
+	key := candleStoreKey(marketID, interval)
+
+	candle, exist := a.current[key]
+	if !exist {
+		latest, err := a.store.GetCandles(marketID, interval, 0, openTime, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(latest) > 0 {
+			candle = latest[0]
+		}
+	}
+
+	if candle == nil {
+		candle = emptyCandle(marketID, interval, openTime, decimal.Zero)
+	} else if candle.OpenTime < openTime {
+		candle = emptyCandle(marketID, interval, openTime, candle.Close)
+	}
+
+	a.current[key] = candle
+
+	return candle, nil
+}
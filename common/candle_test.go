@@ -0,0 +1,116 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type candleTestSuite struct {
+	suite.Suite
+	store      *MemoryCandleStore
+	aggregator *CandleAggregator
+}
+
+func TestCandleTestSuite(t *testing.T) {
+	suite.Run(t, new(candleTestSuite))
+}
+
+func (s *candleTestSuite) SetupTest() {
+	s.store = NewMemoryCandleStore()
+	s.aggregator = NewCandleAggregator(s.store, CandleInterval1m, CandleInterval5m)
+}
+
+func (s *candleTestSuite) addTrade(price, amount string, timestamp uint64) []WebSocketMessage {
+	msgs, err := s.aggregator.AddTrade("HOT-WETH", decimal.RequireFromString(price), decimal.RequireFromString(amount), timestamp)
+	s.Nil(err)
+	return msgs
+}
+
+func (s *candleTestSuite) assertCandle(candle *Candle, openTime uint64, open, high, low, close, volume string, trades int) {
+	s.Equal(openTime, candle.OpenTime)
+	s.Equal(open, candle.Open.String())
+	s.Equal(high, candle.High.String())
+	s.Equal(low, candle.Low.String())
+	s.Equal(close, candle.Close.String())
+	s.Equal(volume, candle.Volume.String())
+	s.Equal(trades, candle.Trades)
+}
+
+func (s *candleTestSuite) TestAddTrade() {
+	msgs := s.addTrade("1.5", "2", 6000)
+	s.Len(msgs, 2)
+	s.Equal("Candles#HOT-WETH#1m", msgs[0].ChannelID)
+	s.Equal("Candles#HOT-WETH#5m", msgs[1].ChannelID)
+
+	s.addTrade("1.7", "1", 6010)
+	msgs = s.addTrade("1.4", "1", 6059)
+
+	s.assertCandle(msgs[0].Payload.(*WebsocketCandleUpdatePayload).Candle, 6000, "1.5", "1.7", "1.4", "1.4", "4", 3)
+	s.Equal("6.1", msgs[0].Payload.(*WebsocketCandleUpdatePayload).Candle.QuoteVolume.String())
+
+	// next minute, same 5 minutes
+	msgs = s.addTrade("1.6", "1", 6060)
+	s.assertCandle(msgs[0].Payload.(*WebsocketCandleUpdatePayload).Candle, 6060, "1.6", "1.6", "1.6", "1.6", "1", 1)
+	s.assertCandle(msgs[1].Payload.(*WebsocketCandleUpdatePayload).Candle, 6000, "1.5", "1.7", "1.4", "1.6", "5", 4)
+
+	candles, err := s.store.GetCandles("HOT-WETH", CandleInterval1m, 0, 10000, 0)
+	s.Nil(err)
+	s.Len(candles, 2)
+}
+
+func (s *candleTestSuite) TestEmptyIntervals() {
+	s.addTrade("1.5", "2", 6000)
+	s.addTrade("1.8", "1", 6200)
+
+	candles, err := s.aggregator.Candles("HOT-WETH", CandleInterval1m, 6300, 5)
+	s.Nil(err)
+	s.Len(candles, 5)
+
+	// 6060 and 6120 are empty, 6180 has a trade, 6240 and 6300 are empty
+	s.assertCandle(candles[0], 6060, "1.5", "1.5", "1.5", "1.5", "0", 0)
+	s.assertCandle(candles[1], 6120, "1.5", "1.5", "1.5", "1.5", "0", 0)
+	s.assertCandle(candles[2], 6180, "1.8", "1.8", "1.8", "1.8", "1", 1)
+	s.assertCandle(candles[4], 6300, "1.8", "1.8", "1.8", "1.8", "0", 0)
+
+	msgs := s.aggregator.Tick(6300)
+	s.Len(msgs, 2)
+
+	// the first trade of an empty bar opens it
+	msgs = s.addTrade("1.9", "1", 6301)
+	s.assertCandle(msgs[0].Payload.(*WebsocketCandleUpdatePayload).Candle, 6300, "1.9", "1.9", "1.9", "1.9", "1", 1)
+}
+
+func (s *candleTestSuite) TestContinueBarFromStore() {
+	s.addTrade("1.5", "2", 6000)
+
+	aggregator := NewCandleAggregator(s.store, CandleInterval1m)
+	msgs, err := aggregator.AddTrade("HOT-WETH", decimal.RequireFromString("1.2"), decimal.RequireFromString("1"), 6030)
+	s.Nil(err)
+
+	s.assertCandle(msgs[0].Payload.(*WebsocketCandleUpdatePayload).Candle, 6000, "1.5", "1.5", "1.2", "1.2", "3", 2)
+}
+
+func (s *candleTestSuite) TestAddMatchResult() {
+	msgs, err := s.aggregator.AddMatchResult(&MatchResult{
+		TakerOrder: &MemoryOrder{MarketID: "HOT-WETH"},
+		MatchItems: []*MatchItem{
+			{MakerOrder: &MemoryOrder{Price: decimal.New(2, 0)}, MatchedAmount: decimal.New(1, 0)},
+			{MakerOrder: &MemoryOrder{Price: decimal.New(3, 0)}, MatchedAmount: decimal.New(1, 0), MatchShouldBeCanceled: true},
+		},
+	}, 6000)
+
+	s.Nil(err)
+	s.Len(msgs, 2)
+	s.assertCandle(msgs[0].Payload.(*WebsocketCandleUpdatePayload).Candle, 6000, "2", "2", "2", "2", "1", 1)
+}
+
+func (s *candleTestSuite) TestChannelID() {
+	marketID, interval, err := ParseCandleChannelID(GetCandleChannelID("HOT-WETH", CandleInterval4h))
+	s.Nil(err)
+	s.Equal("HOT-WETH", marketID)
+	s.Equal(CandleInterval4h, interval)
+
+	_, _, err = ParseCandleChannelID("Candles#HOT-WETH#2m")
+	s.Error(err)
+}
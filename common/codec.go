@@ -0,0 +1,259 @@
+package common
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// IPayloadCodec encodes WebSocketMessages on queues and buses.
+// An encoded message starts with the ID of its codec, so consumers decode messages of any registered codec.
+type IPayloadCodec interface {
+	ID() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// UnknownPayloadType is returned for a payload whose type and version are not registered
+var UnknownPayloadType = errors.New("UnknownPayloadType")
+
+const WsTypeOrderbookChange = "orderbookChange"
+
+// JSONCodec is the default codec, its messages are plain json objects
+// and the ID is the opening brace, so json messages of older producers are decoded as well.
+var JSONCodec IPayloadCodec = jsonCodec{}
+
+// GobCodec is a binary codec which keeps the Go types of interface{} fields, which must be registered with gob.Register.
+// Each message carries its gob type descriptors, so it is not smaller than json.
+var GobCodec IPayloadCodec = gobCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte {
+	return '{'
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ID() byte {
+	return 'G'
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type payloadTypeKey struct {
+	name    string
+	version int
+}
+
+var (
+	codecs              = make(map[byte]IPayloadCodec)
+	payloadTypes        = make(map[payloadTypeKey]func() interface{})
+	payloadTypesByGo    = make(map[reflect.Type]payloadTypeKey)
+	payloadRegistryLock = &sync.RWMutex{}
+)
+
+// legacyPayloadTypes are the payload types of untagged json messages without a type field, by channel prefix
+var legacyPayloadTypes = map[string]string{
+	MarketChannelPrefix: WsTypeOrderbookChange,
+}
+
+func init() {
+	RegisterCodec(JSONCodec)
+	RegisterCodec(GobCodec)
+
+	RegisterPayloadType(WsTypeOrderbookChange, 1, func() interface{} { return &WebsocketMarketOrderChangePayload{} })
+	RegisterPayloadType(WsTypeOrderChange, 1, func() interface{} { return &WebsocketOrderChangePayload{} })
+	RegisterPayloadType(WsTypeTradeChange, 1, func() interface{} { return &WebsocketTradeChangePayload{} })
+	RegisterPayloadType(WsTypeLockedBalanceChange, 1, func() interface{} { return &WebsocketLockedBalanceChangePayload{} })
+	RegisterPayloadType(WsTypeNewMarketTrade, 1, func() interface{} { return &WebsocketMarketNewMarketTradePayload{} })
+	RegisterPayloadType(WsTypeCandleUpdate, 1, func() interface{} { return &WebsocketCandleUpdatePayload{} })
+	RegisterPayloadType(WsTypeTickerUpdate, 1, func() interface{} { return &WebsocketTickerUpdatePayload{} })
+
+	// the order of orderChange payloads
+	gob.Register(&MemoryOrder{})
+}
+
+// RegisterCodec makes messages of the codec decodable, it panics if the ID is taken
+func RegisterCodec(codec IPayloadCodec) {
+	payloadRegistryLock.Lock()
+	defer payloadRegistryLock.Unlock()
+
+	if _, exist := codecs[codec.ID()]; exist {
+		panic(fmt.Errorf("codec %q is registered twice", codec.ID()))
+	}
+
+	codecs[codec.ID()] = codec
+}
+
+// RegisterPayloadType tags payloads of the type returned by newPayload with name and version.
+// newPayload returns a pointer to a new payload, it is used when a message of the tag is decoded.
+// A changed payload is registered as a new version with a new type, so old messages are still decoded.
+func RegisterPayloadType(name string, version int, newPayload func() interface{}) {
+	payloadRegistryLock.Lock()
+	defer payloadRegistryLock.Unlock()
+
+	key := payloadTypeKey{name: name, version: version}
+	goType := reflect.TypeOf(newPayload())
+
+	if _, exist := payloadTypes[key]; exist {
+		panic(fmt.Errorf("payload type %s version %d is registered twice", name, version))
+	}
+
+	if _, exist := payloadTypesByGo[goType]; exist {
+		panic(fmt.Errorf("payload type %s is registered twice", goType))
+	}
+
+	payloadTypes[key] = newPayload
+	payloadTypesByGo[goType] = key
+}
+
+// PayloadTypeOf returns the registered tag of the payload
+func PayloadTypeOf(payload interface{}) (name string, version int, exist bool) {
+	goType := reflect.TypeOf(payload)
+	if goType != nil && goType.Kind() != reflect.Ptr {
+		goType = reflect.PtrTo(goType)
+	}
+
+	payloadRegistryLock.RLock()
+	defer payloadRegistryLock.RUnlock()
+
+	key, exist := payloadTypesByGo[goType]
+
+	return key.name, key.version, exist
+}
+
+// payloadEnvelope is an encoded WebSocketMessage, Payload is encoded by the same codec
+type payloadEnvelope struct {
+	ChannelID string          `json:"channel_id"`
+	Type      string          `json:"payload_type,omitempty"`
+	Version   int             `json:"payload_version,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// EncodeWebSocketMessage encodes the message with its payload tag.
+// JSONCodec also encodes payloads which are not registered, they are decoded as generic json values.
+func EncodeWebSocketMessage(codec IPayloadCodec, msg *WebSocketMessage) ([]byte, error) {
+	name, version, exist := PayloadTypeOf(msg.Payload)
+	if !exist && codec.ID() != JSONCodec.ID() {
+		return nil, UnknownPayloadType
+	}
+
+	payload, err := codec.Marshal(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := codec.Marshal(&payloadEnvelope{
+		ChannelID: msg.ChannelID,
+		Type:      name,
+		Version:   version,
+		Payload:   payload,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if codec.ID() == JSONCodec.ID() {
+		return body, nil
+	}
+
+	return append([]byte{codec.ID()}, body...), nil
+}
+
+// DecodeWebSocketMessage decodes the payload into its registered type.
+// A json message without a tag is decoded into the type named by the type field of its payload,
+// or the legacy type of its channel, or into a generic json value if there is neither. A tag which is not registered is UnknownPayloadType.
+func DecodeWebSocketMessage(data []byte) (*WebSocketMessage, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty websocket message")
+	}
+
+	payloadRegistryLock.RLock()
+	codec, exist := codecs[data[0]]
+	payloadRegistryLock.RUnlock()
+
+	if !exist {
+		return nil, fmt.Errorf("unknown codec %q of websocket message", data[0])
+	}
+
+	body := data
+	if codec.ID() != JSONCodec.ID() {
+		body = data[1:]
+	}
+
+	var envelope payloadEnvelope
+	if err := codec.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+
+	msg := &WebSocketMessage{ChannelID: envelope.ChannelID}
+	tagged := envelope.Type != ""
+
+	if !tagged && codec.ID() == JSONCodec.ID() {
+		var untyped struct {
+			Type string `json:"type"`
+		}
+
+		_ = json.Unmarshal(envelope.Payload, &untyped)
+		envelope.Type = untyped.Type
+		envelope.Version = 1
+
+		if envelope.Type == "" {
+			envelope.Type = legacyPayloadTypes[strings.Split(envelope.ChannelID, "#")[0]]
+		}
+	}
+
+	payloadRegistryLock.RLock()
+	newPayload, exist := payloadTypes[payloadTypeKey{name: envelope.Type, version: envelope.Version}]
+	payloadRegistryLock.RUnlock()
+
+	if !exist {
+		if tagged || codec.ID() != JSONCodec.ID() {
+			return nil, UnknownPayloadType
+		}
+
+		if len(envelope.Payload) > 0 {
+			if err := json.Unmarshal(envelope.Payload, &msg.Payload); err != nil {
+				return nil, err
+			}
+		}
+
+		return msg, nil
+	}
+
+	payload := newPayload()
+	if err := codec.Unmarshal(envelope.Payload, payload); err != nil {
+		return nil, err
+	}
+
+	msg.Payload = payload
+
+	return msg, nil
+}
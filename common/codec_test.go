@@ -0,0 +1,72 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type codecTestSuite struct {
+	suite.Suite
+}
+
+func (s *codecTestSuite) TestRoundTrip() {
+	order := &MemoryOrder{ID: "o1", Trader: "0xabc", Price: decimal.New(15, -1), Amount: decimal.New(2, 0)}
+	msgs := []WebSocketMessage{
+		orderUpdateMessage(order),
+		lockedBalanceChangeMessage("0xabc", "HOT"),
+		CandleUpdateMessage(&Candle{MarketID: "HOT-WETH", Interval: CandleInterval1m, OpenTime: 60, Close: decimal.New(3, 0)}),
+		{ChannelID: "Market#HOT-WETH", Payload: &WebsocketMarketOrderChangePayload{Side: "buy", Sequence: 7, Price: "1", Amount: "2"}},
+	}
+
+	for _, codec := range []IPayloadCodec{JSONCodec, GobCodec} {
+		for i := range msgs {
+			bts, err := EncodeWebSocketMessage(codec, &msgs[i])
+			s.Nil(err)
+			s.Equal(codec.ID(), bts[0])
+
+			msg, err := DecodeWebSocketMessage(bts)
+			s.Nil(err)
+			s.Equal(msgs[i].ChannelID, msg.ChannelID)
+			s.IsType(msgs[i].Payload, msg.Payload)
+		}
+	}
+
+	bts, _ := EncodeWebSocketMessage(GobCodec, &msgs[0])
+	msg, _ := DecodeWebSocketMessage(bts)
+	decoded := msg.Payload.(*WebsocketOrderChangePayload).Order.(*MemoryOrder)
+	s.Equal("o1", decoded.ID)
+	s.Equal("1.5", decoded.Price.String())
+}
+
+func (s *codecTestSuite) TestLegacyJSON() {
+	msg, err := DecodeWebSocketMessage([]byte(`{"channel_id":"TraderAddress#0xabc","payload":{"type":"lockedBalanceChange","symbol":"HOT","balance":"1"}}`))
+	s.Nil(err)
+	s.Equal("HOT", msg.Payload.(*WebsocketLockedBalanceChangePayload).Symbol)
+
+	// orderbook changes have no type field
+	msg, err = DecodeWebSocketMessage([]byte(`{"channel_id":"Market#HOT-WETH","payload":{"side":"buy","sequence":7}}`))
+	s.Nil(err)
+	s.Equal(uint64(7), msg.Payload.(*WebsocketMarketOrderChangePayload).Sequence)
+}
+
+func (s *codecTestSuite) TestUnknownPayloadType() {
+	msg := &WebSocketMessage{ChannelID: "test", Payload: map[string]string{"a": "b"}}
+
+	_, err := EncodeWebSocketMessage(GobCodec, msg)
+	s.Equal(UnknownPayloadType, err)
+
+	bts, err := EncodeWebSocketMessage(JSONCodec, msg)
+	s.Nil(err)
+
+	decoded, err := DecodeWebSocketMessage(bts)
+	s.Nil(err)
+	s.Equal("b", decoded.Payload.(map[string]interface{})["a"])
+
+	_, err = DecodeWebSocketMessage([]byte(`{"channel_id":"test","payload_type":"orderChange","payload_version":2,"payload":{}}`))
+	s.Equal(UnknownPayloadType, err)
+}
+
+func TestCodecSuite(t *testing.T) {
+	suite.Run(t, new(codecTestSuite))
+}
@@ -2,6 +2,7 @@ package common
 
 import "fmt"
 
+const STATUS_CREATED = "created"
 const STATUS_SUCCESSFUL = "successful"
 const STATUS_PENDING = "pending"
 const STATUS_FAILED = "failed"
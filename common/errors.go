@@ -0,0 +1,11 @@
+package common
+
+import "errors"
+
+// orderbook errors
+var (
+	ErrInvalidOrder      = errors.New("invalid order")
+	ErrOrderNotFound     = errors.New("order not found")
+	ErrOrderExists       = errors.New("order already exists")
+	ErrPriceLevelMissing = errors.New("price level not found")
+)
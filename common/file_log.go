@@ -0,0 +1,139 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var FileQueueCorrupted = ErrSegmentLogCorrupted
+
+const (
+	fileLogSegmentPrefix = "segment-"
+	fileLogOffsetPrefix  = "consumer-"
+	fileLogOffsetSuffix  = ".offset"
+	fileLogSyncInterval  = 100 * time.Millisecond
+)
+
+// fileLog is the SegmentLog of file queues on one directory, with the offsets of their consumers
+type fileLog struct {
+	*SegmentLog
+
+	dir           string
+	syncEveryPush bool
+
+	// handles using this log
+	refs int
+}
+
+var fileLogs = make(map[string]*fileLog)
+var fileLogsMutex = &sync.Mutex{}
+
+// acquireFileLog opens the log in config.Dir, or returns the log already opened in this process
+func acquireFileLog(config *FileQueueConfig) (*fileLog, error) {
+	dir, err := filepath.Abs(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fileLogsMutex.Lock()
+	defer fileLogsMutex.Unlock()
+
+	if l, exist := fileLogs[dir]; exist {
+		l.refs++
+		return l, nil
+	}
+
+	segmentSize := config.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = DefaultFileQueueSegmentSize
+	}
+
+	segmentLog, err := OpenSegmentLog(&SegmentLogConfig{
+		Dir:             dir,
+		Prefix:          fileLogSegmentPrefix,
+		SegmentSize:     segmentSize,
+		RetentionBytes:  config.RetentionBytes,
+		RetentionTime:   config.RetentionTime,
+		SyncEveryAppend: config.SyncEveryPush,
+		SyncInterval:    fileLogSyncInterval,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	l := &fileLog{
+		SegmentLog:    segmentLog,
+		dir:           dir,
+		syncEveryPush: config.SyncEveryPush,
+		refs:          1,
+	}
+
+	fileLogs[dir] = l
+
+	return l, nil
+}
+
+func (l *fileLog) release() error {
+	fileLogsMutex.Lock()
+	defer fileLogsMutex.Unlock()
+
+	l.refs--
+	if l.refs > 0 {
+		return nil
+	}
+
+	delete(fileLogs, l.dir)
+
+	return l.Close()
+}
+
+func (l *fileLog) offsetPath(consumer string) string {
+	return filepath.Join(l.dir, fileLogOffsetPrefix+consumer+fileLogOffsetSuffix)
+}
+
+// loadOffset returns the saved offset of the consumer, 0 if it has none
+func (l *fileLog) loadOffset(consumer string) (uint64, error) {
+	bts, err := ioutil.ReadFile(l.offsetPath(consumer))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(bts)), 10, 64)
+}
+
+// saveOffset replaces the offset file with a rename, so a crash leaves either the old or the new offset
+func (l *fileLog) saveOffset(consumer string, offset uint64) error {
+	path := l.offsetPath(consumer)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.WriteString(strconv.FormatUint(offset, 10)); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if l.syncEveryPush {
+		if err = f.Sync(); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultFileQueueSegmentSize = 64 * 1024 * 1024
+	DefaultFileQueueConsumer    = "default"
+
+	// the offset of a consumer is saved after this many handled messages, or this long after the last save
+	fileQueueOffsetSaveBatch    = 100
+	fileQueueOffsetSaveInterval = time.Second
+)
+
+// FileQueueConfig selects the file queue in InitQueue.
+// All queues on the same Dir in one process share the log, and each Consumer reads it from its own offset.
+// Old segments are removed once the log is larger than RetentionBytes, or a segment is older than RetentionTime,
+// which are checked when a new segment is started. Zero keeps everything.
+type FileQueueConfig struct {
+	Dir      string
+	Consumer string
+	Ctx      context.Context
+
+	SegmentSize    int64
+	RetentionBytes int64
+	RetentionTime  time.Duration
+
+	// sync the log after each Push, instead of every 100ms
+	SyncEveryPush bool
+}
+
+// FileQueue is an IQueue on an append-only log on the local disk, it survives restarts without Redis.
+// A message is handled once the consumer pops the next one. The offset of handled messages is saved
+// in batches, when the consumer waits for new messages and on Close,
+// so messages handled since the last save are delivered again after a crash.
+type FileQueue struct {
+	ctx      context.Context
+	log      *fileLog
+	consumer string
+	reader   *SegmentLogReader
+	handled  uint64
+	saved    uint64
+	savedAt  time.Time
+}
+
+func (queue *FileQueue) Init(config *FileQueueConfig) error {
+	if config.Dir == "" {
+		return fmt.Errorf("file queue dir is required")
+	}
+
+	log, err := acquireFileLog(config)
+	if err != nil {
+		return err
+	}
+
+	queue.log = log
+	queue.ctx = config.Ctx
+	if queue.ctx == nil {
+		queue.ctx = context.Background()
+	}
+
+	queue.consumer = config.Consumer
+	if queue.consumer == "" {
+		queue.consumer = DefaultFileQueueConsumer
+	}
+
+	return nil
+}
+
+func (queue *FileQueue) Push(data []byte) error {
+	_, err := queue.log.Append(data)
+	return err
+}
+
+// Pop returns the next message of the consumer, it blocks until a message is pushed or ctx is done
+func (queue *FileQueue) Pop() ([]byte, error) {
+	return queue.pop(nil)
+}
+
+// PopTimeout is Pop which returns QueueTimeout if no message is pushed in timeout
+func (queue *FileQueue) PopTimeout(timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	return queue.pop(timer.C)
+}
+
+// pop waits for a message until timeout fires, a nil timeout never fires
+func (queue *FileQueue) pop(timeout <-chan time.Time) ([]byte, error) {
+	if queue.reader == nil {
+		if err := queue.openReader(); err != nil {
+			return nil, err
+		}
+	}
+
+	// the last popped message is handled
+	queue.handled = queue.reader.Offset()
+
+	if queue.handled-queue.saved >= fileQueueOffsetSaveBatch || time.Since(queue.savedAt) >= fileQueueOffsetSaveInterval {
+		if err := queue.saveOffset(); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		next, appended := queue.log.Next()
+
+		if queue.reader.Offset() < next {
+			return queue.reader.Read()
+		}
+
+		if err := queue.saveOffset(); err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-queue.ctx.Done():
+			return nil, EXIT
+		case <-timeout:
+			return nil, QueueTimeout
+		case <-appended:
+		}
+	}
+}
+
+// Offset returns the offset of the next message of the consumer
+func (queue *FileQueue) Offset() (uint64, error) {
+	if queue.reader == nil {
+		return queue.log.loadOffset(queue.consumer)
+	}
+
+	return queue.reader.Offset(), nil
+}
+
+// Close saves the offset of handled messages and releases the log, which is closed after the last queue on it is closed
+func (queue *FileQueue) Close() error {
+	if queue.reader != nil {
+		queue.reader.Close()
+
+		if err := queue.saveOffset(); err != nil {
+			_ = queue.log.release()
+			return err
+		}
+	}
+
+	return queue.log.release()
+}
+
+func (queue *FileQueue) openReader() error {
+	offset, err := queue.log.loadOffset(queue.consumer)
+	if err != nil {
+		return err
+	}
+
+	// the log was replaced
+	if next, _ := queue.log.Next(); offset > next {
+		offset = next
+	}
+
+	queue.reader = queue.log.NewReader(offset)
+	queue.handled = offset
+	queue.saved = offset
+	queue.savedAt = time.Now()
+
+	return nil
+}
+
+// saveOffset saves the offset of handled messages if it has moved
+func (queue *FileQueue) saveOffset() error {
+	if queue.handled == queue.saved {
+		return nil
+	}
+
+	if err := queue.log.saveOffset(queue.consumer, queue.handled); err != nil {
+		return err
+	}
+
+	queue.saved = queue.handled
+	queue.savedAt = time.Now()
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileQueue(t *testing.T) {
+	suite.Run(t, &queueBehaviorSuite{newConfig: func(name string, ctx context.Context) interface{} {
+		dir, _ := ioutil.TempDir("", name)
+		return &FileQueueConfig{Dir: dir, Ctx: ctx}
+	}})
+}
+
+type fileQueueTestSuite struct {
+	suite.Suite
+	dir    string
+	ctx    context.Context
+	cancel context.CancelFunc
+	queues []*FileQueue
+}
+
+func TestFileQueueTestSuite(t *testing.T) {
+	suite.Run(t, new(fileQueueTestSuite))
+}
+
+func (s *fileQueueTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "file-queue")
+	s.Nil(err)
+
+	s.dir = dir
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.queues = nil
+}
+
+func (s *fileQueueTestSuite) TearDownTest() {
+	s.cancel()
+	s.closeAll()
+	_ = os.RemoveAll(s.dir)
+}
+
+func (s *fileQueueTestSuite) open(config *FileQueueConfig) *FileQueue {
+	config.Dir = s.dir
+	config.Ctx = s.ctx
+
+	queue, err := InitQueue(config)
+	s.Nil(err)
+	s.queues = append(s.queues, queue.(*FileQueue))
+
+	return queue.(*FileQueue)
+}
+
+func (s *fileQueueTestSuite) closeAll() {
+	for _, queue := range s.queues {
+		s.Nil(queue.Close())
+	}
+
+	s.queues = nil
+}
+
+func (s *fileQueueTestSuite) push(queue *FileQueue, from, to int) {
+	for i := from; i < to; i++ {
+		s.Nil(queue.Push([]byte(fmt.Sprintf("msg-%d", i))))
+	}
+}
+
+func (s *fileQueueTestSuite) pop(queue *FileQueue) string {
+	msg, err := queue.Pop()
+	s.Nil(err)
+
+	return string(msg)
+}
+
+func (s *fileQueueTestSuite) TestIndependentConsumers() {
+	producer := s.open(&FileQueueConfig{})
+	engine := s.open(&FileQueueConfig{Consumer: "engine"})
+	websocket := s.open(&FileQueueConfig{Consumer: "websocket"})
+
+	s.push(producer, 0, 3)
+
+	s.Equal("msg-0", s.pop(engine))
+	s.Equal("msg-1", s.pop(engine))
+	s.Equal("msg-0", s.pop(websocket))
+	s.Equal("msg-2", s.pop(engine))
+	s.Equal("msg-1", s.pop(websocket))
+}
+
+func (s *fileQueueTestSuite) TestOffsetsSurviveRestart() {
+	queue := s.open(&FileQueueConfig{Consumer: "engine"})
+	s.push(queue, 0, 3)
+
+	s.Equal("msg-0", s.pop(queue))
+	s.Equal("msg-1", s.pop(queue))
+	s.closeAll()
+
+	// msg-1 may not be handled, it is delivered again
+	queue = s.open(&FileQueueConfig{Consumer: "engine"})
+	offset, err := queue.Offset()
+	s.Nil(err)
+	s.Equal(uint64(1), offset)
+
+	s.Equal("msg-1", s.pop(queue))
+	s.Equal("msg-2", s.pop(queue))
+
+	s.push(queue, 3, 4)
+	s.Equal("msg-3", s.pop(queue))
+}
+
+func (s *fileQueueTestSuite) TestRecoverTornTail() {
+	queue := s.open(&FileQueueConfig{Consumer: "engine"})
+	s.push(queue, 0, 2)
+	s.closeAll()
+
+	// a crash in the middle of a write
+	segment := filepath.Join(s.dir, "segment-00000000000000000000.log")
+	f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+	s.Nil(err)
+	_, err = f.Write([]byte{0, 0, 0, 10, 1, 2, 3, 4, 'm', 's'})
+	s.Nil(err)
+	s.Nil(f.Close())
+
+	queue = s.open(&FileQueueConfig{Consumer: "engine"})
+	s.push(queue, 2, 3)
+
+	s.Equal("msg-0", s.pop(queue))
+	s.Equal("msg-1", s.pop(queue))
+	s.Equal("msg-2", s.pop(queue))
+}
+
+func (s *fileQueueTestSuite) TestCorruptedRecord() {
+	queue := s.open(&FileQueueConfig{SegmentSize: 1})
+	s.push(queue, 0, 3)
+	s.closeAll()
+
+	// flip a byte in the first segment, which is not the last one
+	segment := filepath.Join(s.dir, "segment-00000000000000000000.log")
+	bts, err := ioutil.ReadFile(segment)
+	s.Nil(err)
+	bts[len(bts)-1] ^= 0xff
+	s.Nil(ioutil.WriteFile(segment, bts, 0644))
+
+	queue = s.open(&FileQueueConfig{SegmentSize: 1})
+	_, err = queue.Pop()
+	s.Equal(FileQueueCorrupted, err)
+}
+
+func (s *fileQueueTestSuite) TestRetention() {
+	// each message is in its own segment of 13 bytes
+	queue := s.open(&FileQueueConfig{Consumer: "engine", SegmentSize: 1, RetentionBytes: 30})
+	s.push(queue, 0, 2)
+	s.Equal("msg-0", s.pop(queue))
+
+	s.push(queue, 2, 6)
+
+	// the retention is applied before msg-5 is written
+	segments, err := queue.log.Segments()
+	s.Nil(err)
+	s.Equal([]uint64{3, 4, 5}, segments)
+
+	// msg-1 and msg-2 were removed before they were read
+	s.Equal("msg-3", s.pop(queue))
+	s.Equal("msg-4", s.pop(queue))
+
+	// a new consumer starts from the oldest message
+	other := s.open(&FileQueueConfig{Consumer: "other"})
+	s.Equal("msg-3", s.pop(other))
+}
+
+func (s *fileQueueTestSuite) TestOffsetSavesAreBatched() {
+	queue := s.open(&FileQueueConfig{Consumer: "engine"})
+	s.push(queue, 0, 3)
+
+	s.Equal("msg-0", s.pop(queue))
+	s.Equal("msg-1", s.pop(queue))
+	s.Equal("msg-2", s.pop(queue))
+
+	offset, err := queue.log.loadOffset("engine")
+	s.Nil(err)
+	s.Equal(uint64(0), offset)
+
+	// the offset is saved before waiting for new messages
+	s.cancel()
+	_, err = queue.Pop()
+	s.Equal(EXIT, err)
+
+	offset, err = queue.log.loadOffset("engine")
+	s.Nil(err)
+	s.Equal(uint64(3), offset)
+}
+
+func (s *fileQueueTestSuite) TestPopTimeout() {
+	queue := s.open(&FileQueueConfig{})
+	s.push(queue, 0, 1)
+
+	msg, err := queue.PopTimeout(time.Second)
+	s.Nil(err)
+	s.Equal("msg-0", string(msg))
+
+	_, err = queue.PopTimeout(10 * time.Millisecond)
+	s.Equal(QueueTimeout, err)
+}
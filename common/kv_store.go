@@ -5,12 +5,30 @@ import (
 	"errors"
 	"fmt"
 	"github.com/go-redis/redis"
+	"sort"
+	"strings"
 	"time"
 )
 
+// IKVStore is a key value store, an expire of 0 keeps the value forever.
 type IKVStore interface {
 	Set(key string, value string, expire time.Duration) error
 	Get(key string) (string, error)
+
+	// Delete removes the key, it is not an error if the key doesn't exist
+	Delete(key string) error
+
+	// SetNX sets the value only if the key doesn't exist, it returns whether the value is set
+	SetNX(key string, value string, expire time.Duration) (bool, error)
+
+	// CompareAndSwap sets the value only if the current value is old, it returns whether the value is set
+	CompareAndSwap(key string, old string, value string, expire time.Duration) (bool, error)
+
+	// Incr adds delta to the integer value of the key, which is 0 if it doesn't exist, and returns the result
+	Incr(key string, delta int64) (int64, error)
+
+	// Scan returns all keys with the prefix in order
+	Scan(prefix string) ([]string, error)
 }
 
 var KVStoreEmpty = errors.New("KVStoreEmpty")
@@ -27,6 +45,15 @@ func InitKVStore(config interface{}) (store IKVStore, err error) {
 			return
 		}
 
+		return KVStore, nil
+	case *MemoryKVStoreConfig:
+		KVStore := &MemoryKVStore{}
+		err = KVStore.Init(c)
+
+		if err != nil {
+			return
+		}
+
 		return KVStore, nil
 	default:
 		return nil, fmt.Errorf("KVStore config is not support %v", config)
@@ -35,23 +62,38 @@ func InitKVStore(config interface{}) (store IKVStore, err error) {
 
 type (
 	RedisKVStore struct {
-		ctx    context.Context
-		client *redis.Client
+		ctx       context.Context
+		client    *redis.Client
+		namespace string
 	}
 
+	// Namespace is put before every key, so several environments can share one Redis
 	RedisKVStoreConfig struct {
-		Ctx    context.Context
-		Client *redis.Client
+		Ctx       context.Context
+		Client    *redis.Client
+		Namespace string
 	}
 )
 
+var redisCompareAndSwapScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
 func (queue RedisKVStore) Set(key, value string, expire time.Duration) error {
-	ret := queue.client.Set(key, value, expire)
+	ret := queue.client.Set(queue.namespace+key, value, expire)
 	return ret.Err()
 }
 
 func (queue RedisKVStore) Get(key string) (string, error) {
-	ret := queue.client.Get(key)
+	ret := queue.client.Get(queue.namespace + key)
 	res, err := ret.Result()
 
 	if err == redis.Nil {
@@ -61,6 +103,64 @@ func (queue RedisKVStore) Get(key string) (string, error) {
 	return res, err
 }
 
+func (queue RedisKVStore) Delete(key string) error {
+	return queue.client.Del(queue.namespace + key).Err()
+}
+
+func (queue RedisKVStore) SetNX(key, value string, expire time.Duration) (bool, error) {
+	return queue.client.SetNX(queue.namespace+key, value, expire).Result()
+}
+
+func (queue RedisKVStore) CompareAndSwap(key, old, value string, expire time.Duration) (bool, error) {
+	res, err := redisCompareAndSwapScript.Run(
+		queue.client,
+		[]string{queue.namespace + key},
+		old, value, int64(expire/time.Millisecond),
+	).Int64()
+
+	return res == 1, err
+}
+
+func (queue RedisKVStore) Incr(key string, delta int64) (int64, error) {
+	return queue.client.IncrBy(queue.namespace+key, delta).Result()
+}
+
+func (queue RedisKVStore) Scan(prefix string) ([]string, error) {
+	match := redisGlobEscaper.Replace(queue.namespace+prefix) + "*"
+	keys := make([]string, 0)
+
+	var cursor uint64
+	for {
+		res, next, err := queue.client.Scan(cursor, match, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range res {
+			keys = append(keys, strings.TrimPrefix(key, queue.namespace))
+		}
+
+		if next == 0 {
+			break
+		}
+
+		cursor = next
+	}
+
+	// a key may be returned more than once by SCAN
+	sort.Strings(keys)
+	unique := keys[:0]
+	for i, key := range keys {
+		if i == 0 || key != keys[i-1] {
+			unique = append(unique, key)
+		}
+	}
+
+	return unique, nil
+}
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
 func (queue *RedisKVStore) Init(config *RedisKVStoreConfig) error {
 	if config.Client == nil {
 		return fmt.Errorf("no redis Connection")
@@ -68,6 +168,7 @@ func (queue *RedisKVStore) Init(config *RedisKVStoreConfig) error {
 
 	queue.client = config.Client
 	queue.ctx = config.Ctx
+	queue.namespace = config.Namespace
 
 	return nil
 }
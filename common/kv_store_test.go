@@ -0,0 +1,161 @@
+package common
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+// kvStoreBehaviorSuite is the behavior every IKVStore implementation must have.
+// Each test uses its own namespace.
+type kvStoreBehaviorSuite struct {
+	suite.Suite
+	newConfig func(namespace string) interface{}
+
+	store     IKVStore
+	namespace string
+}
+
+func (s *kvStoreBehaviorSuite) SetupTest() {
+	s.namespace = fmt.Sprintf("NSK_TEST_KV_%d:", time.Now().UnixNano())
+	s.store = s.newStore(s.namespace)
+}
+
+func (s *kvStoreBehaviorSuite) newStore(namespace string) IKVStore {
+	store, err := InitKVStore(s.newConfig(namespace))
+	s.Nil(err)
+
+	return store
+}
+
+func (s *kvStoreBehaviorSuite) TestSetAndGet() {
+	_, err := s.store.Get("key")
+	s.Equal(KVStoreEmpty, err)
+
+	s.Nil(s.store.Set("key", "1", 0))
+	value, err := s.store.Get("key")
+	s.Nil(err)
+	s.Equal("1", value)
+
+	s.Nil(s.store.Set("key", "2", 0))
+	value, _ = s.store.Get("key")
+	s.Equal("2", value)
+
+	s.Nil(s.store.Delete("key"))
+	s.Nil(s.store.Delete("key"))
+	_, err = s.store.Get("key")
+	s.Equal(KVStoreEmpty, err)
+}
+
+func (s *kvStoreBehaviorSuite) TestExpire() {
+	s.Nil(s.store.Set("expire", "1", 100*time.Millisecond))
+	value, err := s.store.Get("expire")
+	s.Nil(err)
+	s.Equal("1", value)
+
+	time.Sleep(150 * time.Millisecond)
+	_, err = s.store.Get("expire")
+	s.Equal(KVStoreEmpty, err)
+
+	// a new value without expire is kept
+	s.Nil(s.store.Set("expire", "2", 0))
+	time.Sleep(150 * time.Millisecond)
+	value, _ = s.store.Get("expire")
+	s.Equal("2", value)
+}
+
+func (s *kvStoreBehaviorSuite) TestSetNX() {
+	set, err := s.store.SetNX("lock", "a", 100*time.Millisecond)
+	s.Nil(err)
+	s.True(set)
+
+	set, _ = s.store.SetNX("lock", "b", 100*time.Millisecond)
+	s.False(set)
+
+	// free again after it expires
+	time.Sleep(150 * time.Millisecond)
+	set, _ = s.store.SetNX("lock", "b", 0)
+	s.True(set)
+
+	value, _ := s.store.Get("lock")
+	s.Equal("b", value)
+}
+
+func (s *kvStoreBehaviorSuite) TestCompareAndSwap() {
+	swapped, err := s.store.CompareAndSwap("cas", "", "1", 0)
+	s.Nil(err)
+	s.False(swapped)
+
+	s.Nil(s.store.Set("cas", "1", 0))
+
+	swapped, _ = s.store.CompareAndSwap("cas", "2", "3", 0)
+	s.False(swapped)
+
+	swapped, _ = s.store.CompareAndSwap("cas", "1", "2", 100*time.Millisecond)
+	s.True(swapped)
+
+	value, _ := s.store.Get("cas")
+	s.Equal("2", value)
+
+	time.Sleep(150 * time.Millisecond)
+	_, err = s.store.Get("cas")
+	s.Equal(KVStoreEmpty, err)
+}
+
+func (s *kvStoreBehaviorSuite) TestIncr() {
+	value, err := s.store.Incr("counter", 1)
+	s.Nil(err)
+	s.Equal(int64(1), value)
+
+	value, _ = s.store.Incr("counter", 10)
+	s.Equal(int64(11), value)
+
+	value, _ = s.store.Incr("counter", -12)
+	s.Equal(int64(-1), value)
+
+	s.Nil(s.store.Set("text", "abc", 0))
+	_, err = s.store.Incr("text", 1)
+	s.NotNil(err)
+}
+
+func (s *kvStoreBehaviorSuite) TestScanAndNamespace() {
+	s.Nil(s.store.Set("order:2", "2", 0))
+	s.Nil(s.store.Set("order:1", "1", 0))
+	s.Nil(s.store.Set("order*", "x", 0))
+	s.Nil(s.store.Set("trade:1", "1", 0))
+	s.Nil(s.store.Set("order:3", "3", 50*time.Millisecond))
+	time.Sleep(100 * time.Millisecond)
+
+	keys, err := s.store.Scan("order:")
+	s.Nil(err)
+	s.Equal([]string{"order:1", "order:2"}, keys)
+
+	keys, _ = s.store.Scan("order*")
+	s.Equal([]string{"order*"}, keys)
+
+	keys, _ = s.store.Scan("")
+	s.Len(keys, 4)
+
+	// another namespace doesn't see these keys
+	other := s.newStore(s.namespace + "other:")
+	_, err = other.Get("order:1")
+	s.Equal(KVStoreEmpty, err)
+
+	keys, _ = other.Scan("")
+	s.Len(keys, 0)
+}
+
+func TestMemoryKVStore(t *testing.T) {
+	suite.Run(t, &kvStoreBehaviorSuite{newConfig: func(namespace string) interface{} {
+		return &MemoryKVStoreConfig{Name: "NSK_TEST_KV", Namespace: namespace}
+	}})
+}
+
+func TestRedisKVStore(t *testing.T) {
+	client := testRedisClient(t)
+
+	suite.Run(t, &kvStoreBehaviorSuite{newConfig: func(namespace string) interface{} {
+		return &RedisKVStoreConfig{Client: client, Namespace: namespace}
+	}})
+}
@@ -0,0 +1,234 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryAckQueueConfig selects the in-process ack queue in InitAckQueue.
+// Queues with the same Name in one process are the same queue.
+// Messages which fail MaxAttempts times are pushed to DeadLetterQueue, a memory queue named Name + ":dead" by default.
+type MemoryAckQueueConfig struct {
+	Name              string
+	Ctx               context.Context
+	VisibilityTimeout time.Duration
+	MaxAttempts       int
+	DeadLetterQueue   IQueue
+}
+
+type memoryAckMessage struct {
+	data    []byte
+	attempt int
+}
+
+type memoryAckInflight struct {
+	message  *memoryAckMessage
+	deadline time.Time
+}
+
+type memoryAckQueueData struct {
+	lock     sync.Mutex
+	ready    []*memoryAckMessage
+	inflight map[uint64]*memoryAckInflight
+	nextID   uint64
+	signal   chan struct{}
+}
+
+// MemoryAckQueue is an unbounded in-process IAckQueue
+type MemoryAckQueue struct {
+	ctx               context.Context
+	data              *memoryAckQueueData
+	visibilityTimeout time.Duration
+	maxAttempts       int
+	deadLetterQueue   IQueue
+}
+
+var memoryAckQueues = make(map[string]*memoryAckQueueData)
+var memoryAckQueuesMutex = &sync.Mutex{}
+
+func (queue *MemoryAckQueue) Init(config *MemoryAckQueueConfig) error {
+	queue.ctx = config.Ctx
+	if queue.ctx == nil {
+		queue.ctx = context.Background()
+	}
+
+	queue.visibilityTimeout, queue.maxAttempts = ackQueueDefaults(config.VisibilityTimeout, config.MaxAttempts)
+
+	queue.deadLetterQueue = config.DeadLetterQueue
+	if queue.deadLetterQueue == nil {
+		deadLetterQueue, err := InitQueue(&MemoryQueueConfig{Name: config.Name + ":dead", Ctx: queue.ctx})
+		if err != nil {
+			return err
+		}
+
+		queue.deadLetterQueue = deadLetterQueue
+	}
+
+	memoryAckQueuesMutex.Lock()
+	defer memoryAckQueuesMutex.Unlock()
+
+	data, exist := memoryAckQueues[config.Name]
+	if !exist {
+		data = &memoryAckQueueData{
+			inflight: make(map[uint64]*memoryAckInflight),
+			signal:   make(chan struct{}, 1),
+		}
+		memoryAckQueues[config.Name] = data
+	}
+
+	queue.data = data
+
+	return nil
+}
+
+func (queue *MemoryAckQueue) Push(data []byte) error {
+	msg := make([]byte, len(data))
+	copy(msg, data)
+
+	queue.data.lock.Lock()
+	defer queue.data.lock.Unlock()
+
+	queue.data.ready = append(queue.data.ready, &memoryAckMessage{data: msg, attempt: 1})
+	queue.data.notify()
+
+	return nil
+}
+
+func (queue *MemoryAckQueue) Pop() (IDelivery, error) {
+	for {
+		for _, msg := range queue.data.takeExpired(time.Now()) {
+			if err := queue.retry(msg); err != nil {
+				return nil, err
+			}
+		}
+
+		d, wait := queue.take()
+		if d != nil {
+			return d, nil
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-queue.ctx.Done():
+			return nil, EXIT
+		case <-queue.data.signal:
+		case <-timeout:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// take returns the first ready message, or how long to wait for the next inflight message to expire
+func (queue *MemoryAckQueue) take() (*delivery, time.Duration) {
+	data := queue.data
+
+	data.lock.Lock()
+	defer data.lock.Unlock()
+
+	if len(data.ready) == 0 {
+		var wait time.Duration
+
+		for _, inflight := range data.inflight {
+			d := time.Until(inflight.deadline)
+			if d <= 0 {
+				d = time.Millisecond
+			}
+
+			if wait == 0 || d < wait {
+				wait = d
+			}
+		}
+
+		return nil, wait
+	}
+
+	msg := data.ready[0]
+	data.ready = data.ready[1:]
+
+	// another consumer may be waiting
+	if len(data.ready) > 0 {
+		data.notify()
+	}
+
+	data.nextID++
+	id := data.nextID
+	data.inflight[id] = &memoryAckInflight{message: msg, deadline: time.Now().Add(queue.visibilityTimeout)}
+
+	return &delivery{
+		data:    msg.data,
+		attempt: msg.attempt,
+		ack: func() error {
+			_, err := data.remove(id)
+			return err
+		},
+		nack: func() error {
+			msg, err := data.remove(id)
+			if err != nil {
+				return err
+			}
+
+			return queue.retry(msg)
+		},
+	}, 0
+}
+
+func (queue *MemoryAckQueue) retry(msg *memoryAckMessage) error {
+	if msg.attempt >= queue.maxAttempts {
+		return queue.deadLetterQueue.Push(msg.data)
+	}
+
+	queue.data.lock.Lock()
+	defer queue.data.lock.Unlock()
+
+	queue.data.ready = append(queue.data.ready, &memoryAckMessage{data: msg.data, attempt: msg.attempt + 1})
+	queue.data.notify()
+
+	return nil
+}
+
+func (data *memoryAckQueueData) notify() {
+	select {
+	case data.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (data *memoryAckQueueData) remove(id uint64) (*memoryAckMessage, error) {
+	data.lock.Lock()
+	defer data.lock.Unlock()
+
+	inflight, exist := data.inflight[id]
+	if !exist {
+		return nil, DeliveryExpired
+	}
+
+	delete(data.inflight, id)
+
+	return inflight.message, nil
+}
+
+func (data *memoryAckQueueData) takeExpired(now time.Time) []*memoryAckMessage {
+	data.lock.Lock()
+	defer data.lock.Unlock()
+
+	var expired []*memoryAckMessage
+
+	for id, inflight := range data.inflight {
+		if !now.Before(inflight.deadline) {
+			expired = append(expired, inflight.message)
+			delete(data.inflight, id)
+		}
+	}
+
+	return expired
+}
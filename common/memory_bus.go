@@ -0,0 +1,131 @@
+package common
+
+import (
+	"context"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"sync"
+)
+
+// MemoryBusConfig selects the in-process bus in InitBus.
+// Buses with the same Name in one process are the same bus.
+// Each subscription buffers BufferSize messages, DefaultBusBufferSize if it is 0.
+type MemoryBusConfig struct {
+	Name       string
+	Ctx        context.Context
+	BufferSize int
+}
+
+type memoryBusData struct {
+	lock          sync.RWMutex
+	subscriptions map[*memorySubscription]bool
+}
+
+// MemoryBus is an in-process IBus.
+// Push never blocks, a message is dropped for a subscription whose buffer is full.
+type MemoryBus struct {
+	name       string
+	ctx        context.Context
+	bufferSize int
+	data       *memoryBusData
+}
+
+type memorySubscription struct {
+	bus      *MemoryBus
+	messages chan []byte
+	closed   chan struct{}
+	once     sync.Once
+}
+
+var memoryBuses = make(map[string]*memoryBusData)
+var memoryBusesMutex = &sync.Mutex{}
+
+func (bus *MemoryBus) Init(config *MemoryBusConfig) error {
+	bus.name = config.Name
+	bus.ctx = config.Ctx
+	if bus.ctx == nil {
+		bus.ctx = context.Background()
+	}
+
+	bus.bufferSize = config.BufferSize
+	if bus.bufferSize <= 0 {
+		bus.bufferSize = DefaultBusBufferSize
+	}
+
+	memoryBusesMutex.Lock()
+	defer memoryBusesMutex.Unlock()
+
+	data, exist := memoryBuses[config.Name]
+	if !exist {
+		data = &memoryBusData{subscriptions: make(map[*memorySubscription]bool)}
+		memoryBuses[config.Name] = data
+	}
+
+	bus.data = data
+
+	return nil
+}
+
+func (bus *MemoryBus) Push(data []byte) error {
+	msg := make([]byte, len(data))
+	copy(msg, data)
+
+	bus.data.lock.RLock()
+	defer bus.data.lock.RUnlock()
+
+	for sub := range bus.data.subscriptions {
+		select {
+		case sub.messages <- msg:
+		default:
+			utils.Errorf("memory bus %s subscription is full, drop a message", bus.name)
+		}
+	}
+
+	return nil
+}
+
+func (bus *MemoryBus) Subscribe() (ISubscription, error) {
+	sub := &memorySubscription{
+		bus:      bus,
+		messages: make(chan []byte, bus.bufferSize),
+		closed:   make(chan struct{}),
+	}
+
+	bus.data.lock.Lock()
+	bus.data.subscriptions[sub] = true
+	bus.data.lock.Unlock()
+
+	go func() {
+		select {
+		case <-bus.ctx.Done():
+			_ = sub.Close()
+		case <-sub.closed:
+		}
+	}()
+
+	return sub, nil
+}
+
+func (sub *memorySubscription) Push(data []byte) error {
+	return sub.bus.Push(data)
+}
+
+func (sub *memorySubscription) Pop() ([]byte, error) {
+	select {
+	case msg := <-sub.messages:
+		return msg, nil
+	case <-sub.closed:
+		return nil, EXIT
+	}
+}
+
+func (sub *memorySubscription) Close() error {
+	sub.once.Do(func() {
+		sub.bus.data.lock.Lock()
+		delete(sub.bus.data.subscriptions, sub)
+		sub.bus.data.lock.Unlock()
+
+		close(sub.closed)
+	})
+
+	return nil
+}
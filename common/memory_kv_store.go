@@ -0,0 +1,179 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryKVStoreConfig selects the in-process store in InitKVStore.
+// Stores with the same Name in one process share their keys, Namespace is put before every key.
+type MemoryKVStoreConfig struct {
+	Name      string
+	Namespace string
+}
+
+type memoryKVEntry struct {
+	value     string
+	expiredAt time.Time
+}
+
+type memoryKVData struct {
+	lock    sync.Mutex
+	entries map[string]*memoryKVEntry
+}
+
+// MemoryKVStore is an in-process IKVStore, an expired key is removed when it is read
+type MemoryKVStore struct {
+	data      *memoryKVData
+	namespace string
+}
+
+var memoryKVStores = make(map[string]*memoryKVData)
+var memoryKVStoresMutex = &sync.Mutex{}
+
+func (store *MemoryKVStore) Init(config *MemoryKVStoreConfig) error {
+	memoryKVStoresMutex.Lock()
+	defer memoryKVStoresMutex.Unlock()
+
+	data, exist := memoryKVStores[config.Name]
+	if !exist {
+		data = &memoryKVData{entries: make(map[string]*memoryKVEntry)}
+		memoryKVStores[config.Name] = data
+	}
+
+	store.data = data
+	store.namespace = config.Namespace
+
+	return nil
+}
+
+// Set keeps the value forever if expire is 0
+func (store *MemoryKVStore) Set(key, value string, expire time.Duration) error {
+	store.data.lock.Lock()
+	defer store.data.lock.Unlock()
+
+	store.data.set(store.namespace+key, value, expire)
+
+	return nil
+}
+
+func (store *MemoryKVStore) Get(key string) (string, error) {
+	store.data.lock.Lock()
+	defer store.data.lock.Unlock()
+
+	entry, exist := store.data.get(store.namespace + key)
+	if !exist {
+		return "", KVStoreEmpty
+	}
+
+	return entry.value, nil
+}
+
+func (store *MemoryKVStore) Delete(key string) error {
+	store.data.lock.Lock()
+	defer store.data.lock.Unlock()
+
+	delete(store.data.entries, store.namespace+key)
+
+	return nil
+}
+
+func (store *MemoryKVStore) SetNX(key, value string, expire time.Duration) (bool, error) {
+	store.data.lock.Lock()
+	defer store.data.lock.Unlock()
+
+	if _, exist := store.data.get(store.namespace + key); exist {
+		return false, nil
+	}
+
+	store.data.set(store.namespace+key, value, expire)
+
+	return true, nil
+}
+
+func (store *MemoryKVStore) CompareAndSwap(key, old, value string, expire time.Duration) (bool, error) {
+	store.data.lock.Lock()
+	defer store.data.lock.Unlock()
+
+	entry, exist := store.data.get(store.namespace + key)
+	if !exist || entry.value != old {
+		return false, nil
+	}
+
+	store.data.set(store.namespace+key, value, expire)
+
+	return true, nil
+}
+
+// Incr keeps the expiry of the key, as Redis does
+func (store *MemoryKVStore) Incr(key string, delta int64) (int64, error) {
+	store.data.lock.Lock()
+	defer store.data.lock.Unlock()
+
+	var current int64
+
+	entry, exist := store.data.get(store.namespace + key)
+	if exist {
+		var err error
+		if current, err = strconv.ParseInt(entry.value, 10, 64); err != nil {
+			return 0, fmt.Errorf("value of %s is not an integer", key)
+		}
+	} else {
+		entry = &memoryKVEntry{}
+		store.data.entries[store.namespace+key] = entry
+	}
+
+	current = current + delta
+	entry.value = strconv.FormatInt(current, 10)
+
+	return current, nil
+}
+
+func (store *MemoryKVStore) Scan(prefix string) ([]string, error) {
+	store.data.lock.Lock()
+	defer store.data.lock.Unlock()
+
+	keys := make([]string, 0)
+
+	for key := range store.data.entries {
+		if !strings.HasPrefix(key, store.namespace+prefix) {
+			continue
+		}
+
+		if _, exist := store.data.get(key); exist {
+			keys = append(keys, strings.TrimPrefix(key, store.namespace))
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (data *memoryKVData) set(key, value string, expire time.Duration) {
+	entry := &memoryKVEntry{value: value}
+	if expire > 0 {
+		entry.expiredAt = time.Now().Add(expire)
+	}
+
+	data.entries[key] = entry
+}
+
+// get returns the entry if it exists and is not expired, the lock is held
+func (data *memoryKVData) get(key string) (*memoryKVEntry, bool) {
+	entry, exist := data.entries[key]
+	if !exist {
+		return nil, false
+	}
+
+	if !entry.expiredAt.IsZero() && !time.Now().Before(entry.expiredAt) {
+		delete(data.entries, key)
+		return nil, false
+	}
+
+	return entry, true
+}
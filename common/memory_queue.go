@@ -0,0 +1,94 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const DefaultMemoryQueueCapacity = 4096
+
+// MemoryQueueConfig selects the in-process queue in InitQueue.
+// Queues with the same Name in one process are the same queue, as Redis queues with the same name are.
+// Capacity is only used when the queue is created, DefaultMemoryQueueCapacity if it is 0.
+type MemoryQueueConfig struct {
+	Name     string
+	Ctx      context.Context
+	Capacity int
+}
+
+// MemoryQueue is a bounded in-process queue.
+// Push blocks while the queue is full, Pop blocks while it is empty, both return EXIT once ctx is done.
+type MemoryQueue struct {
+	ctx      context.Context
+	messages chan []byte
+}
+
+var memoryQueues = make(map[string]chan []byte)
+var memoryQueuesMutex = &sync.Mutex{}
+
+func (queue *MemoryQueue) Init(config *MemoryQueueConfig) error {
+	capacity := config.Capacity
+	if capacity <= 0 {
+		capacity = DefaultMemoryQueueCapacity
+	}
+
+	memoryQueuesMutex.Lock()
+	defer memoryQueuesMutex.Unlock()
+
+	messages, exist := memoryQueues[config.Name]
+	if !exist {
+		messages = make(chan []byte, capacity)
+		memoryQueues[config.Name] = messages
+	}
+
+	queue.messages = messages
+	queue.ctx = config.Ctx
+	if queue.ctx == nil {
+		queue.ctx = context.Background()
+	}
+
+	return nil
+}
+
+func (queue *MemoryQueue) Push(data []byte) error {
+	// the caller may reuse data
+	msg := make([]byte, len(data))
+	copy(msg, data)
+
+	select {
+	case queue.messages <- msg:
+		return nil
+	case <-queue.ctx.Done():
+		return EXIT
+	}
+}
+
+func (queue *MemoryQueue) Pop() ([]byte, error) {
+	select {
+	case msg := <-queue.messages:
+		return msg, nil
+	case <-queue.ctx.Done():
+		return nil, EXIT
+	}
+}
+
+// PopTimeout is Pop which returns QueueTimeout if no message arrives in timeout
+func (queue *MemoryQueue) PopTimeout(timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-queue.messages:
+		return msg, nil
+	case <-queue.ctx.Done():
+		return nil, EXIT
+	case <-timer.C:
+		return nil, QueueTimeout
+	}
+}
+
+// Len returns the number of messages in the queue
+func (queue *MemoryQueue) Len() int {
+	return len(queue.messages)
+}
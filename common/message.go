@@ -3,6 +3,7 @@ package common
 import (
 	"fmt"
 	"github.com/shopspring/decimal"
+	"strings"
 )
 
 // WebsocketMessage is message unit between engine and websocket
@@ -31,6 +32,8 @@ type WebsocketMarketOrderChangePayload struct {
 	Amount   string `json:"amount"`
 }
 
+// WebsocketLockedBalanceChangePayload carries the amount of the symbol locked by all open orders of the trader,
+// Balance is filled by the engine after the change is applied.
 type WebsocketLockedBalanceChangePayload struct {
 	Type    string          `json:"type"`
 	Symbol  string          `json:"symbol"`
@@ -40,6 +43,9 @@ type WebsocketLockedBalanceChangePayload struct {
 type WebsocketOrderChangePayload struct {
 	Type  string      `json:"type"`
 	Order interface{} `json:"order"`
+
+	// State is filled by the engine when order states are tracked
+	State *OrderState `json:"state,omitempty"`
 }
 
 type WebsocketTradeChangePayload struct {
@@ -56,6 +62,7 @@ type WebsocketMarketNewMarketTradePayload struct {
 const (
 	EventNewOrder           = "EVENT/NEW_ORDER"
 	EventCancelOrder        = "EVENT/EVENT_CANCEL_ORDER"
+	EventCancelOrders       = "EVENT/EVENT_CANCEL_ORDERS"
 	EventRestartEngine      = "EVENT/EVENT_RESTART"
 	EventConfirmTransaction = "EVENT/EVENT_CONFIRM_TRANSACTION"
 	EventOpenMarket         = "EVENT/EVENT_OPEN_MARKET"
@@ -79,6 +86,20 @@ type CancelOrderEvent struct {
 	Side  string `json:"side"`
 }
 
+// CancelOrdersEvent cancels all orders matching its fields, empty fields match all orders
+type CancelOrdersEvent struct {
+	Event
+	Trader   string `json:"trader"`
+	Side     string `json:"side"`
+	MinPrice string `json:"minPrice"`
+	MaxPrice string `json:"maxPrice"`
+}
+
+type CloseMarketEvent struct {
+	Event
+	CancelOrders bool `json:"cancelOrders"`
+}
+
 type ConfirmTransactionEvent struct {
 	Event
 	Hash      string `json:"hash"`
@@ -95,6 +116,16 @@ func GetAccountChannelID(address string) string {
 	return fmt.Sprintf("%s#%s", AccountChannelPrefix, address)
 }
 
+// GetAccountAddress returns the address of an account channel, ok is false for other channels
+func GetAccountAddress(channelID string) (address string, ok bool) {
+	prefix := AccountChannelPrefix + "#"
+	if !strings.HasPrefix(channelID, prefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(channelID, prefix), true
+}
+
 func GetMarketChannelID(marketID string) string {
 	return fmt.Sprintf("%s#%s", MarketChannelPrefix, marketID)
 }
@@ -131,6 +162,14 @@ func MessagesForUpdateOrder(order *MemoryOrder) []WebSocketMessage {
 	return []WebSocketMessage{updateMsg, balanceChangeMsg}
 }
 
+// TradeChangeMessage tells the trader that the state of one of their trades is changed
+func TradeChangeMessage(address string, trade interface{}) WebSocketMessage {
+	return accountMessage(address, &WebsocketTradeChangePayload{
+		Type:  WsTypeTradeChange,
+		Trade: trade,
+	})
+}
+
 func orderUpdateMessage(order *MemoryOrder) WebSocketMessage {
 	return accountMessage(order.Trader, &WebsocketOrderChangePayload{
 		Type:  WsTypeOrderChange,
@@ -0,0 +1,117 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// OrderState is the lifecycle of an order in the engine.
+// Status is one of ORDER_PENDING, ORDER_PARTIAL_FILLED, ORDER_FULL_FILLED and ORDER_CANCELED, timestamps are in seconds.
+type OrderState struct {
+	OrderID  string          `json:"orderID"`
+	MarketID string          `json:"marketID"`
+	Trader   string          `json:"trader"`
+	Side     string          `json:"side"`
+	Type     string          `json:"type"`
+	Price    decimal.Decimal `json:"price"`
+
+	OriginalAmount  decimal.Decimal `json:"originalAmount"`
+	FilledAmount    decimal.Decimal `json:"filledAmount"`
+	AvailableAmount decimal.Decimal `json:"availableAmount"`
+
+	// FilledNotional is the sum of amount * price of all fills
+	FilledNotional   decimal.Decimal `json:"filledNotional"`
+	AverageFillPrice decimal.Decimal `json:"averageFillPrice"`
+
+	Status    string               `json:"status"`
+	History   []*OrderStatusChange `json:"history"`
+	CreatedAt uint64               `json:"createdAt"`
+	UpdatedAt uint64               `json:"updatedAt"`
+}
+
+type OrderStatusChange struct {
+	Status    string `json:"status"`
+	Timestamp uint64 `json:"timestamp"`
+}
+
+func NewOrderState(order *MemoryOrder, now uint64) *OrderState {
+	return &OrderState{
+		OrderID:         order.ID,
+		MarketID:        order.MarketID,
+		Trader:          order.Trader,
+		Side:            order.Side,
+		Type:            order.Type,
+		Price:           order.Price,
+		OriginalAmount:  order.Amount,
+		AvailableAmount: order.Amount,
+		Status:          ORDER_PENDING,
+		History:         []*OrderStatusChange{{Status: ORDER_PENDING, Timestamp: now}},
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+}
+
+// Fill adds a fill at price, a negative amount takes back a fill whose settlement failed
+func (state *OrderState) Fill(amount, price decimal.Decimal, now uint64) {
+	state.FilledAmount = state.FilledAmount.Add(amount)
+	state.FilledNotional = state.FilledNotional.Add(amount.Mul(price))
+
+	if state.FilledAmount.IsPositive() {
+		state.AverageFillPrice = state.FilledNotional.Div(state.FilledAmount)
+	} else {
+		state.FilledAmount = decimal.Zero
+		state.FilledNotional = decimal.Zero
+		state.AverageFillPrice = decimal.Zero
+	}
+
+	state.UpdatedAt = now
+}
+
+// Update sets the status of the order after a change.
+// An order which left the book is full filled if it was filled and not canceled, the dust left by matching is not canceled.
+// A canceled order stays canceled.
+func (state *OrderState) Update(order *MemoryOrder, resting, canceled bool, now uint64) {
+	var status string
+
+	switch {
+	case resting && state.FilledAmount.IsZero():
+		status = ORDER_PENDING
+	case resting:
+		status = ORDER_PARTIAL_FILLED
+	case state.Status == ORDER_CANCELED:
+		status = ORDER_CANCELED
+	case !canceled && state.FilledAmount.IsPositive():
+		status = ORDER_FULL_FILLED
+	default:
+		status = ORDER_CANCELED
+	}
+
+	if resting {
+		state.AvailableAmount = order.Amount
+	} else {
+		state.AvailableAmount = decimal.Zero
+	}
+
+	if status != state.Status {
+		state.Status = status
+		state.History = append(state.History, &OrderStatusChange{Status: status, Timestamp: now})
+	}
+
+	state.UpdatedAt = now
+}
+
+// IsDone returns true if the order is not in the book any more
+func (state *OrderState) IsDone() bool {
+	return state.Status == ORDER_FULL_FILLED || state.Status == ORDER_CANCELED
+}
+
+func (state *OrderState) Copy() *OrderState {
+	res := *state
+	res.History = make([]*OrderStatusChange, 0, len(state.History))
+
+	for _, change := range state.History {
+		c := *change
+		res.History = append(res.History, &c)
+	}
+
+	return &res
+}
@@ -36,6 +36,8 @@ type IOrderbook interface {
 
 type (
 	MatchResult struct {
+		// MatchID is set by the engine when settlements of matches are tracked
+		MatchID              string
 		TakerOrder           *MemoryOrder
 		TakerOrderIsDone     bool
 		MatchItems           []*MatchItem
@@ -61,6 +63,13 @@ type (
 		GasFeeAmount decimal.Decimal `json:"gasFeeAmount"`
 		MakerFeeRate decimal.Decimal `json:"makerFeeRate"`
 		TakerFeeRate decimal.Decimal `json:"takerFeeRate"`
+
+		// ExpiredAt is the expiration timestamp (in seconds) carried by the nova order data.
+		// Zero means the order never expires.
+		ExpiredAt uint64 `json:"expiredAt"`
+
+		// Data is the nova order data, the engine reads ExpiredAt from it if ExpiredAt is not set.
+		Data string `json:"data,omitempty"`
 	}
 
 	SnapshotV2 struct {
@@ -70,24 +79,69 @@ type (
 	}
 )
 
+// QuoteTokenSymbol returns the symbol prices are in, WETH in HOT-WETH
 func (order *MemoryOrder) QuoteTokenSymbol() string {
 	parts := strings.Split(order.MarketID, "-")
 	if len(parts) == 2 {
-		return parts[0]
+		return parts[1]
 	} else {
 		return "unknown"
 	}
 }
 
+// BaseTokenSymbol returns the symbol amounts are in, HOT in HOT-WETH
 func (order *MemoryOrder) BaseTokenSymbol() string {
 	parts := strings.Split(order.MarketID, "-")
 	if len(parts) == 2 {
-		return parts[1]
+		return parts[0]
 	} else {
 		return "unknown"
 	}
 }
 
+// Validate checks fields which the orderbook relies on
+func (order *MemoryOrder) Validate() error {
+	switch {
+	case order == nil, order.ID == "":
+		return ErrInvalidOrder
+	case order.Side != "buy" && order.Side != "sell":
+		return ErrInvalidOrder
+	case order.Type != "limit" && order.Type != "market":
+		return ErrInvalidOrder
+	case !order.Amount.IsPositive():
+		return ErrInvalidOrder
+	case order.Type == "limit" && !order.Price.IsPositive():
+		return ErrInvalidOrder
+	default:
+		return nil
+	}
+}
+
+// IsExpired returns true if the order has an expiration timestamp and it is not later than now
+func (order *MemoryOrder) IsExpired(now uint64) bool {
+	return order.ExpiredAt > 0 && order.ExpiredAt <= now
+}
+
+// OrderDataExpiredAt reads the expiration timestamp from nova order data,
+// bytes 3 to 8 of the 32 bytes data as GenerateOrderData of sdk/ethereum writes them.
+func OrderDataExpiredAt(data string) uint64 {
+	var hash [32]byte
+
+	bytes := utils.Hex2Bytes(data)
+	if len(bytes) > len(hash) {
+		bytes = bytes[len(bytes)-len(hash):]
+	}
+
+	copy(hash[len(hash)-len(bytes):], bytes)
+
+	var expiredAt uint64
+	for _, b := range hash[3:8] {
+		expiredAt = expiredAt<<8 | uint64(b)
+	}
+
+	return expiredAt
+}
+
 func (matchResult *MatchResult) QuoteTokenTotalMatchedAmt() decimal.Decimal {
 	quoteTokenAmt := decimal.Zero
 	for _, item := range matchResult.MatchItems {
@@ -157,27 +211,51 @@ func (p *priceLevel) Len() int {
 	return p.orderMap.Len()
 }
 
-func (p *priceLevel) InsertOrder(order *MemoryOrder) {
+func (p *priceLevel) InsertOrder(order *MemoryOrder) error {
 	log.Debug("InsertOrder:", order.ID)
 
 	if _, ok := p.orderMap.Get(order.ID); ok {
-		panic(fmt.Errorf("can't add order which is already in this priceLevel. priceLevel: %s, orderID: %s", p.price.String(), order.ID))
+		return ErrOrderExists
 	}
 
 	p.orderMap.Set(order.ID, order)
 	p.totalAmount = p.totalAmount.Add(order.Amount)
+
+	return nil
 }
 
-func (p *priceLevel) RemoveOrder(o *MemoryOrder) {
+// InsertOrderAtFront puts the order ahead of all orders in this priceLevel
+func (p *priceLevel) InsertOrderAtFront(order *MemoryOrder) error {
+	if _, ok := p.orderMap.Get(order.ID); ok {
+		return ErrOrderExists
+	}
+
+	orderMap := ordered_map.NewOrderedMap()
+	orderMap.Set(order.ID, order)
+
+	iter := p.orderMap.IterFunc()
+	for kv, ok := iter(); ok; kv, ok = iter() {
+		orderMap.Set(kv.Key, kv.Value)
+	}
+
+	p.orderMap = orderMap
+	p.totalAmount = p.totalAmount.Add(order.Amount)
+
+	return nil
+}
+
+func (p *priceLevel) RemoveOrder(o *MemoryOrder) error {
 	orderItem, ok := p.orderMap.Get(o.ID)
 
 	if !ok {
-		panic(fmt.Errorf("can't remove order which is not in this priceLevel. priceLevel: %s", p.price.String()))
+		return ErrOrderNotFound
 	}
 
 	order := orderItem.(*MemoryOrder)
 	p.orderMap.Delete(order.ID)
 	p.totalAmount = p.totalAmount.Sub(order.Amount)
+
+	return nil
 }
 
 func (p *priceLevel) GetOrder(id string) (order *MemoryOrder, exist bool) {
@@ -189,14 +267,16 @@ func (p *priceLevel) GetOrder(id string) (order *MemoryOrder, exist bool) {
 	return orderItem.(*MemoryOrder), exist
 }
 
-func (p *priceLevel) ChangeOrder(o *MemoryOrder, changeAmount decimal.Decimal) {
+func (p *priceLevel) ChangeOrder(o *MemoryOrder, changeAmount decimal.Decimal) error {
 	_, ok := p.orderMap.Get(o.ID)
 
 	if !ok {
-		panic(fmt.Errorf("can't remove order which is not in this priceLevel. priceLevel: %s", p.price.String()))
+		return ErrOrderNotFound
 	}
 
 	p.totalAmount = p.totalAmount.Add(changeAmount)
+
+	return nil
 }
 
 func (p *priceLevel) Less(item llrb.Item) bool {
@@ -275,7 +355,7 @@ func (book *Orderbook) SnapshotV2() *SnapshotV2 {
 	return res
 }
 
-func (book *Orderbook) InsertOrder(order *MemoryOrder) *OrderbookEvent {
+func (book *Orderbook) InsertOrder(order *MemoryOrder) (*OrderbookEvent, error) {
 	startTime := time.Now().UTC()
 	book.lock.Lock()
 	defer book.lock.Unlock()
@@ -296,7 +376,9 @@ func (book *Orderbook) InsertOrder(order *MemoryOrder) *OrderbookEvent {
 		tree.InsertNoReplace(price)
 	}
 
-	price.(*priceLevel).InsertOrder(order)
+	if err := price.(*priceLevel).InsertOrder(order); err != nil {
+		return nil, err
+	}
 
 	orderBookEvent := &OrderbookEvent{
 		OrderID: order.ID,
@@ -307,10 +389,46 @@ func (book *Orderbook) InsertOrder(order *MemoryOrder) *OrderbookEvent {
 
 	book.RunPlugins(orderBookEvent)
 
-	return orderBookEvent
+	return orderBookEvent, nil
 }
 
-func (book *Orderbook) RemoveOrder(order *MemoryOrder) *OrderbookEvent {
+// InsertOrderAtFront is the same as InsertOrder, but the order gets the highest priority in its price level.
+// It is used to give an order back its priority, e.g. when the match which removed it is reverted.
+func (book *Orderbook) InsertOrderAtFront(order *MemoryOrder) (*OrderbookEvent, error) {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	var tree *llrb.LLRB
+	if order.Side == "sell" {
+		tree = book.asksTree
+	} else {
+		tree = book.bidsTree
+	}
+
+	price := tree.Get(newPriceLevel(order.Price))
+
+	if price == nil {
+		price = newPriceLevel(order.Price)
+		tree.InsertNoReplace(price)
+	}
+
+	if err := price.(*priceLevel).InsertOrderAtFront(order); err != nil {
+		return nil, err
+	}
+
+	orderBookEvent := &OrderbookEvent{
+		OrderID: order.ID,
+		Side:    order.Side,
+		Amount:  order.Amount,
+		Price:   order.Price,
+	}
+
+	book.RunPlugins(orderBookEvent)
+
+	return orderBookEvent, nil
+}
+
+func (book *Orderbook) RemoveOrder(order *MemoryOrder) (*OrderbookEvent, error) {
 	book.lock.Lock()
 	defer book.lock.Unlock()
 
@@ -321,20 +439,17 @@ func (book *Orderbook) RemoveOrder(order *MemoryOrder) *OrderbookEvent {
 		tree = book.bidsTree
 	}
 
-	// log
 	plItem := tree.Get(newPriceLevel(order.Price))
 	if plItem == nil {
-		log.Infof("plItem is nil when RemoveOrder")
-		return nil
+		return nil, ErrOrderNotFound
 	}
 
 	price := plItem.(*priceLevel)
 
-	if price == nil {
-		panic(fmt.Sprintf("pl is nil when RemoveOrder, book: %s, order: %+v", book.market, order))
+	if err := price.RemoveOrder(order); err != nil {
+		return nil, err
 	}
 
-	price.RemoveOrder(order)
 	if price.Len() <= 0 {
 		tree.Delete(price)
 	}
@@ -348,10 +463,10 @@ func (book *Orderbook) RemoveOrder(order *MemoryOrder) *OrderbookEvent {
 
 	book.RunPlugins(event)
 
-	return event
+	return event, nil
 }
 
-func (book *Orderbook) ChangeOrder(order *MemoryOrder, changeAmount decimal.Decimal) *OrderbookEvent {
+func (book *Orderbook) ChangeOrder(order *MemoryOrder, changeAmount decimal.Decimal) (*OrderbookEvent, error) {
 	book.lock.Lock()
 	defer book.lock.Unlock()
 
@@ -365,11 +480,12 @@ func (book *Orderbook) ChangeOrder(order *MemoryOrder, changeAmount decimal.Deci
 	price := tree.Get(newPriceLevel(order.Price))
 
 	if price == nil {
-		fmt.Println("book snapshot:", book.SnapshotV2())
-		panic(fmt.Sprintf("can't change order which is not in this orderbook. book: %s, order: %+v", book.market, order))
+		return nil, ErrPriceLevelMissing
 	}
 
-	price.(*priceLevel).ChangeOrder(order, changeAmount)
+	if err := price.(*priceLevel).ChangeOrder(order, changeAmount); err != nil {
+		return nil, err
+	}
 
 	event := &OrderbookEvent{
 		OrderID: order.ID,
@@ -379,7 +495,7 @@ func (book *Orderbook) ChangeOrder(order *MemoryOrder, changeAmount decimal.Deci
 	}
 	book.RunPlugins(event)
 
-	return event
+	return event, nil
 }
 
 func (book *Orderbook) UsePlugin(plugin OrderbookPlugin) {
@@ -412,6 +528,85 @@ func (book *Orderbook) GetOrder(id string, side string, price decimal.Decimal) (
 	return pl.(*priceLevel).GetOrder(id)
 }
 
+// Orders returns all orders of one side in priority order.
+// Bids are sorted by price descending, asks by price ascending, orders in the same price level keep their insertion order.
+func (book *Orderbook) Orders(side string) []*MemoryOrder {
+	book.lock.RLock()
+	defer book.lock.RUnlock()
+
+	orders := make([]*MemoryOrder, 0)
+
+	iterator := func(i llrb.Item) bool {
+		iter := i.(*priceLevel).orderMap.IterFunc()
+		for kv, ok := iter(); ok; kv, ok = iter() {
+			orders = append(orders, kv.Value.(*MemoryOrder))
+		}
+		return true
+	}
+
+	if side == "sell" {
+		book.asksTree.AscendGreaterOrEqual(newPriceLevel(decimal.Zero), iterator)
+	} else {
+		book.bidsTree.DescendLessOrEqual(newPriceLevel(decimal.New(1, 99)), iterator)
+	}
+
+	return orders
+}
+
+// Audit checks invariants of the book and returns a description of each violation, nil if the book is sound
+func (book *Orderbook) Audit() (problems []string) {
+	book.lock.RLock()
+	defer book.lock.RUnlock()
+
+	ids := make(map[string]bool)
+
+	audit := func(side string) llrb.ItemIterator {
+		return func(i llrb.Item) bool {
+			pl := i.(*priceLevel)
+
+			if pl.Len() == 0 {
+				problems = append(problems, fmt.Sprintf("%s price level %s is empty", side, pl.price))
+			}
+
+			total := decimal.Zero
+			iter := pl.orderMap.IterFunc()
+			for kv, ok := iter(); ok; kv, ok = iter() {
+				order := kv.Value.(*MemoryOrder)
+				total = total.Add(order.Amount)
+
+				if ids[order.ID] {
+					problems = append(problems, fmt.Sprintf("order %s is in the book more than once", order.ID))
+				}
+				ids[order.ID] = true
+
+				if order.Side != side || !order.Price.Equal(pl.price) {
+					problems = append(problems, fmt.Sprintf("order %s (%s %s) is in %s price level %s", order.ID, order.Side, order.Price, side, pl.price))
+				}
+
+				if !order.Amount.IsPositive() {
+					problems = append(problems, fmt.Sprintf("order %s has non-positive amount %s", order.ID, order.Amount))
+				}
+			}
+
+			if !total.Equal(pl.totalAmount) {
+				problems = append(problems, fmt.Sprintf("%s price level %s has total amount %s, but its orders sum to %s", side, pl.price, pl.totalAmount, total))
+			}
+
+			return true
+		}
+	}
+
+	book.asksTree.AscendGreaterOrEqual(newPriceLevel(decimal.Zero), audit("sell"))
+	book.bidsTree.DescendLessOrEqual(newPriceLevel(decimal.New(1, 99)), audit("buy"))
+
+	maxBid, minAsk := book.bidsTree.Max(), book.asksTree.Min()
+	if maxBid != nil && minAsk != nil && !maxBid.(*priceLevel).price.LessThan(minAsk.(*priceLevel).price) {
+		problems = append(problems, fmt.Sprintf("book is crossed, max bid %s, min ask %s", maxBid.(*priceLevel).price, minAsk.(*priceLevel).price))
+	}
+
+	return
+}
+
 // MaxBid ...
 func (book *Orderbook) MaxBid() *decimal.Decimal {
 	book.lock.Lock()
@@ -470,6 +665,11 @@ func (book *Orderbook) CanMatch(order *MemoryOrder) bool {
 // amt is quoteCurrency when order is MarketID Buy Order
 // all other amount is baseCurrencyAmt
 func (book *Orderbook) MatchOrder(takerOrder *MemoryOrder, marketAmountDecimals int) *MatchResult {
+	return book.MatchOrderAt(takerOrder, marketAmountDecimals, uint64(time.Now().Unix()))
+}
+
+// MatchOrderAt is the same as MatchOrder, but maker orders expired at the given timestamp are skipped
+func (book *Orderbook) MatchOrderAt(takerOrder *MemoryOrder, marketAmountDecimals int, now uint64) *MatchResult {
 	book.lock.Lock()
 	defer book.lock.Unlock()
 
@@ -497,6 +697,10 @@ func (book *Orderbook) MatchOrder(takerOrder *MemoryOrder, marketAmountDecimals
 
 			bookOrder := kv.Value.(*MemoryOrder)
 
+			if bookOrder.IsExpired(now) {
+				continue
+			}
+
 			if leftAmount.GreaterThanOrEqual(bookOrder.Amount) {
 				matchedAmount := bookOrder.Amount
 
@@ -549,6 +753,10 @@ func (book *Orderbook) MatchOrder(takerOrder *MemoryOrder, marketAmountDecimals
 
 			memoryOrder := kv.Value.(*MemoryOrder)
 
+			if memoryOrder.IsExpired(now) {
+				continue
+			}
+
 			matchedItem := &MatchItem{
 				MakerOrder: memoryOrder,
 			}
@@ -610,12 +818,18 @@ func (book *Orderbook) MatchOrder(takerOrder *MemoryOrder, marketAmountDecimals
 }
 
 func (book *Orderbook) ExecuteMatch(takerOrder *MemoryOrder, marketAmountDecimals int) *MatchResult {
-	result := book.MatchOrder(takerOrder, marketAmountDecimals)
+	return book.ExecuteMatchAt(takerOrder, marketAmountDecimals, uint64(time.Now().Unix()))
+}
+
+// ExecuteMatchAt is the same as ExecuteMatch, but maker orders expired at the given timestamp are skipped
+func (book *Orderbook) ExecuteMatchAt(takerOrder *MemoryOrder, marketAmountDecimals int, now uint64) *MatchResult {
+	result := book.MatchOrderAt(takerOrder, marketAmountDecimals, now)
 
 	cancelSmallMatchesIfExist(result)
 
 	for _, item := range result.MatchItems {
 		var e *OrderbookEvent
+		var err error
 
 		// after match, gasFee is paid
 		if !item.MatchShouldBeCanceled && item.MatchedAmount.IsPositive() {
@@ -623,17 +837,22 @@ func (book *Orderbook) ExecuteMatch(takerOrder *MemoryOrder, marketAmountDecimal
 		}
 
 		if makerOrderShouldBeRemovedAfterMatch(takerOrder.GasFeeAmount, takerOrder.TakerFeeRate, item) {
-			e = book.RemoveOrder(item.MakerOrder)
+			e, err = book.RemoveOrder(item.MakerOrder)
 			item.MakerOrder.Amount = decimal.Zero
 
 			item.MakerOrderIsDone = true
 		} else {
 			changeAmt := item.MatchedAmount
 
-			e = book.ChangeOrder(item.MakerOrder, changeAmt.Mul(decimal.New(-1, 0)))
+			e, err = book.ChangeOrder(item.MakerOrder, changeAmt.Mul(decimal.New(-1, 0)))
 			item.MakerOrder.Amount = item.MakerOrder.Amount.Sub(changeAmt)
 		}
 
+		// maker orders are just found in this book, the book is broken if they can't be changed
+		if err != nil {
+			panic(fmt.Errorf("execute match of book %s error: %v", book.market, err))
+		}
+
 		msg := OrderbookChangeMessage(book.market, book.Sequence, e.Side, e.Price, e.Amount)
 		result.OrderbookActivities = append(result.OrderbookActivities, msg)
 	}
@@ -37,6 +37,53 @@ func (s *orderbookTestSuite) TestSnapshot() {
 	}, s.book.SnapshotV2())
 }
 
+func (s *orderbookTestSuite) TestOrders() {
+	s.book.InsertOrder(NewLimitOrder("o1", "buy", "1.2", "1"))
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.3", "1"))
+	s.book.InsertOrder(NewLimitOrder("o3", "buy", "1.2", "1"))
+	s.book.InsertOrder(NewLimitOrder("o4", "sell", "1.5", "1"))
+	s.book.InsertOrder(NewLimitOrder("o5", "sell", "1.4", "1"))
+
+	ids := func(orders []*MemoryOrder) (res []string) {
+		for _, order := range orders {
+			res = append(res, order.ID)
+		}
+		return
+	}
+
+	s.Equal([]string{"o2", "o1", "o3"}, ids(s.book.Orders("buy")))
+	s.Equal([]string{"o5", "o4"}, ids(s.book.Orders("sell")))
+}
+
+func (s *orderbookTestSuite) TestInsertOrderAtFront() {
+	s.book.InsertOrder(NewLimitOrder("o1", "sell", "1.2", "1"))
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1.2", "2"))
+	s.book.InsertOrderAtFront(NewLimitOrder("o3", "sell", "1.2", "4"))
+	s.book.InsertOrderAtFront(NewLimitOrder("o4", "sell", "1.3", "1"))
+
+	var ids []string
+	for _, order := range s.book.Orders("sell") {
+		ids = append(ids, order.ID)
+	}
+
+	s.Equal([]string{"o3", "o1", "o2", "o4"}, ids)
+	s.Equal("7", s.book.asksTree.Min().(*priceLevel).totalAmount.String())
+}
+
+func (s *orderbookTestSuite) TestAudit() {
+	s.book.InsertOrder(NewLimitOrder("o1", "buy", "1.2", "1"))
+	s.book.InsertOrder(NewLimitOrder("o2", "sell", "1.3", "2"))
+	s.Nil(s.book.Audit())
+
+	s.book.bidsTree.Max().(*priceLevel).totalAmount = decimal.NewFromFloat(3)
+	s.book.InsertOrder(NewLimitOrder("o3", "sell", "1.1", "2"))
+
+	s.Equal([]string{
+		"buy price level 1.2 has total amount 3, but its orders sum to 1",
+		"book is crossed, max bid 1.2, min ask 1.1",
+	}, s.book.Audit())
+}
+
 func (s *orderbookTestSuite) TestNewOrderbok() {
 	s.Equal(0, s.book.bidsTree.Len())
 	s.Equal(0, s.book.asksTree.Len())
@@ -78,6 +125,37 @@ func (s *orderbookTestSuite) TestInsertAndChangeOrder() {
 	s.Equal("3.9", maxBidPriceLevel.totalAmount.String())
 }
 
+func (s *orderbookTestSuite) TestErrors() {
+	_, err := s.book.InsertOrder(NewLimitOrder("o1", "buy", "1.2", "1"))
+	s.Nil(err)
+
+	_, err = s.book.InsertOrder(NewLimitOrder("o1", "buy", "1.2", "1"))
+	s.Equal(ErrOrderExists, err)
+
+	_, err = s.book.RemoveOrder(NewLimitOrder("o2", "buy", "1.2", "1"))
+	s.Equal(ErrOrderNotFound, err)
+
+	_, err = s.book.RemoveOrder(NewLimitOrder("o1", "buy", "1.3", "1"))
+	s.Equal(ErrOrderNotFound, err)
+
+	_, err = s.book.ChangeOrder(NewLimitOrder("o1", "buy", "1.3", "1"), decimal.NewFromFloat(0.9))
+	s.Equal(ErrPriceLevelMissing, err)
+
+	s.Equal("1", s.book.bidsTree.Max().(*priceLevel).totalAmount.String())
+}
+
+func (s *orderbookTestSuite) TestValidate() {
+	s.Nil(NewLimitOrder("o1", "buy", "1.2", "1").Validate())
+	s.Nil(NewOrder("o1", "buy", "0", "1", "market").Validate())
+
+	s.Equal(ErrInvalidOrder, NewLimitOrder("o1", "buy", "0", "1").Validate())
+	s.Equal(ErrInvalidOrder, NewLimitOrder("o1", "buy", "1.2", "0").Validate())
+	s.Equal(ErrInvalidOrder, NewOrder("o1", "buy", "1.2", "1", "stop").Validate())
+
+	var order *MemoryOrder
+	s.Equal(ErrInvalidOrder, order.Validate())
+}
+
 var amtDecimals = 3
 
 func (s *orderbookTestSuite) TestMatch() {
@@ -169,6 +247,22 @@ func (s *orderbookTestSuite) TestMatch5() {
 	s.Equal("o2", result.MatchItems[3].MakerOrder.ID)
 }
 
+func (s *orderbookTestSuite) TestMatchSkipExpiredMakers() {
+	expired := NewLimitOrder("o1", "buy", "1.5", "2")
+	expired.ExpiredAt = 100
+
+	s.book.InsertOrder(expired)
+	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.2", "2"))
+
+	result := s.book.MatchOrderAt(NewLimitOrder("o3", "sell", "1.2", "2"), amtDecimals, 100)
+	s.Equal(1, len(result.MatchItems))
+	s.Equal("o2", result.MatchItems[0].MakerOrder.ID)
+
+	result = s.book.MatchOrderAt(NewLimitOrder("o3", "sell", "1.2", "2"), amtDecimals, 99)
+	s.Equal(1, len(result.MatchItems))
+	s.Equal("o1", result.MatchItems[0].MakerOrder.ID)
+}
+
 func (s *orderbookTestSuite) TestCanBeMatched() {
 	s.book.InsertOrder(NewLimitOrder("o1", "buy", "1.2", "3.4"))
 	s.book.InsertOrder(NewLimitOrder("o2", "buy", "1.3", "3.4"))
@@ -17,6 +17,16 @@ type IQueue interface {
 	Pop() ([]byte, error)
 }
 
+// QueueTimeout is returned by PopTimeout when no message arrives in time
+var QueueTimeout = errors.New("QueueTimeout")
+
+// ITimeoutQueue is a queue whose Pop can give up, the queues of InitQueue satisfy it
+type ITimeoutQueue interface {
+	IQueue
+
+	PopTimeout(timeout time.Duration) ([]byte, error)
+}
+
 func InitQueue(config interface{}) (queue IQueue, err error) {
 	switch c := config.(type) {
 	case nil:
@@ -25,6 +35,22 @@ func InitQueue(config interface{}) (queue IQueue, err error) {
 		client := &RedisQueue{}
 		err = client.Init(c)
 
+		if err != nil {
+			return
+		}
+		return client, nil
+	case *MemoryQueueConfig:
+		client := &MemoryQueue{}
+		err = client.Init(c)
+
+		if err != nil {
+			return
+		}
+		return client, nil
+	case *FileQueueConfig:
+		client := &FileQueue{}
+		err = client.Init(c)
+
 		if err != nil {
 			return
 		}
@@ -76,6 +102,25 @@ func (queue *RedisQueue) Pop() ([]byte, error) {
 	}
 }
 
+// PopTimeout is Pop which returns QueueTimeout if no message arrives in timeout, rounded up to a second by BRPOP
+func (queue *RedisQueue) PopTimeout(timeout time.Duration) ([]byte, error) {
+	select {
+	case <-queue.ctx.Done():
+		return nil, EXIT
+	default:
+	}
+
+	res, err := queue.client.BRPop(timeout, queue.name).Result()
+
+	if err == redis.Nil {
+		return nil, QueueTimeout
+	} else if err != nil {
+		return nil, err
+	}
+
+	return []byte(res[1]), nil
+}
+
 func (queue *RedisQueue) Init(config *RedisQueueConfig) error {
 	if config.Client == nil {
 		return fmt.Errorf("No redis Connection")
@@ -1,26 +1,142 @@
 package common
 
 import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis"
 	"github.com/stretchr/testify/suite"
+	"os"
 	"testing"
+	"time"
 )
 
-type redisQueueTest struct {
+// queueBehaviorSuite is the behavior every IQueue implementation must have
+type queueBehaviorSuite struct {
 	suite.Suite
+	newConfig func(name string, ctx context.Context) interface{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  IQueue
 }
 
-func (s *redisQueueTest) SetupSuite() {
+func (s *queueBehaviorSuite) SetupTest() {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	queue, err := InitQueue(s.newConfig(fmt.Sprintf("NSK_TEST_QUEUE_%d", time.Now().UnixNano()), s.ctx))
+	s.Nil(err)
+	s.queue = queue
 }
 
-func (s *redisQueueTest) SetupTest() {
+func (s *queueBehaviorSuite) TearDownTest() {
+	s.cancel()
 }
 
-func (s *redisQueueTest) TearDownTest() {
+func (s *queueBehaviorSuite) TestFIFO() {
+	for i := 0; i < 3; i++ {
+		s.Nil(s.queue.Push([]byte(fmt.Sprintf("msg-%d", i))))
+	}
+
+	for i := 0; i < 3; i++ {
+		msg, err := s.queue.Pop()
+		s.Nil(err)
+		s.Equal(fmt.Sprintf("msg-%d", i), string(msg))
+	}
+}
+
+func (s *queueBehaviorSuite) TestPopBlocksUntilPush() {
+	popped := make(chan []byte)
+
+	go func() {
+		msg, _ := s.queue.Pop()
+		popped <- msg
+	}()
+
+	select {
+	case <-popped:
+		s.Fail("pop returned from an empty queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.Nil(s.queue.Push([]byte("hello")))
+
+	select {
+	case msg := <-popped:
+		s.Equal("hello", string(msg))
+	case <-time.After(3 * time.Second):
+		s.Fail("pop is still blocked after push")
+	}
+}
+
+func (s *queueBehaviorSuite) TestPopExitsWhenCanceled() {
+	done := make(chan error)
+
+	go func() {
+		_, err := s.queue.Pop()
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	s.cancel()
+
+	select {
+	case err := <-done:
+		s.Equal(EXIT, err)
+	case <-time.After(3 * time.Second):
+		s.Fail("pop is still blocked after cancel")
+	}
 }
 
-func (s *redisQueueTest) TearDownSuite() {
+func TestMemoryQueue(t *testing.T) {
+	suite.Run(t, &queueBehaviorSuite{newConfig: func(name string, ctx context.Context) interface{} {
+		return &MemoryQueueConfig{Name: name, Ctx: ctx}
+	}})
 }
 
 func TestRedisQueue(t *testing.T) {
-	suite.Run(t, new(redisQueueTest))
+	client := testRedisClient(t)
+
+	suite.Run(t, &queueBehaviorSuite{newConfig: func(name string, ctx context.Context) interface{} {
+		return &RedisQueueConfig{Name: name, Ctx: ctx, Client: client}
+	}})
+}
+
+func TestMemoryQueuePushBlocksWhenFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	name := fmt.Sprintf("NSK_TEST_BOUNDED_QUEUE_%d", time.Now().UnixNano())
+	queue, _ := InitQueue(&MemoryQueueConfig{Name: name, Ctx: ctx, Capacity: 1})
+
+	if err := queue.Push([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- queue.Push([]byte("2")) }()
+
+	select {
+	case <-done:
+		t.Fatal("push returned while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+
+	if err := <-done; err != EXIT {
+		t.Fatalf("expected EXIT, got %v", err)
+	}
+}
+
+// testRedisClient skips the test if NSK_REDIS_URL is not set
+func testRedisClient(t *testing.T) *redis.Client {
+	url := os.Getenv("NSK_REDIS_URL")
+	if url == "" {
+		t.Skip("NSK_REDIS_URL is not set")
+	}
+
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return redis.NewClient(options)
 }
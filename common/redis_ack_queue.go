@@ -0,0 +1,310 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedisAckQueueConfig selects the Redis Streams ack queue in InitAckQueue.
+// Consumers of the same Group share the messages of the stream Name, Consumer should be unique in the group.
+// Messages which fail MaxAttempts times are pushed to DeadLetterQueue, a Redis list named Name + ":dead" by default.
+type RedisAckQueueConfig struct {
+	Name              string
+	Group             string
+	Consumer          string
+	Ctx               context.Context
+	Client            *redis.Client
+	VisibilityTimeout time.Duration
+	MaxAttempts       int
+	DeadLetterQueue   IQueue
+}
+
+const DefaultRedisAckQueueGroup = "nsk"
+
+// RedisAckQueue is an IAckQueue on a Redis stream with a consumer group.
+// A message which is not acked in time is claimed from the pending list by any consumer,
+// and added to the stream again with the next attempt number.
+// Pop of one RedisAckQueue should not be called concurrently, init one for each consumer.
+type RedisAckQueue struct {
+	name              string
+	group             string
+	consumer          string
+	ctx               context.Context
+	client            *redis.Client
+	visibilityTimeout time.Duration
+	maxAttempts       int
+	deadLetterQueue   IQueue
+
+	// pending messages are checked at most once in claimInterval
+	claimInterval time.Duration
+	lastClaimAt   time.Time
+}
+
+func (queue *RedisAckQueue) Init(config *RedisAckQueueConfig) error {
+	if config.Client == nil {
+		return fmt.Errorf("No redis Connection")
+	}
+
+	queue.client = config.Client
+	queue.ctx = config.Ctx
+	queue.name = config.Name
+
+	if queue.ctx == nil {
+		queue.ctx = context.Background()
+	}
+
+	queue.group = config.Group
+	if queue.group == "" {
+		queue.group = DefaultRedisAckQueueGroup
+	}
+
+	queue.consumer = config.Consumer
+	if queue.consumer == "" {
+		hostname, _ := os.Hostname()
+		queue.consumer = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	queue.visibilityTimeout, queue.maxAttempts = ackQueueDefaults(config.VisibilityTimeout, config.MaxAttempts)
+
+	queue.claimInterval = queue.visibilityTimeout / 2
+	if queue.claimInterval > time.Second {
+		queue.claimInterval = time.Second
+	} else if queue.claimInterval < 10*time.Millisecond {
+		// XREADGROUP blocks forever with a zero timeout
+		queue.claimInterval = 10 * time.Millisecond
+	}
+
+	queue.deadLetterQueue = config.DeadLetterQueue
+	if queue.deadLetterQueue == nil {
+		deadLetterQueue, err := InitQueue(&RedisQueueConfig{Name: config.Name + ":dead", Ctx: queue.ctx, Client: config.Client})
+		if err != nil {
+			return err
+		}
+
+		queue.deadLetterQueue = deadLetterQueue
+	}
+
+	err := queue.client.XGroupCreateMkStream(queue.name, queue.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	return nil
+}
+
+func (queue *RedisAckQueue) Push(data []byte) error {
+	return queue.client.XAdd(&redis.XAddArgs{
+		Stream: queue.name,
+		Values: map[string]interface{}{"data": data, "attempt": 1},
+	}).Err()
+}
+
+func (queue *RedisAckQueue) Pop() (IDelivery, error) {
+	for {
+		select {
+		case <-queue.ctx.Done():
+			return nil, EXIT
+		default:
+			if err := queue.claimExpired(); err != nil {
+				return nil, err
+			}
+
+			res, err := queue.client.XReadGroup(&redis.XReadGroupArgs{
+				Group:    queue.group,
+				Consumer: queue.consumer,
+				Streams:  []string{queue.name, ">"},
+				Count:    1,
+				Block:    queue.claimInterval,
+			}).Result()
+
+			if err == redis.Nil {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			if len(res) == 0 || len(res[0].Messages) == 0 {
+				continue
+			}
+
+			msg := res[0].Messages[0]
+
+			data, attempt, err := parseRedisAckMessage(msg)
+			if err != nil {
+				if err = queue.deadLetterInvalid(msg, err); err != nil {
+					return nil, err
+				}
+
+				continue
+			}
+
+			return queue.newDelivery(msg.ID, data, attempt), nil
+		}
+	}
+}
+
+func (queue *RedisAckQueue) newDelivery(id string, data []byte, attempt int) *delivery {
+	return &delivery{
+		data:    data,
+		attempt: attempt,
+		ack: func() error {
+			return queue.remove(id)
+		},
+		nack: func() error {
+			return queue.retry(id, data, attempt)
+		},
+	}
+}
+
+// deadLetterInvalid moves an entry which is not a message of this queue to the dead letter queue,
+// so it doesn't block the consumer. Its data is pushed as it is, or all its values as json if it has no data.
+func (queue *RedisAckQueue) deadLetterInvalid(msg redis.XMessage, cause error) error {
+	utils.Errorf("%v, move it to the dead letter queue", cause)
+
+	data, exist := msg.Values["data"].(string)
+	if !exist {
+		bts, _ := json.Marshal(msg.Values)
+		data = string(bts)
+	}
+
+	if err := queue.deadLetterQueue.Push([]byte(data)); err != nil {
+		return err
+	}
+
+	if err := queue.remove(msg.ID); err != nil && err != DeliveryExpired {
+		return err
+	}
+
+	return nil
+}
+
+// claimExpired gives back messages which are not acked within the visibility timeout
+func (queue *RedisAckQueue) claimExpired() error {
+	if time.Since(queue.lastClaimAt) < queue.claimInterval {
+		return nil
+	}
+
+	queue.lastClaimAt = time.Now()
+
+	pending, err := queue.client.XPendingExt(&redis.XPendingExtArgs{
+		Stream: queue.name,
+		Group:  queue.group,
+		Start:  "-",
+		End:    "+",
+		Count:  100,
+	}).Result()
+
+	// some servers reply nil instead of an empty list
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var ids []string
+
+	for _, p := range pending {
+		if p.Idle >= queue.visibilityTimeout {
+			ids = append(ids, p.Id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// only one consumer claims a message, the idle time of a claimed message is reset
+	msgs, err := queue.client.XClaim(&redis.XClaimArgs{
+		Stream:   queue.name,
+		Group:    queue.group,
+		Consumer: queue.consumer,
+		MinIdle:  queue.visibilityTimeout,
+		Messages: ids,
+	}).Result()
+
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		data, attempt, err := parseRedisAckMessage(msg)
+		if err != nil {
+			if err = queue.deadLetterInvalid(msg, err); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err = queue.retry(msg.ID, data, attempt); err != nil && err != DeliveryExpired {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// retry adds the message again before removing the old one, so it is never lost in between
+func (queue *RedisAckQueue) retry(id string, data []byte, attempt int) error {
+	if attempt >= queue.maxAttempts {
+		if err := queue.deadLetterQueue.Push(data); err != nil {
+			return err
+		}
+
+		return queue.remove(id)
+	}
+
+	pipe := queue.client.TxPipeline()
+	pipe.XAdd(&redis.XAddArgs{
+		Stream: queue.name,
+		Values: map[string]interface{}{"data": data, "attempt": attempt + 1},
+	})
+	acked := pipe.XAck(queue.name, queue.group, id)
+	pipe.XDel(queue.name, id)
+
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+
+	// it was given back by another consumer, there is a duplicate now which is fine for at-least-once
+	if acked.Val() == 0 {
+		return DeliveryExpired
+	}
+
+	return nil
+}
+
+func (queue *RedisAckQueue) remove(id string) error {
+	pipe := queue.client.TxPipeline()
+	acked := pipe.XAck(queue.name, queue.group, id)
+	pipe.XDel(queue.name, id)
+
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+
+	if acked.Val() == 0 {
+		return DeliveryExpired
+	}
+
+	return nil
+}
+
+func parseRedisAckMessage(msg redis.XMessage) ([]byte, int, error) {
+	data, _ := msg.Values["data"].(string)
+	attemptString, _ := msg.Values["attempt"].(string)
+
+	attempt, err := strconv.Atoi(attemptString)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid message %s in ack queue: %v", msg.ID, err)
+	}
+
+	return []byte(data), attempt, nil
+}
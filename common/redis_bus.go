@@ -0,0 +1,85 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis"
+)
+
+// RedisBusConfig selects the Redis Pub/Sub bus in InitBus, Channel is the Pub/Sub channel name.
+type RedisBusConfig struct {
+	Channel string
+	Ctx     context.Context
+	Client  *redis.Client
+}
+
+// RedisBus is an IBus on Redis Pub/Sub, every websocket node subscribing to it receives every message.
+// Messages published while a subscription is reconnecting are lost.
+type RedisBus struct {
+	channel string
+	ctx     context.Context
+	client  *redis.Client
+}
+
+type redisSubscription struct {
+	bus      *RedisBus
+	pubSub   *redis.PubSub
+	messages <-chan *redis.Message
+}
+
+func (bus *RedisBus) Init(config *RedisBusConfig) error {
+	if config.Client == nil {
+		return fmt.Errorf("No redis Connection")
+	}
+
+	bus.client = config.Client
+	bus.channel = config.Channel
+	bus.ctx = config.Ctx
+	if bus.ctx == nil {
+		bus.ctx = context.Background()
+	}
+
+	return nil
+}
+
+func (bus *RedisBus) Push(data []byte) error {
+	return bus.client.Publish(bus.channel, data).Err()
+}
+
+// Subscribe returns after Redis confirms the subscription, so no later message is missed
+func (bus *RedisBus) Subscribe() (ISubscription, error) {
+	pubSub := bus.client.Subscribe(bus.channel)
+
+	if _, err := pubSub.Receive(); err != nil {
+		_ = pubSub.Close()
+		return nil, err
+	}
+
+	return &redisSubscription{
+		bus:      bus,
+		pubSub:   pubSub,
+		messages: pubSub.Channel(),
+	}, nil
+}
+
+func (sub *redisSubscription) Push(data []byte) error {
+	return sub.bus.Push(data)
+}
+
+func (sub *redisSubscription) Pop() ([]byte, error) {
+	select {
+	case msg, ok := <-sub.messages:
+		if !ok {
+			return nil, EXIT
+		}
+
+		return []byte(msg.Payload), nil
+	case <-sub.bus.ctx.Done():
+		_ = sub.Close()
+		return nil, EXIT
+	}
+}
+
+func (sub *redisSubscription) Close() error {
+	return sub.pubSub.Close()
+}
@@ -0,0 +1,550 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrSegmentLogCorrupted = errors.New("segment log corrupted")
+
+const (
+	segmentLogSuffix        = ".log"
+	segmentLogHeaderSize    = 8
+	segmentLogRecordMaxSize = 16 * 1024 * 1024
+)
+
+// SegmentLogConfig configures a SegmentLog.
+// Segments are named Prefix, the offset of their first record in 20 digits and ".log".
+type SegmentLogConfig struct {
+	Dir    string
+	Prefix string
+
+	// a new segment is started once the last one reaches SegmentSize, zero only starts one in Roll
+	SegmentSize int64
+
+	// the oldest segments are removed on Roll while the log is larger than RetentionBytes,
+	// or they are older than RetentionTime. Zero keeps everything.
+	RetentionBytes int64
+	RetentionTime  time.Duration
+
+	// sync after each append if SyncEveryAppend, otherwise every SyncInterval if it is positive
+	SyncEveryAppend bool
+	SyncInterval    time.Duration
+
+	// offset of the first record if the log is empty
+	FirstOffset uint64
+}
+
+// Segments returns start offsets of all segments in Dir in order
+func (config *SegmentLogConfig) Segments() ([]uint64, error) {
+	return ListIndexedFiles(config.Dir, config.Prefix, segmentLogSuffix)
+}
+
+func (config *SegmentLogConfig) SegmentPath(start uint64) string {
+	return filepath.Join(config.Dir, fmt.Sprintf("%s%020d%s", config.Prefix, start, segmentLogSuffix))
+}
+
+// SegmentLog is an append-only log of records in a directory, split into segments.
+// Each record is a 4 bytes length, a 4 bytes crc32 of the payload and the payload,
+// its offset is the offset of the segment plus the number of records before it in the segment.
+type SegmentLog struct {
+	config *SegmentLogConfig
+
+	lock       sync.Mutex
+	file       *os.File
+	fileSize   int64
+	nextOffset uint64
+	dirty      bool
+
+	// closed and replaced after each append, to wake up readers
+	appended chan struct{}
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// OpenSegmentLog opens the log in config.Dir, a torn record at the tail of the last segment is truncated.
+func OpenSegmentLog(config *SegmentLogConfig) (*SegmentLog, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &SegmentLog{
+		config:   config,
+		appended: make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+
+	segments, err := config.Segments()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segments) == 0 {
+		err = l.openSegment(config.FirstOffset)
+	} else {
+		err = l.openLastSegment(segments[len(segments)-1])
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the log is behind its owner, e.g. segments were removed by hand
+	if l.nextOffset < config.FirstOffset {
+		l.nextOffset = config.FirstOffset
+
+		if err = l.Roll(); err != nil {
+			return nil, err
+		}
+	} else {
+		l.removeExpiredSegments()
+	}
+
+	if !config.SyncEveryAppend && config.SyncInterval > 0 {
+		l.wg.Add(1)
+		go l.syncLoop()
+	}
+
+	return l, nil
+}
+
+// Append writes a record and returns its offset
+func (l *SegmentLog) Append(data []byte) (uint64, error) {
+	return l.AppendFunc(func(uint64) ([]byte, error) { return data, nil })
+}
+
+// AppendFunc writes the record built by fn with the offset it is written at
+func (l *SegmentLog) AppendFunc(fn func(offset uint64) ([]byte, error)) (uint64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.config.SegmentSize > 0 && l.fileSize >= l.config.SegmentSize {
+		if err := l.roll(); err != nil {
+			return 0, err
+		}
+	}
+
+	data, err := fn(l.nextOffset)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(data) > segmentLogRecordMaxSize {
+		return 0, fmt.Errorf("record of %d bytes is too large for segment log", len(data))
+	}
+
+	record := make([]byte, segmentLogHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[segmentLogHeaderSize:], data)
+
+	if _, err = l.file.Write(record); err != nil {
+		return 0, err
+	}
+
+	if l.config.SyncEveryAppend {
+		if err = l.file.Sync(); err != nil {
+			return 0, err
+		}
+	} else {
+		l.dirty = true
+	}
+
+	offset := l.nextOffset
+	l.fileSize = l.fileSize + int64(len(record))
+	l.nextOffset = l.nextOffset + 1
+
+	close(l.appended)
+	l.appended = make(chan struct{})
+
+	return offset, nil
+}
+
+// Next returns the next offset to be written, and a channel closed when it is written
+func (l *SegmentLog) Next() (uint64, chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.nextOffset, l.appended
+}
+
+// Roll starts a new segment at the next offset and applies the retention
+func (l *SegmentLog) Roll() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.roll()
+}
+
+// RemoveBefore removes segments whose records are all before offset.
+// The segment being written is always kept.
+func (l *SegmentLog) RemoveBefore(offset uint64) {
+	segments, err := l.config.Segments()
+	if err != nil {
+		utils.Errorf("list segments of %s error: %v", l.config.Dir, err)
+		return
+	}
+
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i+1] > offset {
+			break
+		}
+
+		if err := os.Remove(l.config.SegmentPath(segments[i])); err != nil {
+			utils.Errorf("remove segment error: %v", err)
+		}
+	}
+}
+
+func (l *SegmentLog) Segments() ([]uint64, error) {
+	return l.config.Segments()
+}
+
+// NewReader returns a reader of records from offset
+func (l *SegmentLog) NewReader(offset uint64) *SegmentLogReader {
+	return &SegmentLogReader{log: l, offset: offset}
+}
+
+func (l *SegmentLog) Close() error {
+	close(l.stop)
+	l.wg.Wait()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	return l.file.Close()
+}
+
+func (l *SegmentLog) roll() error {
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	if err := l.openSegment(l.nextOffset); err != nil {
+		return err
+	}
+
+	l.removeExpiredSegments()
+
+	return nil
+}
+
+func (l *SegmentLog) openSegment(start uint64) error {
+	f, err := os.OpenFile(l.config.SegmentPath(start), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.file = f
+	l.fileSize = 0
+	l.nextOffset = start
+	l.dirty = false
+
+	return nil
+}
+
+// openLastSegment finds the next offset from the last segment and truncates a torn tail
+func (l *SegmentLog) openLastSegment(start uint64) error {
+	f, err := os.OpenFile(l.config.SegmentPath(start), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	nextOffset := start
+
+	var validSize int64
+	err = ReadSegmentLogRecords(bufio.NewReader(f), func(_ []byte, end int64) error {
+		nextOffset++
+		validSize = end
+		return nil
+	})
+
+	if err == ErrSegmentLogCorrupted {
+		utils.Errorf("segment %s has a torn tail, truncate it to %d bytes", l.config.SegmentPath(start), validSize)
+
+		if err = f.Truncate(validSize); err != nil {
+			_ = f.Close()
+			return err
+		}
+	} else if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = l.openSegment(start); err != nil {
+		return err
+	}
+
+	l.fileSize = validSize
+	l.nextOffset = nextOffset
+
+	return nil
+}
+
+// removeExpiredSegments removes the oldest segments while they are beyond RetentionBytes or RetentionTime.
+// The segment being written is always kept.
+func (l *SegmentLog) removeExpiredSegments() {
+	if l.config.RetentionBytes <= 0 && l.config.RetentionTime <= 0 {
+		return
+	}
+
+	segments, err := l.config.Segments()
+	if err != nil {
+		utils.Errorf("list segments of %s error: %v", l.config.Dir, err)
+		return
+	}
+
+	infos := make([]os.FileInfo, len(segments))
+	var total int64
+
+	for i, start := range segments {
+		info, err := os.Stat(l.config.SegmentPath(start))
+		if err != nil {
+			utils.Errorf("stat segment error: %v", err)
+			return
+		}
+
+		infos[i] = info
+		total = total + info.Size()
+	}
+
+	for i := 0; i+1 < len(segments); i++ {
+		tooLarge := l.config.RetentionBytes > 0 && total > l.config.RetentionBytes
+		tooOld := l.config.RetentionTime > 0 && time.Since(infos[i].ModTime()) > l.config.RetentionTime
+
+		if !tooLarge && !tooOld {
+			break
+		}
+
+		if err := os.Remove(l.config.SegmentPath(segments[i])); err != nil {
+			utils.Errorf("remove segment error: %v", err)
+			return
+		}
+
+		total = total - infos[i].Size()
+	}
+}
+
+func (l *SegmentLog) syncLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(l.config.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.lock.Lock()
+			if l.dirty {
+				if err := l.file.Sync(); err != nil {
+					utils.Errorf("sync segment log %s error: %v", l.config.Dir, err)
+				} else {
+					l.dirty = false
+				}
+			}
+			l.lock.Unlock()
+		}
+	}
+}
+
+// SegmentLogReader reads records of a SegmentLog in order from an offset
+type SegmentLogReader struct {
+	log    *SegmentLog
+	offset uint64
+	file   *os.File
+	reader *bufio.Reader
+}
+
+// Offset returns the offset of the next record to read
+func (r *SegmentLogReader) Offset() uint64 {
+	return r.offset
+}
+
+// Read returns the record at Offset, which must be less than the next offset of the log
+func (r *SegmentLogReader) Read() ([]byte, error) {
+	if r.file == nil {
+		if err := r.seek(); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		data, err := readSegmentLogRecord(r.reader)
+
+		if err == io.EOF {
+			// the rest is in the next segment
+			r.Close()
+
+			if err = r.seek(); err != nil {
+				return nil, err
+			}
+
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		r.offset++
+
+		return data, nil
+	}
+}
+
+func (r *SegmentLogReader) Close() {
+	if r.file != nil {
+		_ = r.file.Close()
+		r.file = nil
+		r.reader = nil
+	}
+}
+
+// seek opens the segment containing r.offset and skips the records before it.
+// If the segment was removed, it starts from the oldest record.
+func (r *SegmentLogReader) seek() error {
+	segments, err := r.log.config.Segments()
+	if err != nil {
+		return err
+	}
+
+	if len(segments) == 0 {
+		return ErrSegmentLogCorrupted
+	}
+
+	if r.offset < segments[0] {
+		utils.Errorf("records of %s from %d to %d were removed before they were read", r.log.config.Dir, r.offset, segments[0]-1)
+		r.offset = segments[0]
+	}
+
+	start := segments[0]
+	for _, s := range segments {
+		if s <= r.offset {
+			start = s
+		}
+	}
+
+	f, err := os.Open(r.log.config.SegmentPath(start))
+	if err != nil {
+		return err
+	}
+
+	r.file = f
+	r.reader = bufio.NewReader(f)
+
+	for i := start; i < r.offset; i++ {
+		if _, err = readSegmentLogRecord(r.reader); err != nil {
+			r.Close()
+
+			if err == io.EOF {
+				return ErrSegmentLogCorrupted
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadSegmentLogRecords calls fn with each record and the file offset after it.
+// It returns ErrSegmentLogCorrupted when a record is incomplete or its checksum doesn't match.
+func ReadSegmentLogRecords(r io.Reader, fn func(data []byte, end int64) error) error {
+	var offset int64
+
+	for {
+		data, err := readSegmentLogRecord(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		offset = offset + segmentLogHeaderSize + int64(len(data))
+
+		if err := fn(data, offset); err != nil {
+			return err
+		}
+	}
+}
+
+// readSegmentLogRecord returns io.EOF only if there is nothing left
+func readSegmentLogRecord(r io.Reader) ([]byte, error) {
+	header := make([]byte, segmentLogHeaderSize)
+
+	if _, err := io.ReadFull(r, header); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, ErrSegmentLogCorrupted
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > segmentLogRecordMaxSize {
+		return nil, ErrSegmentLogCorrupted
+	}
+
+	data := make([]byte, size)
+
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, ErrSegmentLogCorrupted
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, ErrSegmentLogCorrupted
+	}
+
+	return data, nil
+}
+
+// ListIndexedFiles returns the numbers of files in dir named prefix, a number and suffix, in order
+func ListIndexedFiles(dir, prefix, suffix string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := make([]uint64, 0)
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+
+		index, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	sort.Slice(indexes, func(a, b int) bool { return indexes[a] < indexes[b] })
+
+	return indexes, nil
+}
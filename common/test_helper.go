@@ -19,6 +19,31 @@ func (m *MockKVStore) Get(key string) (string, error) {
 	return args.String(0), args.Error(1)
 }
 
+func (m *MockKVStore) Delete(key string) error {
+	args := m.Called(key)
+	return args.Error(0)
+}
+
+func (m *MockKVStore) SetNX(key string, value string, expire time.Duration) (bool, error) {
+	args := m.Called(key, value, expire)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockKVStore) CompareAndSwap(key string, old string, value string, expire time.Duration) (bool, error) {
+	args := m.Called(key, old, value, expire)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockKVStore) Incr(key string, delta int64) (int64, error) {
+	args := m.Called(key, delta)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockKVStore) Scan(prefix string) ([]string, error) {
+	args := m.Called(prefix)
+	return args.Get(0).([]string), args.Error(1)
+}
+
 type MockQueue struct {
 	mock.Mock
 	Buffers [][]byte
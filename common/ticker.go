@@ -0,0 +1,286 @@
+package common
+
+import (
+	"fmt"
+	"github.com/shopspring/decimal"
+	"sort"
+	"sync"
+)
+
+// TickerWindow is the length of the rolling window of tickers in seconds
+const TickerWindow = 24 * 60 * 60
+
+// tickerBucketInterval is the resolution of the rolling window, a trade leaves the window with its minute
+const tickerBucketInterval = CandleInterval1m
+
+// Ticker shows the trades of a market in the last 24 hours.
+// Open is the price of the first trade in the window, without trades in the window all prices are the last price.
+type Ticker struct {
+	MarketID           string          `json:"marketID"`
+	LastPrice          decimal.Decimal `json:"lastPrice"`
+	Open               decimal.Decimal `json:"open"`
+	High               decimal.Decimal `json:"high"`
+	Low                decimal.Decimal `json:"low"`
+	Volume             decimal.Decimal `json:"volume"`
+	QuoteVolume        decimal.Decimal `json:"quoteVolume"`
+	PriceChange        decimal.Decimal `json:"priceChange"`
+	PriceChangePercent decimal.Decimal `json:"priceChangePercent"`
+	Trades             int             `json:"trades"`
+	UpdatedAt          uint64          `json:"updatedAt"`
+}
+
+// rollingWindow keeps one minute bars of a market.
+// Sums are updated when a bar enters or leaves the window, high and low come from monotonic queues of bars,
+// so no update rescans the window.
+type rollingWindow struct {
+	marketID string
+
+	bars  []*Candle
+	highs []*Candle // highs are decreasing
+	lows  []*Candle // lows are increasing
+
+	volume      decimal.Decimal
+	quoteVolume decimal.Decimal
+	trades      int
+
+	lastPrice decimal.Decimal
+	updatedAt uint64
+}
+
+func (w *rollingWindow) addBar(bar *Candle) {
+	w.bars = append(w.bars, bar)
+	w.volume = w.volume.Add(bar.Volume)
+	w.quoteVolume = w.quoteVolume.Add(bar.QuoteVolume)
+	w.trades = w.trades + bar.Trades
+	w.lastPrice = bar.Close
+	w.pushExtremes(bar)
+}
+
+func (w *rollingWindow) addTrade(price, amount decimal.Decimal, timestamp uint64) {
+	openTime := tickerBucketInterval.OpenTime(timestamp)
+
+	// a late trade is counted in the last bar
+	if n := len(w.bars); n > 0 && w.bars[n-1].OpenTime >= openTime {
+		bar := w.bars[n-1]
+		bar.addTrade(price, amount)
+		w.pushExtremes(bar)
+	} else {
+		bar := emptyCandle(w.marketID, tickerBucketInterval, openTime, price)
+		bar.addTrade(price, amount)
+		w.bars = append(w.bars, bar)
+		w.pushExtremes(bar)
+	}
+
+	w.volume = w.volume.Add(amount)
+	w.quoteVolume = w.quoteVolume.Add(amount.Mul(price))
+	w.trades = w.trades + 1
+	w.lastPrice = price
+}
+
+// pushExtremes puts a new or changed last bar into the queues
+func (w *rollingWindow) pushExtremes(bar *Candle) {
+	for len(w.highs) > 0 && w.highs[len(w.highs)-1].High.LessThanOrEqual(bar.High) {
+		w.highs = w.highs[:len(w.highs)-1]
+	}
+	w.highs = append(w.highs, bar)
+
+	for len(w.lows) > 0 && w.lows[len(w.lows)-1].Low.GreaterThanOrEqual(bar.Low) {
+		w.lows = w.lows[:len(w.lows)-1]
+	}
+	w.lows = append(w.lows, bar)
+}
+
+// expire removes bars which are out of the window at now, it returns true if any bar is removed
+func (w *rollingWindow) expire(now uint64) bool {
+	var expired bool
+
+	for len(w.bars) > 0 && w.bars[0].OpenTime+TickerWindow <= now {
+		bar := w.bars[0]
+		w.bars[0] = nil
+		w.bars = w.bars[1:]
+
+		w.volume = w.volume.Sub(bar.Volume)
+		w.quoteVolume = w.quoteVolume.Sub(bar.QuoteVolume)
+		w.trades = w.trades - bar.Trades
+
+		if len(w.highs) > 0 && w.highs[0] == bar {
+			w.highs = w.highs[1:]
+		}
+
+		if len(w.lows) > 0 && w.lows[0] == bar {
+			w.lows = w.lows[1:]
+		}
+
+		expired = true
+	}
+
+	return expired
+}
+
+func (w *rollingWindow) ticker() *Ticker {
+	ticker := &Ticker{
+		MarketID:    w.marketID,
+		LastPrice:   w.lastPrice,
+		Open:        w.lastPrice,
+		High:        w.lastPrice,
+		Low:         w.lastPrice,
+		Volume:      w.volume,
+		QuoteVolume: w.quoteVolume,
+		Trades:      w.trades,
+		UpdatedAt:   w.updatedAt,
+	}
+
+	if len(w.bars) > 0 {
+		ticker.Open = w.bars[0].Open
+		ticker.High = w.highs[0].High
+		ticker.Low = w.lows[0].Low
+	}
+
+	ticker.PriceChange = ticker.LastPrice.Sub(ticker.Open)
+	if ticker.Open.IsPositive() {
+		ticker.PriceChangePercent = ticker.PriceChange.Mul(decimal.New(100, 0)).DivRound(ticker.Open, 2)
+	}
+
+	return ticker
+}
+
+// TickerAggregator keeps the 24 hours tickers of all markets, driven by trades
+type TickerAggregator struct {
+	lock    sync.Mutex
+	windows map[string]*rollingWindow
+}
+
+func NewTickerAggregator() *TickerAggregator {
+	return &TickerAggregator{windows: make(map[string]*rollingWindow)}
+}
+
+func (a *TickerAggregator) window(marketID string) *rollingWindow {
+	w, exist := a.windows[marketID]
+	if !exist {
+		w = &rollingWindow{marketID: marketID}
+		a.windows[marketID] = w
+	}
+
+	return w
+}
+
+// Restore fills the window of a market with its one minute candles, oldest first, e.g. after a restart
+func (a *TickerAggregator) Restore(marketID string, candles []*Candle, now uint64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	w := &rollingWindow{marketID: marketID}
+	for _, candle := range candles {
+		if candle.Interval != tickerBucketInterval || candle.Trades == 0 {
+			continue
+		}
+
+		w.addBar(candle.Copy())
+		w.updatedAt = candle.OpenTime
+	}
+
+	w.expire(now)
+	a.windows[marketID] = w
+}
+
+// AddTrade updates the ticker of the market and returns the ticker update messages
+func (a *TickerAggregator) AddTrade(marketID string, price, amount decimal.Decimal, timestamp uint64) []WebSocketMessage {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	w := a.window(marketID)
+	w.addTrade(price, amount, timestamp)
+	w.expire(timestamp)
+
+	if timestamp > w.updatedAt {
+		w.updatedAt = timestamp
+	}
+
+	return TickerUpdateMessages(w.ticker())
+}
+
+// AddMatchResult adds a trade at the maker price for each item which is not canceled.
+// The error is always nil, it is returned like CandleAggregator.AddMatchResult, so both are engine market data handlers.
+func (a *TickerAggregator) AddMatchResult(matchResult *MatchResult, timestamp uint64) (msgs []WebSocketMessage, err error) {
+	for _, item := range matchResult.MatchItems {
+		if item.MatchShouldBeCanceled {
+			continue
+		}
+
+		msgs = append(msgs, a.AddTrade(matchResult.TakerOrder.MarketID, item.MakerOrder.Price, item.MatchedAmount, timestamp)...)
+	}
+
+	return msgs, nil
+}
+
+// Tick moves the windows of all markets to now, and returns update messages of tickers which are changed
+func (a *TickerAggregator) Tick(now uint64) (msgs []WebSocketMessage) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, w := range a.windows {
+		if w.expire(now) {
+			w.updatedAt = now
+			msgs = append(msgs, TickerUpdateMessages(w.ticker())...)
+		}
+	}
+
+	return msgs
+}
+
+// Ticker returns the ticker of the market, false if the market never traded
+func (a *TickerAggregator) Ticker(marketID string) (*Ticker, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	w, exist := a.windows[marketID]
+	if !exist {
+		return nil, false
+	}
+
+	return w.ticker(), true
+}
+
+// Tickers returns tickers of all markets, sorted by market id
+func (a *TickerAggregator) Tickers() []*Ticker {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	tickers := make([]*Ticker, 0, len(a.windows))
+	for _, w := range a.windows {
+		tickers = append(tickers, w.ticker())
+	}
+
+	sort.Slice(tickers, func(i, j int) bool {
+		return tickers[i].MarketID < tickers[j].MarketID
+	})
+
+	return tickers
+}
+
+// TickerChannelPrefix is the channel of all markets, Ticker#<market> is the channel of one market
+const TickerChannelPrefix = "Ticker"
+
+const WsTypeTickerUpdate = "tickerUpdate"
+
+type WebsocketTickerUpdatePayload struct {
+	Type   string  `json:"type"`
+	Ticker *Ticker `json:"ticker"`
+}
+
+func GetTickerChannelID(marketID string) string {
+	return fmt.Sprintf("%s#%s", TickerChannelPrefix, marketID)
+}
+
+// TickerUpdateMessages returns the update messages of the market channel and the channel of all markets
+func TickerUpdateMessages(ticker *Ticker) []WebSocketMessage {
+	payload := &WebsocketTickerUpdatePayload{
+		Type:   WsTypeTickerUpdate,
+		Ticker: ticker,
+	}
+
+	return []WebSocketMessage{
+		{ChannelID: GetTickerChannelID(ticker.MarketID), Payload: payload},
+		{ChannelID: TickerChannelPrefix, Payload: payload},
+	}
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type tickerTestSuite struct {
+	suite.Suite
+	aggregator *TickerAggregator
+}
+
+func TestTickerTestSuite(t *testing.T) {
+	suite.Run(t, new(tickerTestSuite))
+}
+
+func (s *tickerTestSuite) SetupTest() {
+	s.aggregator = NewTickerAggregator()
+}
+
+func (s *tickerTestSuite) addTrade(price, amount string, timestamp uint64) *Ticker {
+	msgs := s.aggregator.AddTrade("HOT-WETH", decimal.RequireFromString(price), decimal.RequireFromString(amount), timestamp)
+	s.Len(msgs, 2)
+	s.Equal("Ticker#HOT-WETH", msgs[0].ChannelID)
+	s.Equal("Ticker", msgs[1].ChannelID)
+
+	return msgs[0].Payload.(*WebsocketTickerUpdatePayload).Ticker
+}
+
+func (s *tickerTestSuite) TestRollingWindow() {
+	s.addTrade("2", "1", 0)
+	s.addTrade("3", "1", 30)
+	s.addTrade("1", "2", 3600)
+	ticker := s.addTrade("2.5", "1", 7200)
+
+	s.Equal("2.5", ticker.LastPrice.String())
+	s.Equal("2", ticker.Open.String())
+	s.Equal("3", ticker.High.String())
+	s.Equal("1", ticker.Low.String())
+	s.Equal("5", ticker.Volume.String())
+	s.Equal("9.5", ticker.QuoteVolume.String())
+	s.Equal("0.5", ticker.PriceChange.String())
+	s.Equal("25", ticker.PriceChangePercent.String())
+	s.Equal(4, ticker.Trades)
+
+	// the first minute leaves the window
+	msgs := s.aggregator.Tick(TickerWindow + 60)
+	s.Len(msgs, 2)
+
+	ticker, exist := s.aggregator.Ticker("HOT-WETH")
+	s.True(exist)
+	s.Equal("1", ticker.Open.String())
+	s.Equal("2.5", ticker.High.String())
+	s.Equal("1", ticker.Low.String())
+	s.Equal("3", ticker.Volume.String())
+	s.Equal("150", ticker.PriceChangePercent.String())
+
+	// nothing changes in the next tick
+	s.Len(s.aggregator.Tick(TickerWindow+61), 0)
+
+	// all trades leave the window
+	s.aggregator.Tick(7200 + TickerWindow)
+	ticker, _ = s.aggregator.Ticker("HOT-WETH")
+	s.Equal("2.5", ticker.High.String())
+	s.Equal("2.5", ticker.Low.String())
+	s.True(ticker.Volume.IsZero())
+	s.True(ticker.PriceChange.IsZero())
+	s.Equal(0, ticker.Trades)
+}
+
+func (s *tickerTestSuite) TestTradesInSameMinute() {
+	s.addTrade("2", "1", 60)
+	s.addTrade("4", "1", 70)
+	s.addTrade("3", "1", 80)
+	ticker := s.addTrade("1", "1", 90)
+
+	s.Equal("4", ticker.High.String())
+	s.Equal("1", ticker.Low.String())
+	s.Equal("2", ticker.Open.String())
+}
+
+func (s *tickerTestSuite) TestRestoreFromCandles() {
+	store := NewMemoryCandleStore()
+	candles := NewCandleAggregator(store, CandleInterval1m)
+
+	_, _ = candles.AddTrade("HOT-WETH", decimal.New(2, 0), decimal.New(1, 0), 0)
+	_, _ = candles.AddTrade("HOT-WETH", decimal.New(4, 0), decimal.New(1, 0), 600)
+
+	history, err := store.GetCandles("HOT-WETH", CandleInterval1m, 0, 600, 0)
+	s.Nil(err)
+
+	s.aggregator.Restore("HOT-WETH", history, 660)
+
+	ticker, exist := s.aggregator.Ticker("HOT-WETH")
+	s.True(exist)
+	s.Equal("4", ticker.LastPrice.String())
+	s.Equal("100", ticker.PriceChangePercent.String())
+	s.Equal(2, ticker.Trades)
+
+	_, exist = s.aggregator.Ticker("ABC-WETH")
+	s.False(exist)
+	s.Len(s.aggregator.Tickers(), 1)
+}
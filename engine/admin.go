@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"net/http"
+	"strings"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// AdminAuthenticator decides whether a request may use the admin API
+type AdminAuthenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+type AdminAuthenticatorFunc func(req *http.Request) error
+
+func (f AdminAuthenticatorFunc) Authenticate(req *http.Request) error {
+	return f(req)
+}
+
+// NoAuthentication accepts every request, only use it on a port which is not reachable from outside
+var NoAuthentication = AdminAuthenticatorFunc(func(req *http.Request) error {
+	return nil
+})
+
+// BearerTokenAuthenticator accepts requests with the header "Authorization: Bearer <token>"
+func BearerTokenAuthenticator(token string) AdminAuthenticator {
+	return AdminAuthenticatorFunc(func(req *http.Request) error {
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			return ErrUnauthorized
+		}
+
+		return nil
+	})
+}
+
+// AdminHandler serves the admin API of an engine, it can be mounted under any path prefix with http.StripPrefix.
+//
+//	GET  /markets                          states and sequences of all markets
+//	GET  /markets/{id}/book?level=2|3      aggregated price levels, or all orders
+//	GET  /markets/{id}/audit               invariant violations of the book
+//	POST /markets/{id}/halt
+//	POST /markets/{id}/resume
+//	POST /markets/{id}/close?cancelOrders=true
+//	GET  /orders/{id}
+//	POST /checkpoint
+//	GET  /replication                      role and lag of the replica
+type AdminHandler struct {
+	engine *Engine
+	auth   AdminAuthenticator
+}
+
+// NewAdminHandler panics if auth is nil, pass NoAuthentication explicitly to skip authentication
+func NewAdminHandler(engine *Engine, auth AdminAuthenticator) *AdminHandler {
+	if auth == nil {
+		panic("admin authenticator is nil")
+	}
+
+	return &AdminHandler{engine: engine, auth: auth}
+}
+
+func (h *AdminHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if err := h.auth.Authenticate(req); err != nil {
+		writeAdminError(resp, http.StatusUnauthorized, err)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "markets":
+		h.get(resp, req, func() (interface{}, error) {
+			return h.engine.Markets(), nil
+		})
+	case len(parts) == 3 && parts[0] == "markets":
+		h.serveMarket(resp, req, parts[1], parts[2])
+	case len(parts) == 2 && parts[0] == "orders":
+		h.get(resp, req, func() (interface{}, error) {
+			order, exist := h.engine.FindOrder(parts[1])
+			if !exist {
+				return nil, ErrOrderNotFound
+			}
+
+			return order, nil
+		})
+	case len(parts) == 1 && parts[0] == "replication":
+		h.get(resp, req, func() (interface{}, error) {
+			status := h.engine.ReplicationStatus()
+			if status == nil {
+				return map[string]interface{}{"role": h.engine.Role()}, nil
+			}
+
+			return status, nil
+		})
+	case len(parts) == 1 && parts[0] == "checkpoint":
+		h.post(resp, req, func() (interface{}, error) {
+			return nil, h.engine.Checkpoint()
+		})
+	default:
+		writeAdminError(resp, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (h *AdminHandler) serveMarket(resp http.ResponseWriter, req *http.Request, marketID, action string) {
+	switch action {
+	case "book":
+		h.get(resp, req, func() (interface{}, error) {
+			if req.URL.Query().Get("level") == "3" {
+				return h.engine.OrderbookL3(marketID)
+			}
+
+			return h.engine.OrderbookL2(marketID)
+		})
+	case "audit":
+		h.get(resp, req, func() (interface{}, error) {
+			problems, err := h.engine.AuditMarket(marketID)
+			if problems == nil {
+				problems = []string{}
+			}
+
+			return map[string]interface{}{"problems": problems}, err
+		})
+	case "halt":
+		h.post(resp, req, func() (interface{}, error) {
+			return nil, h.engine.HaltMarket(marketID)
+		})
+	case "resume":
+		h.post(resp, req, func() (interface{}, error) {
+			// ResumeMarket creates missing markets, a typo must not create one
+			if _, exist := h.engine.GetMarketState(marketID); !exist {
+				return nil, ErrUnknownMarket
+			}
+
+			return nil, h.engine.ResumeMarket(marketID)
+		})
+	case "close":
+		h.post(resp, req, func() (interface{}, error) {
+			canceledOrders, _, err := h.engine.CloseMarket(marketID, req.URL.Query().Get("cancelOrders") == "true")
+			return map[string]interface{}{"canceledOrders": len(canceledOrders)}, err
+		})
+	default:
+		writeAdminError(resp, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (h *AdminHandler) get(resp http.ResponseWriter, req *http.Request, fn func() (interface{}, error)) {
+	h.handle(resp, req, http.MethodGet, fn)
+}
+
+func (h *AdminHandler) post(resp http.ResponseWriter, req *http.Request, fn func() (interface{}, error)) {
+	h.handle(resp, req, http.MethodPost, fn)
+}
+
+func (h *AdminHandler) handle(resp http.ResponseWriter, req *http.Request, method string, fn func() (interface{}, error)) {
+	if req.Method != method {
+		writeAdminError(resp, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	data, err := fn()
+	if err != nil {
+		writeAdminError(resp, adminErrorStatus(err), err)
+		return
+	}
+
+	if method == http.MethodPost {
+		utils.Infof("admin %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+	}
+
+	if data == nil {
+		data = map[string]string{"status": "ok"}
+	}
+
+	writeAdminJSON(resp, http.StatusOK, data)
+}
+
+func adminErrorStatus(err error) int {
+	switch err {
+	case ErrUnknownMarket, ErrOrderNotFound:
+		return http.StatusNotFound
+	case ErrJournalNotEnabled, ErrNotLeader:
+		return http.StatusConflict
+	case ErrEngineStopped:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeAdminError(resp http.ResponseWriter, status int, err error) {
+	writeAdminJSON(resp, status, map[string]string{"error": err.Error()})
+}
+
+func writeAdminJSON(resp http.ResponseWriter, status int, data interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+
+	if err := json.NewEncoder(resp).Encode(data); err != nil {
+		utils.Errorf("write admin response error: %v", err)
+	}
+}
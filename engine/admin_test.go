@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type adminTestSuite struct {
+	suite.Suite
+	engine  *Engine
+	handler *AdminHandler
+}
+
+func TestAdminTestSuite(t *testing.T) {
+	suite.Run(t, new(adminTestSuite))
+}
+
+func (s *adminTestSuite) SetupTest() {
+	s.engine = NewEngine(context.Background())
+	s.handler = NewAdminHandler(s.engine, BearerTokenAuthenticator("secret"))
+
+	_, _, err := s.engine.HandleNewOrder(&common.MemoryOrder{
+		ID:       "o1",
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(1.2),
+		Amount:   decimal.NewFromFloat(10),
+		Side:     "sell",
+		Type:     "limit",
+		Trader:   "alice",
+	})
+	s.Nil(err)
+}
+
+func (s *adminTestSuite) request(method, path string, res interface{}) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, req)
+
+	if res != nil {
+		s.Nil(json.Unmarshal(recorder.Body.Bytes(), res))
+	}
+
+	return recorder.Code
+}
+
+func (s *adminTestSuite) TestAuthentication() {
+	req := httptest.NewRequest(http.MethodGet, "/markets", nil)
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, req)
+
+	s.Equal(http.StatusUnauthorized, recorder.Code)
+}
+
+func (s *adminTestSuite) TestInspect() {
+	var markets []*MarketInfo
+	s.Equal(http.StatusOK, s.request(http.MethodGet, "/markets", &markets))
+	s.Len(markets, 1)
+	s.Equal(MarketStateOpen, markets[0].State)
+	s.Equal(1, markets[0].Asks)
+
+	var l2 common.SnapshotV2
+	s.Equal(http.StatusOK, s.request(http.MethodGet, "/markets/HOT-WETH/book", &l2))
+	s.Equal([][2]string{{"1.2", "10"}}, l2.Asks)
+
+	var l3 OrderbookL3
+	s.Equal(http.StatusOK, s.request(http.MethodGet, "/markets/HOT-WETH/book?level=3", &l3))
+	s.Equal("o1", l3.Asks[0].ID)
+
+	var order common.MemoryOrder
+	s.Equal(http.StatusOK, s.request(http.MethodGet, "/orders/o1", &order))
+	s.Equal("alice", order.Trader)
+	s.Equal(http.StatusNotFound, s.request(http.MethodGet, "/orders/o2", nil))
+
+	var audit struct {
+		Problems []string `json:"problems"`
+	}
+	s.Equal(http.StatusOK, s.request(http.MethodGet, "/markets/HOT-WETH/audit", &audit))
+	s.Len(audit.Problems, 0)
+
+	s.Equal(http.StatusNotFound, s.request(http.MethodGet, "/markets/HOT-DAI/book", nil))
+}
+
+func (s *adminTestSuite) TestOperations() {
+	s.Equal(http.StatusMethodNotAllowed, s.request(http.MethodGet, "/markets/HOT-WETH/halt", nil))
+
+	s.Equal(http.StatusOK, s.request(http.MethodPost, "/markets/HOT-WETH/halt", nil))
+	state, _ := s.engine.GetMarketState("HOT-WETH")
+	s.Equal(MarketStateHalted, state)
+
+	s.Equal(http.StatusOK, s.request(http.MethodPost, "/markets/HOT-WETH/resume", nil))
+	s.Equal(http.StatusOK, s.request(http.MethodPost, "/markets/HOT-WETH/close?cancelOrders=true", nil))
+	state, _ = s.engine.GetMarketState("HOT-WETH")
+	s.Equal(MarketStateClosed, state)
+
+	s.Equal(http.StatusNotFound, s.request(http.MethodPost, "/markets/HOT-DAI/resume", nil))
+	s.Equal(http.StatusConflict, s.request(http.MethodPost, "/checkpoint", nil))
+}
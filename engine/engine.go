@@ -2,8 +2,10 @@ package engine
 
 import (
 	"context"
+	"fmt"
 	"github.com/novaprotocolio/sdk-backend/common"
 	"sync"
+	"time"
 )
 
 type Engine struct {
@@ -18,15 +20,52 @@ type Engine struct {
 	dbHandler                  *DBHandler
 	orderBookSnapshotHandler   *OrderbookSnapshotHandler
 	orderBookActivitiesHandler *OrderbookActivitiesHandler
+	orderExpiredHandler        *OrderExpiredHandler
+	handlerConfig              *HandlerConfig
 
-	lock sync.Mutex
+	// journal records every accepted command ahead of applying it, see recovery.go
+	journal        *Journal
+	replaying      bool
+	checkpointLock sync.Mutex
+
+	// replica follows or leads a replicated journal, role and leaseDeadline are accessed atomically, see replication.go
+	replica       *replica
+	role          int32
+	leaseDeadline int64
+
+	// executed matches are pending until their transactions are confirmed, see settlement.go
+	trackSettlements bool
+
+	// limitConfig decides rate limits and open order caps of markets, see limits.go
+	limitConfig *LimitConfig
+
+	// risk rejects orders which can't be funded, see risk.go
+	risk *RiskChecker
+
+	// orderStore persists states of orders if it is not nil, see order_state.go
+	orderStore OrderStore
+
+	// marketDataHandlers build candles and tickers from executed matches, see market_data.go
+	marketDataHandlers []MarketDataHandler
+
+	// amounts locked by open orders of each trader, see locked_balance.go
+	lockedBalances *lockedBalanceLedger
+
+	// lock only protects marketHandlerMap, orderbooks are owned by their market goroutines
+	lock sync.RWMutex
 }
 
+// OrderExpiryCheckInterval is how often the expiry loop looks for expired orders.
+// Order expiration timestamps are in seconds.
+const OrderExpiryCheckInterval = time.Second
+
 func NewEngine(ctx context.Context) *Engine {
 	engine := &Engine{
 		ctx:              ctx,
 		marketHandlerMap: make(map[string]*MarketHandler),
 		Wg:               sync.WaitGroup{},
+		handlerConfig:    DefaultHandlerConfig(),
+		lockedBalances:   newLockedBalanceLedger(),
 	}
 
 	return engine
@@ -41,104 +80,463 @@ func (e *Engine) RegisterOrderbookSnapshotHandler(handler OrderbookSnapshotHandl
 func (e *Engine) RegisterOrderbookActivitiesHandler(handler OrderbookActivitiesHandler) {
 	e.orderBookActivitiesHandler = &handler
 }
+func (e *Engine) RegisterOrderExpiredHandler(handler OrderExpiredHandler) {
+	e.orderExpiredHandler = &handler
+}
 
+// Handlers are called with the changes of each market in order, see HandlerConfig for retries and failures.
 type DBHandler interface {
-	Update(matchResult common.MatchResult) sync.WaitGroup
+	Update(ctx context.Context, matchResult common.MatchResult) error
 }
 type OrderbookSnapshotHandler interface {
-	Update(key string, snapshot *common.SnapshotV2) sync.WaitGroup
+	Update(ctx context.Context, key string, snapshot *common.SnapshotV2) error
 }
 type OrderbookActivitiesHandler interface {
-	Update(webSocketMessages []common.WebSocketMessage) sync.WaitGroup
+	Update(ctx context.Context, webSocketMessages []common.WebSocketMessage) error
+}
+type OrderExpiredHandler interface {
+	Update(ctx context.Context, expiredOrders []*common.MemoryOrder) error
 }
 
-func (e *Engine) HandleNewOrder(order *common.MemoryOrder) (matchResult common.MatchResult, hasMatch bool) {
-	e.lock.Lock()
-	defer e.lock.Unlock()
+// HandleNewOrder matches the order in the goroutine of its market and waits for the result.
+// An error is returned if the order is invalid, already in the book, or the market doesn't accept new orders.
+func (e *Engine) HandleNewOrder(order *common.MemoryOrder) (matchResult common.MatchResult, hasMatch bool, err error) {
+	if err = e.checkLeader(); err != nil {
+		return
+	}
+
+	if err = order.Validate(); err != nil {
+		return
+	}
+
+	fillExpiredAt(order)
+
+	var funds *cachedFunds
+	if e.risk != nil {
+		if funds, err = e.risk.fundsOf(order); err != nil {
+			return
+		}
+	}
+
+	handler := e.getOrCreateMarketHandler(order.MarketID)
+
+	if doErr := handler.do(func() {
+		matchResult, hasMatch, err = e.handleNewOrder(handler, order, funds)
+	}); doErr != nil {
+		return matchResult, false, doErr
+	}
+
+	return
+}
+
+// SubmitNewOrder is the asynchronous version of HandleNewOrder.
+// It returns once the order is queued in its market, callback is called in the market goroutine after matching.
+// It blocks while the market inbox is full, and returns ErrEngineStopped if the engine is stopped.
+func (e *Engine) SubmitNewOrder(order *common.MemoryOrder, callback func(matchResult common.MatchResult, hasMatch bool, err error)) error {
+	if err := e.checkLeader(); err != nil {
+		return err
+	}
+
+	if err := order.Validate(); err != nil {
+		return err
+	}
+
+	fillExpiredAt(order)
+
+	var funds *cachedFunds
+	if e.risk != nil {
+		var err error
+		if funds, err = e.risk.fundsOf(order); err != nil {
+			return err
+		}
+	}
+
+	handler := e.getOrCreateMarketHandler(order.MarketID)
+
+	if !handler.submit(func() {
+		matchResult, hasMatch, err := e.handleNewOrder(handler, order, funds)
+
+		if callback != nil {
+			callback(matchResult, hasMatch, err)
+		}
+	}) {
+		return ErrEngineStopped
+	}
+
+	return nil
+}
+
+// handleNewOrder runs in the market goroutine, funds are fetched by the caller if the risk checker is used
+func (e *Engine) handleNewOrder(handler *MarketHandler, order *common.MemoryOrder, funds *cachedFunds) (matchResult common.MatchResult, hasMatch bool, err error) {
+	if err = handler.state.newOrderError(); err != nil {
+		return
+	}
+
+	if handler.hasOrder(order) {
+		err = ErrOrderExists
+		return
+	}
+
+	if err = e.checkLimits(handler, order); err != nil {
+		return
+	}
 
-	// find or create marketHandler if not exist yet
-	if _, exist := e.marketHandlerMap[order.MarketID]; !exist {
-		marketHandler, err := NewMarketHandler(e.ctx, order.MarketID)
-		if err != nil {
-			panic(err)
+	if e.risk != nil {
+		if err = e.risk.reserve(order, funds, true); err != nil {
+			return
 		}
+	}
+
+	now := uint64(time.Now().Unix())
+	if err = e.journalCommand(handler, &JournalCommand{
+		Type:      JournalNewOrder,
+		MarketID:  handler.market,
+		Timestamp: now,
+		Order:     order,
+	}); err != nil {
+		// release the reserved funds
+		e.syncLockedAmounts(handler, order)
+		return
+	}
+
+	e.trackNewOrder(handler, order, now)
+
+	matchResult, hasMatch, expiredOrders := handler.handleNewOrder(order, now)
 
-		e.marketHandlerMap[order.MarketID] = marketHandler
+	if e.risk != nil && matchResult.MatchID != "" {
+		e.risk.lockSettlement(handler.settlements.pending[matchResult.MatchID])
 	}
 
-	// feed the handler with this new order
-	handler, _ := e.marketHandlerMap[order.MarketID]
-	matchResult, hasMatch = handler.handleNewOrder(order)
+	e.syncLockedAmounts(handler, order)
+	e.syncLockedAmounts(handler, expiredOrders...)
+	for _, item := range matchResult.MatchItems {
+		e.syncLockedAmounts(handler, item.MakerOrder)
+
+		if !item.MatchShouldBeCanceled {
+			e.trackFill(handler, order, item.MakerOrder, item.MatchedAmount, now)
+		}
+		e.trackOrders(handler, false, now, item.MakerOrder)
+	}
+	e.trackOrders(handler, false, now, order)
+	e.trackOrders(handler, true, now, expiredOrders...)
+	e.fillAccountMessages(handler, matchResult.OrderbookActivities)
 
-	e.triggerDBHandlerIfNotNil(matchResult)
+	e.triggerOrderExpiredHandlerIfNotNil(handler, expiredOrders)
+	e.triggerDBHandlerIfNotNil(handler, matchResult)
+	e.triggerMarketDataHandlersIfNotNil(handler, matchResult, now)
 	e.triggerOrderbookSnapshotHandlerIfNotNil(handler)
-	e.triggerOrderbookActivityHandlerIfNotNil(matchResult.OrderbookActivities)
+	e.triggerOrderbookActivityHandlerIfNotNil(handler, matchResult.OrderbookActivities)
 
 	return
 }
 
-func (e *Engine) ReInsertOrder(order *common.MemoryOrder) (msg *common.WebSocketMessage) {
-	e.lock.Lock()
-	defer e.lock.Unlock()
+// ReInsertOrder puts an order back to the book without matching, e.g. when the engine is restored from a database
+func (e *Engine) ReInsertOrder(order *common.MemoryOrder) (msg *common.WebSocketMessage, err error) {
+	if err = e.checkLeader(); err != nil {
+		return
+	}
+
+	if err = order.Validate(); err != nil {
+		return
+	}
+
+	fillExpiredAt(order)
+
+	handler := e.getOrCreateMarketHandler(order.MarketID)
 
-	if _, exist := e.marketHandlerMap[order.MarketID]; !exist {
-		marketHandler, err := NewMarketHandler(e.ctx, order.MarketID)
-		if err != nil {
-			panic(err)
+	if doErr := handler.do(func() {
+		if handler.hasOrder(order) {
+			err = ErrOrderExists
+			return
 		}
 
-		e.marketHandlerMap[order.MarketID] = marketHandler
+		if err = e.journalCommand(handler, &JournalCommand{
+			Type:      JournalReInsertOrder,
+			MarketID:  handler.market,
+			Timestamp: uint64(time.Now().Unix()),
+			Order:     order,
+		}); err != nil {
+			return
+		}
+
+		event, insertErr := handler.insertOrder(order)
+		if insertErr != nil {
+			panic(fmt.Errorf("insert order %s to book %s error: %v", order.ID, handler.market, insertErr))
+		}
+
+		e.syncLockedAmounts(handler, order)
+		e.trackOrders(handler, false, uint64(time.Now().Unix()), order)
+
+		e.triggerOrderbookSnapshotHandlerIfNotNil(handler)
+
+		m := common.OrderbookChangeMessage(handler.market, handler.orderbook.Sequence, event.Side, event.Price, event.Amount)
+		msg = &m
+	}); doErr != nil {
+		return nil, doErr
 	}
 
-	handler, _ := e.marketHandlerMap[order.MarketID]
-	event := handler.orderbook.InsertOrder(order)
+	return
+}
+
+// HandleCancelOrder removes the order with the same id, side and price from the book
+func (e *Engine) HandleCancelOrder(order *common.MemoryOrder) (msg *common.WebSocketMessage, err error) {
+	if order == nil {
+		return nil, ErrInvalidOrder
+	}
+
+	if err = e.checkLeader(); err != nil {
+		return
+	}
+
+	handler := e.getMarketHandler(order.MarketID)
+	if handler == nil {
+		return nil, ErrUnknownMarket
+	}
+
+	if doErr := handler.do(func() {
+		msg, err = e.handleCancelOrder(handler, order)
+	}); doErr != nil {
+		return nil, doErr
+	}
+
+	return
+}
+
+func (e *Engine) handleCancelOrder(handler *MarketHandler, order *common.MemoryOrder) (msg *common.WebSocketMessage, err error) {
+	if !handler.state.acceptCancel() {
+		return nil, ErrMarketHalted
+	}
+
+	bookOrder, exist := handler.orderbook.GetOrder(order.ID, order.Side, order.Price)
+	if !exist {
+		return nil, ErrOrderNotFound
+	}
+
+	now := uint64(time.Now().Unix())
+	if err = e.journalCommand(handler, &JournalCommand{
+		Type:      JournalCancelOrder,
+		MarketID:  handler.market,
+		Timestamp: now,
+		Order:     order,
+	}); err != nil {
+		return nil, err
+	}
+
+	event, err := handler.handleCancelOrder(bookOrder)
+	if err != nil {
+		panic(fmt.Errorf("remove order %s from book %s error: %v", order.ID, handler.market, err))
+	}
+
+	e.syncLockedAmounts(handler, bookOrder)
+	e.trackOrders(handler, true, now, bookOrder)
 
 	e.triggerOrderbookSnapshotHandlerIfNotNil(handler)
 
-	if event == nil {
+	m := common.OrderbookChangeMessage(handler.market, handler.orderbook.Sequence, event.Side, event.Price, event.Amount)
+	return &m, nil
+}
+
+// ExpireOrders removes orders which are expired at now from all markets.
+// It emits the same orderbook and orderChange messages as a cancel, nothing is expired if the engine is not the leader.
+func (e *Engine) ExpireOrders(now uint64) (expiredOrders []*common.MemoryOrder, msgs []common.WebSocketMessage) {
+	if e.checkLeader() != nil {
 		return
-	} else {
-		msg := common.OrderbookChangeMessage(handler.market, handler.orderbook.Sequence, event.Side, event.Price, event.Amount)
-		return &msg
 	}
+
+	var lock sync.Mutex
+
+	e.doInAllMarkets(func(handler *MarketHandler) {
+		if next := handler.expiryIndex.nextExpiredAt(); next == 0 || next > now {
+			return
+		}
+
+		if e.journalCommand(handler, &JournalCommand{
+			Type:      JournalExpireOrders,
+			MarketID:  handler.market,
+			Timestamp: now,
+		}) != nil {
+			return
+		}
+
+		orders, marketMsgs := handler.handleExpireOrders(now)
+		if len(orders) == 0 {
+			return
+		}
+
+		e.syncLockedAmounts(handler, orders...)
+		e.trackOrders(handler, true, now, orders...)
+		e.fillAccountMessages(handler, marketMsgs)
+
+		e.triggerOrderbookSnapshotHandlerIfNotNil(handler)
+		e.triggerOrderbookActivityHandlerIfNotNil(handler, marketMsgs)
+		e.triggerOrderExpiredHandlerIfNotNil(handler, orders)
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		expiredOrders = append(expiredOrders, orders...)
+		msgs = append(msgs, marketMsgs...)
+	})
+
+	return
 }
 
-func (e *Engine) HandleCancelOrder(order *common.MemoryOrder) (msg *common.WebSocketMessage, success bool) {
+// MarketQueueDepths returns the number of commands waiting in the inbox of each market
+func (e *Engine) MarketQueueDepths() map[string]int {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	depths := make(map[string]int, len(e.marketHandlerMap))
+	for market, handler := range e.marketHandlerMap {
+		depths[market] = handler.QueueDepth()
+	}
+
+	return depths
+}
+
+func (e *Engine) getMarketHandler(marketID string) *MarketHandler {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	return e.marketHandlerMap[marketID]
+}
+
+// find or create marketHandler if not exist yet, markets created on the fly are open
+func (e *Engine) getOrCreateMarketHandler(marketID string) *MarketHandler {
+	if handler := e.getMarketHandler(marketID); handler != nil {
+		return handler
+	}
+
 	e.lock.Lock()
 	defer e.lock.Unlock()
 
-	handler, _ := e.marketHandlerMap[order.MarketID]
+	if handler, exist := e.marketHandlerMap[marketID]; exist {
+		return handler
+	}
 
-	event := handler.handleCancelOrder(order)
-	if event == nil {
-		return
-	} else {
-		e.triggerOrderbookSnapshotHandlerIfNotNil(handler)
+	handler, err := NewMarketHandler(e.ctx, marketID)
+	if err != nil {
+		panic(err)
+	}
 
-		msg := common.OrderbookChangeMessage(handler.market, handler.orderbook.Sequence, event.Side, event.Price, event.Amount)
-		return &msg, true
+	if e.trackSettlements {
+		handler.settlements = newSettlementTracker()
 	}
+
+	if e.limitConfig != nil {
+		if limits := e.limitConfig.limitsOf(marketID); limits != nil {
+			handler.limiter = newMarketLimiter(limits)
+		}
+	}
+
+	handler.onPanic = func(r interface{}) {
+		e.setMarketState(handler, MarketStateHalted, false)
+	}
+
+	handler.dispatcher = newHandlerDispatcher(e, handler, e.handlerConfig)
+	e.Wg.Add(1)
+	go handler.dispatcher.run(&e.Wg)
+
+	e.marketHandlerMap[marketID] = handler
+
+	e.Wg.Add(1)
+	go handler.run(&e.Wg)
+
+	return handler
 }
 
-func (e *Engine) triggerDBHandlerIfNotNil(matchResult common.MatchResult) {
-	if e.dbHandler != nil {
-		(*e.dbHandler).Update(matchResult)
+// doInAllMarkets executes fn in every market goroutine concurrently and waits for all of them
+func (e *Engine) doInAllMarkets(fn func(handler *MarketHandler)) {
+	e.lock.RLock()
+	handlers := make([]*MarketHandler, 0, len(e.marketHandlerMap))
+	for _, handler := range e.marketHandlerMap {
+		handlers = append(handlers, handler)
+	}
+	e.lock.RUnlock()
+
+	var wg sync.WaitGroup
+
+	for _, handler := range handlers {
+		handler := handler
+
+		done := make(chan struct{})
+		if !handler.submit(func() {
+			defer close(done)
+			fn(handler)
+		}) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case <-done:
+			case <-handler.stopped:
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// StartOrderExpiry runs a loop removing expired orders until the engine ctx is canceled.
+// If settlements are tracked, the loop also expires settlements which are not bound in UnboundSettlementTTL.
+func (e *Engine) StartOrderExpiry() {
+	e.Wg.Add(1)
+
+	go func() {
+		defer e.Wg.Done()
+
+		ticker := time.NewTicker(OrderExpiryCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-e.ctx.Done():
+				return
+			case now := <-ticker.C:
+				e.ExpireOrders(uint64(now.Unix()))
+				e.ExpireUnboundSettlements(uint64(now.Unix()))
+			}
+		}
+	}()
+}
+
+func (e *Engine) triggerDBHandlerIfNotNil(handler *MarketHandler, matchResult common.MatchResult) {
+	if e.dbHandler != nil && !e.replaying {
+		handler.dispatcher.dispatch("db", func(ctx context.Context) error {
+			return (*e.dbHandler).Update(ctx, matchResult)
+		})
 	}
 }
 
 func (e *Engine) triggerOrderbookSnapshotHandlerIfNotNil(handler *MarketHandler) {
-	if e.orderBookSnapshotHandler != nil {
+	if e.orderBookSnapshotHandler != nil && !e.replaying {
 		snapshot := handler.orderbook.SnapshotV2()
 		snapshot.Sequence = handler.orderbook.Sequence
 
 		snapshotKey := common.GetMarketOrderbookSnapshotV2Key(handler.market)
 
-		(*e.orderBookSnapshotHandler).Update(snapshotKey, snapshot)
+		handler.dispatcher.dispatch("orderbook snapshot", func(ctx context.Context) error {
+			return (*e.orderBookSnapshotHandler).Update(ctx, snapshotKey, snapshot)
+		})
+	}
+}
+
+func (e *Engine) triggerOrderbookActivityHandlerIfNotNil(handler *MarketHandler, msgs []common.WebSocketMessage) {
+	if e.orderBookActivitiesHandler != nil && !e.replaying {
+		handler.dispatcher.dispatch("orderbook activities", func(ctx context.Context) error {
+			return (*e.orderBookActivitiesHandler).Update(ctx, msgs)
+		})
 	}
 }
 
-func (e *Engine) triggerOrderbookActivityHandlerIfNotNil(msgs []common.WebSocketMessage) {
-	if e.orderBookActivitiesHandler != nil {
-		(*e.orderBookActivitiesHandler).Update(msgs)
+func (e *Engine) triggerOrderExpiredHandlerIfNotNil(handler *MarketHandler, orders []*common.MemoryOrder) {
+	if e.orderExpiredHandler != nil && len(orders) > 0 && !e.replaying {
+		handler.dispatcher.dispatch("order expired", func(ctx context.Context) error {
+			return (*e.orderExpiredHandler).Update(ctx, orders)
+		})
 	}
 }
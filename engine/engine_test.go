@@ -2,11 +2,12 @@ package engine
 
 import (
 	"context"
+	"fmt"
 	"github.com/novaprotocolio/sdk-backend/common"
 	"github.com/labstack/gommon/log"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/suite"
-	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -30,7 +31,7 @@ func (s *engineTestSuite) TestNewEngine() {
 		Type:     "limit",
 	}
 
-	matchRst, hasMatch := e.HandleNewOrder(&order)
+	matchRst, hasMatch, _ := e.HandleNewOrder(&order)
 
 	s.False(hasMatch, "should have no match")
 	s.True(len(matchRst.MatchItems) == 0, "should have no match")
@@ -56,8 +57,8 @@ func (s *engineTestSuite) TestNewEngineHandleOrders() {
 		Type:     "limit",
 	}
 
-	matchRst, hasMatch := e.HandleNewOrder(&orderSell)
-	matchRst2, hasMatch2 := e.HandleNewOrder(&orderBuy)
+	matchRst, hasMatch, _ := e.HandleNewOrder(&orderSell)
+	matchRst2, hasMatch2, _ := e.HandleNewOrder(&orderBuy)
 
 	s.False(hasMatch, "should have no match")
 	s.Equal(0, len(matchRst.MatchItems), "should have no match")
@@ -93,8 +94,8 @@ func (s *engineTestSuite) TestNewEngineHandleOrders2() {
 		Type:     "limit",
 	}
 
-	matchRst, hasMatch := e.HandleNewOrder(&orderSell)
-	matchRst2, hasMatch2 := e.HandleNewOrder(&orderBuy)
+	matchRst, hasMatch, _ := e.HandleNewOrder(&orderSell)
+	matchRst2, hasMatch2, _ := e.HandleNewOrder(&orderBuy)
 
 	s.False(hasMatch, "should have no match")
 	s.Equal(0, len(matchRst.MatchItems), "should have no match")
@@ -215,7 +216,7 @@ func (s *engineTestSuite) TestSmallSellBeIgnored() {
 		TakerFeeRate: decimal.NewFromFloat(0.003),
 	}
 
-	_, hasMatch := e.HandleNewOrder(&smallSell)
+	_, hasMatch, _ := e.HandleNewOrder(&smallSell)
 	s.False(hasMatch)
 
 	handler, _ := e.marketHandlerMap["HOT-WETH"]
@@ -239,7 +240,7 @@ func (s *engineTestSuite) TestBigSellWillNotBeIgnored() {
 		TakerFeeRate: decimal.NewFromFloat(0.003),
 	}
 
-	_, hasMatch := e.HandleNewOrder(&bigSell)
+	_, hasMatch, _ := e.HandleNewOrder(&bigSell)
 	s.False(hasMatch)
 
 	handler, _ := e.marketHandlerMap["HOT-WETH"]
@@ -389,12 +390,183 @@ func (s *engineTestSuite) TestHandleOrdersKeepBigRemainingOrder() {
 	s.NotNil(handler.orderbook.MinAsk())
 }
 
+func (s *engineTestSuite) TestExpireOrders() {
+	e := NewEngine(context.Background())
+
+	order := common.MemoryOrder{
+		ID:        "fake-id",
+		MarketID:  "HOT-WETH",
+		Price:     decimal.NewFromFloat(1.0),
+		Amount:    decimal.NewFromFloat(100.0),
+		Side:      "sell",
+		Type:      "limit",
+		ExpiredAt: 1000,
+	}
+
+	e.HandleNewOrder(&order)
+
+	expiredOrders, msgs := e.ExpireOrders(999)
+	s.Equal(0, len(expiredOrders))
+	s.Equal(0, len(msgs))
+
+	expiredOrders, msgs = e.ExpireOrders(1000)
+	s.Equal(1, len(expiredOrders))
+	s.Equal("fake-id", expiredOrders[0].ID)
+
+	// orderbook change + order change + locked balance change
+	s.Equal(3, len(msgs))
+	payload := msgs[0].Payload.(*common.WebsocketMarketOrderChangePayload)
+	s.Equal("-100", payload.Amount)
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.Nil(handler.orderbook.MinAsk())
+}
+
+func (s *engineTestSuite) TestExpiredAtFromOrderData() {
+	e := NewEngine(context.Background())
+
+	// nova order data expiring at 9999999999
+	order := common.MemoryOrder{
+		ID:       "fake-id",
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(1.0),
+		Amount:   decimal.NewFromFloat(100.0),
+		Side:     "sell",
+		Type:     "limit",
+		Data:     "0x01010002540be3ff006400c8006400000000000d119600000000000000000000",
+	}
+
+	e.HandleNewOrder(&order)
+	s.Equal(uint64(9999999999), order.ExpiredAt)
+
+	expiredOrders, _ := e.ExpireOrders(9999999998)
+	s.Equal(0, len(expiredOrders))
+
+	expiredOrders, _ = e.ExpireOrders(9999999999)
+	s.Equal(1, len(expiredOrders))
+	s.Equal("fake-id", expiredOrders[0].ID)
+}
+
+func (s *engineTestSuite) TestExpiryIndexDropsOrdersLeavingTheBook() {
+	e := NewEngine(context.Background())
+
+	var orders []*common.MemoryOrder
+	for i := 0; i < 100; i++ {
+		order := limitOrder(fmt.Sprintf("o%d", i), "t1", "sell", 1.0+float64(i)/100, 1)
+		order.ExpiredAt = 9999999999
+		orders = append(orders, order)
+
+		_, _, err := e.HandleNewOrder(order)
+		s.Nil(err)
+	}
+
+	for _, order := range orders[10:] {
+		_, err := e.HandleCancelOrder(order)
+		s.Nil(err)
+	}
+
+	// fills the 5 cheapest makers
+	_, _, err := e.HandleNewOrder(limitOrder("taker", "t2", "buy", 1.04, 5))
+	s.Nil(err)
+
+	handler := e.marketHandlerMap["HOT-WETH"]
+	s.Nil(handler.do(func() {
+		s.Equal(5, handler.expiryIndex.Len())
+	}))
+}
+
+func (s *engineTestSuite) TestExpiredMakerIsNotTaken() {
+	e := NewEngine(context.Background())
+
+	orderSell := common.MemoryOrder{
+		ID:        "fake-id1",
+		MarketID:  "HOT-WETH",
+		Price:     decimal.NewFromFloat(1.0),
+		Amount:    decimal.NewFromFloat(100.0),
+		Side:      "sell",
+		Type:      "limit",
+		ExpiredAt: 1,
+	}
+	orderBuy := common.MemoryOrder{
+		ID:       "fake-id2",
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(1.0),
+		Amount:   decimal.NewFromFloat(100.0),
+		Side:     "buy",
+		Type:     "limit",
+	}
+
+	e.HandleNewOrder(&orderSell)
+	matchRst, hasMatch, _ := e.HandleNewOrder(&orderBuy)
+
+	s.False(hasMatch)
+	s.Equal(0, len(matchRst.MatchItems))
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.Nil(handler.orderbook.MinAsk())
+	s.NotNil(handler.orderbook.MaxBid())
+}
+
+type blockingDBHandler struct {
+	market  string
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (handler blockingDBHandler) Update(ctx context.Context, matchRst common.MatchResult) error {
+	if matchRst.TakerOrder != nil && matchRst.TakerOrder.MarketID == handler.market {
+		handler.entered <- struct{}{}
+		<-handler.release
+	}
+	return nil
+}
+
+func (s *engineTestSuite) TestMarketsAreHandledConcurrently() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	e := NewEngine(ctx)
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	e.RegisterDBHandler(blockingDBHandler{market: "HOT-WETH", entered: entered, release: release})
+
+	newOrder := func(id, market string) *common.MemoryOrder {
+		return &common.MemoryOrder{
+			ID:       id,
+			MarketID: market,
+			Price:    decimal.NewFromFloat(1.0),
+			Amount:   decimal.NewFromFloat(100.0),
+			Side:     "sell",
+			Type:     "limit",
+		}
+	}
+
+	// make HOT-WETH busy, the first order blocks in db handler, the second waits in the inbox
+	done := make(chan struct{}, 2)
+	s.Nil(e.SubmitNewOrder(newOrder("o1", "HOT-WETH"), func(common.MatchResult, bool, error) { done <- struct{}{} }))
+	s.Nil(e.SubmitNewOrder(newOrder("o2", "HOT-WETH"), func(common.MatchResult, bool, error) { done <- struct{}{} }))
+	<-entered
+
+	// another market is not blocked
+	_, hasMatch, _ := e.HandleNewOrder(newOrder("o3", "DAI-WETH"))
+	s.False(hasMatch)
+
+	s.Equal(1, e.MarketQueueDepths()["HOT-WETH"])
+	s.Equal(0, e.MarketQueueDepths()["DAI-WETH"])
+
+	close(release)
+	<-done
+	<-done
+
+	s.Equal(0, e.MarketQueueDepths()["HOT-WETH"])
+}
+
 type FakeDBHandler struct {
 }
 
-func (handler FakeDBHandler) Update(matchRst common.MatchResult) sync.WaitGroup {
+func (handler FakeDBHandler) Update(ctx context.Context, matchRst common.MatchResult) error {
 	log.Info("Update called of fake db handler")
-	return sync.WaitGroup{}
+	return nil
 }
 
 func (s *engineTestSuite) TestNewEngineWithDBHandler() {
@@ -412,8 +584,341 @@ func (s *engineTestSuite) TestNewEngineWithDBHandler() {
 		Type:     "limit",
 	}
 
-	matchRst, hasMatch := e.HandleNewOrder(&order)
+	matchRst, hasMatch, _ := e.HandleNewOrder(&order)
 
 	s.False(hasMatch, "should have no match")
 	s.Equal(0, len(matchRst.MatchItems), "should have no match")
 }
+
+func (s *engineTestSuite) TestMarketStates() {
+	e := NewEngine(context.Background())
+
+	newOrder := func(id, side string) *common.MemoryOrder {
+		return &common.MemoryOrder{
+			ID:       id,
+			MarketID: "HOT-WETH",
+			Price:    decimal.NewFromFloat(1.0),
+			Amount:   decimal.NewFromFloat(100.0),
+			Side:     side,
+			Type:     "limit",
+		}
+	}
+
+	s.Equal(ErrUnknownMarket, e.HaltMarket("HOT-WETH"))
+
+	s.Nil(e.SetMarketState("HOT-WETH", MarketStatePreOpen))
+	_, _, err := e.HandleNewOrder(newOrder("o1", "sell"))
+	s.Equal(ErrMarketPreOpen, err)
+
+	s.Nil(e.OpenMarket("HOT-WETH"))
+	_, _, err = e.HandleNewOrder(newOrder("o1", "sell"))
+	s.Nil(err)
+	_, _, err = e.HandleNewOrder(newOrder("o2", "sell"))
+	s.Nil(err)
+
+	// halted book rejects both new orders and cancels
+	s.Nil(e.HaltMarket("HOT-WETH"))
+	_, _, err = e.HandleNewOrder(newOrder("o3", "buy"))
+	s.Equal(ErrMarketHalted, err)
+	_, err = e.HandleCancelOrder(newOrder("o1", "sell"))
+	s.Equal(ErrMarketHalted, err)
+
+	s.Nil(e.SetMarketCancelOnly("HOT-WETH"))
+	_, _, err = e.HandleNewOrder(newOrder("o3", "buy"))
+	s.Equal(ErrMarketCancelOnly, err)
+	_, err = e.HandleCancelOrder(newOrder("o1", "sell"))
+	s.Nil(err)
+
+	canceledOrders, msgs, err := e.CloseMarket("HOT-WETH", true)
+	s.Nil(err)
+	s.Equal(1, len(canceledOrders))
+	s.Equal("o2", canceledOrders[0].ID)
+	s.True(len(msgs) > 0)
+	s.Nil(e.marketHandlerMap["HOT-WETH"].orderbook.MinAsk())
+
+	_, _, err = e.HandleNewOrder(newOrder("o3", "buy"))
+	s.Equal(ErrMarketClosed, err)
+
+	state, _ := e.GetMarketState("HOT-WETH")
+	s.Equal(MarketStateClosed, state)
+}
+
+func (s *engineTestSuite) TestErrors() {
+	e := NewEngine(context.Background())
+
+	order := func(id, market string) *common.MemoryOrder {
+		return &common.MemoryOrder{
+			ID:       id,
+			MarketID: market,
+			Price:    decimal.NewFromFloat(1.0),
+			Amount:   decimal.NewFromFloat(100.0),
+			Side:     "sell",
+			Type:     "limit",
+		}
+	}
+
+	_, err := e.HandleCancelOrder(order("o1", "HOT-WETH"))
+	s.Equal(ErrUnknownMarket, err)
+
+	invalid := order("o1", "HOT-WETH")
+	invalid.Side = "both"
+	_, _, err = e.HandleNewOrder(invalid)
+	s.Equal(ErrInvalidOrder, err)
+
+	_, _, err = e.HandleNewOrder(order("o1", "HOT-WETH"))
+	s.Nil(err)
+	_, _, err = e.HandleNewOrder(order("o1", "HOT-WETH"))
+	s.Equal(ErrOrderExists, err)
+	_, err = e.ReInsertOrder(order("o1", "HOT-WETH"))
+	s.Equal(ErrOrderExists, err)
+
+	_, err = e.HandleCancelOrder(order("o2", "HOT-WETH"))
+	s.Equal(ErrOrderNotFound, err)
+}
+
+func (s *engineTestSuite) TestPanicHaltsOnlyAffectedMarket() {
+	e := NewEngine(context.Background())
+
+	order := func(id, market string) *common.MemoryOrder {
+		return &common.MemoryOrder{
+			ID:       id,
+			MarketID: market,
+			Price:    decimal.NewFromFloat(1.0),
+			Amount:   decimal.NewFromFloat(100.0),
+			Side:     "sell",
+			Type:     "limit",
+		}
+	}
+
+	e.HandleNewOrder(order("o1", "HOT-WETH"))
+	e.HandleNewOrder(order("o2", "DAI-WETH"))
+
+	err := e.getMarketHandler("HOT-WETH").do(func() {
+		panic("broken invariant")
+	})
+	s.Equal(ErrMarketPanicked, err)
+
+	state, _ := e.GetMarketState("HOT-WETH")
+	s.Equal(MarketStateHalted, state)
+
+	_, _, err = e.HandleNewOrder(order("o3", "DAI-WETH"))
+	s.Nil(err)
+	state, _ = e.GetMarketState("DAI-WETH")
+	s.Equal(MarketStateOpen, state)
+}
+
+func (s *engineTestSuite) TestLockedBalances() {
+	e := NewEngine(context.Background())
+
+	buy := &common.MemoryOrder{
+		ID:           "buy-1",
+		MarketID:     "HOT-WETH",
+		Price:        decimal.NewFromFloat(2),
+		Amount:       decimal.NewFromFloat(10),
+		Side:         "buy",
+		Type:         "limit",
+		Trader:       "alice",
+		TakerFeeRate: decimal.NewFromFloat(0.01),
+		GasFeeAmount: decimal.NewFromFloat(0.5),
+	}
+
+	res, _, err := e.HandleNewOrder(buy)
+	s.Nil(err)
+
+	// 10 * 2 + 20 * 0.01 + 0.5
+	s.Equal("20.7", e.LockedBalance("alice", "WETH").String())
+	s.Equal("20.7", lockedBalanceOf(res.OrderbookActivities, "alice", "WETH"))
+
+	sell := &common.MemoryOrder{
+		ID:       "sell-1",
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(2),
+		Amount:   decimal.NewFromFloat(4),
+		Side:     "sell",
+		Type:     "limit",
+		Trader:   "bob",
+	}
+
+	res, _, err = e.HandleNewOrder(sell)
+	s.Nil(err)
+
+	// 6 * 2 + 12 * 0.01, the gas fee is paid by the first match
+	s.Equal("12.12", e.LockedBalance("alice", "WETH").String())
+	s.Equal("12.12", lockedBalanceOf(res.OrderbookActivities, "alice", "WETH"))
+	s.Equal("0", lockedBalanceOf(res.OrderbookActivities, "bob", "HOT"))
+	s.Len(e.LockedBalances("bob"), 0)
+
+	_, err = e.HandleCancelOrder(buy)
+	s.Nil(err)
+	s.True(e.LockedBalance("alice", "WETH").IsZero())
+}
+
+func lockedBalanceOf(msgs []common.WebSocketMessage, trader, symbol string) string {
+	balance := ""
+
+	for _, msg := range msgs {
+		payload, ok := msg.Payload.(*common.WebsocketLockedBalanceChangePayload)
+		if ok && msg.ChannelID == common.GetAccountChannelID(trader) && payload.Symbol == symbol {
+			balance = payload.Balance.String()
+		}
+	}
+
+	return balance
+}
+
+type countingSnapshotHandler struct {
+	count *int32
+}
+
+func (handler countingSnapshotHandler) Update(ctx context.Context, key string, snapshot *common.SnapshotV2) error {
+	atomic.AddInt32(handler.count, 1)
+	return nil
+}
+
+func (s *engineTestSuite) TestCancelOrders() {
+	e := NewEngine(context.Background())
+
+	var snapshots int32
+	e.RegisterOrderbookSnapshotHandler(countingSnapshotHandler{count: &snapshots})
+
+	orders := []*common.MemoryOrder{
+		{ID: "a1", Trader: "alice", Side: "buy", Price: decimal.NewFromFloat(1)},
+		{ID: "a2", Trader: "alice", Side: "buy", Price: decimal.NewFromFloat(1)},
+		{ID: "a3", Trader: "alice", Side: "buy", Price: decimal.NewFromFloat(0.5)},
+		{ID: "a4", Trader: "alice", Side: "sell", Price: decimal.NewFromFloat(2)},
+		{ID: "b1", Trader: "bob", Side: "buy", Price: decimal.NewFromFloat(1)},
+	}
+
+	for _, order := range orders {
+		order.MarketID = "HOT-WETH"
+		order.Type = "limit"
+		order.Amount = decimal.NewFromFloat(10)
+
+		_, _, err := e.HandleNewOrder(order)
+		s.Nil(err)
+	}
+
+	minPrice := decimal.NewFromFloat(0.8)
+	atomic.StoreInt32(&snapshots, 0)
+
+	canceled, msgs, err := e.CancelOrders(&CancelFilter{MarketID: "HOT-WETH", Trader: "alice", Side: "buy", MinPrice: &minPrice})
+	s.Nil(err)
+	s.Len(canceled, 2)
+	s.Equal(int32(1), atomic.LoadInt32(&snapshots))
+
+	// two orderbook changes with consecutive sequences, two orderChange and one lockedBalanceChange messages
+	s.Len(msgs, 5)
+	first := msgs[0].Payload.(*common.WebsocketMarketOrderChangePayload)
+	second := msgs[1].Payload.(*common.WebsocketMarketOrderChangePayload)
+	s.Equal("-10", first.Amount)
+	s.Equal("1", first.Price)
+	s.Equal("-10", second.Amount)
+	s.Equal(first.Sequence+1, second.Sequence)
+
+	handler := e.getMarketHandler("HOT-WETH")
+	s.Equal(second.Sequence, handler.orderbook.Sequence)
+	s.Equal("5", e.LockedBalance("alice", "WETH").String())
+
+	canceled, _, err = e.CancelOrders(&CancelFilter{Trader: "alice"})
+	s.Nil(err)
+	s.Len(canceled, 2)
+	s.Len(handler.orderbook.Orders("buy"), 1)
+	s.Len(handler.orderbook.Orders("sell"), 0)
+}
+
+func (s *engineTestSuite) TestOrderStates() {
+	e := NewEngine(context.Background())
+	store := NewMemoryOrderStore()
+	e.UseOrderStore(store)
+
+	sell := &common.MemoryOrder{
+		ID:       "sell-1",
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(2),
+		Amount:   decimal.NewFromFloat(10),
+		Side:     "sell",
+		Type:     "limit",
+	}
+	_, _, err := e.HandleNewOrder(sell)
+	s.Nil(err)
+
+	buy := &common.MemoryOrder{
+		ID:       "buy-1",
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(3),
+		Amount:   decimal.NewFromFloat(4),
+		Side:     "buy",
+		Type:     "limit",
+	}
+	res, _, err := e.HandleNewOrder(buy)
+	s.Nil(err)
+
+	var states []*common.OrderState
+	for _, msg := range res.OrderbookActivities {
+		if payload, ok := msg.Payload.(*common.WebsocketOrderChangePayload); ok {
+			states = append(states, payload.State)
+		}
+	}
+
+	s.Len(states, 2)
+	s.Equal(common.ORDER_PARTIAL_FILLED, states[0].Status)
+	s.Equal("6", states[0].AvailableAmount.String())
+	s.Equal(common.ORDER_FULL_FILLED, states[1].Status)
+	s.Equal("2", states[1].AverageFillPrice.String())
+
+	_, err = e.HandleCancelOrder(sell)
+	s.Nil(err)
+
+	state, err := e.GetOrderState("sell-1")
+	s.Nil(err)
+	s.Equal(common.ORDER_CANCELED, state.Status)
+	s.Equal("10", state.OriginalAmount.String())
+	s.Equal("4", state.FilledAmount.String())
+
+	var history []string
+	for _, change := range state.History {
+		history = append(history, change.Status)
+	}
+	s.Equal([]string{common.ORDER_PENDING, common.ORDER_PARTIAL_FILLED, common.ORDER_CANCELED}, history)
+
+	// finished orders leave the memory of the market
+	handler := e.getMarketHandler("HOT-WETH")
+	handler.do(func() {
+		s.Len(handler.orderStates.states, 0)
+	})
+}
+
+func (s *engineTestSuite) TestFindOrderQueriesItsMarket() {
+	e := NewEngine(context.Background())
+	e.UseOrderStore(NewMemoryOrderStore())
+
+	order := &common.MemoryOrder{
+		ID:       "dai-1",
+		MarketID: "HOT-DAI",
+		Price:    decimal.NewFromFloat(2),
+		Amount:   decimal.NewFromFloat(10),
+		Side:     "sell",
+		Type:     "limit",
+	}
+	_, _, err := e.HandleNewOrder(order)
+	s.Nil(err)
+
+	// a busy market doesn't hold up orders of other markets
+	handler := e.getOrCreateMarketHandler("HOT-WETH")
+	release := make(chan struct{})
+	defer close(release)
+	handler.submit(func() { <-release })
+
+	found, exist := e.FindOrder("dai-1")
+	s.True(exist)
+	s.Equal("HOT-DAI", found.MarketID)
+
+	_, exist = e.FindOrder("unknown")
+	s.False(exist)
+
+	_, err = e.HandleCancelOrder(order)
+	s.Nil(err)
+
+	_, exist = e.FindOrder("dai-1")
+	s.False(exist)
+}
@@ -0,0 +1,31 @@
+package engine
+
+import (
+	"errors"
+	"github.com/novaprotocolio/sdk-backend/common"
+)
+
+var (
+	ErrInvalidOrder  = common.ErrInvalidOrder
+	ErrOrderNotFound = common.ErrOrderNotFound
+	ErrOrderExists   = common.ErrOrderExists
+
+	ErrUnknownMarket    = errors.New("unknown market")
+	ErrMarketPreOpen    = errors.New("market is not open yet")
+	ErrMarketHalted     = errors.New("market is halted")
+	ErrMarketCancelOnly = errors.New("market only accepts cancel requests")
+	ErrMarketClosed     = errors.New("market is closed")
+	ErrEngineStopped    = errors.New("engine is stopped")
+	ErrNotLeader        = errors.New("engine is not the leader")
+
+	ErrJournalNotEnabled    = errors.New("journal is not enabled")
+	ErrJournalWriteFailed   = errors.New("write journal failed, market is halted")
+	ErrOrderStoreNotEnabled = errors.New("order store is not enabled")
+
+	// ErrMarketPanicked is returned when a command breaks an invariant of the market, the market is halted
+	ErrMarketPanicked = errors.New("market handler panicked")
+
+	ErrSettlementNotTracked = errors.New("settlements are not tracked")
+	ErrUnknownMatch         = errors.New("unknown match")
+	ErrUnknownTransaction   = errors.New("unknown transaction")
+)
@@ -0,0 +1,234 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"github.com/shopspring/decimal"
+)
+
+type EventLoopConfig struct {
+	// EventQueue is the source of engine events, usually NOVA_ENGINE_EVENTS_QUEUE_KEY
+	EventQueue common.IQueue
+
+	// WebsocketQueue receives the messages produced by each event, usually NOVA_WEBSOCKET_MESSAGES_QUEUE_KEY,
+	// or an IBus when there are several websocket servers
+	WebsocketQueue common.IPusher
+
+	// Codec encodes the websocket messages, common.JSONCodec if it is nil
+	Codec common.IPayloadCodec
+
+	// OnError is called with the raw event for every event which can't be decoded or handled.
+	// Errors are logged if it is nil.
+	OnError func(data []byte, err error)
+}
+
+// StartEventLoop pops events from the event queue and dispatches them to the engine
+// until the engine ctx is canceled.
+func (e *Engine) StartEventLoop(config *EventLoopConfig) {
+	e.Wg.Add(1)
+
+	go func() {
+		defer e.Wg.Done()
+		e.runEventLoop(config)
+	}()
+}
+
+func (e *Engine) runEventLoop(config *EventLoopConfig) {
+	for {
+		select {
+		case <-e.ctx.Done():
+			utils.Infof("Engine Event Loop Exit")
+			return
+		default:
+			// Pop should not block this go thread all the time to make it has chance to exit gracefully
+			data, err := config.EventQueue.Pop()
+
+			if err == common.EXIT {
+				continue
+			} else if err != nil {
+				utils.Errorf("read event error %v", err)
+				continue
+			}
+
+			msgs, err := e.HandleEvent(data)
+
+			if err != nil {
+				config.reportError(data, err)
+				continue
+			}
+
+			e.pushWebsocketMessages(config.WebsocketQueue, config.Codec, msgs)
+		}
+	}
+}
+
+// HandleEvent decodes one raw engine event and applies it to the engine.
+// It returns the websocket messages caused by this event.
+func (e *Engine) HandleEvent(data []byte) (msgs []common.WebSocketMessage, err error) {
+	var event common.Event
+
+	if err = json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("decode event error: %v", err)
+	}
+
+	switch event.Type {
+	case common.EventNewOrder:
+		var newOrderEvent common.NewOrderEvent
+		if err = json.Unmarshal(data, &newOrderEvent); err != nil {
+			return nil, fmt.Errorf("decode new order event error: %v", err)
+		}
+
+		var order common.MemoryOrder
+		if err = json.Unmarshal([]byte(newOrderEvent.Order), &order); err != nil {
+			return nil, fmt.Errorf("decode order of new order event error: %v", err)
+		}
+
+		if order.MarketID == "" {
+			order.MarketID = newOrderEvent.MarketID
+		}
+
+		matchResult, _, err := e.HandleNewOrder(&order)
+		if err != nil {
+			return nil, fmt.Errorf("order %s is rejected: %v", order.ID, err)
+		}
+
+		return matchResult.OrderbookActivities, nil
+	case common.EventCancelOrder:
+		var cancelOrderEvent common.CancelOrderEvent
+		if err = json.Unmarshal(data, &cancelOrderEvent); err != nil {
+			return nil, fmt.Errorf("decode cancel order event error: %v", err)
+		}
+
+		price, err := decimal.NewFromString(cancelOrderEvent.Price)
+		if err != nil {
+			return nil, fmt.Errorf("decode price of cancel order event error: %v", err)
+		}
+
+		return e.cancelOrderByID(cancelOrderEvent.MarketID, cancelOrderEvent.ID, cancelOrderEvent.Side, price)
+	case common.EventCancelOrders:
+		var cancelOrdersEvent common.CancelOrdersEvent
+		if err = json.Unmarshal(data, &cancelOrdersEvent); err != nil {
+			return nil, fmt.Errorf("decode cancel orders event error: %v", err)
+		}
+
+		filter := &CancelFilter{
+			MarketID: cancelOrdersEvent.MarketID,
+			Trader:   cancelOrdersEvent.Trader,
+			Side:     cancelOrdersEvent.Side,
+		}
+
+		if filter.MinPrice, err = decodeOptionalPrice(cancelOrdersEvent.MinPrice); err != nil {
+			return nil, fmt.Errorf("decode min price of cancel orders event error: %v", err)
+		}
+
+		if filter.MaxPrice, err = decodeOptionalPrice(cancelOrdersEvent.MaxPrice); err != nil {
+			return nil, fmt.Errorf("decode max price of cancel orders event error: %v", err)
+		}
+
+		_, msgs, err = e.CancelOrders(filter)
+		return msgs, err
+	case common.EventConfirmTransaction:
+		var confirmTransactionEvent common.ConfirmTransactionEvent
+		if err = json.Unmarshal(data, &confirmTransactionEvent); err != nil {
+			return nil, fmt.Errorf("decode confirm transaction event error: %v", err)
+		}
+
+		_, msgs, err = e.ConfirmTransaction(
+			confirmTransactionEvent.MarketID,
+			confirmTransactionEvent.Hash,
+			confirmTransactionEvent.Status,
+			confirmTransactionEvent.Timestamp,
+		)
+
+		return msgs, err
+	case common.EventOpenMarket:
+		return nil, e.OpenMarket(event.MarketID)
+	case common.EventRestartEngine:
+		return nil, e.Restart()
+	case common.EventCloseMarket:
+		var closeMarketEvent common.CloseMarketEvent
+		if err = json.Unmarshal(data, &closeMarketEvent); err != nil {
+			return nil, fmt.Errorf("decode close market event error: %v", err)
+		}
+
+		_, msgs, err = e.CloseMarket(closeMarketEvent.MarketID, closeMarketEvent.CancelOrders)
+		return msgs, err
+	default:
+		return nil, fmt.Errorf("event type %q is not handled by engine", event.Type)
+	}
+}
+
+// cancelOrderByID finds the order in the book and cancels it in a single market command
+func (e *Engine) cancelOrderByID(marketID, orderID, side string, price decimal.Decimal) (msgs []common.WebSocketMessage, err error) {
+	handler := e.getMarketHandler(marketID)
+	if handler == nil {
+		return nil, ErrUnknownMarket
+	}
+
+	if doErr := handler.do(func() {
+		bookOrder, exist := handler.orderbook.GetOrder(orderID, side, price)
+		if !exist {
+			err = ErrOrderNotFound
+			return
+		}
+
+		var msg *common.WebSocketMessage
+		if msg, err = e.handleCancelOrder(handler, bookOrder); err != nil {
+			return
+		}
+
+		msgs = append(msgs, *msg)
+		msgs = append(msgs, common.MessagesForUpdateOrder(bookOrder)...)
+		e.fillAccountMessages(handler, msgs)
+	}); doErr != nil {
+		return nil, doErr
+	}
+
+	return
+}
+
+func decodeOptionalPrice(s string) (*decimal.Decimal, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	price, err := decimal.NewFromString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &price, nil
+}
+
+func (e *Engine) pushWebsocketMessages(queue common.IPusher, codec common.IPayloadCodec, msgs []common.WebSocketMessage) {
+	if queue == nil {
+		return
+	}
+
+	if codec == nil {
+		codec = common.JSONCodec
+	}
+
+	for i := range msgs {
+		bts, err := common.EncodeWebSocketMessage(codec, &msgs[i])
+		if err != nil {
+			utils.Errorf("encode websocket message error: %v", err)
+			continue
+		}
+
+		if err = queue.Push(bts); err != nil {
+			utils.Errorf("push websocket message error: %v", err)
+		}
+	}
+}
+
+func (config *EventLoopConfig) reportError(data []byte, err error) {
+	if config.OnError != nil {
+		config.OnError(data, err)
+		return
+	}
+
+	utils.Errorf("engine event error: %v, event: %s", err, string(data))
+}
@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type chanQueue struct {
+	ctx context.Context
+	ch  chan []byte
+}
+
+func newChanQueue(ctx context.Context) *chanQueue {
+	return &chanQueue{ctx: ctx, ch: make(chan []byte, 100)}
+}
+
+func (q *chanQueue) Push(data []byte) error {
+	q.ch <- data
+	return nil
+}
+
+func (q *chanQueue) Pop() ([]byte, error) {
+	select {
+	case <-q.ctx.Done():
+		return nil, common.EXIT
+	case data := <-q.ch:
+		return data, nil
+	case <-time.After(10 * time.Millisecond):
+		return nil, common.EXIT
+	}
+}
+
+type eventLoopTestSuite struct {
+	suite.Suite
+}
+
+func TestEventLoopTestSuite(t *testing.T) {
+	suite.Run(t, new(eventLoopTestSuite))
+}
+
+func newOrderEvent(order *common.MemoryOrder) []byte {
+	orderBts, _ := json.Marshal(order)
+
+	bts, _ := json.Marshal(common.NewOrderEvent{
+		Event: common.Event{Type: common.EventNewOrder, MarketID: order.MarketID},
+		Order: string(orderBts),
+	})
+
+	return bts
+}
+
+func (s *eventLoopTestSuite) TestHandleNewOrderAndCancelEvents() {
+	e := NewEngine(context.Background())
+
+	msgs, err := e.HandleEvent(newOrderEvent(&common.MemoryOrder{
+		ID:       "fake-id",
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(1.0),
+		Amount:   decimal.NewFromFloat(100.0),
+		Side:     "sell",
+		Type:     "limit",
+	}))
+
+	s.Nil(err)
+	s.True(len(msgs) > 0)
+
+	handler, _ := e.marketHandlerMap["HOT-WETH"]
+	s.NotNil(handler.orderbook.MinAsk())
+
+	cancelBts, _ := json.Marshal(common.CancelOrderEvent{
+		Event: common.Event{Type: common.EventCancelOrder, MarketID: "HOT-WETH"},
+		ID:    "fake-id",
+		Price: "1",
+		Side:  "sell",
+	})
+
+	msgs, err = e.HandleEvent(cancelBts)
+	s.Nil(err)
+	s.Equal(3, len(msgs))
+	s.Nil(handler.orderbook.MinAsk())
+
+	_, err = e.HandleEvent(cancelBts)
+	s.NotNil(err)
+}
+
+func (s *eventLoopTestSuite) TestEventLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := NewEngine(ctx)
+
+	eventQueue := newChanQueue(ctx)
+	wsQueue := newChanQueue(ctx)
+	errs := make(chan error, 10)
+
+	e.StartEventLoop(&EventLoopConfig{
+		EventQueue:     eventQueue,
+		WebsocketQueue: wsQueue,
+		OnError: func(data []byte, err error) {
+			errs <- err
+		},
+	})
+
+	_ = eventQueue.Push([]byte("not a json"))
+	_ = eventQueue.Push(newOrderEvent(&common.MemoryOrder{
+		ID:       "fake-id",
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(1.0),
+		Amount:   decimal.NewFromFloat(100.0),
+		Side:     "sell",
+		Type:     "limit",
+	}))
+
+	select {
+	case err := <-errs:
+		s.NotNil(err)
+	case <-time.After(time.Second):
+		s.Fail("decode error is not reported")
+	}
+
+	select {
+	case bts := <-wsQueue.ch:
+		var msg common.WebSocketMessage
+		s.Nil(json.Unmarshal(bts, &msg))
+	case <-time.After(time.Second):
+		s.Fail("no websocket message is pushed")
+	}
+
+	cancel()
+	e.Wg.Wait()
+}
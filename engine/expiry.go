@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"container/heap"
+	"github.com/novaprotocolio/sdk-backend/common"
+)
+
+// expiryIndex is a min-heap of resting orders ordered by their expiration timestamp.
+// Orders leaving the book are removed from the index by their position, so it only holds resting orders.
+type expiryIndex struct {
+	orders    []*common.MemoryOrder
+	positions map[string]int
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{positions: make(map[string]int)}
+}
+
+func (idx *expiryIndex) Len() int { return len(idx.orders) }
+
+func (idx *expiryIndex) Less(i, j int) bool { return idx.orders[i].ExpiredAt < idx.orders[j].ExpiredAt }
+
+func (idx *expiryIndex) Swap(i, j int) {
+	idx.orders[i], idx.orders[j] = idx.orders[j], idx.orders[i]
+	idx.positions[idx.orders[i].ID] = i
+	idx.positions[idx.orders[j].ID] = j
+}
+
+func (idx *expiryIndex) Push(x interface{}) {
+	order := x.(*common.MemoryOrder)
+	idx.positions[order.ID] = len(idx.orders)
+	idx.orders = append(idx.orders, order)
+}
+
+func (idx *expiryIndex) Pop() interface{} {
+	n := len(idx.orders)
+	order := idx.orders[n-1]
+	idx.orders[n-1] = nil
+	idx.orders = idx.orders[:n-1]
+	delete(idx.positions, order.ID)
+	return order
+}
+
+// add indexes the order, an order with the same id is replaced
+func (idx *expiryIndex) add(order *common.MemoryOrder) {
+	if order.ExpiredAt == 0 {
+		return
+	}
+
+	if position, exist := idx.positions[order.ID]; exist {
+		idx.orders[position] = order
+		heap.Fix(idx, position)
+		return
+	}
+
+	heap.Push(idx, order)
+}
+
+// remove drops the order from the index when it leaves the book
+func (idx *expiryIndex) remove(order *common.MemoryOrder) {
+	if position, exist := idx.positions[order.ID]; exist {
+		heap.Remove(idx, position)
+	}
+}
+
+// popExpired returns all indexed orders which are expired at now
+func (idx *expiryIndex) popExpired(now uint64) []*common.MemoryOrder {
+	var orders []*common.MemoryOrder
+
+	for idx.Len() > 0 && idx.orders[0].IsExpired(now) {
+		orders = append(orders, heap.Pop(idx).(*common.MemoryOrder))
+	}
+
+	return orders
+}
+
+// nextExpiredAt returns the earliest expiration timestamp in the index, 0 if the index is empty
+func (idx *expiryIndex) nextExpiredAt() uint64 {
+	if len(idx.orders) == 0 {
+		return 0
+	}
+
+	return idx.orders[0].ExpiredAt
+}
+
+// fillExpiredAt reads the expiration timestamp of the order from its nova order data if it is not set
+func fillExpiredAt(order *common.MemoryOrder) {
+	if order.ExpiredAt == 0 && order.Data != "" {
+		order.ExpiredAt = common.OrderDataExpiredAt(order.Data)
+	}
+}
@@ -0,0 +1,262 @@
+package engine
+
+import (
+	"context"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"sync"
+	"time"
+)
+
+type DispatchMode int
+
+const (
+	// DispatchSync calls handlers in the market goroutine, the market waits until handlers succeed or give up
+	DispatchSync DispatchMode = iota
+	// DispatchAsync calls handlers in a goroutine of each market, in the same order as they are dispatched
+	DispatchAsync
+)
+
+type FailurePolicy int
+
+const (
+	// FailurePolicyHaltMarket keeps the failed call in the buffer and halts the market
+	FailurePolicyHaltMarket FailurePolicy = iota
+	// FailurePolicyBuffer keeps the failed call in the buffer, the market keeps trading
+	FailurePolicyBuffer
+)
+
+// HandlerConfig decides how registered handlers are called.
+// A call is retried with exponential backoff, if it still fails, it is buffered and the next calls wait behind it,
+// so handlers always see changes of a market in order. Buffered calls are only retried every MaxRetryBackoff,
+// once per call, never by new commands. Calls are never dropped, the market is halted once BufferSize calls are buffered.
+type HandlerConfig struct {
+	Mode DispatchMode
+
+	// Timeout of each call, zero means no timeout
+	Timeout time.Duration
+
+	// MaxRetries of a new call, zero means it is buffered after the first failure
+	MaxRetries      int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	FailurePolicy FailurePolicy
+
+	// BufferSize is the number of buffered calls which halts the market,
+	// calls of commands accepted by a halted market are still buffered beyond it
+	BufferSize int
+
+	// AsyncQueueSize is the capacity of the queue of each market in DispatchAsync mode
+	AsyncQueueSize int
+}
+
+func DefaultHandlerConfig() *HandlerConfig {
+	return &HandlerConfig{
+		Mode:            DispatchSync,
+		MaxRetries:      3,
+		RetryBackoff:    100 * time.Millisecond,
+		MaxRetryBackoff: 2 * time.Second,
+		FailurePolicy:   FailurePolicyHaltMarket,
+		BufferSize:      1024,
+		AsyncQueueSize:  1024,
+	}
+}
+
+// SetHandlerConfig should be called before any order is handled.
+// Zero RetryBackoff, MaxRetryBackoff, BufferSize and AsyncQueueSize are taken from DefaultHandlerConfig.
+func (e *Engine) SetHandlerConfig(config *HandlerConfig) {
+	c := *config
+	defaults := DefaultHandlerConfig()
+
+	if c.RetryBackoff <= 0 {
+		c.RetryBackoff = defaults.RetryBackoff
+	}
+
+	if c.MaxRetryBackoff <= 0 {
+		c.MaxRetryBackoff = defaults.MaxRetryBackoff
+	}
+
+	if c.BufferSize <= 0 {
+		c.BufferSize = defaults.BufferSize
+	}
+
+	if c.AsyncQueueSize <= 0 {
+		c.AsyncQueueSize = defaults.AsyncQueueSize
+	}
+
+	e.handlerConfig = &c
+}
+
+type handlerCall struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// handlerDispatcher calls the handlers of one market
+type handlerDispatcher struct {
+	engine  *Engine
+	handler *MarketHandler
+	config  *HandlerConfig
+
+	// failed calls waiting to be retried, in dispatch order.
+	// It is only touched by the market goroutine in sync mode, or by the dispatcher goroutine in async mode.
+	buffer []*handlerCall
+
+	queue chan *handlerCall
+}
+
+func newHandlerDispatcher(engine *Engine, handler *MarketHandler, config *HandlerConfig) *handlerDispatcher {
+	d := &handlerDispatcher{
+		engine:  engine,
+		handler: handler,
+		config:  config,
+	}
+
+	if config.Mode == DispatchAsync {
+		d.queue = make(chan *handlerCall, config.AsyncQueueSize)
+	}
+
+	return d
+}
+
+// run retries buffered calls periodically until ctx is canceled, it also processes calls of the async queue in async mode
+func (d *handlerDispatcher) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(d.config.MaxRetryBackoff)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.engine.ctx.Done():
+			return
+		case call := <-d.queue:
+			d.process(call)
+		case <-ticker.C:
+			if d.config.Mode == DispatchAsync {
+				d.flushBuffered()
+			} else {
+				// the buffer of sync mode is owned by the market goroutine
+				d.handler.submit(d.flushBuffered)
+			}
+		}
+	}
+}
+
+func (d *handlerDispatcher) dispatch(name string, fn func(ctx context.Context) error) {
+	call := &handlerCall{name: name, fn: fn}
+
+	if d.config.Mode == DispatchAsync {
+		select {
+		case d.queue <- call:
+		case <-d.engine.ctx.Done():
+		}
+
+		return
+	}
+
+	d.process(call)
+}
+
+func (d *handlerDispatcher) process(call *handlerCall) {
+	d.buffer = append(d.buffer, call)
+
+	// calls behind failed calls wait for them, buffered calls are only retried by run
+	if len(d.buffer) == 1 {
+		d.flush(true)
+	}
+
+	if len(d.buffer) >= d.config.BufferSize {
+		utils.Errorf("handler buffer of market %s is full, buffered calls: %d", d.handler.market, len(d.buffer))
+		d.halt()
+	}
+}
+
+// flushBuffered tries each buffered call once, the ticker of run is the backoff between tries
+func (d *handlerDispatcher) flushBuffered() {
+	if len(d.buffer) > 0 {
+		d.flush(false)
+	}
+}
+
+// flush calls buffered calls in order, it stops at the first call which still fails
+func (d *handlerDispatcher) flush(retry bool) {
+	for len(d.buffer) > 0 {
+		call := d.buffer[0]
+
+		var err error
+		if retry {
+			err = d.callWithRetry(call)
+		} else {
+			err = d.call(call)
+		}
+
+		if err != nil {
+			utils.Errorf("%s handler of market %s failed, buffered calls: %d, error: %v", call.name, d.handler.market, len(d.buffer), err)
+
+			if d.config.FailurePolicy == FailurePolicyHaltMarket {
+				d.halt()
+			}
+
+			return
+		}
+
+		d.buffer[0] = nil
+		d.buffer = d.buffer[1:]
+	}
+}
+
+func (d *handlerDispatcher) callWithRetry(call *handlerCall) (err error) {
+	backoff := d.config.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		if err = d.call(call); err == nil {
+			return nil
+		}
+
+		if attempt >= d.config.MaxRetries {
+			return err
+		}
+
+		select {
+		case <-d.engine.ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff = backoff * 2
+		if backoff > d.config.MaxRetryBackoff {
+			backoff = d.config.MaxRetryBackoff
+		}
+	}
+}
+
+func (d *handlerDispatcher) call(call *handlerCall) error {
+	ctx := d.engine.ctx
+
+	if d.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.config.Timeout)
+		defer cancel()
+	}
+
+	return call.fn(ctx)
+}
+
+// halt stops trading of the market until it is resumed by an operator
+func (d *handlerDispatcher) halt() {
+	halt := func() {
+		if d.handler.state != MarketStateHalted {
+			utils.Errorf("market %s is halted because its handlers failed", d.handler.market)
+			d.engine.setMarketState(d.handler, MarketStateHalted, false)
+		}
+	}
+
+	if d.config.Mode == DispatchAsync {
+		// the market goroutine may be waiting for the async queue
+		go d.handler.submit(halt)
+		return
+	}
+
+	halt()
+}
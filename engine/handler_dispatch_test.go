@@ -0,0 +1,234 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyDBHandler fails while failing is true, and records taker order ids of successful updates
+type flakyDBHandler struct {
+	lock    sync.Mutex
+	failing bool
+	calls   int
+	ids     []string
+}
+
+func (handler *flakyDBHandler) Update(ctx context.Context, matchRst common.MatchResult) error {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	handler.calls++
+
+	if handler.failing {
+		return errors.New("db is down")
+	}
+
+	handler.ids = append(handler.ids, matchRst.TakerOrder.ID)
+	return nil
+}
+
+func (handler *flakyDBHandler) setFailing(failing bool) {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	handler.failing = failing
+}
+
+func (handler *flakyDBHandler) callCount() int {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	return handler.calls
+}
+
+func (handler *flakyDBHandler) updatedIDs() []string {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	return append([]string{}, handler.ids...)
+}
+
+type handlerDispatchTestSuite struct {
+	suite.Suite
+	dbHandler *flakyDBHandler
+}
+
+func TestHandlerDispatchTestSuite(t *testing.T) {
+	suite.Run(t, new(handlerDispatchTestSuite))
+}
+
+func (s *handlerDispatchTestSuite) SetupTest() {
+	s.dbHandler = &flakyDBHandler{}
+}
+
+func (s *handlerDispatchTestSuite) newEngine(ctx context.Context, config *HandlerConfig) *Engine {
+	config.RetryBackoff = time.Millisecond
+	config.MaxRetryBackoff = 5 * time.Millisecond
+
+	e := NewEngine(ctx)
+	e.SetHandlerConfig(config)
+	e.RegisterDBHandler(s.dbHandler)
+
+	return e
+}
+
+// waitForUpdates waits for buffered calls retried by the dispatcher
+func (s *handlerDispatchTestSuite) waitForUpdates(count int) {
+	for i := 0; i < 100 && len(s.dbHandler.updatedIDs()) < count; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (s *handlerDispatchTestSuite) newOrder(id string) *common.MemoryOrder {
+	return &common.MemoryOrder{
+		ID:       id,
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(1.0),
+		Amount:   decimal.NewFromFloat(100.0),
+		Side:     "sell",
+		Type:     "limit",
+	}
+}
+
+func (s *handlerDispatchTestSuite) TestFailedCallHaltsMarket() {
+	e := s.newEngine(context.Background(), DefaultHandlerConfig())
+
+	s.dbHandler.setFailing(true)
+	_, _, err := e.HandleNewOrder(s.newOrder("o1"))
+	s.Nil(err)
+	// the first call and 3 retries, the buffered call may be retried periodically after them
+	s.True(s.dbHandler.callCount() >= 4)
+
+	state, _ := e.GetMarketState("HOT-WETH")
+	s.Equal(MarketStateHalted, state)
+
+	_, _, err = e.HandleNewOrder(s.newOrder("o2"))
+	s.Equal(ErrMarketHalted, err)
+
+	// buffered call is delivered before the next one after the market is resumed
+	s.dbHandler.setFailing(false)
+	s.Nil(e.ResumeMarket("HOT-WETH"))
+	_, _, err = e.HandleNewOrder(s.newOrder("o3"))
+	s.Nil(err)
+
+	s.waitForUpdates(2)
+	s.Equal([]string{"o1", "o3"}, s.dbHandler.updatedIDs())
+}
+
+func (s *handlerDispatchTestSuite) TestBufferPolicyKeepsTrading() {
+	config := DefaultHandlerConfig()
+	config.FailurePolicy = FailurePolicyBuffer
+	config.MaxRetries = 0
+	config.BufferSize = 2
+
+	e := s.newEngine(context.Background(), config)
+
+	s.dbHandler.setFailing(true)
+	e.HandleNewOrder(s.newOrder("o1"))
+
+	state, _ := e.GetMarketState("HOT-WETH")
+	s.Equal(MarketStateOpen, state)
+
+	// the market is halted once the buffer is full, the call is kept
+	e.HandleNewOrder(s.newOrder("o2"))
+	state, _ = e.GetMarketState("HOT-WETH")
+	s.Equal(MarketStateHalted, state)
+
+	_, _, err := e.HandleNewOrder(s.newOrder("o3"))
+	s.Equal(ErrMarketHalted, err)
+
+	s.dbHandler.setFailing(false)
+	s.Nil(e.ResumeMarket("HOT-WETH"))
+	e.HandleNewOrder(s.newOrder("o4"))
+
+	s.waitForUpdates(3)
+	s.Equal([]string{"o1", "o2", "o4"}, s.dbHandler.updatedIDs())
+}
+
+func (s *handlerDispatchTestSuite) TestSyncDispatchRetriesBufferedCalls() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := DefaultHandlerConfig()
+	config.FailurePolicy = FailurePolicyBuffer
+	config.MaxRetries = 0
+
+	e := s.newEngine(ctx, config)
+
+	s.dbHandler.setFailing(true)
+	e.HandleNewOrder(s.newOrder("o1"))
+	e.HandleNewOrder(s.newOrder("o2"))
+	s.dbHandler.setFailing(false)
+
+	// buffered calls are retried while the market is idle
+	s.waitForUpdates(2)
+
+	s.Equal([]string{"o1", "o2"}, s.dbHandler.updatedIDs())
+}
+
+func (s *handlerDispatchTestSuite) TestAsyncDispatch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := DefaultHandlerConfig()
+	config.Mode = DispatchAsync
+	config.FailurePolicy = FailurePolicyBuffer
+	config.MaxRetries = 0
+
+	e := s.newEngine(ctx, config)
+
+	s.dbHandler.setFailing(true)
+	e.HandleNewOrder(s.newOrder("o1"))
+	e.HandleNewOrder(s.newOrder("o2"))
+	s.dbHandler.setFailing(false)
+
+	// buffered calls are retried by the dispatcher without new orders
+	s.waitForUpdates(2)
+
+	s.Equal([]string{"o1", "o2"}, s.dbHandler.updatedIDs())
+}
+
+func (s *handlerDispatchTestSuite) TestNewCommandsDoNotRetryBufferedCalls() {
+	config := DefaultHandlerConfig()
+	config.FailurePolicy = FailurePolicyBuffer
+	config.MaxRetries = 2
+
+	e := s.newEngine(context.Background(), config)
+	// only retried by new calls
+	e.handlerConfig.MaxRetryBackoff = time.Hour
+
+	s.dbHandler.setFailing(true)
+	e.HandleNewOrder(s.newOrder("o1"))
+	s.Equal(3, s.dbHandler.callCount())
+
+	// the new call waits behind the buffered one without calling the handler
+	_, _, err := e.HandleNewOrder(s.newOrder("o2"))
+	s.Nil(err)
+	s.Equal(3, s.dbHandler.callCount())
+}
+
+func (s *handlerDispatchTestSuite) TestPartialConfigUsesDefaults() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	e := NewEngine(ctx)
+	e.SetHandlerConfig(&HandlerConfig{Mode: DispatchAsync, FailurePolicy: FailurePolicyBuffer})
+	e.RegisterDBHandler(s.dbHandler)
+
+	defaults := DefaultHandlerConfig()
+	s.Equal(defaults.MaxRetryBackoff, e.handlerConfig.MaxRetryBackoff)
+	s.Equal(defaults.BufferSize, e.handlerConfig.BufferSize)
+
+	s.dbHandler.setFailing(true)
+	_, _, err := e.HandleNewOrder(s.newOrder("o1"))
+	s.Nil(err)
+
+	state, _ := e.GetMarketState("HOT-WETH")
+	s.Equal(MarketStateOpen, state)
+}
@@ -0,0 +1,296 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// journal command types
+const (
+	JournalNewOrder       = "newOrder"
+	JournalReInsertOrder  = "reInsertOrder"
+	JournalCancelOrder    = "cancelOrder"
+	JournalExpireOrders   = "expireOrders"
+	JournalSetMarketState = "setMarketState"
+
+	JournalBindTransaction    = "bindTransaction"
+	JournalConfirmTransaction = "confirmTransaction"
+	JournalExpireSettlement   = "expireSettlement"
+)
+
+// JournalCommand is one accepted engine command.
+// Timestamp is the time used by the engine when the command was applied,
+// replaying the command with the same timestamp gives the same result.
+type JournalCommand struct {
+	Index     uint64              `json:"index"`
+	Type      string              `json:"type"`
+	MarketID  string              `json:"marketID"`
+	Timestamp uint64              `json:"timestamp"`
+	Order     *common.MemoryOrder `json:"order,omitempty"`
+
+	// for JournalSetMarketState
+	State        MarketState `json:"state,omitempty"`
+	CancelOrders bool        `json:"cancelOrders,omitempty"`
+
+	// for JournalBindTransaction, JournalConfirmTransaction and JournalExpireSettlement
+	MatchID           string `json:"matchID,omitempty"`
+	TransactionHash   string `json:"transactionHash,omitempty"`
+	TransactionStatus string `json:"transactionStatus,omitempty"`
+}
+
+// Checkpoint is a copy of all books.
+// Every command with an index not greater than Index is included in the checkpoint.
+type Checkpoint struct {
+	Index   uint64              `json:"index"`
+	Markets []*MarketCheckpoint `json:"markets"`
+}
+
+// MarketCheckpoint is a copy of one book.
+// Commands of this market with an index not greater than JournalIndex are included in the checkpoint.
+// Bids and Asks are in priority order.
+type MarketCheckpoint struct {
+	MarketID     string                `json:"marketID"`
+	State        MarketState           `json:"state"`
+	Sequence     uint64                `json:"sequence"`
+	JournalIndex uint64                `json:"journalIndex"`
+	Bids         []*common.MemoryOrder `json:"bids"`
+	Asks         []*common.MemoryOrder `json:"asks"`
+
+	// pending settlements, only if settlements are tracked
+	SettlementSequence uint64        `json:"settlementSequence,omitempty"`
+	Settlements        []*Settlement `json:"settlements,omitempty"`
+}
+
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs the journal file after each command
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval syncs the journal file every FsyncInterval
+	FsyncInterval
+	// FsyncNever leaves syncing to the operating system
+	FsyncNever
+)
+
+const DefaultFsyncInterval = 100 * time.Millisecond
+
+type JournalConfig struct {
+	Dir           string
+	FsyncPolicy   FsyncPolicy
+	FsyncInterval time.Duration
+}
+
+var ErrJournalCorrupted = common.ErrSegmentLogCorrupted
+
+const (
+	journalSegmentPrefix = "journal-"
+	checkpointPrefix     = "checkpoint-"
+	checkpointSuffix     = ".json"
+)
+
+// Journal is an append-only log of engine commands on a common.SegmentLog, the offset of a command is its index.
+// A new segment is started after each checkpoint, segments fully covered by the checkpoint are removed.
+type Journal struct {
+	config *JournalConfig
+	log    *common.SegmentLog
+}
+
+// OpenJournal opens the journal in config.Dir, a torn record at the tail of the last segment is truncated.
+func OpenJournal(config *JournalConfig) (*Journal, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("journal dir is required")
+	}
+
+	if config.FsyncInterval <= 0 {
+		config.FsyncInterval = DefaultFsyncInterval
+	}
+
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	j := &Journal{config: config}
+
+	checkpointIndex, err := j.latestCheckpointIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	logConfig := journalLogConfig(config.Dir)
+	logConfig.FirstOffset = checkpointIndex + 1
+	logConfig.SyncEveryAppend = config.FsyncPolicy == FsyncAlways
+
+	if config.FsyncPolicy == FsyncInterval {
+		logConfig.SyncInterval = config.FsyncInterval
+	}
+
+	if j.log, err = common.OpenSegmentLog(logConfig); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// journalLogConfig is the log of the journal in dir, segments are only started by checkpoints
+func journalLogConfig(dir string) *common.SegmentLogConfig {
+	return &common.SegmentLogConfig{Dir: dir, Prefix: journalSegmentPrefix}
+}
+
+// Append writes the command to the journal and assigns its index
+func (j *Journal) Append(cmd *JournalCommand) (uint64, error) {
+	return j.log.AppendFunc(func(index uint64) ([]byte, error) {
+		cmd.Index = index
+		return json.Marshal(cmd)
+	})
+}
+
+// LastIndex returns the index of the last appended command
+func (j *Journal) LastIndex() uint64 {
+	next, _ := j.log.Next()
+	return next - 1
+}
+
+// Replay calls fn with every command whose index is not less than fromIndex, in order.
+// It stops at the last command appended before it starts.
+func (j *Journal) Replay(fromIndex uint64, fn func(cmd *JournalCommand) error) error {
+	next, _ := j.log.Next()
+
+	reader := j.log.NewReader(fromIndex)
+	defer reader.Close()
+
+	for reader.Offset() < next {
+		data, err := reader.Read()
+		if err != nil {
+			return err
+		}
+
+		cmd, err := decodeJournalCommand(data)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(cmd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SaveCheckpoint writes the checkpoint, starts a new segment,
+// and removes segments and checkpoints which are no longer needed
+func (j *Journal) SaveCheckpoint(checkpoint *Checkpoint) error {
+	bts, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	path := j.checkpointPath(checkpoint.Index)
+	tmpPath := path + ".tmp"
+
+	if err = writeFileSync(tmpPath, bts); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	if err = j.log.Roll(); err != nil {
+		return err
+	}
+
+	j.log.RemoveBefore(checkpoint.Index + 1)
+	j.removeCheckpointsBefore(checkpoint.Index)
+
+	return nil
+}
+
+// LoadCheckpoint returns the latest checkpoint, nil if there is none
+func (j *Journal) LoadCheckpoint() (*Checkpoint, error) {
+	index, err := j.latestCheckpointIndex()
+	if err != nil || index == 0 {
+		return nil, err
+	}
+
+	bts, err := ioutil.ReadFile(j.checkpointPath(index))
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoint Checkpoint
+	if err = json.Unmarshal(bts, &checkpoint); err != nil {
+		return nil, err
+	}
+
+	return &checkpoint, nil
+}
+
+func (j *Journal) Close() error {
+	return j.log.Close()
+}
+
+func (j *Journal) latestCheckpointIndex() (uint64, error) {
+	indexes, err := common.ListIndexedFiles(j.config.Dir, checkpointPrefix, checkpointSuffix)
+	if err != nil || len(indexes) == 0 {
+		return 0, err
+	}
+
+	return indexes[len(indexes)-1], nil
+}
+
+func (j *Journal) removeCheckpointsBefore(index uint64) {
+	checkpoints, err := common.ListIndexedFiles(j.config.Dir, checkpointPrefix, checkpointSuffix)
+	if err != nil {
+		utils.Errorf("list checkpoints error: %v", err)
+		return
+	}
+
+	for _, checkpointIndex := range checkpoints {
+		if checkpointIndex >= index {
+			continue
+		}
+
+		if err := os.Remove(j.checkpointPath(checkpointIndex)); err != nil {
+			utils.Errorf("remove checkpoint error: %v", err)
+		}
+	}
+}
+
+func (j *Journal) checkpointPath(index uint64) string {
+	return filepath.Join(j.config.Dir, fmt.Sprintf("%s%020d%s", checkpointPrefix, index, checkpointSuffix))
+}
+
+func decodeJournalCommand(data []byte) (*JournalCommand, error) {
+	var cmd JournalCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return nil, ErrJournalCorrupted
+	}
+
+	return &cmd, nil
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
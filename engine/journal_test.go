@@ -0,0 +1,278 @@
+package engine
+
+import (
+	"context"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type journalTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func TestJournalTestSuite(t *testing.T) {
+	suite.Run(t, new(journalTestSuite))
+}
+
+func (s *journalTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "engine-journal")
+	s.Nil(err)
+	s.dir = dir
+}
+
+func (s *journalTestSuite) TearDownTest() {
+	_ = os.RemoveAll(s.dir)
+}
+
+func (s *journalTestSuite) openJournal() *Journal {
+	journal, err := OpenJournal(&JournalConfig{Dir: s.dir, FsyncPolicy: FsyncAlways})
+	s.Nil(err)
+	return journal
+}
+
+func (s *journalTestSuite) newOrder(id, side, price, amount string) *common.MemoryOrder {
+	return &common.MemoryOrder{
+		ID:       id,
+		MarketID: "HOT-WETH",
+		Price:    decimal.RequireFromString(price),
+		Amount:   decimal.RequireFromString(amount),
+		Side:     side,
+		Type:     "limit",
+	}
+}
+
+func (s *journalTestSuite) TestAppendAndReplay() {
+	journal := s.openJournal()
+
+	for i := 0; i < 3; i++ {
+		index, err := journal.Append(&JournalCommand{Type: JournalNewOrder, MarketID: "HOT-WETH"})
+		s.Nil(err)
+		s.Equal(uint64(i+1), index)
+	}
+
+	s.Nil(journal.Close())
+
+	journal = s.openJournal()
+	defer journal.Close()
+
+	s.Equal(uint64(3), journal.LastIndex())
+
+	var indexes []uint64
+	s.Nil(journal.Replay(2, func(cmd *JournalCommand) error {
+		indexes = append(indexes, cmd.Index)
+		return nil
+	}))
+
+	s.Equal([]uint64{2, 3}, indexes)
+}
+
+func (s *journalTestSuite) TestTornTailIsTruncated() {
+	journal := s.openJournal()
+	_, _ = journal.Append(&JournalCommand{Type: JournalNewOrder, MarketID: "HOT-WETH"})
+	_, _ = journal.Append(&JournalCommand{Type: JournalNewOrder, MarketID: "HOT-WETH"})
+	s.Nil(journal.Close())
+
+	segments, _ := filepath.Glob(filepath.Join(s.dir, "journal-*.log"))
+	s.Equal(1, len(segments))
+
+	info, _ := os.Stat(segments[0])
+	s.Nil(os.Truncate(segments[0], info.Size()-3))
+
+	journal = s.openJournal()
+	defer journal.Close()
+
+	s.Equal(uint64(1), journal.LastIndex())
+
+	index, err := journal.Append(&JournalCommand{Type: JournalNewOrder, MarketID: "HOT-WETH"})
+	s.Nil(err)
+	s.Equal(uint64(2), index)
+}
+
+func (s *journalTestSuite) TestRecover() {
+	e := NewEngine(context.Background())
+	e.UseJournal(s.openJournal())
+
+	e.HandleNewOrder(s.newOrder("o1", "sell", "1.2", "10"))
+	e.HandleNewOrder(s.newOrder("o2", "sell", "1.2", "10"))
+	e.HandleNewOrder(s.newOrder("o3", "buy", "1.0", "10"))
+	s.Nil(e.Checkpoint())
+
+	e.HandleNewOrder(s.newOrder("o4", "sell", "1.2", "5"))
+	e.HandleNewOrder(s.newOrder("o5", "buy", "1.2", "15"))
+	e.HandleCancelOrder(s.newOrder("o3", "buy", "1.0", "10"))
+	e.HandleNewOrder(s.newOrder("o6", "buy", "0.9", "1"))
+
+	before := e.marketHandlerMap["HOT-WETH"]
+	s.Nil(e.journal.Close())
+
+	recovered := NewEngine(context.Background())
+	recovered.UseJournal(s.openJournal())
+	defer recovered.journal.Close()
+
+	s.Nil(recovered.Recover())
+
+	after := recovered.marketHandlerMap["HOT-WETH"]
+	s.Equal(before.orderbook.Sequence, after.orderbook.Sequence)
+	s.Equal(before.orderbook.SnapshotV2(), after.orderbook.SnapshotV2())
+
+	ids := func(orders []*common.MemoryOrder) (res []string) {
+		for _, order := range orders {
+			res = append(res, order.ID)
+		}
+		return
+	}
+
+	s.Equal([]string{"o2", "o4"}, ids(after.orderbook.Orders("sell")))
+	s.Equal(ids(before.orderbook.Orders("buy")), ids(after.orderbook.Orders("buy")))
+
+	// new commands continue the journal
+	recovered.HandleNewOrder(s.newOrder("o7", "buy", "0.8", "1"))
+	s.Equal(before.orderbook.Sequence+1, after.orderbook.Sequence)
+}
+
+func (s *journalTestSuite) TestRestartEvent() {
+	e := NewEngine(context.Background())
+	e.UseJournal(s.openJournal())
+	defer e.journal.Close()
+
+	e.HandleNewOrder(s.newOrder("o1", "sell", "1.2", "10"))
+	e.HandleNewOrder(s.newOrder("o2", "buy", "1.0", "10"))
+	s.Nil(e.Checkpoint())
+	e.HandleNewOrder(s.newOrder("o3", "buy", "1.2", "4"))
+
+	handler := e.marketHandlerMap["HOT-WETH"]
+	sequence := handler.orderbook.Sequence
+	snapshot := handler.orderbook.SnapshotV2()
+
+	// the book is broken by something which is not journaled
+	s.Nil(handler.do(func() {
+		_, _ = handler.insertOrder(s.newOrder("ghost", "sell", "2", "1"))
+	}))
+
+	_, err := e.HandleEvent([]byte(`{"eventType": "EVENT/EVENT_RESTART"}`))
+	s.Nil(err)
+
+	s.Nil(handler.do(func() {
+		s.Equal(sequence, handler.orderbook.Sequence)
+		s.Equal(snapshot, handler.orderbook.SnapshotV2())
+	}))
+
+	// new commands continue the rebuilt book
+	e.HandleNewOrder(s.newOrder("o4", "buy", "0.9", "1"))
+	s.Equal(sequence+1, handler.orderbook.Sequence)
+}
+
+func (s *journalTestSuite) TestFailedJournalWriteHaltsMarket() {
+	e := NewEngine(context.Background())
+	e.UseJournal(s.openJournal())
+
+	_, _, err := e.HandleNewOrder(s.newOrder("o1", "sell", "1.2", "10"))
+	s.Nil(err)
+
+	// every later write fails
+	s.Nil(e.journal.Close())
+
+	_, _, err = e.HandleNewOrder(s.newOrder("o2", "sell", "1.3", "10"))
+	s.Equal(ErrJournalWriteFailed, err)
+
+	_, exist := e.FindOrder("o2")
+	s.False(exist)
+
+	state, _ := e.GetMarketState("HOT-WETH")
+	s.Equal(MarketStateHalted, state)
+
+	// a panic halts the market without panicking again in the recovery path
+	handler := e.getOrCreateMarketHandler("ABC-WETH")
+	s.Equal(ErrMarketPanicked, handler.do(func() { panic("broken invariant") }))
+
+	state, _ = e.GetMarketState("ABC-WETH")
+	s.Equal(MarketStateHalted, state)
+}
+
+func (s *journalTestSuite) TestRecoverMarketState() {
+	e := NewEngine(context.Background())
+	e.UseJournal(s.openJournal())
+
+	e.HandleNewOrder(s.newOrder("o1", "sell", "1.2", "10"))
+	s.Nil(e.HaltMarket("HOT-WETH"))
+	s.Nil(e.Checkpoint())
+	s.Nil(e.SetMarketCancelOnly("HOT-WETH"))
+	s.Nil(e.journal.Close())
+
+	recovered := NewEngine(context.Background())
+	recovered.UseJournal(s.openJournal())
+	defer recovered.journal.Close()
+
+	s.Nil(recovered.Recover())
+
+	state, exist := recovered.GetMarketState("HOT-WETH")
+	s.True(exist)
+	s.Equal(MarketStateCancelOnly, state)
+}
+
+func (s *journalTestSuite) TestRecoverPendingSettlements() {
+	newEngine := func() *Engine {
+		e := NewEngine(context.Background())
+		e.UseSettlementTracking()
+		e.UseJournal(s.openJournal())
+		return e
+	}
+
+	e := newEngine()
+	e.HandleNewOrder(s.newOrder("o1", "sell", "1", "10"))
+	e.HandleNewOrder(s.newOrder("o2", "sell", "1", "10"))
+	matchResult, _, _ := e.HandleNewOrder(s.newOrder("t1", "buy", "1", "15"))
+	s.Nil(e.Checkpoint())
+	_, err := e.BindMatchTransaction("HOT-WETH", matchResult.MatchID, "0xhash")
+	s.Nil(err)
+	s.Nil(e.journal.Close())
+
+	recovered := newEngine()
+	defer recovered.journal.Close()
+	s.Nil(recovered.Recover())
+
+	settlements := recovered.PendingSettlements("HOT-WETH")
+	s.Equal(1, len(settlements))
+	s.Equal("0xhash", settlements[0].TransactionHash)
+
+	_, _, err = recovered.ConfirmTransaction("HOT-WETH", "0xhash", common.STATUS_FAILED, 0)
+	s.Nil(err)
+
+	var ids []string
+	for _, order := range recovered.marketHandlerMap["HOT-WETH"].orderbook.Orders("sell") {
+		ids = append(ids, order.ID+":"+order.Amount.String())
+	}
+	s.Equal([]string{"o1:10", "o2:10"}, ids)
+}
+
+func (s *journalTestSuite) TestRecoverExpiredSettlements() {
+	newEngine := func() *Engine {
+		e := NewEngine(context.Background())
+		e.UseSettlementTracking()
+		e.UseJournal(s.openJournal())
+		return e
+	}
+
+	e := newEngine()
+	e.HandleNewOrder(s.newOrder("o1", "sell", "1", "10"))
+	e.HandleNewOrder(s.newOrder("t1", "buy", "1", "4"))
+	createdAt := e.PendingSettlements("HOT-WETH")[0].CreatedAt
+
+	settlements, _ := e.ExpireUnboundSettlements(createdAt + uint64(UnboundSettlementTTL/time.Second) + 1)
+	s.Equal(1, len(settlements))
+	s.Nil(e.journal.Close())
+
+	recovered := newEngine()
+	defer recovered.journal.Close()
+	s.Nil(recovered.Recover())
+
+	s.Equal(0, len(recovered.PendingSettlements("HOT-WETH")))
+	s.Equal("10", recovered.marketHandlerMap["HOT-WETH"].orderbook.Orders("sell")[0].Amount.String())
+}
@@ -0,0 +1,253 @@
+package engine
+
+import (
+	"errors"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"github.com/shopspring/decimal"
+	"time"
+)
+
+var (
+	ErrTraderRateLimited    = errors.New("too many orders from trader")
+	ErrMarketRateLimited    = errors.New("too many orders in market")
+	ErrTooManyOpenOrders    = errors.New("too many open orders")
+	ErrOpenNotionalExceeded = errors.New("notional of open orders exceeds limit")
+)
+
+// OrdersRejectedByLimits counts new orders rejected by limits, labeled by market and reason
+var OrdersRejectedByLimits = utils.NewCounterVec(
+	"engine_orders_rejected_by_limits_total",
+	"New orders rejected by engine limits.",
+	"market", "reason",
+)
+
+// Limits of one market, a zero field means no limit
+type Limits struct {
+	// TraderOrdersPerSecond and TraderBurst limit new orders of each trader in the market
+	TraderOrdersPerSecond float64
+	TraderBurst           int
+
+	// MarketOrdersPerSecond and MarketBurst limit new orders of all traders in the market
+	MarketOrdersPerSecond float64
+	MarketBurst           int
+
+	// MaxOpenOrders of each trader in the market
+	MaxOpenOrders int
+
+	// MaxOpenNotional of each trader in the market, the sum of amount * price of open orders in quote token
+	MaxOpenNotional decimal.Decimal
+}
+
+type LimitConfig struct {
+	Default *Limits
+
+	// Markets overrides Default for some markets
+	Markets map[string]*Limits
+}
+
+func (c *LimitConfig) limitsOf(marketID string) *Limits {
+	if limits, exist := c.Markets[marketID]; exist {
+		return limits
+	}
+
+	return c.Default
+}
+
+// SetLimitConfig should be called before any order is handled
+func (e *Engine) SetLimitConfig(config *LimitConfig) {
+	e.limitConfig = config
+}
+
+// tokenBucket allows rate events per second on average and burst events at once
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = b.tokens + elapsed*b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+
+	b.last = now
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.refill(now)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens = b.tokens - 1
+
+	return true
+}
+
+type openOrder struct {
+	trader   string
+	notional decimal.Decimal
+}
+
+// BucketPruneInterval is how often buckets of idle traders are dropped
+const BucketPruneInterval = time.Minute
+
+// marketLimiter enforces Limits in one market, it is owned by the market goroutine
+type marketLimiter struct {
+	limits *Limits
+
+	market    *tokenBucket
+	traders   map[string]*tokenBucket
+	lastPrune time.Time
+
+	orders   map[string]*openOrder
+	counts   map[string]int
+	notional map[string]decimal.Decimal
+}
+
+func newMarketLimiter(limits *Limits) *marketLimiter {
+	l := &marketLimiter{
+		limits:    limits,
+		traders:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+
+	l.reset()
+
+	if limits.MarketOrdersPerSecond > 0 {
+		l.market = newTokenBucket(limits.MarketOrdersPerSecond, limits.MarketBurst, time.Now())
+	}
+
+	return l
+}
+
+// check returns an error if the order breaks a limit, a rate token is taken if it doesn't
+func (l *marketLimiter) check(order *common.MemoryOrder, now time.Time) error {
+	// open order caps only apply to limit orders, which can rest in the book
+	if order.Type == "limit" {
+		if l.limits.MaxOpenOrders > 0 && l.counts[order.Trader] >= l.limits.MaxOpenOrders {
+			return ErrTooManyOpenOrders
+		}
+
+		if l.limits.MaxOpenNotional.IsPositive() {
+			notional := l.notional[order.Trader].Add(order.Amount.Mul(order.Price))
+			if notional.GreaterThan(l.limits.MaxOpenNotional) {
+				return ErrOpenNotionalExceeded
+			}
+		}
+	}
+
+	var bucket *tokenBucket
+	if l.limits.TraderOrdersPerSecond > 0 {
+		l.prune(now)
+
+		bucket = l.traders[order.Trader]
+		if bucket == nil {
+			bucket = newTokenBucket(l.limits.TraderOrdersPerSecond, l.limits.TraderBurst, now)
+			l.traders[order.Trader] = bucket
+		}
+
+		bucket.refill(now)
+		if bucket.tokens < 1 {
+			return ErrTraderRateLimited
+		}
+	}
+
+	if l.market != nil && !l.market.take(now) {
+		return ErrMarketRateLimited
+	}
+
+	if bucket != nil {
+		bucket.take(now)
+	}
+
+	return nil
+}
+
+// prune drops buckets which are full again, they are the same as new ones
+func (l *marketLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < BucketPruneInterval {
+		return
+	}
+
+	l.lastPrune = now
+
+	for trader, bucket := range l.traders {
+		if bucket.refill(now); bucket.tokens >= bucket.burst {
+			delete(l.traders, trader)
+		}
+	}
+}
+
+// sync counts the order as open if it is resting in the book
+func (l *marketLimiter) sync(order *common.MemoryOrder, resting bool) {
+	if current, exist := l.orders[order.ID]; exist {
+		delete(l.orders, order.ID)
+
+		if l.counts[current.trader] <= 1 {
+			delete(l.counts, current.trader)
+			delete(l.notional, current.trader)
+		} else {
+			l.counts[current.trader] = l.counts[current.trader] - 1
+			l.notional[current.trader] = l.notional[current.trader].Sub(current.notional)
+		}
+	}
+
+	if !resting {
+		return
+	}
+
+	current := &openOrder{trader: order.Trader, notional: order.Amount.Mul(order.Price)}
+	l.orders[order.ID] = current
+	l.counts[current.trader] = l.counts[current.trader] + 1
+	l.notional[current.trader] = l.notional[current.trader].Add(current.notional)
+}
+
+func (l *marketLimiter) reset() {
+	l.orders = make(map[string]*openOrder)
+	l.counts = make(map[string]int)
+	l.notional = make(map[string]decimal.Decimal)
+}
+
+// checkLimits runs in the market goroutine before the order is accepted
+func (e *Engine) checkLimits(handler *MarketHandler, order *common.MemoryOrder) error {
+	if handler.limiter == nil {
+		return nil
+	}
+
+	err := handler.limiter.check(order, time.Now())
+	if err != nil {
+		OrdersRejectedByLimits.Inc(handler.market, limitReason(err))
+	}
+
+	return err
+}
+
+func limitReason(err error) string {
+	switch err {
+	case ErrTraderRateLimited:
+		return "trader_rate"
+	case ErrMarketRateLimited:
+		return "market_rate"
+	case ErrTooManyOpenOrders:
+		return "open_orders"
+	case ErrOpenNotionalExceeded:
+		return "open_notional"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type limitsTestSuite struct {
+	suite.Suite
+}
+
+func TestLimitsTestSuite(t *testing.T) {
+	suite.Run(t, new(limitsTestSuite))
+}
+
+func limitOrder(id, trader, side string, price, amount float64) *common.MemoryOrder {
+	return &common.MemoryOrder{
+		ID:       id,
+		MarketID: "HOT-WETH",
+		Price:    decimal.NewFromFloat(price),
+		Amount:   decimal.NewFromFloat(amount),
+		Side:     side,
+		Type:     "limit",
+		Trader:   trader,
+	}
+}
+
+func (s *limitsTestSuite) TestRateLimits() {
+	l := newMarketLimiter(&Limits{
+		TraderOrdersPerSecond: 1,
+		TraderBurst:           2,
+		MarketOrdersPerSecond: 10,
+		MarketBurst:           3,
+	})
+
+	now := time.Now()
+
+	s.Nil(l.check(limitOrder("1", "alice", "buy", 1, 1), now))
+	s.Nil(l.check(limitOrder("2", "alice", "buy", 1, 1), now))
+	s.Equal(ErrTraderRateLimited, l.check(limitOrder("3", "alice", "buy", 1, 1), now))
+
+	s.Nil(l.check(limitOrder("4", "bob", "buy", 1, 1), now))
+	s.Equal(ErrMarketRateLimited, l.check(limitOrder("5", "carol", "buy", 1, 1), now))
+
+	// the market bucket has one token again, alice's bucket doesn't
+	now = now.Add(100 * time.Millisecond)
+	s.Equal(ErrTraderRateLimited, l.check(limitOrder("6", "alice", "buy", 1, 1), now))
+	s.Nil(l.check(limitOrder("7", "carol", "buy", 1, 1), now))
+
+	now = now.Add(BucketPruneInterval)
+	s.Nil(l.check(limitOrder("8", "alice", "buy", 1, 1), now))
+	s.Len(l.traders, 1)
+}
+
+func (s *limitsTestSuite) TestOpenOrderLimits() {
+	e := NewEngine(context.Background())
+	e.SetLimitConfig(&LimitConfig{
+		Default: &Limits{MaxOpenOrders: 2},
+		Markets: map[string]*Limits{
+			"HOT-DAI": {MaxOpenNotional: decimal.NewFromFloat(100)},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		_, _, err := e.HandleNewOrder(limitOrder(fmt.Sprintf("buy-%d", i), "alice", "buy", 1, 10))
+		s.Nil(err)
+	}
+
+	before := OrdersRejectedByLimits.Value("HOT-WETH", "open_orders")
+
+	_, _, err := e.HandleNewOrder(limitOrder("buy-2", "alice", "buy", 1, 10))
+	s.Equal(ErrTooManyOpenOrders, err)
+	s.Equal(before+1, OrdersRejectedByLimits.Value("HOT-WETH", "open_orders"))
+
+	// a filled order is not open any more
+	_, _, err = e.HandleNewOrder(limitOrder("sell-0", "bob", "sell", 1, 10))
+	s.Nil(err)
+
+	_, _, err = e.HandleNewOrder(limitOrder("buy-2", "alice", "buy", 1, 10))
+	s.Nil(err)
+
+	order := limitOrder("dai-0", "alice", "buy", 2, 40)
+	order.MarketID = "HOT-DAI"
+	_, _, err = e.HandleNewOrder(order)
+	s.Nil(err)
+
+	order = limitOrder("dai-1", "alice", "buy", 2, 11)
+	order.MarketID = "HOT-DAI"
+	_, _, err = e.HandleNewOrder(order)
+	s.Equal(ErrOpenNotionalExceeded, err)
+}
+
+func (s *limitsTestSuite) TestOpenOrderLimitsSkipMarketOrders() {
+	l := newMarketLimiter(&Limits{MaxOpenOrders: 1, MaxOpenNotional: decimal.NewFromFloat(10)})
+	now := time.Now()
+
+	order := limitOrder("1", "alice", "buy", 1, 10)
+	s.Nil(l.check(order, now))
+	l.sync(order, true)
+
+	s.Equal(ErrTooManyOpenOrders, l.check(limitOrder("2", "alice", "buy", 1, 1), now))
+
+	// a market order doesn't rest, the caps of open orders don't apply to it
+	market := limitOrder("3", "alice", "sell", 0, 100)
+	market.Type = "market"
+	s.Nil(l.check(market, now))
+}
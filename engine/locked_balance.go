@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/shopspring/decimal"
+	"sync"
+)
+
+type tokenHolder struct {
+	token  string
+	holder string
+}
+
+type orderLock struct {
+	tokenHolder
+	amount decimal.Decimal
+}
+
+// orderLocks keeps the amount locked by each resting order and the total of each token and holder.
+// It is not safe for concurrent use.
+type orderLocks struct {
+	orders map[string]*orderLock
+	locked map[tokenHolder]decimal.Decimal
+}
+
+func newOrderLocks() *orderLocks {
+	return &orderLocks{
+		orders: make(map[string]*orderLock),
+		locked: make(map[tokenHolder]decimal.Decimal),
+	}
+}
+
+func (l *orderLocks) set(orderID string, key tokenHolder, amount decimal.Decimal) {
+	l.release(orderID)
+
+	l.orders[orderID] = &orderLock{tokenHolder: key, amount: amount}
+	l.locked[key] = l.locked[key].Add(amount)
+}
+
+func (l *orderLocks) release(orderID string) {
+	current, exist := l.orders[orderID]
+	if !exist {
+		return
+	}
+
+	delete(l.orders, orderID)
+
+	remaining := l.locked[current.tokenHolder].Sub(current.amount)
+	if remaining.IsPositive() {
+		l.locked[current.tokenHolder] = remaining
+	} else {
+		delete(l.locked, current.tokenHolder)
+	}
+}
+
+// spendingOf returns the amount the order spends if it is fully filled.
+// Sell orders spend base token, buy orders spend quote token and also pay the gas fee and the taker fee in it.
+func spendingOf(order *common.MemoryOrder) decimal.Decimal {
+	if order.Side == "sell" {
+		return order.Amount
+	}
+
+	// amount of market buy orders is in quote token
+	notional := order.Amount
+	if order.Type == "limit" {
+		notional = order.Amount.Mul(order.Price)
+	}
+
+	return notional.Add(notional.Mul(order.TakerFeeRate)).Add(order.GasFeeAmount)
+}
+
+// lockedBalanceLedger keeps the amount of each symbol locked by resting orders of each trader in all markets
+type lockedBalanceLedger struct {
+	lock  sync.RWMutex
+	locks *orderLocks
+}
+
+func newLockedBalanceLedger() *lockedBalanceLedger {
+	return &lockedBalanceLedger{locks: newOrderLocks()}
+}
+
+func (l *lockedBalanceLedger) sync(order *common.MemoryOrder, resting bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !resting {
+		l.locks.release(order.ID)
+		return
+	}
+
+	key := tokenHolder{token: order.QuoteTokenSymbol(), holder: order.Trader}
+	if order.Side == "sell" {
+		key.token = order.BaseTokenSymbol()
+	}
+
+	l.locks.set(order.ID, key, spendingOf(order))
+}
+
+func (l *lockedBalanceLedger) get(trader, symbol string) decimal.Decimal {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return l.locks.locked[tokenHolder{token: symbol, holder: trader}]
+}
+
+func (l *lockedBalanceLedger) balances(trader string) map[string]decimal.Decimal {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	balances := make(map[string]decimal.Decimal)
+	for key, amount := range l.locks.locked {
+		if key.holder == trader {
+			balances[key.token] = amount
+		}
+	}
+
+	return balances
+}
+
+func (l *lockedBalanceLedger) reset() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.locks = newOrderLocks()
+}
+
+// LockedBalance returns the amount of the symbol locked by open orders of the trader in all markets
+func (e *Engine) LockedBalance(trader, symbol string) decimal.Decimal {
+	return e.lockedBalances.get(trader, symbol)
+}
+
+// LockedBalances returns the locked amount of every symbol the trader has open orders in
+func (e *Engine) LockedBalances(trader string) map[string]decimal.Decimal {
+	return e.lockedBalances.balances(trader)
+}
+
+// syncLockedAmounts updates locks and open order counts of orders changed by a command, it runs in the market goroutine
+func (e *Engine) syncLockedAmounts(handler *MarketHandler, orders ...*common.MemoryOrder) {
+	for _, order := range orders {
+		if order == nil {
+			continue
+		}
+
+		bookOrder, exist := handler.orderbook.GetOrder(order.ID, order.Side, order.Price)
+		resting := exist && bookOrder == order
+
+		e.lockedBalances.sync(order, resting)
+
+		if handler.limiter != nil {
+			handler.limiter.sync(order, resting)
+		}
+
+		if e.risk != nil {
+			e.risk.sync(order, resting)
+		}
+	}
+}
+
+// fillAccountMessages sets the balances of lockedBalanceChange messages to the locked amounts after the command,
+// and the states of orderChange messages if order states are tracked.
+func (e *Engine) fillAccountMessages(handler *MarketHandler, msgs []common.WebSocketMessage) {
+	e.fillOrderStates(handler, msgs)
+
+	for _, msg := range msgs {
+		payload, ok := msg.Payload.(*common.WebsocketLockedBalanceChangePayload)
+		if !ok {
+			continue
+		}
+
+		if trader, ok := common.GetAccountAddress(msg.ChannelID); ok {
+			payload.Balance = e.lockedBalances.get(trader, payload.Symbol)
+		}
+	}
+}
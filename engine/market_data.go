@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"context"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"time"
+)
+
+// MarketDataHandler builds market data from executed matches, common.CandleAggregator and common.TickerAggregator satisfy it.
+// Returned messages are published through the OrderbookActivitiesHandler.
+type MarketDataHandler interface {
+	AddMatchResult(matchResult *common.MatchResult, timestamp uint64) ([]common.WebSocketMessage, error)
+
+	// Tick moves the data on while there are no trades
+	Tick(now uint64) []common.WebSocketMessage
+}
+
+// MarketDataTickInterval is how often the market data loop calls Tick of market data handlers
+const MarketDataTickInterval = 5 * time.Second
+
+// RegisterMarketDataHandler adds a handler which is called with every executed match.
+// It should be called before any order is handled.
+func (e *Engine) RegisterMarketDataHandler(handler MarketDataHandler) {
+	e.marketDataHandlers = append(e.marketDataHandlers, handler)
+}
+
+// StartMarketData runs a loop calling Tick of market data handlers until the engine ctx is canceled.
+func (e *Engine) StartMarketData() {
+	e.Wg.Add(1)
+
+	go func() {
+		defer e.Wg.Done()
+
+		ticker := time.NewTicker(MarketDataTickInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-e.ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, handler := range e.marketDataHandlers {
+					if err := e.publishMarketData(e.ctx, handler.Tick(uint64(now.Unix()))); err != nil {
+						utils.Errorf("publish market data error: %v", err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (e *Engine) triggerMarketDataHandlersIfNotNil(handler *MarketHandler, matchResult common.MatchResult, now uint64) {
+	if len(e.marketDataHandlers) == 0 || e.replaying || !matchResult.ExistMatchToBeExecuted() {
+		return
+	}
+
+	for _, dataHandler := range e.marketDataHandlers {
+		dataHandler := dataHandler
+
+		// a retry only publishes the messages again, so trades are not counted twice
+		var msgs []common.WebSocketMessage
+		added := false
+
+		handler.dispatcher.dispatch("market data", func(ctx context.Context) error {
+			if !added {
+				var err error
+				msgs, err = dataHandler.AddMatchResult(&matchResult, now)
+				added = true
+
+				if err != nil {
+					utils.Errorf("add match result of market %s to market data error: %v", handler.market, err)
+				}
+			}
+
+			return e.publishMarketData(ctx, msgs)
+		})
+	}
+}
+
+func (e *Engine) publishMarketData(ctx context.Context, msgs []common.WebSocketMessage) error {
+	if e.orderBookActivitiesHandler == nil || len(msgs) == 0 {
+		return nil
+	}
+
+	return (*e.orderBookActivitiesHandler).Update(ctx, msgs)
+}
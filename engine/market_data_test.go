@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"context"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/stretchr/testify/suite"
+	"sync"
+	"testing"
+)
+
+// recordingActivitiesHandler keeps all published messages
+type recordingActivitiesHandler struct {
+	lock sync.Mutex
+	msgs []common.WebSocketMessage
+}
+
+func (handler *recordingActivitiesHandler) Update(ctx context.Context, msgs []common.WebSocketMessage) error {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	handler.msgs = append(handler.msgs, msgs...)
+	return nil
+}
+
+func (handler *recordingActivitiesHandler) channelMessages(channelID string) (res []common.WebSocketMessage) {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+
+	for _, msg := range handler.msgs {
+		if msg.ChannelID == channelID {
+			res = append(res, msg)
+		}
+	}
+
+	return
+}
+
+type marketDataTestSuite struct {
+	suite.Suite
+	engine     *Engine
+	activities *recordingActivitiesHandler
+}
+
+func TestMarketDataTestSuite(t *testing.T) {
+	suite.Run(t, new(marketDataTestSuite))
+}
+
+func (s *marketDataTestSuite) SetupTest() {
+	s.activities = &recordingActivitiesHandler{}
+	s.engine = NewEngine(context.Background())
+	s.engine.RegisterOrderbookActivitiesHandler(s.activities)
+}
+
+func (s *marketDataTestSuite) TestCandlesOfMatches() {
+	store := common.NewMemoryCandleStore()
+	s.engine.RegisterMarketDataHandler(common.NewCandleAggregator(store, common.CandleInterval1m))
+
+	_, _, err := s.engine.HandleNewOrder(limitOrder("o1", "t1", "sell", 1.2, 10))
+	s.Nil(err)
+	s.Len(s.activities.channelMessages(common.GetCandleChannelID("HOT-WETH", common.CandleInterval1m)), 0)
+
+	_, _, err = s.engine.HandleNewOrder(limitOrder("o2", "t2", "buy", 1.2, 4))
+	s.Nil(err)
+
+	msgs := s.activities.channelMessages(common.GetCandleChannelID("HOT-WETH", common.CandleInterval1m))
+	s.Len(msgs, 1)
+
+	candle := msgs[0].Payload.(*common.WebsocketCandleUpdatePayload).Candle
+	s.Equal("1.2", candle.Close.String())
+	s.Equal("4", candle.Volume.String())
+
+	candles, err := store.GetCandles("HOT-WETH", common.CandleInterval1m, 0, candle.OpenTime, 0)
+	s.Nil(err)
+	s.Len(candles, 1)
+}
+
+func (s *marketDataTestSuite) TestTickersOfMatches() {
+	tickers := common.NewTickerAggregator()
+	s.engine.RegisterMarketDataHandler(tickers)
+
+	_, _, err := s.engine.HandleNewOrder(limitOrder("o1", "t1", "sell", 1.2, 10))
+	s.Nil(err)
+	_, _, err = s.engine.HandleNewOrder(limitOrder("o2", "t2", "buy", 1.3, 4))
+	s.Nil(err)
+
+	ticker, exist := tickers.Ticker("HOT-WETH")
+	s.True(exist)
+	s.Equal("1.2", ticker.LastPrice.String())
+	s.Equal("4", ticker.Volume.String())
+
+	s.Len(s.activities.channelMessages(common.GetTickerChannelID("HOT-WETH")), 1)
+	s.Len(s.activities.channelMessages(common.TickerChannelPrefix), 1)
+}
@@ -7,28 +7,145 @@ import (
 	"github.com/novaprotocolio/sdk-backend/utils"
 	"github.com/labstack/gommon/log"
 	"github.com/shopspring/decimal"
+	"runtime/debug"
+	"sync"
 )
 
+// MarketInboxSize is the capacity of the command inbox of each market.
+// Callers are blocked when the inbox of a market is full.
+const MarketInboxSize = 1024
+
+// MarketHandler owns the orderbook of one market.
+// The orderbook is only touched by the market goroutine, commands are sent to it through the inbox,
+// so requests in each market are processed serially and different markets are processed concurrently.
 type MarketHandler struct {
 	ctx                  context.Context
 	market               string
 	marketAmountDecimals int
 	orderbook            *common.Orderbook
+	expiryIndex          *expiryIndex
+	state                MarketState
+
+	// settlements is nil if settlements are not tracked
+	settlements *settlementTracker
+
+	// limiter is nil if the market has no limits
+	limiter *marketLimiter
+
+	// orderStates is only used if order states are tracked
+	orderStates *orderStates
+
+	// dispatcher calls registered handlers with changes of this market
+	dispatcher *handlerDispatcher
+
+	// onPanic is called in the market goroutine after a command panics
+	onPanic func(r interface{})
+
+	inbox   chan func()
+	stopped chan struct{}
 }
 
-func (m MarketHandler) handleNewOrder(newOrder *common.MemoryOrder) (matchResult common.MatchResult, hasMatchOrder bool) {
+// run executes commands in the inbox one by one until ctx is canceled
+func (m *MarketHandler) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer close(m.stopped)
 
-	if m.orderbook.CanMatch(newOrder) {
-		matchResult = *m.orderbook.ExecuteMatch(newOrder, m.marketAmountDecimals)
+	for {
+		select {
+		case <-m.ctx.Done():
+			utils.Infof("Market %s Handler Exit", m.market)
+			return
+		case fn := <-m.inbox:
+			m.execute(fn)
+		}
+	}
+}
+
+// execute runs one command, a panic only stops this command and is reported to onPanic.
+// If onPanic panics too, the process exits.
+func (m *MarketHandler) execute(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			utils.Errorf("market %s panicked: %v\n%s", m.market, r, debug.Stack())
+
+			if m.onPanic != nil {
+				m.onPanic(r)
+			}
+		}
+	}()
+
+	fn()
+
+	m.orderStates.prune()
+}
+
+// submit puts fn into the inbox without waiting for it to be executed.
+// It blocks while the inbox is full and returns false if the market handler is stopped.
+func (m *MarketHandler) submit(fn func()) bool {
+	select {
+	case m.inbox <- fn:
+		return true
+	case <-m.stopped:
+		return false
+	}
+}
 
-		if len(matchResult.MatchItems) == 0 {
-			log.Errorf("No Match Items, %+v %+v", matchResult, newOrder)
-			panic(fmt.Errorf("no match items"))
+// do executes fn in the market goroutine and waits for it to finish.
+// It returns ErrEngineStopped if the market handler is stopped before fn is executed,
+// and ErrMarketPanicked if fn panics.
+func (m *MarketHandler) do(fn func()) error {
+	done := make(chan struct{})
+	finished := false
+
+	if !m.submit(func() {
+		defer close(done)
+		fn()
+		finished = true
+	}) {
+		return ErrEngineStopped
+	}
+
+	select {
+	case <-done:
+	case <-m.stopped:
+		// fn may finish right before the handler stops
+		select {
+		case <-done:
+		default:
+			return ErrEngineStopped
 		}
+	}
+
+	if !finished {
+		return ErrMarketPanicked
+	}
+
+	return nil
+}
+
+// QueueDepth returns the number of commands waiting in the inbox
+func (m *MarketHandler) QueueDepth() int {
+	return len(m.inbox)
+}
+
+func (m *MarketHandler) handleNewOrder(newOrder *common.MemoryOrder, now uint64) (matchResult common.MatchResult, hasMatchOrder bool, expiredOrders []*common.MemoryOrder) {
+	// expired orders must leave the book before they can be taken
+	expiredOrders, expiredMsgs := m.handleExpireOrders(now)
+	matchResult.OrderbookActivities = append(matchResult.OrderbookActivities, expiredMsgs...)
+
+	if m.orderbook.CanMatch(newOrder) {
+		activities := matchResult.OrderbookActivities
+		matchResult = *m.orderbook.ExecuteMatchAt(newOrder, m.marketAmountDecimals, now)
+		matchResult.OrderbookActivities = append(activities, matchResult.OrderbookActivities...)
 
 		for i := range matchResult.MatchItems {
 			item := matchResult.MatchItems[i]
 
+			// filled makers are removed from the book by the match
+			if item.MakerOrderIsDone {
+				m.expiryIndex.remove(item.MakerOrder)
+			}
+
 			msgs := common.MessagesForUpdateOrder(item.MakerOrder)
 			matchResult.OrderbookActivities = append(matchResult.OrderbookActivities, msgs...)
 
@@ -36,7 +153,17 @@ func (m MarketHandler) handleNewOrder(newOrder *common.MemoryOrder) (matchResult
 			utils.Debugf("  [Take Liquidity] price: %s amount: %s (%s) ", item.MakerOrder.Price.StringFixed(5), item.MatchedAmount.StringFixed(5), item.MakerOrder.ID)
 		}
 
-		hasMatchOrder = true
+		hasMatchOrder = len(matchResult.MatchItems) > 0
+		if !hasMatchOrder {
+			log.Warnf("No Match Items, %+v %+v", matchResult, newOrder)
+		}
+	}
+
+	matchResult.TakerOrder = newOrder
+
+	if hasMatchOrder {
+		msgs := m.trackMatch(&matchResult, now)
+		matchResult.OrderbookActivities = append(matchResult.OrderbookActivities, msgs...)
 	}
 
 	msgs := common.MessagesForUpdateOrder(newOrder)
@@ -51,7 +178,12 @@ func (m MarketHandler) handleNewOrder(newOrder *common.MemoryOrder) (matchResult
 			newOrder.GasFeeAmount = decimal.Zero
 		}
 
-		e := m.orderbook.InsertOrder(newOrder)
+		e, err := m.insertOrder(newOrder)
+		if err != nil {
+			// the engine makes sure the order is not in the book before matching
+			panic(fmt.Errorf("insert order %s to book %s error: %v", newOrder.ID, m.market, err))
+		}
+
 		msg := common.OrderbookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount)
 		matchResult.OrderbookActivities = append(matchResult.OrderbookActivities, msg)
 
@@ -61,21 +193,122 @@ func (m MarketHandler) handleNewOrder(newOrder *common.MemoryOrder) (matchResult
 	return
 }
 
-func (m *MarketHandler) handleCancelOrder(bookOrder *common.MemoryOrder) *common.OrderbookEvent {
-	return m.orderbook.RemoveOrder(bookOrder)
+func (m *MarketHandler) handleCancelOrder(bookOrder *common.MemoryOrder) (*common.OrderbookEvent, error) {
+	return m.removeOrder(bookOrder)
 }
 
-func NewMarketHandler(ctx context.Context, market string) (*MarketHandler, error) {
+// removeOrder removes the order from the book and everything indexing it
+func (m *MarketHandler) removeOrder(order *common.MemoryOrder) (*common.OrderbookEvent, error) {
+	e, err := m.orderbook.RemoveOrder(order)
+	if err != nil {
+		return nil, err
+	}
+
+	m.expiryIndex.remove(order)
+
+	return e, nil
+}
+
+func (m *MarketHandler) insertOrder(order *common.MemoryOrder) (*common.OrderbookEvent, error) {
+	e, err := m.orderbook.InsertOrder(order)
+	if err != nil {
+		return nil, err
+	}
+
+	m.expiryIndex.add(order)
+
+	return e, nil
+}
+
+// hasOrder returns true if an order with the same id is in the book at the price of the order
+func (m *MarketHandler) hasOrder(order *common.MemoryOrder) bool {
+	_, exist := m.orderbook.GetOrder(order.ID, order.Side, order.Price)
+	return exist
+}
+
+// handleExpireOrders removes all orders expired at now from the orderbook.
+// Each removal produces the same messages as a cancel.
+func (m *MarketHandler) handleExpireOrders(now uint64) (expiredOrders []*common.MemoryOrder, msgs []common.WebSocketMessage) {
+	for _, order := range m.expiryIndex.popExpired(now) {
+		// the order may have been canceled or filled already
+		bookOrder, exist := m.orderbook.GetOrder(order.ID, order.Side, order.Price)
+		if !exist || bookOrder != order {
+			continue
+		}
+
+		e, err := m.orderbook.RemoveOrder(order)
+		if err != nil {
+			continue
+		}
+
+		msgs = append(msgs, common.OrderbookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount))
+		msgs = append(msgs, common.MessagesForUpdateOrder(order)...)
+		expiredOrders = append(expiredOrders, order)
+
+		utils.Debugf("  [Expire Order] price: %s amount: %s (%s)", order.Price.StringFixed(5), order.Amount.StringFixed(5), order.ID)
+	}
+
+	return
+}
+
+// setState changes the state of the market, all orders are removed if cancelOrders is true.
+// Each removal produces the same messages as a cancel.
+func (m *MarketHandler) setState(state MarketState, cancelOrders bool) (canceledOrders []*common.MemoryOrder, msgs []common.WebSocketMessage) {
+	m.state = state
+
+	if !cancelOrders {
+		return
+	}
+
+	for _, side := range []string{"buy", "sell"} {
+		for _, order := range m.orderbook.Orders(side) {
+			e, err := m.removeOrder(order)
+			if err != nil {
+				continue
+			}
+
+			msgs = append(msgs, common.OrderbookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount))
+			msgs = append(msgs, common.MessagesForUpdateOrder(order)...)
+			canceledOrders = append(canceledOrders, order)
+		}
+	}
+
+	return
+}
+
+// reset empties the book and everything kept with it, the market is open as a new one
+func (m *MarketHandler) reset() {
+	m.orderbook = newMarketOrderbook(m.market)
+	m.expiryIndex = newExpiryIndex()
+	m.state = MarketStateOpen
+	m.orderStates = newOrderStates()
+
+	if m.settlements != nil {
+		m.settlements = newSettlementTracker()
+	}
+}
+
+// newMarketOrderbook returns an empty book whose sequence goes up with every book event
+func newMarketOrderbook(market string) *common.Orderbook {
 	marketOrderbook := common.NewOrderbook(market)
 
 	marketOrderbook.UsePlugin(func(e *common.OrderbookEvent) {
 		marketOrderbook.Sequence = marketOrderbook.Sequence + 1
 	})
 
+	return marketOrderbook
+}
+
+func NewMarketHandler(ctx context.Context, market string) (*MarketHandler, error) {
 	marketHandler := MarketHandler{
-		market:    market,
-		ctx:       ctx,
-		orderbook: marketOrderbook,
+		market:      market,
+		ctx:         ctx,
+		orderbook:   newMarketOrderbook(market),
+		expiryIndex: newExpiryIndex(),
+		state:       MarketStateOpen,
+		orderStates: newOrderStates(),
+		inbox:       make(chan func(), MarketInboxSize),
+		stopped:     make(chan struct{}),
 	}
 
 	return &marketHandler, nil
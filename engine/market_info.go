@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"sort"
+	"sync"
+)
+
+type MarketInfo struct {
+	MarketID   string      `json:"marketID"`
+	State      MarketState `json:"state"`
+	Sequence   uint64      `json:"sequence"`
+	QueueDepth int         `json:"queueDepth"`
+	Bids       int         `json:"bids"`
+	Asks       int         `json:"asks"`
+}
+
+// OrderbookL3 lists orders of a book in priority order
+type OrderbookL3 struct {
+	Sequence uint64                `json:"sequence"`
+	Bids     []*common.MemoryOrder `json:"bids"`
+	Asks     []*common.MemoryOrder `json:"asks"`
+}
+
+// Markets returns the state of every market, sorted by market id
+func (e *Engine) Markets() []*MarketInfo {
+	var lock sync.Mutex
+	infos := make([]*MarketInfo, 0)
+
+	e.doInAllMarkets(func(handler *MarketHandler) {
+		info := &MarketInfo{
+			MarketID:   handler.market,
+			State:      handler.state,
+			Sequence:   handler.orderbook.Sequence,
+			QueueDepth: handler.QueueDepth(),
+			Bids:       len(handler.orderbook.Orders("buy")),
+			Asks:       len(handler.orderbook.Orders("sell")),
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		infos = append(infos, info)
+	})
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].MarketID < infos[j].MarketID
+	})
+
+	return infos
+}
+
+// OrderbookL2 returns the aggregated price levels of the market
+func (e *Engine) OrderbookL2(marketID string) (snapshot *common.SnapshotV2, err error) {
+	err = e.doInMarket(marketID, func(handler *MarketHandler) {
+		snapshot = handler.orderbook.SnapshotV2()
+		snapshot.Sequence = handler.orderbook.Sequence
+	})
+
+	return
+}
+
+// OrderbookL3 returns copies of all orders of the market
+func (e *Engine) OrderbookL3(marketID string) (book *OrderbookL3, err error) {
+	err = e.doInMarket(marketID, func(handler *MarketHandler) {
+		book = &OrderbookL3{
+			Sequence: handler.orderbook.Sequence,
+			Bids:     copyOrders(handler.orderbook.Orders("buy")),
+			Asks:     copyOrders(handler.orderbook.Orders("sell")),
+		}
+	})
+
+	return
+}
+
+// FindOrder looks for the order in the book of its market and returns a copy of it.
+// The market of the order comes from the order store, without one the books of all markets are searched.
+func (e *Engine) FindOrder(orderID string) (order *common.MemoryOrder, exist bool) {
+	if e.orderStore == nil {
+		return e.findOrderInAllMarkets(orderID)
+	}
+
+	state, err := e.orderStore.GetOrderState(orderID)
+	if err != nil {
+		if err != ErrOrderNotFound {
+			utils.Errorf("load state of order %s error: %v", orderID, err)
+		}
+
+		return nil, false
+	}
+
+	_ = e.doInMarket(state.MarketID, func(handler *MarketHandler) {
+		order, exist = findBookOrder(handler, orderID)
+	})
+
+	return
+}
+
+func (e *Engine) findOrderInAllMarkets(orderID string) (order *common.MemoryOrder, exist bool) {
+	var lock sync.Mutex
+
+	e.doInAllMarkets(func(handler *MarketHandler) {
+		if o, found := findBookOrder(handler, orderID); found {
+			lock.Lock()
+			order, exist = o, true
+			lock.Unlock()
+		}
+	})
+
+	return
+}
+
+// findBookOrder returns a copy of the order if it is in the book of the handler
+func findBookOrder(handler *MarketHandler, orderID string) (*common.MemoryOrder, bool) {
+	for _, side := range []string{"buy", "sell"} {
+		for _, bookOrder := range handler.orderbook.Orders(side) {
+			if bookOrder.ID == orderID {
+				o := *bookOrder
+				return &o, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// AuditMarket checks invariants of the book of the market, see common.Orderbook.Audit
+func (e *Engine) AuditMarket(marketID string) (problems []string, err error) {
+	err = e.doInMarket(marketID, func(handler *MarketHandler) {
+		problems = handler.orderbook.Audit()
+	})
+
+	return
+}
+
+func (e *Engine) doInMarket(marketID string, fn func(handler *MarketHandler)) error {
+	handler := e.getMarketHandler(marketID)
+	if handler == nil {
+		return ErrUnknownMarket
+	}
+
+	return handler.do(func() {
+		fn(handler)
+	})
+}
@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"time"
+)
+
+type MarketState string
+
+const (
+	// new orders are rejected, cancels are accepted
+	MarketStatePreOpen MarketState = "preOpen"
+	// new orders and cancels are accepted
+	MarketStateOpen MarketState = "open"
+	// the book is frozen, new orders and cancels are rejected
+	MarketStateHalted MarketState = "halted"
+	// new orders are rejected, cancels are accepted
+	MarketStateCancelOnly MarketState = "cancelOnly"
+	// new orders are rejected, cancels of remaining orders are accepted
+	MarketStateClosed MarketState = "closed"
+)
+
+func (state MarketState) valid() bool {
+	switch state {
+	case MarketStatePreOpen, MarketStateOpen, MarketStateHalted, MarketStateCancelOnly, MarketStateClosed:
+		return true
+	default:
+		return false
+	}
+}
+
+// newOrderError returns the reason why a new order is rejected in this state
+func (state MarketState) newOrderError() error {
+	switch state {
+	case MarketStateOpen:
+		return nil
+	case MarketStatePreOpen:
+		return ErrMarketPreOpen
+	case MarketStateHalted:
+		return ErrMarketHalted
+	case MarketStateCancelOnly:
+		return ErrMarketCancelOnly
+	default:
+		return ErrMarketClosed
+	}
+}
+
+func (state MarketState) acceptCancel() bool {
+	return state != MarketStateHalted
+}
+
+// OpenMarket creates the market if it doesn't exist, and starts accepting new orders
+func (e *Engine) OpenMarket(marketID string) error {
+	return e.SetMarketState(marketID, MarketStateOpen)
+}
+
+// HaltMarket freezes the book of the market
+func (e *Engine) HaltMarket(marketID string) error {
+	return e.SetMarketState(marketID, MarketStateHalted)
+}
+
+// ResumeMarket starts accepting new orders again after the market was halted or cancel-only
+func (e *Engine) ResumeMarket(marketID string) error {
+	return e.SetMarketState(marketID, MarketStateOpen)
+}
+
+// SetMarketCancelOnly stops accepting new orders, remaining orders can still be canceled
+func (e *Engine) SetMarketCancelOnly(marketID string) error {
+	return e.SetMarketState(marketID, MarketStateCancelOnly)
+}
+
+// SetMarketState changes the state of the market.
+// A market is created if it doesn't exist and the new state is pre-open or open.
+func (e *Engine) SetMarketState(marketID string, state MarketState) (err error) {
+	if !state.valid() {
+		return fmt.Errorf("invalid market state %q", state)
+	}
+
+	if err = e.checkLeader(); err != nil {
+		return
+	}
+
+	var handler *MarketHandler
+	if state == MarketStatePreOpen || state == MarketStateOpen {
+		handler = e.getOrCreateMarketHandler(marketID)
+	} else {
+		handler = e.getMarketHandler(marketID)
+	}
+
+	if handler == nil {
+		return ErrUnknownMarket
+	}
+
+	return handler.do(func() {
+		e.setMarketState(handler, state, false)
+	})
+}
+
+// CloseMarket stops accepting new orders.
+// If cancelOrders is true, all remaining orders are canceled, and the messages of these cancels are broadcast.
+func (e *Engine) CloseMarket(marketID string, cancelOrders bool) (canceledOrders []*common.MemoryOrder, msgs []common.WebSocketMessage, err error) {
+	if err = e.checkLeader(); err != nil {
+		return
+	}
+
+	handler := e.getMarketHandler(marketID)
+	if handler == nil {
+		return nil, nil, ErrUnknownMarket
+	}
+
+	if err = handler.do(func() {
+		canceledOrders, msgs = e.setMarketState(handler, MarketStateClosed, cancelOrders)
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	return
+}
+
+// GetMarketState returns the state of the market, false if the market doesn't exist
+func (e *Engine) GetMarketState(marketID string) (state MarketState, exist bool) {
+	handler := e.getMarketHandler(marketID)
+	if handler == nil {
+		return "", false
+	}
+
+	if err := handler.do(func() {
+		state = handler.state
+	}); err != nil {
+		return "", false
+	}
+
+	return state, true
+}
+
+func (e *Engine) setMarketState(handler *MarketHandler, state MarketState, cancelOrders bool) (canceledOrders []*common.MemoryOrder, msgs []common.WebSocketMessage) {
+	if handler.state == state && !cancelOrders {
+		return
+	}
+
+	now := uint64(time.Now().Unix())
+	if e.journalCommand(handler, &JournalCommand{
+		Type:         JournalSetMarketState,
+		MarketID:     handler.market,
+		Timestamp:    now,
+		State:        state,
+		CancelOrders: cancelOrders,
+	}) != nil {
+		return
+	}
+
+	canceledOrders, msgs = handler.setState(state, cancelOrders)
+	e.syncLockedAmounts(handler, canceledOrders...)
+	e.trackOrders(handler, true, now, canceledOrders...)
+	e.fillAccountMessages(handler, msgs)
+
+	if len(canceledOrders) > 0 {
+		e.triggerOrderbookSnapshotHandlerIfNotNil(handler)
+		e.triggerOrderbookActivityHandlerIfNotNil(handler, msgs)
+	}
+
+	return
+}
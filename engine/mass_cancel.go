@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"github.com/shopspring/decimal"
+	"sync"
+	"time"
+)
+
+// CancelFilter selects the orders canceled by CancelOrders, empty fields match all orders
+type CancelFilter struct {
+	MarketID string
+	Trader   string
+	Side     string
+
+	// MinPrice and MaxPrice are inclusive
+	MinPrice *decimal.Decimal
+	MaxPrice *decimal.Decimal
+}
+
+func (f *CancelFilter) match(order *common.MemoryOrder) bool {
+	switch {
+	case f.Trader != "" && order.Trader != f.Trader:
+		return false
+	case f.MinPrice != nil && order.Price.LessThan(*f.MinPrice):
+		return false
+	case f.MaxPrice != nil && order.Price.GreaterThan(*f.MaxPrice):
+		return false
+	default:
+		return true
+	}
+}
+
+func (f *CancelFilter) sides() []string {
+	if f.Side != "" {
+		return []string{f.Side}
+	}
+
+	return []string{"buy", "sell"}
+}
+
+// CancelOrders cancels every order matching the filter, each market is handled in a single command.
+// The messages contain one orderbook change for each canceled order, and the book snapshot is published once per market.
+// Without a MarketID, all markets are searched and halted markets are skipped.
+func (e *Engine) CancelOrders(filter *CancelFilter) (canceledOrders []*common.MemoryOrder, msgs []common.WebSocketMessage, err error) {
+	if filter.Side != "" && filter.Side != "buy" && filter.Side != "sell" {
+		return nil, nil, fmt.Errorf("invalid side %q", filter.Side)
+	}
+
+	if err = e.checkLeader(); err != nil {
+		return
+	}
+
+	if filter.MarketID != "" {
+		handler := e.getMarketHandler(filter.MarketID)
+		if handler == nil {
+			return nil, nil, ErrUnknownMarket
+		}
+
+		if doErr := handler.do(func() {
+			canceledOrders, msgs, err = e.cancelOrders(handler, filter)
+		}); doErr != nil {
+			return nil, nil, doErr
+		}
+
+		return
+	}
+
+	var lock sync.Mutex
+
+	e.doInAllMarkets(func(handler *MarketHandler) {
+		orders, marketMsgs, cancelErr := e.cancelOrders(handler, filter)
+		if cancelErr != nil {
+			// orders canceled before a failed journal write are still returned
+			utils.Infof("market %s is skipped by mass cancel: %v", handler.market, cancelErr)
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		canceledOrders = append(canceledOrders, orders...)
+		msgs = append(msgs, marketMsgs...)
+	})
+
+	return
+}
+
+func (e *Engine) cancelOrders(handler *MarketHandler, filter *CancelFilter) (canceledOrders []*common.MemoryOrder, msgs []common.WebSocketMessage, err error) {
+	if !handler.state.acceptCancel() {
+		return nil, nil, ErrMarketHalted
+	}
+
+	var orders []*common.MemoryOrder
+	for _, side := range filter.sides() {
+		for _, order := range handler.orderbook.Orders(side) {
+			if filter.match(order) {
+				orders = append(orders, order)
+			}
+		}
+	}
+
+	if len(orders) == 0 {
+		return
+	}
+
+	now := uint64(time.Now().Unix())
+	for i, order := range orders {
+		if err = e.journalCommand(handler, &JournalCommand{
+			Type:      JournalCancelOrder,
+			MarketID:  handler.market,
+			Timestamp: now,
+			Order:     order,
+		}); err != nil {
+			// only the journaled cancels are applied
+			orders = orders[:i]
+			break
+		}
+	}
+
+	if len(orders) == 0 {
+		return
+	}
+
+	canceledOrders, msgs = handler.cancelOrders(orders)
+
+	e.syncLockedAmounts(handler, canceledOrders...)
+	e.trackOrders(handler, true, now, canceledOrders...)
+	e.fillAccountMessages(handler, msgs)
+
+	e.triggerOrderbookSnapshotHandlerIfNotNil(handler)
+
+	return
+}
+
+// cancelOrders removes the orders from the book.
+// Each removal has its own orderbook change with the sequence after it, so consumers see no gap.
+func (m *MarketHandler) cancelOrders(orders []*common.MemoryOrder) (canceledOrders []*common.MemoryOrder, msgs []common.WebSocketMessage) {
+	for _, order := range orders {
+		e, err := m.removeOrder(order)
+		if err != nil {
+			panic(fmt.Errorf("remove order %s from book %s error: %v", order.ID, m.market, err))
+		}
+
+		canceledOrders = append(canceledOrders, order)
+		msgs = append(msgs, common.OrderbookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount))
+	}
+
+	// one locked balance message for each trader and symbol is enough
+	balances := make(map[string]bool)
+	for _, order := range canceledOrders {
+		for _, msg := range common.MessagesForUpdateOrder(order) {
+			if payload, ok := msg.Payload.(*common.WebsocketLockedBalanceChangePayload); ok {
+				key := msg.ChannelID + "#" + payload.Symbol
+				if balances[key] {
+					continue
+				}
+
+				balances[key] = true
+			}
+
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return
+}
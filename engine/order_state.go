@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"context"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"github.com/shopspring/decimal"
+	"sync"
+)
+
+// OrderStore persists order states. SaveOrderState is called through the handler dispatcher,
+// so it is retried and ordered as configured by HandlerConfig.
+type OrderStore interface {
+	SaveOrderState(ctx context.Context, state *common.OrderState) error
+
+	// GetOrderState returns ErrOrderNotFound if the order is unknown
+	GetOrderState(orderID string) (*common.OrderState, error)
+}
+
+// MemoryOrderStore keeps all order states in memory
+type MemoryOrderStore struct {
+	lock   sync.RWMutex
+	states map[string]*common.OrderState
+}
+
+func NewMemoryOrderStore() *MemoryOrderStore {
+	return &MemoryOrderStore{states: make(map[string]*common.OrderState)}
+}
+
+func (s *MemoryOrderStore) SaveOrderState(ctx context.Context, state *common.OrderState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.states[state.OrderID] = state.Copy()
+
+	return nil
+}
+
+func (s *MemoryOrderStore) GetOrderState(orderID string) (*common.OrderState, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	state, exist := s.states[orderID]
+	if !exist {
+		return nil, ErrOrderNotFound
+	}
+
+	return state.Copy(), nil
+}
+
+// UseOrderStore makes the engine track states of orders and fill them into orderChange messages.
+// It should be called before any order is handled.
+func (e *Engine) UseOrderStore(store OrderStore) {
+	e.orderStore = store
+}
+
+// GetOrderState returns the state of the order from the order store
+func (e *Engine) GetOrderState(orderID string) (*common.OrderState, error) {
+	if e.orderStore == nil {
+		return nil, ErrOrderStoreNotEnabled
+	}
+
+	return e.orderStore.GetOrderState(orderID)
+}
+
+// orderStates keeps states of the orders in the book of one market, it is owned by the market goroutine.
+// Orders finished by a command stay until the command is done, so its messages can carry their final states.
+type orderStates struct {
+	states   map[string]*common.OrderState
+	finished []string
+}
+
+func newOrderStates() *orderStates {
+	return &orderStates{states: make(map[string]*common.OrderState)}
+}
+
+// prune drops states of finished orders, it is called after each command
+func (s *orderStates) prune() {
+	for _, id := range s.finished {
+		if state, exist := s.states[id]; exist && state.IsDone() {
+			delete(s.states, id)
+		}
+	}
+
+	s.finished = s.finished[:0]
+}
+
+// orderState returns the state of the order, it is loaded from the store or created if the order is not in the book
+func (e *Engine) orderState(handler *MarketHandler, order *common.MemoryOrder, now uint64) *common.OrderState {
+	if state, exist := handler.orderStates.states[order.ID]; exist {
+		return state
+	}
+
+	state, err := e.orderStore.GetOrderState(order.ID)
+	if err != nil {
+		if err != ErrOrderNotFound {
+			utils.Errorf("load state of order %s error: %v", order.ID, err)
+		}
+
+		state = common.NewOrderState(order, now)
+	}
+
+	handler.orderStates.states[order.ID] = state
+
+	return state
+}
+
+// trackNewOrder creates the state of a new order before it is matched
+func (e *Engine) trackNewOrder(handler *MarketHandler, order *common.MemoryOrder, now uint64) {
+	if e.orderStore == nil {
+		return
+	}
+
+	handler.orderStates.states[order.ID] = common.NewOrderState(order, now)
+}
+
+// trackFill records a fill of the taker and the maker at the maker price, a negative amount takes it back
+func (e *Engine) trackFill(handler *MarketHandler, taker, maker *common.MemoryOrder, amount decimal.Decimal, now uint64) {
+	if e.orderStore == nil {
+		return
+	}
+
+	e.orderState(handler, taker, now).Fill(amount, maker.Price, now)
+	e.orderState(handler, maker, now).Fill(amount, maker.Price, now)
+}
+
+// trackOrders updates statuses of orders changed by a command and saves them, canceled is true if they are removed by a cancel or expiry
+func (e *Engine) trackOrders(handler *MarketHandler, canceled bool, now uint64, orders ...*common.MemoryOrder) {
+	if e.orderStore == nil {
+		return
+	}
+
+	for _, order := range orders {
+		if order == nil {
+			continue
+		}
+
+		bookOrder, exist := handler.orderbook.GetOrder(order.ID, order.Side, order.Price)
+		resting := exist && bookOrder == order
+
+		state := e.orderState(handler, order, now)
+		state.Update(order, resting, canceled, now)
+
+		if !resting {
+			handler.orderStates.finished = append(handler.orderStates.finished, order.ID)
+		}
+
+		e.triggerOrderStoreIfNotNil(handler, state.Copy())
+	}
+}
+
+func (e *Engine) triggerOrderStoreIfNotNil(handler *MarketHandler, state *common.OrderState) {
+	if e.orderStore != nil && !e.replaying {
+		handler.dispatcher.dispatch("order store", func(ctx context.Context) error {
+			return e.orderStore.SaveOrderState(ctx, state)
+		})
+	}
+}
+
+// restoreOrderStates loads states of all orders in the book after recovery
+func (e *Engine) restoreOrderStates(handler *MarketHandler, now uint64) {
+	if e.orderStore == nil {
+		return
+	}
+
+	handler.orderStates = newOrderStates()
+
+	for _, side := range []string{"buy", "sell"} {
+		for _, order := range handler.orderbook.Orders(side) {
+			e.orderState(handler, order, now).Update(order, true, false, now)
+		}
+	}
+}
+
+// fillOrderStates sets states of orderChange messages to copies of the current states
+func (e *Engine) fillOrderStates(handler *MarketHandler, msgs []common.WebSocketMessage) {
+	if e.orderStore == nil {
+		return
+	}
+
+	for _, msg := range msgs {
+		payload, ok := msg.Payload.(*common.WebsocketOrderChangePayload)
+		if !ok {
+			continue
+		}
+
+		order, ok := payload.Order.(*common.MemoryOrder)
+		if !ok {
+			continue
+		}
+
+		if state, exist := handler.orderStates.states[order.ID]; exist {
+			payload.State = state.Copy()
+		}
+	}
+}
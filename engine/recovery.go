@@ -0,0 +1,424 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UseJournal makes the engine write every accepted command to the journal ahead of applying it.
+// It should be called before any order is handled, usually followed by Recover.
+func (e *Engine) UseJournal(journal *Journal) {
+	e.journal = journal
+}
+
+// Recover loads the latest checkpoint of the journal and replays the commands after it,
+// so that books, priorities and sequences are the same as before the engine stopped.
+// Registered handlers are not triggered during replay, a snapshot of each market is published at the end.
+func (e *Engine) Recover() error {
+	if e.journal == nil {
+		return ErrJournalNotEnabled
+	}
+
+	checkpoint, err := e.journal.LoadCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	e.replaying = true
+
+	marketJournalIndexes, err := e.restoreCheckpoint(checkpoint)
+	if err != nil {
+		e.replaying = false
+		return err
+	}
+
+	fromIndex := uint64(1)
+	if checkpoint != nil {
+		fromIndex = checkpoint.Index + 1
+	}
+
+	var replayed int
+	err = e.journal.Replay(fromIndex, func(cmd *JournalCommand) error {
+		if index, exist := marketJournalIndexes[cmd.MarketID]; exist && cmd.Index <= index {
+			return nil
+		}
+
+		replayed = replayed + 1
+		return e.applyJournalCommand(cmd)
+	})
+
+	// wait for the last replayed command of each market before turning handlers on
+	e.doInAllMarkets(func(*MarketHandler) {})
+	e.replaying = false
+
+	if err != nil {
+		return err
+	}
+
+	e.rebuildDerivedState()
+
+	utils.Infof("Engine recovered from journal, checkpoint: %v, replayed commands: %d", checkpoint != nil, replayed)
+
+	return nil
+}
+
+// Restart drops every book and rebuilds it from the latest checkpoint and the journal, as Recover does,
+// e.g. after a market panicked and its book is suspected to be wrong.
+// Each market is rebuilt in its own goroutine, commands queued behind the rebuild are applied to the rebuilt book.
+// Registered handlers are not triggered for replayed commands, a snapshot of each market is published at the end.
+func (e *Engine) Restart() error {
+	if err := e.checkLeader(); err != nil {
+		return err
+	}
+
+	if e.journal == nil {
+		return ErrJournalNotEnabled
+	}
+
+	// checkpoints must not remove segments which are being replayed
+	e.checkpointLock.Lock()
+	defer e.checkpointLock.Unlock()
+
+	checkpoint, err := e.journal.LoadCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	marketCheckpoints := make(map[string]*MarketCheckpoint)
+	fromIndex := uint64(1)
+
+	if checkpoint != nil {
+		fromIndex = checkpoint.Index + 1
+
+		for _, marketCheckpoint := range checkpoint.Markets {
+			marketCheckpoints[marketCheckpoint.MarketID] = marketCheckpoint
+		}
+	}
+
+	var lock sync.Mutex
+	var errs []error
+
+	e.doInAllMarkets(func(handler *MarketHandler) {
+		if err := e.rebuildMarket(handler, marketCheckpoints[handler.market], fromIndex); err != nil {
+			lock.Lock()
+			defer lock.Unlock()
+
+			errs = append(errs, err)
+		}
+	})
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	e.rebuildDerivedState()
+
+	utils.Infof("Engine restarted from journal, checkpoint: %v", checkpoint != nil)
+
+	return nil
+}
+
+// rebuildMarket runs in the market goroutine, so no command of the market is journaled meanwhile.
+// Commands of other markets are appended concurrently, the replay stops at the last command written before it starts.
+func (e *Engine) rebuildMarket(handler *MarketHandler, marketCheckpoint *MarketCheckpoint, fromIndex uint64) error {
+	lastIndex := e.journal.LastIndex()
+	handler.reset()
+
+	var marketJournalIndex uint64
+
+	if marketCheckpoint != nil {
+		if err := handler.restoreCheckpoint(marketCheckpoint); err != nil {
+			return err
+		}
+
+		marketJournalIndex = marketCheckpoint.JournalIndex
+	}
+
+	if lastIndex < fromIndex {
+		return nil
+	}
+
+	err := e.journal.Replay(fromIndex, func(cmd *JournalCommand) error {
+		if cmd.MarketID == handler.market && cmd.Index > marketJournalIndex {
+			if err := handler.applyJournalCommand(cmd); err != nil {
+				return err
+			}
+		}
+
+		if cmd.Index >= lastIndex {
+			return errReplayStopped
+		}
+
+		return nil
+	})
+
+	if err == errReplayStopped {
+		return nil
+	}
+
+	return err
+}
+
+// Checkpoint saves a copy of all books to the journal, older journal segments are removed
+func (e *Engine) Checkpoint() error {
+	// a fenced leader must not remove segments written by the new leader
+	if err := e.checkLeader(); err != nil {
+		return err
+	}
+
+	if e.journal == nil {
+		return ErrJournalNotEnabled
+	}
+
+	e.checkpointLock.Lock()
+	defer e.checkpointLock.Unlock()
+
+	// Commands are journaled and applied in their market goroutine,
+	// so when a market is copied, all its journaled commands are applied.
+	checkpoint := &Checkpoint{
+		Index:   e.journal.LastIndex(),
+		Markets: make([]*MarketCheckpoint, 0),
+	}
+
+	var lock sync.Mutex
+
+	e.doInAllMarkets(func(handler *MarketHandler) {
+		marketCheckpoint := &MarketCheckpoint{
+			MarketID:     handler.market,
+			State:        handler.state,
+			Sequence:     handler.orderbook.Sequence,
+			JournalIndex: e.journal.LastIndex(),
+			Bids:         copyOrders(handler.orderbook.Orders("buy")),
+			Asks:         copyOrders(handler.orderbook.Orders("sell")),
+		}
+
+		if handler.settlements != nil {
+			marketCheckpoint.SettlementSequence = handler.settlements.sequence
+
+			for _, settlement := range handler.settlements.list() {
+				marketCheckpoint.Settlements = append(marketCheckpoint.Settlements, copySettlement(settlement))
+			}
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		checkpoint.Markets = append(checkpoint.Markets, marketCheckpoint)
+	})
+
+	sort.Slice(checkpoint.Markets, func(i, j int) bool {
+		return checkpoint.Markets[i].MarketID < checkpoint.Markets[j].MarketID
+	})
+
+	return e.journal.SaveCheckpoint(checkpoint)
+}
+
+// StartCheckpoints saves a checkpoint every interval until the engine ctx is canceled
+func (e *Engine) StartCheckpoints(interval time.Duration) {
+	e.Wg.Add(1)
+
+	go func() {
+		defer e.Wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-e.ctx.Done():
+				return
+			case <-ticker.C:
+				if e.Role() != RoleLeader {
+					continue
+				}
+
+				if err := e.Checkpoint(); err != nil {
+					utils.Errorf("save engine checkpoint error: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// restoreCheckpoint restores all markets of the checkpoint, which may be nil.
+// It returns the journal index of each market, commands of a market up to its index are included in the checkpoint.
+func (e *Engine) restoreCheckpoint(checkpoint *Checkpoint) (map[string]uint64, error) {
+	marketJournalIndexes := make(map[string]uint64)
+
+	if checkpoint == nil {
+		return marketJournalIndexes, nil
+	}
+
+	for _, marketCheckpoint := range checkpoint.Markets {
+		if err := e.restoreMarket(marketCheckpoint); err != nil {
+			return nil, err
+		}
+
+		marketJournalIndexes[marketCheckpoint.MarketID] = marketCheckpoint.JournalIndex
+	}
+
+	return marketJournalIndexes, nil
+}
+
+// rebuildDerivedState rebuilds what is not journaled from the books, after commands are replayed
+func (e *Engine) rebuildDerivedState() {
+	e.lockedBalances.reset()
+	if e.risk != nil {
+		e.risk.reset()
+	}
+
+	e.doInAllMarkets(func(handler *MarketHandler) {
+		if handler.limiter != nil {
+			handler.limiter.reset()
+		}
+
+		e.restoreOrderStates(handler, uint64(time.Now().Unix()))
+		e.syncLockedAmounts(handler, handler.orderbook.Orders("buy")...)
+		e.syncLockedAmounts(handler, handler.orderbook.Orders("sell")...)
+
+		if e.risk != nil && handler.settlements != nil {
+			for _, settlement := range handler.settlements.list() {
+				e.risk.lockSettlement(settlement)
+			}
+		}
+		e.triggerOrderbookSnapshotHandlerIfNotNil(handler)
+	})
+}
+
+func (e *Engine) restoreMarket(marketCheckpoint *MarketCheckpoint) (err error) {
+	handler := e.getOrCreateMarketHandler(marketCheckpoint.MarketID)
+
+	if doErr := handler.do(func() {
+		err = handler.restoreCheckpoint(marketCheckpoint)
+	}); doErr != nil {
+		return doErr
+	}
+
+	return
+}
+
+// restoreCheckpoint puts the orders and pending settlements of the checkpoint into the empty book
+func (m *MarketHandler) restoreCheckpoint(marketCheckpoint *MarketCheckpoint) error {
+	for _, orders := range [][]*common.MemoryOrder{marketCheckpoint.Bids, marketCheckpoint.Asks} {
+		for _, order := range orders {
+			if _, err := m.insertOrder(order); err != nil {
+				return fmt.Errorf("restore order %s of market %s error: %v", order.ID, m.market, err)
+			}
+		}
+	}
+
+	m.orderbook.Sequence = marketCheckpoint.Sequence
+	m.state = marketCheckpoint.State
+
+	if m.settlements != nil {
+		m.settlements.sequence = marketCheckpoint.SettlementSequence
+		m.restoreSettlements(marketCheckpoint.Settlements)
+	}
+
+	return nil
+}
+
+func (e *Engine) applyJournalCommand(cmd *JournalCommand) error {
+	handler := e.getOrCreateMarketHandler(cmd.MarketID)
+
+	var err error
+
+	doErr := handler.do(func() {
+		err = handler.applyJournalCommand(cmd)
+	})
+
+	// a command which panicked when it was accepted panics again, the halt of the market follows it in the journal
+	if doErr != nil && doErr != ErrMarketPanicked {
+		return doErr
+	}
+
+	return err
+}
+
+// applyJournalCommand applies the command to the book without journaling it or triggering handlers
+func (m *MarketHandler) applyJournalCommand(cmd *JournalCommand) (err error) {
+	switch cmd.Type {
+	case JournalNewOrder:
+		m.handleNewOrder(cmd.Order, cmd.Timestamp)
+	case JournalReInsertOrder:
+		_, err = m.insertOrder(cmd.Order)
+	case JournalCancelOrder:
+		if bookOrder, exist := m.orderbook.GetOrder(cmd.Order.ID, cmd.Order.Side, cmd.Order.Price); exist {
+			_, err = m.handleCancelOrder(bookOrder)
+		}
+	case JournalExpireOrders:
+		m.handleExpireOrders(cmd.Timestamp)
+	case JournalSetMarketState:
+		m.setState(cmd.State, cmd.CancelOrders)
+	case JournalBindTransaction:
+		if m.settlements == nil {
+			break
+		}
+
+		if settlement, exist := m.settlements.pending[cmd.MatchID]; exist {
+			m.bindTransaction(settlement, cmd.TransactionHash)
+		}
+	case JournalConfirmTransaction:
+		if m.settlements == nil {
+			break
+		}
+
+		if settlement, exist := m.settlements.getByHash(cmd.TransactionHash); exist {
+			m.confirmTransaction(settlement, cmd.TransactionStatus, cmd.Timestamp)
+		}
+	case JournalExpireSettlement:
+		if m.settlements == nil {
+			break
+		}
+
+		if settlement, exist := m.settlements.pending[cmd.MatchID]; exist {
+			m.confirmTransaction(settlement, common.STATUS_FAILED, cmd.Timestamp)
+		}
+	default:
+		err = fmt.Errorf("unknown journal command type %q at index %d", cmd.Type, cmd.Index)
+	}
+
+	return
+}
+
+// journalCommand writes the command ahead of applying it, a command which is not journaled must not be applied.
+// Leadership is checked again right before the write, since it may be lost while the command waits in the market inbox.
+// The engine can't promise recovery of the market after a failed write, so the market is halted,
+// without journaling the halt, and stays halted until the journal is fixed and the engine is restarted.
+func (e *Engine) journalCommand(handler *MarketHandler, cmd *JournalCommand) error {
+	if e.journal == nil || e.replaying {
+		return nil
+	}
+
+	if err := e.checkLeader(); err != nil {
+		utils.Errorf("%s command of market %s is rejected: %v", cmd.Type, handler.market, err)
+		return err
+	}
+
+	if _, err := e.journal.Append(cmd); err != nil {
+		utils.Errorf("write journal of market %s error: %v, halt the market", handler.market, err)
+		handler.setState(MarketStateHalted, false)
+
+		return ErrJournalWriteFailed
+	}
+
+	return nil
+}
+
+var errReplayStopped = errors.New("replay stopped")
+
+func copyOrders(orders []*common.MemoryOrder) []*common.MemoryOrder {
+	res := make([]*common.MemoryOrder, 0, len(orders))
+
+	for _, order := range orders {
+		o := *order
+		res = append(res, &o)
+	}
+
+	return res
+}
@@ -0,0 +1,583 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReplicaRole is the role of an engine in replication.
+// An engine which is not replicated is a leader without a lease.
+type ReplicaRole int32
+
+const (
+	RoleLeader ReplicaRole = iota
+	RoleFollower
+	// RoleFenced is a leader which lost its lease, or a replica which failed to follow.
+	// It accepts no commands until the process is restarted.
+	RoleFenced
+)
+
+func (r ReplicaRole) String() string {
+	switch r {
+	case RoleLeader:
+		return "leader"
+	case RoleFollower:
+		return "follower"
+	case RoleFenced:
+		return "fenced"
+	default:
+		return "unknown"
+	}
+}
+
+func (r ReplicaRole) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+const (
+	DefaultLeaseTTL              = 3 * time.Second
+	DefaultReplicaPollInterval   = 20 * time.Millisecond
+	leaseLastIndexKeySuffix      = ":lastIndex"
+	replicaLeaseRenewIntervalDiv = 3
+)
+
+type ReplicationConfig struct {
+	// Journal is the journal of the leader, on storage shared by all replicas.
+	// Followers read it, the promoted follower opens it for writing.
+	Journal *JournalConfig
+
+	// Store holds the lease under LeaseKey, the value is the NodeID of the leader
+	Store    common.IKVStore
+	LeaseKey string
+	NodeID   string
+	LeaseTTL time.Duration
+
+	// PollInterval is how often followers look for new commands
+	PollInterval time.Duration
+
+	// OnPromoted is called after the engine becomes the leader, e.g. to start the order expiry and checkpoints
+	OnPromoted func()
+}
+
+// ReplicationStatus shows how far a follower is behind the leader.
+// LeaderIndex is the last journal index published by the leader with its lease.
+type ReplicationStatus struct {
+	Role          ReplicaRole `json:"role"`
+	NodeID        string      `json:"nodeID"`
+	AppliedIndex  uint64      `json:"appliedIndex"`
+	LeaderIndex   uint64      `json:"leaderIndex"`
+	Lag           uint64      `json:"lag"`
+	LastAppliedAt time.Time   `json:"lastAppliedAt"`
+	Error         string      `json:"error,omitempty"`
+}
+
+// StartReplication starts the engine as a follower of the leader writing config.Journal.
+// It restores the latest checkpoint, then applies each command the leader appends, with handlers turned off,
+// so books and sequences stay identical to the leader.
+// Once the lease is free, the follower takes it, applies the rest of the journal, opens it and becomes the leader.
+//
+// A leader stops accepting commands half a lease before its lease expires, unless it is renewed,
+// so the old leader has stopped writing when a follower can take over.
+// It should be called instead of UseJournal and Recover, before any order is handled.
+func (e *Engine) StartReplication(config *ReplicationConfig) error {
+	if config.Journal == nil || config.Store == nil || config.LeaseKey == "" || config.NodeID == "" {
+		return fmt.Errorf("journal, store, lease key and node id are required for replication")
+	}
+
+	c := *config
+	if c.LeaseTTL <= 0 {
+		c.LeaseTTL = DefaultLeaseTTL
+	}
+
+	if c.PollInterval <= 0 {
+		c.PollInterval = DefaultReplicaPollInterval
+	}
+
+	if err := os.MkdirAll(c.Journal.Dir, 0755); err != nil {
+		return err
+	}
+
+	r := &replica{
+		engine: e,
+		config: &c,
+		tail:   newJournalTail(c.Journal.Dir),
+		lease:  &lease{store: c.Store, key: c.LeaseKey, holder: c.NodeID, ttl: c.LeaseTTL},
+	}
+
+	e.replica = r
+	e.setRole(RoleFollower)
+	e.replaying = true
+
+	if err := r.restore(); err != nil {
+		e.replaying = false
+		return err
+	}
+
+	e.Wg.Add(1)
+	go r.run()
+
+	return nil
+}
+
+// ReplicationStatus returns nil if the engine is not replicated
+func (e *Engine) ReplicationStatus() *ReplicationStatus {
+	if e.replica == nil {
+		return nil
+	}
+
+	return e.replica.status()
+}
+
+// Role returns the replica role of the engine
+func (e *Engine) Role() ReplicaRole {
+	return ReplicaRole(atomic.LoadInt32(&e.role))
+}
+
+func (e *Engine) setRole(role ReplicaRole) {
+	atomic.StoreInt32(&e.role, int32(role))
+}
+
+// checkLeader returns ErrNotLeader if the engine must not accept commands
+func (e *Engine) checkLeader() error {
+	if e.Role() != RoleLeader {
+		return ErrNotLeader
+	}
+
+	if deadline := atomic.LoadInt64(&e.leaseDeadline); deadline > 0 && time.Now().UnixNano() > deadline {
+		return ErrNotLeader
+	}
+
+	return nil
+}
+
+type replica struct {
+	engine *Engine
+	config *ReplicationConfig
+	tail   *journalTail
+	lease  *lease
+
+	// marketJournalIndexes are the journal indexes of markets in the restored checkpoint
+	marketJournalIndexes map[string]uint64
+
+	lock          sync.Mutex
+	appliedIndex  uint64
+	leaderIndex   uint64
+	lastAppliedAt time.Time
+	err           error
+}
+
+func (r *replica) status() *ReplicationStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	status := &ReplicationStatus{
+		Role:          r.engine.Role(),
+		NodeID:        r.config.NodeID,
+		AppliedIndex:  r.appliedIndex,
+		LeaderIndex:   r.leaderIndex,
+		LastAppliedAt: r.lastAppliedAt,
+	}
+
+	if status.Role != RoleFollower {
+		status.LeaderIndex = status.AppliedIndex
+	} else if status.LeaderIndex > status.AppliedIndex {
+		status.Lag = status.LeaderIndex - status.AppliedIndex
+	}
+
+	if r.err != nil {
+		status.Error = r.err.Error()
+	}
+
+	return status
+}
+
+// restore loads the latest checkpoint of the leader
+func (r *replica) restore() error {
+	checkpoint, err := r.tail.journal.LoadCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	r.marketJournalIndexes, err = r.engine.restoreCheckpoint(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	if checkpoint != nil {
+		r.appliedIndex = checkpoint.Index
+	}
+
+	r.tail.fromIndex = r.appliedIndex + 1
+
+	utils.Infof("Replica %s restored checkpoint at index %d", r.config.NodeID, r.appliedIndex)
+
+	return nil
+}
+
+func (r *replica) run() {
+	defer r.engine.Wg.Done()
+
+	poll := time.NewTicker(r.config.PollInterval)
+	defer poll.Stop()
+
+	leaseTicker := time.NewTicker(r.config.LeaseTTL / replicaLeaseRenewIntervalDiv)
+	defer leaseTicker.Stop()
+
+	for {
+		select {
+		case <-r.engine.ctx.Done():
+			return
+		case <-poll.C:
+			if r.engine.Role() != RoleFollower {
+				continue
+			}
+
+			if err := r.follow(); err != nil {
+				r.fail(err)
+				return
+			}
+		case <-leaseTicker.C:
+			var err error
+
+			switch r.engine.Role() {
+			case RoleFollower:
+				err = r.tryPromote()
+			case RoleLeader:
+				err = r.renew()
+			default:
+				return
+			}
+
+			if err != nil {
+				r.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// fail stops replication, the engine is fenced as it can't be trusted as a follower or a leader any more
+func (r *replica) fail(err error) {
+	utils.Errorf("replica %s stopped: %v", r.config.NodeID, err)
+
+	r.lock.Lock()
+	r.err = err
+	r.lock.Unlock()
+
+	r.engine.setRole(RoleFenced)
+}
+
+// follow applies the commands appended by the leader since the last poll
+func (r *replica) follow() error {
+	return r.tail.read(func(cmd *JournalCommand) error {
+		r.lock.Lock()
+		applied := r.appliedIndex
+		r.lock.Unlock()
+
+		if cmd.Index <= applied {
+			return nil
+		}
+
+		if cmd.Index != applied+1 {
+			return fmt.Errorf("journal command %d is missing, next command is %d", applied+1, cmd.Index)
+		}
+
+		if index, exist := r.marketJournalIndexes[cmd.MarketID]; !exist || cmd.Index > index {
+			if err := r.engine.applyJournalCommand(cmd); err != nil {
+				return err
+			}
+		}
+
+		r.lock.Lock()
+		r.appliedIndex = cmd.Index
+		r.lastAppliedAt = time.Now()
+		r.lock.Unlock()
+
+		return nil
+	})
+}
+
+func (r *replica) tryPromote() error {
+	holder, err := r.lease.holderOf()
+	if err != nil {
+		utils.Errorf("read lease %s error: %v", r.config.LeaseKey, err)
+		return nil
+	}
+
+	if holder != "" {
+		r.updateLeaderIndex()
+		return nil
+	}
+
+	deadline := time.Now().Add(r.config.LeaseTTL / 2)
+
+	acquired, err := r.lease.acquire()
+	if err != nil {
+		utils.Errorf("acquire lease %s error: %v", r.config.LeaseKey, err)
+		return nil
+	}
+
+	if !acquired {
+		return nil
+	}
+
+	return r.promote(deadline)
+}
+
+// promote turns the follower into the leader, the lease is held
+func (r *replica) promote(deadline time.Time) error {
+	e := r.engine
+
+	// the old leader stopped accepting commands before its lease expired, everything it journaled is on disk
+	if err := r.follow(); err != nil {
+		return err
+	}
+
+	journal, err := OpenJournal(r.config.Journal)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	applied := r.appliedIndex
+	r.lock.Unlock()
+
+	if journal.LastIndex() != applied {
+		_ = journal.Close()
+		return fmt.Errorf("journal ends at %d after promotion, but %d commands are applied", journal.LastIndex(), applied)
+	}
+
+	r.tail.close()
+
+	// wait for the last applied command of each market before turning journal and handlers on
+	e.doInAllMarkets(func(*MarketHandler) {})
+	e.journal = journal
+	e.replaying = false
+
+	e.rebuildDerivedState()
+
+	atomic.StoreInt64(&e.leaseDeadline, deadline.UnixNano())
+	e.setRole(RoleLeader)
+	r.publishLastIndex()
+
+	utils.Infof("Replica %s is promoted to leader at index %d", r.config.NodeID, applied)
+
+	if r.config.OnPromoted != nil {
+		r.config.OnPromoted()
+	}
+
+	return nil
+}
+
+// renew extends the lease of the leader, losing it fences the engine
+func (r *replica) renew() error {
+	deadline := time.Now().Add(r.config.LeaseTTL / 2)
+
+	renewed, err := r.lease.renew()
+	if err != nil {
+		// the engine stops accepting commands at the deadline, until the lease is renewed
+		utils.Errorf("renew lease %s error: %v", r.config.LeaseKey, err)
+		return nil
+	}
+
+	if !renewed {
+		return fmt.Errorf("lease %s is lost", r.config.LeaseKey)
+	}
+
+	atomic.StoreInt64(&r.engine.leaseDeadline, deadline.UnixNano())
+	r.publishLastIndex()
+
+	return nil
+}
+
+func (r *replica) publishLastIndex() {
+	index := r.engine.journal.LastIndex()
+
+	if err := r.config.Store.Set(r.config.LeaseKey+leaseLastIndexKeySuffix, strconv.FormatUint(index, 10), 0); err != nil {
+		utils.Errorf("publish journal index error: %v", err)
+	}
+
+	r.lock.Lock()
+	r.appliedIndex = index
+	r.lastAppliedAt = time.Now()
+	r.lock.Unlock()
+}
+
+func (r *replica) updateLeaderIndex() {
+	value, err := r.config.Store.Get(r.config.LeaseKey + leaseLastIndexKeySuffix)
+	if err != nil {
+		if err != common.KVStoreEmpty {
+			utils.Errorf("read journal index of leader error: %v", err)
+		}
+
+		return
+	}
+
+	index, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		utils.Errorf("invalid journal index of leader %q", value)
+		return
+	}
+
+	r.lock.Lock()
+	r.leaderIndex = index
+	r.lock.Unlock()
+}
+
+// lease is held by the node whose id is stored under key
+type lease struct {
+	store  common.IKVStore
+	key    string
+	holder string
+	ttl    time.Duration
+}
+
+// holderOf returns the id of the holder, empty if the lease is free
+func (l *lease) holderOf() (string, error) {
+	holder, err := l.store.Get(l.key)
+	if err == common.KVStoreEmpty {
+		return "", nil
+	}
+
+	return holder, err
+}
+
+func (l *lease) acquire() (bool, error) {
+	return l.store.SetNX(l.key, l.holder, l.ttl)
+}
+
+// renew returns false if the lease is held by another node or expired
+func (l *lease) renew() (bool, error) {
+	return l.store.CompareAndSwap(l.key, l.holder, l.holder, l.ttl)
+}
+
+// journalTail reads commands appended to a journal by another process.
+// Unlike OpenJournal, it never truncates the journal, a torn record at the tail is read again once it is complete.
+type journalTail struct {
+	// only for checkpoints, the log is read through its files
+	journal *Journal
+	log     *common.SegmentLogConfig
+
+	// fromIndex decides the first segment to read
+	fromIndex uint64
+
+	file    *os.File
+	segment uint64
+	offset  int64
+}
+
+func newJournalTail(dir string) *journalTail {
+	return &journalTail{journal: &Journal{config: &JournalConfig{Dir: dir}}, log: journalLogConfig(dir)}
+}
+
+// read calls fn with every complete command after the last one read.
+// The first read starts from the segment containing fromIndex, fn skips the commands before it.
+func (t *journalTail) read(fn func(cmd *JournalCommand) error) error {
+	for {
+		if t.file == nil {
+			segments, err := t.log.Segments()
+			if err != nil || len(segments) == 0 {
+				return err
+			}
+
+			segment := segments[0]
+			for _, s := range segments {
+				if s <= t.fromIndex {
+					segment = s
+				}
+			}
+
+			if err = t.open(segment); err != nil {
+				return err
+			}
+		}
+
+		err := t.readSegment(fn)
+		if err != nil && err != ErrJournalCorrupted {
+			return err
+		}
+
+		next, err := t.nextSegment()
+		if err != nil || next == 0 {
+			// a torn record of the last segment is still being written
+			return err
+		}
+
+		// the leader has moved to the next segment, so this one is complete
+		if err = t.readSegment(fn); err != nil {
+			return err
+		}
+
+		if err = t.open(next); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("journal segment %d is removed before it is read, replica is too far behind", next)
+			}
+
+			return err
+		}
+	}
+}
+
+func (t *journalTail) readSegment(fn func(cmd *JournalCommand) error) error {
+	if _, err := t.file.Seek(t.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	start := t.offset
+
+	return common.ReadSegmentLogRecords(t.file, func(data []byte, end int64) error {
+		cmd, err := decodeJournalCommand(data)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(cmd); err != nil {
+			return err
+		}
+
+		t.offset = start + end
+		return nil
+	})
+}
+
+func (t *journalTail) nextSegment() (uint64, error) {
+	segments, err := t.log.Segments()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, segment := range segments {
+		if segment > t.segment {
+			return segment, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// open keeps the segment open, so it can be read to the end even if a checkpoint removes it
+func (t *journalTail) open(segment uint64) error {
+	f, err := os.Open(t.log.SegmentPath(segment))
+	if err != nil {
+		return err
+	}
+
+	t.close()
+	t.file, t.segment, t.offset = f, segment, 0
+
+	return nil
+}
+
+func (t *journalTail) close() {
+	if t.file != nil {
+		_ = t.file.Close()
+		t.file = nil
+	}
+}
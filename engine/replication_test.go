@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/stretchr/testify/suite"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type replicationTestSuite struct {
+	suite.Suite
+	dir   string
+	store common.IKVStore
+
+	cancels []context.CancelFunc
+	engines []*Engine
+}
+
+func TestReplicationTestSuite(t *testing.T) {
+	suite.Run(t, new(replicationTestSuite))
+}
+
+func (s *replicationTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "engine-replication")
+	s.Nil(err)
+
+	s.dir = dir
+	s.store, err = common.InitKVStore(&common.MemoryKVStoreConfig{Name: dir})
+	s.Nil(err)
+	s.cancels = nil
+	s.engines = nil
+}
+
+func (s *replicationTestSuite) TearDownTest() {
+	for i, cancel := range s.cancels {
+		cancel()
+		s.engines[i].Wg.Wait()
+
+		if s.engines[i].journal != nil {
+			_ = s.engines[i].journal.Close()
+		}
+	}
+
+	_ = os.RemoveAll(s.dir)
+}
+
+// waitFor polls cond until it is true or 5 seconds passed
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+
+	return cond()
+}
+
+func (s *replicationTestSuite) startReplica(nodeID string) (*Engine, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := NewEngine(ctx)
+
+	s.Nil(e.StartReplication(&ReplicationConfig{
+		Journal:      &JournalConfig{Dir: s.dir, FsyncPolicy: FsyncNever},
+		Store:        s.store,
+		LeaseKey:     "engine-lease",
+		NodeID:       nodeID,
+		LeaseTTL:     1200 * time.Millisecond,
+		PollInterval: 5 * time.Millisecond,
+	}))
+
+	s.cancels = append(s.cancels, cancel)
+	s.engines = append(s.engines, e)
+
+	return e, cancel
+}
+
+func (s *replicationTestSuite) startLeader(nodeID string) (*Engine, context.CancelFunc) {
+	e, cancel := s.startReplica(nodeID)
+
+	s.True(waitFor(func() bool { return e.Role() == RoleLeader }))
+
+	return e, cancel
+}
+
+func (s *replicationTestSuite) assertSameBooks(leader, follower *Engine) {
+	s.True(waitFor(func() bool {
+		return follower.ReplicationStatus().AppliedIndex == leader.journal.LastIndex()
+	}))
+
+	leaderBook, err := leader.OrderbookL3("HOT-WETH")
+	s.Nil(err)
+
+	followerBook, err := follower.OrderbookL3("HOT-WETH")
+	s.Nil(err)
+
+	// decimals restored from a checkpoint have other exponents, so books are compared as json
+	leaderJSON, _ := json.Marshal(leaderBook)
+	followerJSON, _ := json.Marshal(followerBook)
+	s.Equal(string(leaderJSON), string(followerJSON))
+}
+
+func (s *replicationTestSuite) TestFollowAndPromote() {
+	leader, crash := s.startLeader("a")
+
+	_, _, err := leader.HandleNewOrder(limitOrder("o1", "t1", "sell", 1.2, 10))
+	s.Nil(err)
+	s.Nil(leader.Checkpoint())
+	_, _, err = leader.HandleNewOrder(limitOrder("o2", "t1", "sell", 1.1, 10))
+	s.Nil(err)
+
+	follower, _ := s.startReplica("b")
+	s.Equal(RoleFollower, follower.Role())
+
+	_, _, err = leader.HandleNewOrder(limitOrder("o3", "t2", "buy", 1.15, 4))
+	s.Nil(err)
+	_, err = leader.HandleCancelOrder(limitOrder("o1", "t1", "sell", 1.2, 10))
+	s.Nil(err)
+
+	s.assertSameBooks(leader, follower)
+
+	_, _, err = follower.HandleNewOrder(limitOrder("o4", "t2", "buy", 1, 1))
+	s.Equal(ErrNotLeader, err)
+
+	s.True(waitFor(func() bool {
+		status := follower.ReplicationStatus()
+		return status.LeaderIndex == leader.journal.LastIndex() && status.Lag == 0
+	}))
+
+	// the leader stops renewing its lease
+	crash()
+	leader.Wg.Wait()
+
+	s.True(waitFor(func() bool { return follower.Role() == RoleLeader }))
+
+	lastIndex := follower.journal.LastIndex()
+
+	_, _, err = follower.HandleNewOrder(limitOrder("o4", "t2", "buy", 1, 1))
+	s.Nil(err)
+	s.Equal(lastIndex+1, follower.journal.LastIndex())
+
+	book, err := follower.OrderbookL3("HOT-WETH")
+	s.Nil(err)
+	s.Len(book.Bids, 1)
+	s.Len(book.Asks, 1)
+	s.Equal("o2", book.Asks[0].ID)
+}
+
+func (s *replicationTestSuite) TestLeaderIsFencedWhenLeaseIsLost() {
+	leader, _ := s.startLeader("a")
+
+	s.Nil(s.store.Set("engine-lease", "b", time.Minute))
+
+	s.True(waitFor(func() bool { return leader.Role() == RoleFenced }))
+
+	_, _, err := leader.HandleNewOrder(limitOrder("o1", "t1", "sell", 1.2, 10))
+	s.Equal(ErrNotLeader, err)
+	s.Equal(ErrNotLeader, leader.Checkpoint())
+}
+
+func (s *replicationTestSuite) TestQueuedCommandsAreRejectedAfterLeaseIsLost() {
+	leader, _ := s.startLeader("a")
+
+	_, _, err := leader.HandleNewOrder(limitOrder("o1", "t1", "sell", 1.2, 10))
+	s.Nil(err)
+	lastIndex := leader.journal.LastIndex()
+
+	// o2 passes the check on submission and waits behind a slow command
+	handler := leader.getMarketHandler("HOT-WETH")
+	started, release := make(chan struct{}), make(chan struct{})
+	handler.submit(func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	done := make(chan error)
+	go func() {
+		_, _, err := leader.HandleNewOrder(limitOrder("o2", "t1", "sell", 1.3, 10))
+		done <- err
+	}()
+
+	s.True(waitFor(func() bool { return handler.QueueDepth() == 1 }))
+	s.Nil(s.store.Set("engine-lease", "b", time.Minute))
+	s.True(waitFor(func() bool { return leader.Role() == RoleFenced }))
+	close(release)
+
+	s.Equal(ErrNotLeader, <-done)
+	s.Equal(lastIndex, leader.journal.LastIndex())
+
+	_, exist := leader.FindOrder("o2")
+	s.False(exist)
+}
@@ -0,0 +1,367 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"github.com/shopspring/decimal"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInsufficientBalance   = errors.New("insufficient balance")
+	ErrInsufficientAllowance = errors.New("insufficient allowance")
+	ErrBalanceUnavailable    = errors.New("balance is unavailable")
+)
+
+// BalanceSource is where the risk checker reads balances and allowances in the smallest token unit.
+// sdk.BlockChain satisfies it.
+type BalanceSource interface {
+	GetTokenBalance(tokenAddress, address string) decimal.Decimal
+	GetTokenAllowance(tokenAddress, proxyAddress, address string) decimal.Decimal
+}
+
+// MarketTokens describes the tokens of a market.
+// The base token is the traded one (HOT in HOT-WETH), order amounts are in base token and prices are in quote token.
+type MarketTokens struct {
+	BaseTokenAddress   string
+	BaseTokenDecimals  int32
+	QuoteTokenAddress  string
+	QuoteTokenDecimals int32
+}
+
+type RiskConfig struct {
+	Source BalanceSource
+
+	// ProxyAddress is the spender whose allowance is checked
+	ProxyAddress string
+
+	Markets map[string]*MarketTokens
+
+	// CacheTTL is how long balances and allowances are cached, DefaultRiskCacheTTL if zero
+	CacheTTL time.Duration
+}
+
+const DefaultRiskCacheTTL = 3 * time.Second
+
+type cachedFunds struct {
+	balance   decimal.Decimal
+	allowance decimal.Decimal
+	fetchedAt time.Time
+}
+
+// RiskChecker rejects orders which their traders can't fund.
+// Funds of a trader are min(balance, allowance) minus the amounts locked by the trader's resting orders in all markets.
+// If settlements are tracked, matched amounts are also locked until ConfirmTransaction, as balances on chain don't change before.
+// Balances are fetched before an order enters its market goroutine, so a slow chain never blocks matching.
+type RiskChecker struct {
+	config *RiskConfig
+
+	lock  sync.Mutex
+	cache map[tokenHolder]*cachedFunds
+	locks *orderLocks
+}
+
+func NewRiskChecker(config *RiskConfig) *RiskChecker {
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = DefaultRiskCacheTTL
+	}
+
+	return &RiskChecker{
+		config: config,
+		cache:  make(map[tokenHolder]*cachedFunds),
+		locks:  newOrderLocks(),
+	}
+}
+
+// UseRiskChecker makes the engine check new orders against the funds of their traders.
+// It should be called before any order is handled.
+func (e *Engine) UseRiskChecker(risk *RiskChecker) {
+	e.risk = risk
+}
+
+// Check returns an error if the trader can't fund the order now, nothing is locked
+func (r *RiskChecker) Check(order *common.MemoryOrder) error {
+	funds, err := r.fundsOf(order)
+	if err != nil {
+		return err
+	}
+
+	return r.reserve(order, funds, false)
+}
+
+// LockedAmount returns the amount of the token locked by resting orders of the trader, in token unit
+func (r *RiskChecker) LockedAmount(trader, tokenAddress string) decimal.Decimal {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.locks.locked[tokenHolder{token: tokenAddress, holder: trader}]
+}
+
+// Invalidate drops cached funds of the trader, e.g. after a deposit or a settlement is observed
+func (r *RiskChecker) Invalidate(trader string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for key := range r.cache {
+		if key.holder == trader {
+			delete(r.cache, key)
+		}
+	}
+}
+
+// fundsOf returns the funds the order spends from, it may read them from the chain
+func (r *RiskChecker) fundsOf(order *common.MemoryOrder) (*cachedFunds, error) {
+	key, _, err := r.required(order)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.funds(key)
+}
+
+// reserve checks the order against funds returned by fundsOf and, if lock is true, locks its amount in the same critical section,
+// so orders of the same trader in different markets can't spend the same funds.
+func (r *RiskChecker) reserve(order *common.MemoryOrder, funds *cachedFunds, lock bool) error {
+	key, amount, err := r.required(order)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	locked := r.locks.locked[key]
+	if current, exist := r.locks.orders[order.ID]; exist {
+		locked = locked.Sub(current.amount)
+	}
+
+	if funds.balance.Sub(locked).LessThan(amount) {
+		return ErrInsufficientBalance
+	}
+
+	if funds.allowance.Sub(locked).LessThan(amount) {
+		return ErrInsufficientAllowance
+	}
+
+	if lock {
+		r.locks.set(order.ID, key, amount)
+	}
+
+	return nil
+}
+
+// sync locks the remaining amount of a resting order, or releases the lock of an order which left the book
+func (r *RiskChecker) sync(order *common.MemoryOrder, resting bool) {
+	var key tokenHolder
+	amount := decimal.Zero
+
+	if resting {
+		var err error
+		if key, amount, err = r.required(order); err != nil {
+			resting = false
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if resting {
+		r.locks.set(order.ID, key, amount)
+	} else {
+		r.locks.release(order.ID)
+	}
+}
+
+// lockSettlement locks the amounts the orders of a pending settlement spend on chain
+func (r *RiskChecker) lockSettlement(settlement *Settlement) {
+	tokens, exist := r.config.Markets[settlement.MarketID]
+	if !exist {
+		return
+	}
+
+	amounts := make(map[string]decimal.Decimal)
+	keys := make(map[string]tokenHolder)
+
+	add := func(order *common.MemoryOrder, amount, price decimal.Decimal) {
+		id := settlementLockID(settlement, order)
+
+		key := tokenHolder{token: tokens.QuoteTokenAddress, holder: order.Trader}
+		spending := amount.Mul(price)
+		spending = spending.Add(spending.Mul(order.TakerFeeRate))
+
+		if order.Side == "sell" {
+			key.token = tokens.BaseTokenAddress
+			spending = amount
+		}
+
+		keys[id] = key
+		amounts[id] = amounts[id].Add(spending)
+	}
+
+	for _, item := range settlement.Items {
+		add(settlement.TakerOrder, item.MatchedAmount, item.MakerOrder.Price)
+		add(item.MakerOrder, item.MatchedAmount, item.MakerOrder.Price)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for id, amount := range amounts {
+		r.locks.set(id, keys[id], amount)
+	}
+}
+
+// releaseSettlement releases the locks of a confirmed settlement.
+// Cached funds of its traders are dropped if the transaction succeeded, since their balances have changed.
+func (r *RiskChecker) releaseSettlement(settlement *Settlement) {
+	orders := []*common.MemoryOrder{settlement.TakerOrder}
+	for _, item := range settlement.Items {
+		orders = append(orders, item.MakerOrder)
+	}
+
+	r.lock.Lock()
+	for _, order := range orders {
+		r.locks.release(settlementLockID(settlement, order))
+	}
+	r.lock.Unlock()
+
+	if settlement.Status == common.STATUS_SUCCESSFUL {
+		for _, order := range orders {
+			r.Invalidate(order.Trader)
+		}
+	}
+}
+
+func settlementLockID(settlement *Settlement, order *common.MemoryOrder) string {
+	return settlement.ID + "/" + order.ID
+}
+
+// reset releases all locks, the engine locks resting orders again after recovery
+func (r *RiskChecker) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.locks = newOrderLocks()
+}
+
+// required returns the token and the amount the order spends if it is fully filled
+func (r *RiskChecker) required(order *common.MemoryOrder) (key tokenHolder, amount decimal.Decimal, err error) {
+	tokens, exist := r.config.Markets[order.MarketID]
+	if !exist {
+		return key, amount, ErrUnknownMarket
+	}
+
+	key = tokenHolder{token: tokens.QuoteTokenAddress, holder: order.Trader}
+	if order.Side == "sell" {
+		key.token = tokens.BaseTokenAddress
+	}
+
+	return key, spendingOf(order), nil
+}
+
+// funds returns the cached balance and allowance in token unit, they are fetched again after CacheTTL
+func (r *RiskChecker) funds(key tokenHolder) (*cachedFunds, error) {
+	r.lock.Lock()
+	funds, exist := r.cache[key]
+	r.lock.Unlock()
+
+	if exist && time.Since(funds.fetchedAt) < r.config.CacheTTL {
+		return funds, nil
+	}
+
+	decimals, err := r.decimalsOf(key.token)
+	if err != nil {
+		return nil, err
+	}
+
+	funds, err = r.fetch(key, decimals)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	r.cache[key] = funds
+	r.lock.Unlock()
+
+	return funds, nil
+}
+
+// fetch reads funds from the source, which may panic when the chain is not reachable
+func (r *RiskChecker) fetch(key tokenHolder, decimals int32) (funds *cachedFunds, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			utils.Errorf("fetch funds of %s for token %s error: %v", key.holder, key.token, e)
+			funds, err = nil, ErrBalanceUnavailable
+		}
+	}()
+
+	balance := r.config.Source.GetTokenBalance(key.token, key.holder)
+	allowance := r.config.Source.GetTokenAllowance(key.token, r.config.ProxyAddress, key.holder)
+
+	return &cachedFunds{
+		balance:   balance.Shift(-decimals),
+		allowance: allowance.Shift(-decimals),
+		fetchedAt: time.Now(),
+	}, nil
+}
+
+func (r *RiskChecker) decimalsOf(tokenAddress string) (int32, error) {
+	for _, tokens := range r.config.Markets {
+		if tokens.BaseTokenAddress == tokenAddress {
+			return tokens.BaseTokenDecimals, nil
+		}
+
+		if tokens.QuoteTokenAddress == tokenAddress {
+			return tokens.QuoteTokenDecimals, nil
+		}
+	}
+
+	return 0, fmt.Errorf("decimals of token %s are unknown", tokenAddress)
+}
+
+// MemoryBalanceSource is a BalanceSource kept in memory, for tests and simulations.
+// Amounts are in the smallest token unit.
+type MemoryBalanceSource struct {
+	lock       sync.RWMutex
+	balances   map[tokenHolder]decimal.Decimal
+	allowances map[tokenHolder]decimal.Decimal
+}
+
+func NewMemoryBalanceSource() *MemoryBalanceSource {
+	return &MemoryBalanceSource{
+		balances:   make(map[tokenHolder]decimal.Decimal),
+		allowances: make(map[tokenHolder]decimal.Decimal),
+	}
+}
+
+func (s *MemoryBalanceSource) SetBalance(tokenAddress, address string, balance decimal.Decimal) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.balances[tokenHolder{token: tokenAddress, holder: address}] = balance
+}
+
+// SetAllowance sets the allowance for any proxy
+func (s *MemoryBalanceSource) SetAllowance(tokenAddress, address string, allowance decimal.Decimal) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.allowances[tokenHolder{token: tokenAddress, holder: address}] = allowance
+}
+
+func (s *MemoryBalanceSource) GetTokenBalance(tokenAddress, address string) decimal.Decimal {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.balances[tokenHolder{token: tokenAddress, holder: address}]
+}
+
+func (s *MemoryBalanceSource) GetTokenAllowance(tokenAddress, proxyAddress, address string) decimal.Decimal {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.allowances[tokenHolder{token: tokenAddress, holder: address}]
+}
@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"context"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type riskTestSuite struct {
+	suite.Suite
+	source *MemoryBalanceSource
+	risk   *RiskChecker
+	engine *Engine
+}
+
+func TestRiskTestSuite(t *testing.T) {
+	suite.Run(t, new(riskTestSuite))
+}
+
+func (s *riskTestSuite) SetupTest() {
+	s.source = NewMemoryBalanceSource()
+	s.risk = NewRiskChecker(&RiskConfig{
+		Source:       s.source,
+		ProxyAddress: "proxy",
+		Markets: map[string]*MarketTokens{
+			"HOT-WETH": {
+				BaseTokenAddress:   "hot",
+				BaseTokenDecimals:  18,
+				QuoteTokenAddress:  "weth",
+				QuoteTokenDecimals: 18,
+			},
+		},
+		CacheTTL: time.Minute,
+	})
+
+	s.engine = NewEngine(context.Background())
+	s.engine.UseRiskChecker(s.risk)
+}
+
+// fund gives the trader amount of token, with enough allowance
+func (s *riskTestSuite) fund(token, trader, amount string) {
+	raw := decimal.RequireFromString(amount).Shift(18)
+	s.source.SetBalance(token, trader, raw)
+	s.source.SetAllowance(token, trader, raw)
+	s.risk.Invalidate(trader)
+}
+
+func (s *riskTestSuite) newOrder(id, trader, side, price, amount string) *common.MemoryOrder {
+	return &common.MemoryOrder{
+		ID:       id,
+		MarketID: "HOT-WETH",
+		Price:    decimal.RequireFromString(price),
+		Amount:   decimal.RequireFromString(amount),
+		Side:     side,
+		Type:     "limit",
+		Trader:   trader,
+	}
+}
+
+func (s *riskTestSuite) TestRestingOrdersLockFunds() {
+	s.fund("hot", "alice", "15")
+
+	_, _, err := s.engine.HandleNewOrder(s.newOrder("o1", "alice", "sell", "1", "10"))
+	s.Nil(err)
+	s.Equal("10", s.risk.LockedAmount("alice", "hot").String())
+
+	_, _, err = s.engine.HandleNewOrder(s.newOrder("o2", "alice", "sell", "1", "10"))
+	s.Equal(ErrInsufficientBalance, err)
+
+	_, err = s.engine.HandleCancelOrder(s.newOrder("o1", "alice", "sell", "1", "10"))
+	s.Nil(err)
+	s.True(s.risk.LockedAmount("alice", "hot").IsZero())
+
+	_, _, err = s.engine.HandleNewOrder(s.newOrder("o2", "alice", "sell", "1", "10"))
+	s.Nil(err)
+}
+
+func (s *riskTestSuite) TestMatchReleasesLocks() {
+	s.fund("hot", "alice", "10")
+	s.fund("weth", "bob", "6")
+
+	_, _, err := s.engine.HandleNewOrder(s.newOrder("o1", "alice", "sell", "0.5", "10"))
+	s.Nil(err)
+
+	// 10 * 0.5 = 5 weth, the rest 2 rests in the book at 0.5
+	_, _, err = s.engine.HandleNewOrder(s.newOrder("o2", "bob", "buy", "0.5", "12"))
+	s.Nil(err)
+
+	s.True(s.risk.LockedAmount("alice", "hot").IsZero())
+	s.Equal("1", s.risk.LockedAmount("bob", "weth").String())
+}
+
+func (s *riskTestSuite) TestPendingSettlementsLockFunds() {
+	s.engine.UseSettlementTracking()
+	s.fund("hot", "alice", "10")
+	s.fund("weth", "bob", "5")
+
+	_, _, err := s.engine.HandleNewOrder(s.newOrder("o1", "alice", "sell", "0.5", "10"))
+	s.Nil(err)
+	matchResult, _, err := s.engine.HandleNewOrder(s.newOrder("o2", "bob", "buy", "0.5", "10"))
+	s.Nil(err)
+
+	// balances on chain don't change until the match is settled
+	s.Equal("10", s.risk.LockedAmount("alice", "hot").String())
+	s.Equal("5", s.risk.LockedAmount("bob", "weth").String())
+
+	_, _, err = s.engine.HandleNewOrder(s.newOrder("o3", "alice", "sell", "0.5", "1"))
+	s.Equal(ErrInsufficientBalance, err)
+
+	_, err = s.engine.BindMatchTransaction("HOT-WETH", matchResult.MatchID, "0xhash")
+	s.Nil(err)
+
+	s.source.SetBalance("hot", "alice", decimal.Zero)
+	_, _, err = s.engine.ConfirmTransaction("HOT-WETH", "0xhash", common.STATUS_SUCCESSFUL, 0)
+	s.Nil(err)
+
+	s.True(s.risk.LockedAmount("alice", "hot").IsZero())
+	s.True(s.risk.LockedAmount("bob", "weth").IsZero())
+
+	// cached funds are dropped after the settlement
+	_, _, err = s.engine.HandleNewOrder(s.newOrder("o3", "alice", "sell", "0.5", "1"))
+	s.Equal(ErrInsufficientBalance, err)
+}
+
+// blockingBalanceSource blocks until release is closed
+type blockingBalanceSource struct {
+	*MemoryBalanceSource
+	release chan struct{}
+}
+
+func (source *blockingBalanceSource) GetTokenBalance(tokenAddress, address string) decimal.Decimal {
+	<-source.release
+	return source.MemoryBalanceSource.GetTokenBalance(tokenAddress, address)
+}
+
+func (s *riskTestSuite) TestFundsAreFetchedOutsideOfMarket() {
+	source := &blockingBalanceSource{MemoryBalanceSource: s.source, release: make(chan struct{})}
+	s.risk.config.Source = source
+	s.fund("hot", "alice", "10")
+
+	done := make(chan error)
+	go func() {
+		_, _, err := s.engine.HandleNewOrder(s.newOrder("o1", "alice", "sell", "1", "10"))
+		done <- err
+	}()
+
+	// the market keeps working while the balance of alice is being fetched
+	time.Sleep(10 * time.Millisecond)
+	handler := s.engine.getOrCreateMarketHandler("HOT-WETH")
+	s.Nil(handler.do(func() {}))
+
+	close(source.release)
+	s.Nil(<-done)
+}
+
+func (s *riskTestSuite) TestInsufficientAllowance() {
+	s.source.SetBalance("weth", "bob", decimal.RequireFromString("100").Shift(18))
+	s.source.SetAllowance("weth", "bob", decimal.RequireFromString("1").Shift(18))
+
+	_, _, err := s.engine.HandleNewOrder(s.newOrder("o1", "bob", "buy", "0.5", "10"))
+	s.Equal(ErrInsufficientAllowance, err)
+}
+
+func (s *riskTestSuite) TestCache() {
+	s.fund("hot", "alice", "10")
+	s.Nil(s.risk.Check(s.newOrder("o1", "alice", "sell", "1", "10")))
+
+	// cached balance is used until it is invalidated
+	s.source.SetBalance("hot", "alice", decimal.Zero)
+	s.Nil(s.risk.Check(s.newOrder("o1", "alice", "sell", "1", "10")))
+
+	s.risk.Invalidate("alice")
+	s.Equal(ErrInsufficientBalance, s.risk.Check(s.newOrder("o1", "alice", "sell", "1", "10")))
+}
+
+type unreachableBalanceSource struct{}
+
+func (unreachableBalanceSource) GetTokenBalance(tokenAddress, address string) decimal.Decimal {
+	panic("connection refused")
+}
+
+func (unreachableBalanceSource) GetTokenAllowance(tokenAddress, proxyAddress, address string) decimal.Decimal {
+	panic("connection refused")
+}
+
+func (s *riskTestSuite) TestUnreachableSource() {
+	s.risk.config.Source = unreachableBalanceSource{}
+	s.Equal(ErrBalanceUnavailable, s.risk.Check(s.newOrder("o1", "alice", "sell", "1", "10")))
+}
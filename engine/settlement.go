@@ -0,0 +1,493 @@
+package engine
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"github.com/shopspring/decimal"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Settlement tracks an executed match from the moment it leaves the book until its transaction is confirmed.
+// Status is one of common.STATUS_PENDING, common.STATUS_SUCCESSFUL and common.STATUS_FAILED.
+type Settlement struct {
+	ID              string              `json:"id"`
+	MarketID        string              `json:"marketID"`
+	TransactionHash string              `json:"transactionHash"`
+	Status          string              `json:"status"`
+	TakerOrder      *common.MemoryOrder `json:"takerOrder"`
+	Items           []*SettlementItem   `json:"items"`
+	CreatedAt       uint64              `json:"createdAt"`
+}
+
+type SettlementItem struct {
+	MakerOrder       *common.MemoryOrder `json:"makerOrder"`
+	MatchedAmount    decimal.Decimal     `json:"matchedAmount"`
+	MakerOrderIsDone bool                `json:"makerOrderIsDone"`
+}
+
+// SettlementTrade is the trade payload of tradeChange messages, one for each item of a settlement
+type SettlementTrade struct {
+	MatchID         string `json:"matchID"`
+	MarketID        string `json:"marketID"`
+	TransactionHash string `json:"transactionHash"`
+	Status          string `json:"status"`
+	TakerOrderID    string `json:"takerOrderID"`
+	MakerOrderID    string `json:"makerOrderID"`
+	Price           string `json:"price"`
+	Amount          string `json:"amount"`
+}
+
+func init() {
+	// the trade of tradeChange payloads encoded by common.GobCodec
+	gob.Register(&SettlementTrade{})
+}
+
+// UnboundSettlementTTL is how long a settlement waits for BindMatchTransaction,
+// a settlement still not bound after it is expired as if its transaction failed.
+const UnboundSettlementTTL = 10 * time.Minute
+
+// settlementTracker keeps the pending settlements of one market, it is owned by the market goroutine
+type settlementTracker struct {
+	sequence uint64
+	pending  map[string]*Settlement
+
+	// transaction hash -> settlement id
+	hashes map[string]string
+}
+
+func newSettlementTracker() *settlementTracker {
+	return &settlementTracker{
+		pending: make(map[string]*Settlement),
+		hashes:  make(map[string]string),
+	}
+}
+
+func (t *settlementTracker) add(settlement *Settlement) {
+	t.pending[settlement.ID] = settlement
+
+	if settlement.TransactionHash != "" {
+		t.hashes[settlement.TransactionHash] = settlement.ID
+	}
+}
+
+func (t *settlementTracker) remove(settlement *Settlement) {
+	delete(t.pending, settlement.ID)
+	delete(t.hashes, settlement.TransactionHash)
+}
+
+func (t *settlementTracker) getByHash(hash string) (*Settlement, bool) {
+	id, exist := t.hashes[hash]
+	if !exist {
+		return nil, false
+	}
+
+	return t.pending[id], true
+}
+
+// unbound returns settlements created before deadline which are not bound to a transaction yet
+func (t *settlementTracker) unbound(deadline uint64) (settlements []*Settlement) {
+	for _, settlement := range t.list() {
+		if settlement.TransactionHash == "" && settlement.CreatedAt < deadline {
+			settlements = append(settlements, settlement)
+		}
+	}
+
+	return
+}
+
+// list returns pending settlements in the order they are created
+func (t *settlementTracker) list() []*Settlement {
+	settlements := make([]*Settlement, 0, len(t.pending))
+	for _, settlement := range t.pending {
+		settlements = append(settlements, settlement)
+	}
+
+	sort.Slice(settlements, func(i, j int) bool {
+		if settlements[i].CreatedAt != settlements[j].CreatedAt {
+			return settlements[i].CreatedAt < settlements[j].CreatedAt
+		}
+
+		return settlements[i].ID < settlements[j].ID
+	})
+
+	return settlements
+}
+
+// UseSettlementTracking makes every executed match pending until its transaction is confirmed.
+// It should be called before any order is handled.
+func (e *Engine) UseSettlementTracking() {
+	e.trackSettlements = true
+}
+
+// BindMatchTransaction records the hash of the transaction which settles the match
+func (e *Engine) BindMatchTransaction(marketID, matchID, hash string) (msgs []common.WebSocketMessage, err error) {
+	if err = e.checkLeader(); err != nil {
+		return
+	}
+
+	handler := e.getMarketHandler(marketID)
+	if handler == nil {
+		return nil, ErrUnknownMarket
+	}
+
+	if doErr := handler.do(func() {
+		if handler.settlements == nil {
+			err = ErrSettlementNotTracked
+			return
+		}
+
+		settlement, exist := handler.settlements.pending[matchID]
+		if !exist {
+			err = ErrUnknownMatch
+			return
+		}
+
+		if settlement.TransactionHash != "" {
+			err = fmt.Errorf("match %s is already bound to transaction %s", matchID, settlement.TransactionHash)
+			return
+		}
+
+		if err = e.journalCommand(handler, &JournalCommand{
+			Type:            JournalBindTransaction,
+			MarketID:        handler.market,
+			Timestamp:       uint64(time.Now().Unix()),
+			MatchID:         matchID,
+			TransactionHash: hash,
+		}); err != nil {
+			return
+		}
+
+		msgs = handler.bindTransaction(settlement, hash)
+		e.triggerOrderbookActivityHandlerIfNotNil(handler, msgs)
+	}); doErr != nil {
+		return nil, doErr
+	}
+
+	return
+}
+
+// ConfirmTransaction settles the match bound to the transaction.
+// If the transaction failed, the matched maker amounts go back to the book at their original priority where possible.
+// The matched amount of the taker stays consumed and the trader places a new order instead,
+// the remainder of a taker resting in the book is canceled since it would cross the restored makers.
+func (e *Engine) ConfirmTransaction(marketID, hash, status string, timestamp uint64) (settlement *Settlement, msgs []common.WebSocketMessage, err error) {
+	if status != common.STATUS_SUCCESSFUL && status != common.STATUS_FAILED {
+		return nil, nil, fmt.Errorf("invalid transaction status %q", status)
+	}
+
+	if err = e.checkLeader(); err != nil {
+		return
+	}
+
+	handler := e.getMarketHandler(marketID)
+	if handler == nil {
+		return nil, nil, ErrUnknownMarket
+	}
+
+	if doErr := handler.do(func() {
+		if handler.settlements == nil {
+			err = ErrSettlementNotTracked
+			return
+		}
+
+		var exist bool
+		settlement, exist = handler.settlements.getByHash(hash)
+		if !exist {
+			err = ErrUnknownTransaction
+			return
+		}
+
+		if err = e.journalCommand(handler, &JournalCommand{
+			Type:              JournalConfirmTransaction,
+			MarketID:          handler.market,
+			Timestamp:         timestamp,
+			TransactionHash:   hash,
+			TransactionStatus: status,
+		}); err != nil {
+			return
+		}
+
+		msgs = e.finishSettlement(handler, settlement, status, timestamp)
+	}); doErr != nil {
+		return nil, nil, doErr
+	}
+
+	return
+}
+
+// ExpireUnboundSettlements fails settlements of all markets which are not bound to a transaction within UnboundSettlementTTL.
+// Makers and takers are restored as for a failed transaction, nothing is expired if the engine is not the leader.
+func (e *Engine) ExpireUnboundSettlements(now uint64) (settlements []*Settlement, msgs []common.WebSocketMessage) {
+	if !e.trackSettlements || e.checkLeader() != nil {
+		return
+	}
+
+	ttl := uint64(UnboundSettlementTTL / time.Second)
+	if now < ttl {
+		return
+	}
+
+	var lock sync.Mutex
+
+	e.doInAllMarkets(func(handler *MarketHandler) {
+		if handler.settlements == nil {
+			return
+		}
+
+		for _, settlement := range handler.settlements.unbound(now - ttl) {
+			if e.journalCommand(handler, &JournalCommand{
+				Type:      JournalExpireSettlement,
+				MarketID:  handler.market,
+				Timestamp: now,
+				MatchID:   settlement.ID,
+			}) != nil {
+				return
+			}
+
+			marketMsgs := e.finishSettlement(handler, settlement, common.STATUS_FAILED, now)
+
+			lock.Lock()
+			settlements = append(settlements, settlement)
+			msgs = append(msgs, marketMsgs...)
+			lock.Unlock()
+		}
+	})
+
+	return
+}
+
+// finishSettlement confirms the settlement in the market goroutine and updates everything derived from its orders
+func (e *Engine) finishSettlement(handler *MarketHandler, settlement *Settlement, status string, now uint64) []common.WebSocketMessage {
+	msgs, restored := handler.confirmTransaction(settlement, status, now)
+
+	if e.risk != nil {
+		e.risk.releaseSettlement(settlement)
+	}
+
+	for _, item := range settlement.Items {
+		e.syncLockedAmounts(handler, item.MakerOrder)
+
+		if status == common.STATUS_FAILED {
+			e.trackFill(handler, settlement.TakerOrder, item.MakerOrder, item.MatchedAmount.Neg(), now)
+		}
+		e.trackOrders(handler, false, now, item.MakerOrder)
+	}
+
+	e.syncLockedAmounts(handler, settlement.TakerOrder)
+	e.trackOrders(handler, status == common.STATUS_FAILED, now, settlement.TakerOrder)
+	e.fillAccountMessages(handler, msgs)
+
+	if restored {
+		e.triggerOrderbookSnapshotHandlerIfNotNil(handler)
+	}
+	e.triggerOrderbookActivityHandlerIfNotNil(handler, msgs)
+
+	return msgs
+}
+
+// PendingSettlements returns copies of the settlements of the market which are not confirmed yet
+func (e *Engine) PendingSettlements(marketID string) (settlements []*Settlement) {
+	handler := e.getMarketHandler(marketID)
+	if handler == nil {
+		return nil
+	}
+
+	handler.do(func() {
+		if handler.settlements == nil {
+			return
+		}
+
+		for _, settlement := range handler.settlements.list() {
+			settlements = append(settlements, copySettlement(settlement))
+		}
+	})
+
+	return
+}
+
+// trackMatch creates a pending settlement for the executed part of the match result
+func (m *MarketHandler) trackMatch(matchResult *common.MatchResult, now uint64) (msgs []common.WebSocketMessage) {
+	if m.settlements == nil || !matchResult.ExistMatchToBeExecuted() {
+		return
+	}
+
+	m.settlements.sequence = m.settlements.sequence + 1
+
+	settlement := &Settlement{
+		ID:         fmt.Sprintf("%s-%d", m.market, m.settlements.sequence),
+		MarketID:   m.market,
+		Status:     common.STATUS_PENDING,
+		TakerOrder: matchResult.TakerOrder,
+		CreatedAt:  now,
+	}
+
+	for _, item := range matchResult.MatchItems {
+		if item.MatchShouldBeCanceled || !item.MatchedAmount.IsPositive() {
+			continue
+		}
+
+		settlement.Items = append(settlement.Items, &SettlementItem{
+			MakerOrder:       item.MakerOrder,
+			MatchedAmount:    item.MatchedAmount,
+			MakerOrderIsDone: item.MakerOrderIsDone,
+		})
+	}
+
+	m.settlements.add(settlement)
+	matchResult.MatchID = settlement.ID
+
+	return tradeChangeMessages(settlement)
+}
+
+func (m *MarketHandler) bindTransaction(settlement *Settlement, hash string) []common.WebSocketMessage {
+	settlement.TransactionHash = hash
+	m.settlements.add(settlement)
+
+	return tradeChangeMessages(settlement)
+}
+
+// confirmTransaction finishes the settlement, restored is true if the book is changed
+func (m *MarketHandler) confirmTransaction(settlement *Settlement, status string, now uint64) (msgs []common.WebSocketMessage, restored bool) {
+	settlement.Status = status
+	m.settlements.remove(settlement)
+
+	msgs = tradeChangeMessages(settlement)
+
+	if status == common.STATUS_FAILED {
+		// the taker is not restored, a resting taker would cross the restored makers
+		taker := settlement.TakerOrder
+		if bookOrder, exist := m.orderbook.GetOrder(taker.ID, taker.Side, taker.Price); exist && bookOrder == taker {
+			e, err := m.handleCancelOrder(taker)
+			if err != nil {
+				panic(fmt.Errorf("remove taker order %s from book %s error: %v", taker.ID, m.market, err))
+			}
+
+			msgs = append(msgs, common.OrderbookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount))
+			restored = true
+		}
+
+		// Fully matched makers are taken from the front of their price levels,
+		// putting them back to the front in reverse order gives them the original priority.
+		for i := len(settlement.Items) - 1; i >= 0; i-- {
+			item := settlement.Items[i]
+
+			if e := m.restoreMakerAmount(item, now); e != nil {
+				msgs = append(msgs, common.OrderbookChangeMessage(m.market, m.orderbook.Sequence, e.Side, e.Price, e.Amount))
+				restored = true
+			}
+		}
+	}
+
+	msgs = append(msgs, common.MessagesForUpdateOrder(settlement.TakerOrder)...)
+	for _, item := range settlement.Items {
+		msgs = append(msgs, common.MessagesForUpdateOrder(item.MakerOrder)...)
+	}
+
+	utils.Infof("match %s of market %s is %s, transaction: %s", settlement.ID, m.market, status, settlement.TransactionHash)
+
+	return
+}
+
+// restoreMakerAmount gives the matched amount back to the maker order.
+// Nothing is restored if the order has left the book for other reasons, is expired, or the market is closed.
+func (m *MarketHandler) restoreMakerAmount(item *SettlementItem, now uint64) *common.OrderbookEvent {
+	order := item.MakerOrder
+
+	if bookOrder, exist := m.orderbook.GetOrder(order.ID, order.Side, order.Price); exist {
+		if bookOrder != order {
+			return nil
+		}
+
+		e, err := m.orderbook.ChangeOrder(order, item.MatchedAmount)
+		if err != nil {
+			return nil
+		}
+
+		order.Amount = order.Amount.Add(item.MatchedAmount)
+
+		return e
+	}
+
+	if !item.MakerOrderIsDone || order.IsExpired(now) || m.state == MarketStateClosed {
+		return nil
+	}
+
+	order.Amount = order.Amount.Add(item.MatchedAmount)
+	e, err := m.orderbook.InsertOrderAtFront(order)
+	if err != nil {
+		order.Amount = order.Amount.Sub(item.MatchedAmount)
+		return nil
+	}
+
+	m.expiryIndex.add(order)
+
+	return e
+}
+
+func tradeChangeMessages(settlement *Settlement) (msgs []common.WebSocketMessage) {
+	for _, item := range settlement.Items {
+		trade := &SettlementTrade{
+			MatchID:         settlement.ID,
+			MarketID:        settlement.MarketID,
+			TransactionHash: settlement.TransactionHash,
+			Status:          settlement.Status,
+			TakerOrderID:    settlement.TakerOrder.ID,
+			MakerOrderID:    item.MakerOrder.ID,
+			Price:           item.MakerOrder.Price.String(),
+			Amount:          item.MatchedAmount.String(),
+		}
+
+		msgs = append(msgs, common.TradeChangeMessage(settlement.TakerOrder.Trader, trade))
+		msgs = append(msgs, common.TradeChangeMessage(item.MakerOrder.Trader, trade))
+	}
+
+	return
+}
+
+func copySettlement(settlement *Settlement) *Settlement {
+	res := *settlement
+	takerOrder := *settlement.TakerOrder
+	res.TakerOrder = &takerOrder
+	res.Items = make([]*SettlementItem, 0, len(settlement.Items))
+
+	for _, item := range settlement.Items {
+		i := *item
+		makerOrder := *item.MakerOrder
+		i.MakerOrder = &makerOrder
+		res.Items = append(res.Items, &i)
+	}
+
+	return &res
+}
+
+// restoreSettlements puts settlements of a checkpoint back.
+// Orders are shared with the book and between settlements again, as they were before the checkpoint.
+func (m *MarketHandler) restoreSettlements(settlements []*Settlement) {
+	orders := make(map[string]*common.MemoryOrder)
+
+	resolve := func(order *common.MemoryOrder) *common.MemoryOrder {
+		if bookOrder, exist := m.orderbook.GetOrder(order.ID, order.Side, order.Price); exist {
+			return bookOrder
+		}
+
+		if o, exist := orders[order.ID]; exist {
+			return o
+		}
+
+		orders[order.ID] = order
+		return order
+	}
+
+	for _, settlement := range settlements {
+		settlement.TakerOrder = resolve(settlement.TakerOrder)
+		for _, item := range settlement.Items {
+			item.MakerOrder = resolve(item.MakerOrder)
+		}
+
+		m.settlements.add(settlement)
+	}
+}
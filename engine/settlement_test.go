@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"context"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"time"
+)
+
+type settlementTestSuite struct {
+	suite.Suite
+	engine *Engine
+}
+
+func TestSettlementTestSuite(t *testing.T) {
+	suite.Run(t, new(settlementTestSuite))
+}
+
+func (s *settlementTestSuite) SetupTest() {
+	s.engine = NewEngine(context.Background())
+	s.engine.UseSettlementTracking()
+}
+
+func (s *settlementTestSuite) newOrder(id, side, price, amount string) *common.MemoryOrder {
+	return &common.MemoryOrder{
+		ID:       id,
+		MarketID: "HOT-WETH",
+		Price:    decimal.RequireFromString(price),
+		Amount:   decimal.RequireFromString(amount),
+		Side:     side,
+		Type:     "limit",
+		Trader:   "trader-" + id,
+	}
+}
+
+func (s *settlementTestSuite) askIDsAndAmounts() (res []string) {
+	for _, order := range s.engine.marketHandlerMap["HOT-WETH"].orderbook.Orders("sell") {
+		res = append(res, order.ID+":"+order.Amount.String())
+	}
+	return
+}
+
+// o1 is fully taken and o2 is partially taken by one match
+func (s *settlementTestSuite) match() string {
+	s.engine.HandleNewOrder(s.newOrder("o1", "sell", "1", "10"))
+	s.engine.HandleNewOrder(s.newOrder("o2", "sell", "1", "10"))
+	s.engine.HandleNewOrder(s.newOrder("o3", "sell", "1", "10"))
+
+	matchResult, hasMatch, err := s.engine.HandleNewOrder(s.newOrder("t1", "buy", "1", "15"))
+	s.Nil(err)
+	s.True(hasMatch)
+	s.Equal("HOT-WETH-1", matchResult.MatchID)
+	s.Equal([]string{"o2:5", "o3:10"}, s.askIDsAndAmounts())
+
+	settlements := s.engine.PendingSettlements("HOT-WETH")
+	s.Equal(1, len(settlements))
+	s.Equal(common.STATUS_PENDING, settlements[0].Status)
+	s.Equal(2, len(settlements[0].Items))
+
+	msgs, err := s.engine.BindMatchTransaction("HOT-WETH", matchResult.MatchID, "0xhash")
+	s.Nil(err)
+	s.Equal(4, len(msgs))
+
+	return matchResult.MatchID
+}
+
+func (s *settlementTestSuite) TestFailedTransactionRestoresMakers() {
+	s.match()
+
+	settlement, msgs, err := s.engine.ConfirmTransaction("HOT-WETH", "0xhash", common.STATUS_FAILED, 0)
+	s.Nil(err)
+	s.Equal(common.STATUS_FAILED, settlement.Status)
+	s.Equal([]string{"o1:10", "o2:10", "o3:10"}, s.askIDsAndAmounts())
+
+	var tradeChanges int
+	for _, msg := range msgs {
+		if payload, ok := msg.Payload.(*common.WebsocketTradeChangePayload); ok {
+			s.Equal(common.STATUS_FAILED, payload.Trade.(*SettlementTrade).Status)
+			tradeChanges++
+		}
+	}
+	s.Equal(4, tradeChanges)
+
+	s.Equal(0, len(s.engine.PendingSettlements("HOT-WETH")))
+
+	_, _, err = s.engine.ConfirmTransaction("HOT-WETH", "0xhash", common.STATUS_FAILED, 0)
+	s.Equal(ErrUnknownTransaction, err)
+}
+
+func (s *settlementTestSuite) TestSuccessfulTransaction() {
+	s.match()
+
+	settlement, msgs, err := s.engine.ConfirmTransaction("HOT-WETH", "0xhash", common.STATUS_SUCCESSFUL, 0)
+	s.Nil(err)
+	s.Equal(common.STATUS_SUCCESSFUL, settlement.Status)
+	s.True(len(msgs) > 0)
+	s.Equal([]string{"o2:5", "o3:10"}, s.askIDsAndAmounts())
+	s.Equal(0, len(s.engine.PendingSettlements("HOT-WETH")))
+}
+
+func (s *settlementTestSuite) TestUnknownMatch() {
+	s.engine.HandleNewOrder(s.newOrder("o1", "sell", "1", "10"))
+
+	_, err := s.engine.BindMatchTransaction("HOT-WETH", "HOT-WETH-1", "0xhash")
+	s.Equal(ErrUnknownMatch, err)
+
+	_, err = s.engine.BindMatchTransaction("DAI-WETH", "DAI-WETH-1", "0xhash")
+	s.Equal(ErrUnknownMarket, err)
+}
+
+func (s *settlementTestSuite) TestFailedTransactionKeepsTakerConsumed() {
+	s.engine.HandleNewOrder(s.newOrder("o1", "sell", "1", "10"))
+
+	// the remaining 5 of the taker rests in the book
+	matchResult, _, err := s.engine.HandleNewOrder(s.newOrder("t1", "buy", "1", "15"))
+	s.Nil(err)
+	s.Equal("5", s.engine.LockedBalance("trader-t1", "WETH").String())
+
+	_, err = s.engine.BindMatchTransaction("HOT-WETH", matchResult.MatchID, "0xhash")
+	s.Nil(err)
+
+	_, _, err = s.engine.ConfirmTransaction("HOT-WETH", "0xhash", common.STATUS_FAILED, 0)
+	s.Nil(err)
+
+	// the maker is restored, the matched amount of the taker stays consumed and its remainder is canceled
+	s.Equal([]string{"o1:10"}, s.askIDsAndAmounts())
+	s.Equal(0, len(s.engine.marketHandlerMap["HOT-WETH"].orderbook.Orders("buy")))
+	s.Equal("5", matchResult.TakerOrder.Amount.String())
+	s.True(s.engine.LockedBalance("trader-t1", "WETH").IsZero())
+}
+
+func (s *settlementTestSuite) TestExpireUnboundSettlements() {
+	s.engine.HandleNewOrder(s.newOrder("o1", "sell", "1", "10"))
+	s.engine.HandleNewOrder(s.newOrder("o2", "sell", "1", "10"))
+	_, _, err := s.engine.HandleNewOrder(s.newOrder("t1", "buy", "1", "15"))
+	s.Nil(err)
+
+	createdAt := s.engine.PendingSettlements("HOT-WETH")[0].CreatedAt
+	ttl := uint64(UnboundSettlementTTL / time.Second)
+
+	settlements, _ := s.engine.ExpireUnboundSettlements(createdAt + ttl)
+	s.Equal(0, len(settlements))
+	s.Equal(1, len(s.engine.PendingSettlements("HOT-WETH")))
+
+	settlements, msgs := s.engine.ExpireUnboundSettlements(createdAt + ttl + 1)
+	s.Equal(1, len(settlements))
+	s.Equal(common.STATUS_FAILED, settlements[0].Status)
+	s.True(len(msgs) > 0)
+	s.Equal(0, len(s.engine.PendingSettlements("HOT-WETH")))
+	s.Equal([]string{"o1:10", "o2:10"}, s.askIDsAndAmounts())
+}
+
+func (s *settlementTestSuite) TestBoundSettlementsAreNotExpired() {
+	s.match()
+
+	settlements, _ := s.engine.ExpireUnboundSettlements(uint64(time.Now().Add(UnboundSettlementTTL * 2).Unix()))
+	s.Equal(0, len(settlements))
+	s.Equal(1, len(s.engine.PendingSettlements("HOT-WETH")))
+}
@@ -3,6 +3,7 @@ module github.com/novaprotocolio/sdk-backend
 require (
 	github.com/FactomProject/basen v0.0.0-20150613233007-fe3947df716e // indirect
 	github.com/FactomProject/btcutilecc v0.0.0-20130527213604-d3a63a5752ec // indirect
+	github.com/alicebob/miniredis/v2 v2.23.0
 	github.com/aristanetworks/goarista v0.0.0-20190628180533-8e7d5b18fe7a // indirect
 	github.com/btcsuite/btcd v0.20.0-beta
 	github.com/cevaris/ordered_map v0.0.0-20180310183325-0efaee1733e3
@@ -0,0 +1,249 @@
+package settlement
+
+import (
+	"errors"
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/launcher"
+	"github.com/novaprotocolio/sdk-backend/sdk"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"github.com/shopspring/decimal"
+	"math/big"
+	"time"
+)
+
+// ItemTypeMatchOrders is the ItemType of launch logs created by the builder
+const ItemTypeMatchOrders = "matchOrders"
+
+const (
+	DefaultBaseGasLimit     int64 = 100000
+	DefaultGasLimitPerMaker int64 = 150000
+)
+
+var (
+	ErrNothingToSettle = errors.New("nothing to settle")
+	ErrUnknownMarket   = errors.New("unknown market")
+)
+
+// Market holds the token addresses and decimals of a market
+type Market struct {
+	ID                 string
+	BaseTokenAddress   string
+	BaseTokenDecimals  int32
+	QuoteTokenAddress  string
+	QuoteTokenDecimals int32
+}
+
+// SignedOrder is an order as it was signed by its trader.
+// Amounts are in tokens, e.g. 1.5 for 1.5 HOT, they are converted to base units by the builder.
+type SignedOrder struct {
+	Trader           string
+	BaseTokenAmount  decimal.Decimal
+	QuoteTokenAmount decimal.Decimal
+	GasTokenAmount   decimal.Decimal
+	Data             string
+	Signature        string
+}
+
+// OrderSource supplies the signed orders, the engine only knows the fields needed for matching
+type OrderSource interface {
+	GetSignedOrder(orderID string) (*SignedOrder, error)
+}
+
+type OrderSourceFunc func(orderID string) (*SignedOrder, error)
+
+func (f OrderSourceFunc) GetSignedOrder(orderID string) (*SignedOrder, error) {
+	return f(orderID)
+}
+
+// GasEstimator returns the gas used by the transaction, it is optional
+type GasEstimator interface {
+	EstimateGas(from, to string, data []byte) (int64, error)
+}
+
+type Config struct {
+	Nova   sdk.NovaProtocol
+	Orders OrderSource
+
+	// Markets are keyed by market id
+	Markets map[string]*Market
+
+	// RelayerAddress signs and sends the transaction, it must be the relayer of every order
+	RelayerAddress string
+
+	// NovaContractAddress receives the transaction
+	NovaContractAddress string
+
+	// Without a GasEstimator, the gas limit is BaseGasLimit + GasLimitPerMaker * makers.
+	// With one, the estimate is raised by GasLimitMargin, e.g. 0.2 for 20%.
+	GasEstimator     GasEstimator
+	GasLimitMargin   decimal.Decimal
+	BaseGasLimit     int64
+	GasLimitPerMaker int64
+}
+
+// Batch is the transaction settling one match result
+type Batch struct {
+	MatchID  string
+	MarketID string
+
+	// Items are the settled match items, canceled items are skipped
+	Items []*common.MatchItem
+
+	// LaunchLog is ready to be signed, its ItemID is left to the caller
+	LaunchLog *launcher.LaunchLog
+}
+
+// Builder turns match results into matchOrders transactions of the Nova contract
+type Builder struct {
+	config *Config
+}
+
+// NewBuilder fills missing gas limits with DefaultBaseGasLimit and DefaultGasLimitPerMaker
+func NewBuilder(config *Config) *Builder {
+	c := *config
+
+	if c.BaseGasLimit <= 0 {
+		c.BaseGasLimit = DefaultBaseGasLimit
+	}
+
+	if c.GasLimitPerMaker <= 0 {
+		c.GasLimitPerMaker = DefaultGasLimitPerMaker
+	}
+
+	return &Builder{config: &c}
+}
+
+// Build returns ErrNothingToSettle if all items of the match result should be canceled
+func (b *Builder) Build(matchResult *common.MatchResult) (*Batch, error) {
+	market, exist := b.config.Markets[matchResult.TakerOrder.MarketID]
+	if !exist {
+		return nil, ErrUnknownMarket
+	}
+
+	var items []*common.MatchItem
+	for _, item := range matchResult.MatchItems {
+		if !item.MatchShouldBeCanceled {
+			items = append(items, item)
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, ErrNothingToSettle
+	}
+
+	takerOrder, err := b.sdkOrder(market, matchResult.TakerOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	makerOrders := make([]*sdk.Order, 0, len(items))
+	baseTokenFilledAmounts := make([]*big.Int, 0, len(items))
+
+	for _, item := range items {
+		makerOrder, err := b.sdkOrder(market, item.MakerOrder)
+		if err != nil {
+			return nil, err
+		}
+
+		filledAmount, err := toBaseUnits(item.MatchedAmount, market.BaseTokenDecimals)
+		if err != nil {
+			return nil, fmt.Errorf("matched amount of maker order %s: %v", item.MakerOrder.ID, err)
+		}
+
+		makerOrders = append(makerOrders, makerOrder)
+		baseTokenFilledAmounts = append(baseTokenFilledAmounts, filledAmount)
+	}
+
+	data := b.config.Nova.GetMatchOrderCallData(takerOrder, makerOrders, baseTokenFilledAmounts)
+
+	gasLimit, err := b.gasLimit(data, len(makerOrders))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return &Batch{
+		MatchID:  matchResult.MatchID,
+		MarketID: market.ID,
+		Items:    items,
+		LaunchLog: &launcher.LaunchLog{
+			ItemType:  ItemTypeMatchOrders,
+			Status:    common.STATUS_CREATED,
+			From:      b.config.RelayerAddress,
+			To:        b.config.NovaContractAddress,
+			Value:     decimal.Zero,
+			GasLimit:  gasLimit,
+			Data:      utils.Bytes2HexP(data),
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+	}, nil
+}
+
+func (b *Builder) sdkOrder(market *Market, order *common.MemoryOrder) (*sdk.Order, error) {
+	signed, err := b.config.Orders.GetSignedOrder(order.ID)
+	if err != nil {
+		return nil, fmt.Errorf("get signed order %s error: %v", order.ID, err)
+	}
+
+	if signed.Trader != order.Trader {
+		return nil, fmt.Errorf("signed order %s belongs to %s, not %s", order.ID, signed.Trader, order.Trader)
+	}
+
+	baseTokenAmount, err := toBaseUnits(signed.BaseTokenAmount, market.BaseTokenDecimals)
+	if err != nil {
+		return nil, fmt.Errorf("base token amount of order %s: %v", order.ID, err)
+	}
+
+	quoteTokenAmount, err := toBaseUnits(signed.QuoteTokenAmount, market.QuoteTokenDecimals)
+	if err != nil {
+		return nil, fmt.Errorf("quote token amount of order %s: %v", order.ID, err)
+	}
+
+	// gas fees are paid in the quote token
+	gasTokenAmount, err := toBaseUnits(signed.GasTokenAmount, market.QuoteTokenDecimals)
+	if err != nil {
+		return nil, fmt.Errorf("gas token amount of order %s: %v", order.ID, err)
+	}
+
+	return sdk.NewOrderWithData(
+		signed.Trader,
+		b.config.RelayerAddress,
+		market.BaseTokenAddress,
+		market.QuoteTokenAddress,
+		baseTokenAmount,
+		quoteTokenAmount,
+		gasTokenAmount,
+		signed.Data,
+		signed.Signature,
+	), nil
+}
+
+func (b *Builder) gasLimit(data []byte, makers int) (int64, error) {
+	if b.config.GasEstimator == nil {
+		return b.config.BaseGasLimit + b.config.GasLimitPerMaker*int64(makers), nil
+	}
+
+	gas, err := b.config.GasEstimator.EstimateGas(b.config.RelayerAddress, b.config.NovaContractAddress, data)
+	if err != nil {
+		return 0, fmt.Errorf("estimate gas error: %v", err)
+	}
+
+	return decimal.New(gas, 0).Mul(decimal.New(1, 0).Add(b.config.GasLimitMargin)).Ceil().IntPart(), nil
+}
+
+// toBaseUnits fails if the amount has more decimal places than the token
+func toBaseUnits(amount decimal.Decimal, decimals int32) (*big.Int, error) {
+	if amount.IsNegative() {
+		return nil, fmt.Errorf("negative amount %s", amount)
+	}
+
+	units := amount.Shift(decimals)
+	if !units.Equal(units.Truncate(0)) {
+		return nil, fmt.Errorf("amount %s has more than %d decimal places", amount, decimals)
+	}
+
+	return utils.DecimalToBigInt(units), nil
+}
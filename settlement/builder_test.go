@@ -0,0 +1,162 @@
+package settlement
+
+import (
+	"errors"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/sdk"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+	"math/big"
+	"testing"
+)
+
+type builderTestSuite struct {
+	suite.Suite
+	nova   *sdk.MockNovaProtocol
+	orders map[string]*SignedOrder
+}
+
+func TestBuilderTestSuite(t *testing.T) {
+	suite.Run(t, new(builderTestSuite))
+}
+
+func (s *builderTestSuite) SetupTest() {
+	s.nova = &sdk.MockNovaProtocol{}
+	s.orders = map[string]*SignedOrder{
+		"taker": {Trader: "t", BaseTokenAmount: decimal.New(3, 0), QuoteTokenAmount: decimal.New(3, -1), GasTokenAmount: decimal.New(1, -3), Data: "0x01", Signature: "0xaa"},
+		"m1":    {Trader: "m1", BaseTokenAmount: decimal.New(1, 0), QuoteTokenAmount: decimal.New(1, -1), Data: "0x02", Signature: "0xbb"},
+		"m2":    {Trader: "m2", BaseTokenAmount: decimal.New(2, 0), QuoteTokenAmount: decimal.New(2, -1), Data: "0x03", Signature: "0xcc"},
+	}
+}
+
+func (s *builderTestSuite) builder(estimator GasEstimator) *Builder {
+	return NewBuilder(&Config{
+		Nova: s.nova,
+		Orders: OrderSourceFunc(func(orderID string) (*SignedOrder, error) {
+			order, exist := s.orders[orderID]
+			if !exist {
+				return nil, errors.New("not found")
+			}
+
+			return order, nil
+		}),
+		Markets: map[string]*Market{
+			"HOT-WETH": {ID: "HOT-WETH", BaseTokenAddress: "0xhot", BaseTokenDecimals: 18, QuoteTokenAddress: "0xweth", QuoteTokenDecimals: 18},
+		},
+		RelayerAddress:      "0xrelayer",
+		NovaContractAddress: "0xnova",
+		GasEstimator:        estimator,
+		GasLimitMargin:      decimal.New(2, -1),
+	})
+}
+
+func (s *builderTestSuite) matchResult(canceled ...bool) *common.MatchResult {
+	result := &common.MatchResult{
+		MatchID:    "HOT-WETH-1",
+		TakerOrder: &common.MemoryOrder{ID: "taker", MarketID: "HOT-WETH", Trader: "t", Side: "buy"},
+	}
+
+	for i, id := range []string{"m1", "m2"} {
+		result.MatchItems = append(result.MatchItems, &common.MatchItem{
+			MakerOrder:            &common.MemoryOrder{ID: id, MarketID: "HOT-WETH", Trader: id, Side: "sell"},
+			MatchedAmount:         decimal.New(int64(i+1), -1),
+			MatchShouldBeCanceled: i < len(canceled) && canceled[i],
+		})
+	}
+
+	return result
+}
+
+func units(amount string) *big.Int {
+	return utils.DecimalToBigInt(utils.StringToDecimal(amount).Shift(18))
+}
+
+func (s *builderTestSuite) TestBuild() {
+	s.nova.On("GetMatchOrderCallData", mock.Anything, mock.Anything, mock.Anything).Return([]byte{1, 2, 3})
+
+	batch, err := s.builder(nil).Build(s.matchResult())
+	s.Nil(err)
+
+	s.Equal("HOT-WETH-1", batch.MatchID)
+	s.Len(batch.Items, 2)
+	s.Equal(ItemTypeMatchOrders, batch.LaunchLog.ItemType)
+	s.Equal(common.STATUS_CREATED, batch.LaunchLog.Status)
+	s.Equal("0xrelayer", batch.LaunchLog.From)
+	s.Equal("0xnova", batch.LaunchLog.To)
+	s.Equal("0x010203", batch.LaunchLog.Data)
+	s.True(batch.LaunchLog.Value.IsZero())
+	s.Equal(DefaultBaseGasLimit+2*DefaultGasLimitPerMaker, batch.LaunchLog.GasLimit)
+
+	args := s.nova.Calls[0].Arguments
+	taker := args.Get(0).(*sdk.Order)
+	makers := args.Get(1).([]*sdk.Order)
+	filled := args.Get(2).([]*big.Int)
+
+	s.Equal("0xrelayer", taker.Relayer)
+	s.Equal("0xhot", taker.BaseTokenAddress)
+	s.Equal(0, units("3").Cmp(taker.BaseTokenAmount))
+	s.Equal(0, units("0.3").Cmp(taker.QuoteTokenAmount))
+	s.Equal(0, units("0.001").Cmp(taker.GasTokenAmount))
+	s.Equal("0xaa", taker.Signature)
+
+	s.Len(makers, 2)
+	s.Equal("m2", makers[1].Trader)
+	s.Equal("0x03", makers[1].Data)
+	s.Equal(0, units("0.1").Cmp(filled[0]))
+	s.Equal(0, units("0.2").Cmp(filled[1]))
+}
+
+func (s *builderTestSuite) TestSkipCanceledItems() {
+	s.nova.On("GetMatchOrderCallData", mock.Anything, mock.Anything, mock.Anything).Return([]byte{1})
+
+	batch, err := s.builder(nil).Build(s.matchResult(true, false))
+	s.Nil(err)
+	s.Len(batch.Items, 1)
+	s.Equal("m2", batch.Items[0].MakerOrder.ID)
+
+	makers := s.nova.Calls[0].Arguments.Get(1).([]*sdk.Order)
+	s.Len(makers, 1)
+	s.Equal("m2", makers[0].Trader)
+
+	_, err = s.builder(nil).Build(s.matchResult(true, true))
+	s.Equal(ErrNothingToSettle, err)
+}
+
+type fixedGasEstimator int64
+
+func (g fixedGasEstimator) EstimateGas(from, to string, data []byte) (int64, error) {
+	return int64(g), nil
+}
+
+func (s *builderTestSuite) TestGasEstimator() {
+	s.nova.On("GetMatchOrderCallData", mock.Anything, mock.Anything, mock.Anything).Return([]byte{1})
+
+	batch, err := s.builder(fixedGasEstimator(100001)).Build(s.matchResult())
+	s.Nil(err)
+	s.Equal(int64(120002), batch.LaunchLog.GasLimit)
+}
+
+func (s *builderTestSuite) TestErrors() {
+	s.nova.On("GetMatchOrderCallData", mock.Anything, mock.Anything, mock.Anything).Return([]byte{1})
+
+	result := s.matchResult()
+	result.TakerOrder.MarketID = "ABC-WETH"
+	_, err := s.builder(nil).Build(result)
+	s.Equal(ErrUnknownMarket, err)
+
+	result = s.matchResult()
+	result.MatchItems[0].MatchedAmount = decimal.New(1, -19)
+	_, err = s.builder(nil).Build(result)
+	s.Error(err)
+
+	result = s.matchResult()
+	result.MatchItems[1].MakerOrder.Trader = "someone else"
+	_, err = s.builder(nil).Build(result)
+	s.Error(err)
+
+	delete(s.orders, "m1")
+	_, err = s.builder(nil).Build(s.matchResult())
+	s.Error(err)
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 const DefaultMetricPort = "3006"
@@ -40,7 +43,8 @@ func (MetricsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	responseBody(resp, "Hello")
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	responseBody(resp, exportMetrics())
 }
 
 func responseBody(resp http.ResponseWriter, data string) {
@@ -49,3 +53,101 @@ func responseBody(resp http.ResponseWriter, data string) {
 		Errorf("metrics error: %v", err)
 	}
 }
+
+// CounterVec is a group of counters with the same name told apart by label values.
+// Registered counters are exported by MetricsHandler in the prometheus text format.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]uint64
+}
+
+var registry struct {
+	lock     sync.Mutex
+	counters []*CounterVec
+}
+
+// NewCounterVec creates and registers a counter, label values are given in the same order as labels
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]uint64),
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.counters = append(registry.counters, c)
+
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	key := c.key(labelValues)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.values[key] = c.values[key] + 1
+}
+
+func (c *CounterVec) Value(labelValues ...string) uint64 {
+	key := c.key(labelValues)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.values[key]
+}
+
+func (c *CounterVec) key(labelValues []string) string {
+	pairs := make([]string, 0, len(c.labels))
+	for i, label := range c.labels {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+
+		pairs = append(pairs, fmt.Sprintf("%s=%q", label, value))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (c *CounterVec) export(b *strings.Builder) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key == "" {
+			fmt.Fprintf(b, "%s %d\n", c.name, c.values[key])
+		} else {
+			fmt.Fprintf(b, "%s{%s} %d\n", c.name, key, c.values[key])
+		}
+	}
+}
+
+func exportMetrics() string {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	var b strings.Builder
+	for _, c := range registry.counters {
+		c.export(&b)
+	}
+
+	return b.String()
+}
@@ -63,12 +63,17 @@ func (w *Watcher) Run() {
 				continue
 			}
 
-			w.lastSyncedBlockNumber = w.lastSyncedBlockNumber + 1
-			err = w.KVClient.Set(common.NOVA_WATCHER_BLOCK_NUMBER_CACHE_KEY, strconv.FormatUint(w.lastSyncedBlockNumber, 10), 0)
+			saved, err := w.saveBlockNumber(w.lastSyncedBlockNumber, w.lastSyncedBlockNumber+1)
 
 			if err != nil {
 				utils.Errorf("Watcher Save LastSyncedBlockNumber Error %v", err)
+			} else if !saved {
+				utils.Errorf("Watcher LastSyncedBlockNumber is changed by another watcher, reload it")
+				w.initBlockNumber()
+				continue
 			}
+
+			w.lastSyncedBlockNumber = w.lastSyncedBlockNumber + 1
 		}
 	}
 }
@@ -103,6 +108,20 @@ func (w *Watcher) initBlockNumber() {
 	return
 }
 
+// saveBlockNumber advances the cached block number from previous to current atomically,
+// it returns false if the cache doesn't hold previous, e.g. another watcher has moved it.
+func (w *Watcher) saveBlockNumber(previous, current uint64) (bool, error) {
+	value := strconv.FormatUint(current, 10)
+
+	saved, err := w.KVClient.CompareAndSwap(common.NOVA_WATCHER_BLOCK_NUMBER_CACHE_KEY, strconv.FormatUint(previous, 10), value, 0)
+	if err != nil || saved {
+		return saved, err
+	}
+
+	// nothing is cached before the first block is synced
+	return w.KVClient.SetNX(common.NOVA_WATCHER_BLOCK_NUMBER_CACHE_KEY, value, 0)
+}
+
 func (w *Watcher) syncNextBlock() (err error) {
 	utils.Debugf("Sync Block %d", w.lastSyncedBlockNumber+1)
 
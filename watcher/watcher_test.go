@@ -50,6 +50,26 @@ func (s *watcherTestSuit) TestInitLastBlockNumberWithoutCache() {
 	s.Equal(uint64(10086), watcher.lastSyncedBlockNumber)
 }
 
+func (s *watcherTestSuit) TestSaveBlockNumber() {
+	watcher := s.InitWatcher()
+	watcher.KVClient, _ = common.InitKVStore(&common.MemoryKVStoreConfig{Name: "watcher-test", Namespace: "test:"})
+	s.Nil(watcher.KVClient.Delete(common.NOVA_WATCHER_BLOCK_NUMBER_CACHE_KEY))
+
+	saved, err := watcher.saveBlockNumber(10, 11)
+	s.Nil(err)
+	s.True(saved)
+
+	saved, _ = watcher.saveBlockNumber(11, 12)
+	s.True(saved)
+
+	// another watcher has saved 12
+	saved, _ = watcher.saveBlockNumber(11, 12)
+	s.False(saved)
+
+	value, _ := watcher.KVClient.Get(common.NOVA_WATCHER_BLOCK_NUMBER_CACHE_KEY)
+	s.Equal("12", value)
+}
+
 func TestWatcherSuite(t *testing.T) {
 	suite.Run(t, new(watcherTestSuit))
 }
@@ -0,0 +1,142 @@
+package websocket
+
+import (
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"time"
+)
+
+// CandleHistoryFetcher returns the latest bars of a market, oldest first
+type CandleHistoryFetcher interface {
+	GetCandles(marketID string, interval common.CandleInterval) ([]*common.Candle, error)
+}
+
+// AggregatorCandleFetcher reads history from a candle aggregator.
+// A websocket server in another process can use an aggregator on the same store, it doesn't need trades.
+type AggregatorCandleFetcher struct {
+	Aggregator *common.CandleAggregator
+
+	// Limit is the number of bars, common.DefaultCandleHistoryLimit if it is 0
+	Limit int
+}
+
+func (f *AggregatorCandleFetcher) GetCandles(marketID string, interval common.CandleInterval) ([]*common.Candle, error) {
+	return f.Aggregator.Candles(marketID, interval, uint64(time.Now().Unix()), f.Limit)
+}
+
+type candleSnapshot struct {
+	Type     string                `json:"type"`
+	MarketID string                `json:"marketID"`
+	Interval common.CandleInterval `json:"interval"`
+	Candles  []*common.Candle      `json:"candles"`
+}
+
+type candleUpdate struct {
+	Type     string                `json:"type"`
+	MarketID string                `json:"marketID"`
+	Interval common.CandleInterval `json:"interval"`
+	Candle   *common.Candle        `json:"candle"`
+}
+
+type candleChannel struct {
+	*Channel
+	MarketID string
+	Interval common.CandleInterval
+
+	fetcher CandleHistoryFetcher
+
+	// last is the latest bar received, it may be newer than the history
+	last *common.Candle
+}
+
+func (c *candleChannel) handleSubscriber(client *Client) {
+	c.Channel.handleSubscriber(client)
+
+	candles, err := c.fetcher.GetCandles(c.MarketID, c.Interval)
+	if err != nil {
+		utils.Errorf("get history of channel %s error: %v", c.ID, err)
+	}
+
+	candles = mergeLastCandle(candles, c.last)
+	if candles == nil {
+		candles = []*common.Candle{}
+	}
+
+	msg := &candleSnapshot{
+		Type:     "candleSnapshot",
+		MarketID: c.MarketID,
+		Interval: c.Interval,
+		Candles:  candles,
+	}
+
+	if err = client.Send(msg); err != nil {
+		utils.Debugf("send message to client error: %v", err)
+		c.handleUnsubscriber(client.ID)
+	}
+}
+
+func (c *candleChannel) handleMessage(msg *common.WebSocketMessage) {
+	p, ok := msg.Payload.(*common.WebsocketCandleUpdatePayload)
+	if !ok || p.Candle == nil {
+		utils.Errorf("invalid candle update %T of channel %s", msg.Payload, c.ID)
+		return
+	}
+
+	// updates of older bars are late, the bar has moved on
+	if c.last != nil && p.Candle.OpenTime < c.last.OpenTime {
+		return
+	}
+
+	c.last = p.Candle
+
+	messageToBeSent := &candleUpdate{
+		Type:     common.WsTypeCandleUpdate,
+		MarketID: c.MarketID,
+		Interval: c.Interval,
+		Candle:   p.Candle,
+	}
+
+	for _, client := range c.Clients {
+		if err := client.Send(messageToBeSent); err != nil {
+			utils.Debugf("send message to client error: %v", err)
+			c.handleUnsubscriber(client.ID)
+		}
+	}
+}
+
+// mergeLastCandle replaces or appends the live bar to the history
+func mergeLastCandle(candles []*common.Candle, last *common.Candle) []*common.Candle {
+	if last == nil {
+		return candles
+	}
+
+	if n := len(candles); n > 0 {
+		switch {
+		case candles[n-1].OpenTime == last.OpenTime:
+			return append(candles[:n-1], last)
+		case candles[n-1].OpenTime > last.OpenTime:
+			return candles
+		}
+	}
+
+	return append(candles, last)
+}
+
+// NewCandleChannelCreator creates channels with ids like Candles#HOT-WETH#1m,
+// register it with RegisterChannelCreator(common.CandleChannelPrefix, ...)
+func NewCandleChannelCreator(fetcher CandleHistoryFetcher) func(channelID string) IChannel {
+	return func(channelID string) IChannel {
+		marketID, interval, err := common.ParseCandleChannelID(channelID)
+		if err != nil {
+			utils.Errorf("create candles channel error: %v", err)
+			return createBaseChannel(channelID)
+		}
+
+		return &candleChannel{
+			Channel:  createBaseChannel(channelID),
+			MarketID: marketID,
+			Interval: interval,
+			fetcher:  fetcher,
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package websocket
+
+import (
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/shopspring/decimal"
+)
+
+type mockCandleFetcher struct {
+	candles []*common.Candle
+}
+
+func (f *mockCandleFetcher) GetCandles(marketID string, interval common.CandleInterval) ([]*common.Candle, error) {
+	res := make([]*common.Candle, 0, len(f.candles))
+	for _, candle := range f.candles {
+		res = append(res, candle.Copy())
+	}
+
+	return res, nil
+}
+
+func newCandle(openTime uint64, close int64) *common.Candle {
+	price := decimal.New(close, 0)
+
+	return &common.Candle{
+		MarketID: "HOT-WETH",
+		Interval: common.CandleInterval1m,
+		OpenTime: openTime,
+		Open:     price,
+		High:     price,
+		Low:      price,
+		Close:    price,
+	}
+}
+
+func (s *channelTestSuit) TestRunCandleChannel() {
+	fetcher := &mockCandleFetcher{candles: []*common.Candle{newCandle(60, 1), newCandle(120, 2)}}
+
+	channel := NewCandleChannelCreator(fetcher)("Candles#HOT-WETH#1m").(*candleChannel)
+	s.Equal("HOT-WETH", channel.MarketID)
+	s.Equal(common.CandleInterval1m, channel.Interval)
+
+	go runChannel(channel)
+
+	c1, c1Connection := s.InitRecordingClient()
+	channel.AddSubscriber(c1)
+
+	snapshot := c1Connection.next().(*candleSnapshot)
+	s.Equal("candleSnapshot", snapshot.Type)
+	s.Len(snapshot.Candles, 2)
+
+	// live update of the last bar
+	msg := common.CandleUpdateMessage(newCandle(120, 3))
+	channel.AddMessage(&msg)
+
+	update := c1Connection.next().(*candleUpdate)
+	s.Equal("3", update.Candle.Close.String())
+
+	// a late update of an older bar is dropped
+	late := common.CandleUpdateMessage(newCandle(60, 4))
+	channel.AddMessage(&late)
+	s.True(c1Connection.idle())
+
+	// a new subscriber gets the live bar with the history
+	next := common.CandleUpdateMessage(newCandle(180, 5))
+	channel.AddMessage(&next)
+	s.IsType(&candleUpdate{}, c1Connection.next())
+
+	c2, c2Connection := s.InitRecordingClient()
+	channel.AddSubscriber(c2)
+
+	snapshot = c2Connection.next().(*candleSnapshot)
+	s.Len(snapshot.Candles, 3)
+	s.Equal(uint64(180), snapshot.Candles[2].OpenTime)
+}
@@ -74,7 +74,7 @@ func runChannel(c IChannel) {
 	for {
 		select {
 		case msg := <-c.MessagesChan():
-			c.handleMessage(msg)
+			handleMessageSafely(c, msg)
 		case client := <-c.SubScribeChan():
 			c.handleSubscriber(client)
 		case ID := <-c.UnsubscribeChan():
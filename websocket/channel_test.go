@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -28,6 +29,37 @@ func (m *MockWebsocketConnection) RemoteAddr() net.Addr {
 	return args.Get(0).(net.Addr)
 }
 
+// recordingConnection passes written messages to the test goroutine through a channel
+type recordingConnection struct {
+	MockWebsocketConnection
+	sent chan interface{}
+}
+
+func (c *recordingConnection) WriteJSON(data interface{}) error {
+	c.sent <- data
+	return nil
+}
+
+// next waits for the next written message
+func (c *recordingConnection) next() interface{} {
+	select {
+	case data := <-c.sent:
+		return data
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+// idle is true if nothing is written in a while
+func (c *recordingConnection) idle() bool {
+	select {
+	case <-c.sent:
+		return false
+	case <-time.After(time.Millisecond * 20):
+		return true
+	}
+}
+
 type channelTestSuit struct {
 	suite.Suite
 }
@@ -41,6 +73,14 @@ func (s *channelTestSuit) InitClient() (*Client, *MockWebsocketConnection) {
 	return client, conn
 }
 
+func (s *channelTestSuit) InitRecordingClient() (*Client, *recordingConnection) {
+	client := NewClient()
+	conn := &recordingConnection{sent: make(chan interface{}, 16)}
+
+	client.Conn = conn
+	return client, conn
+}
+
 func (s *channelTestSuit) SetupSuite() {
 }
 
@@ -181,3 +221,77 @@ func (s *channelTestSuit) TestCreateChannel() {
 func TestChannelSuit(t *testing.T) {
 	suite.Run(t, new(channelTestSuit))
 }
+
+type snapshotFetcherFunc func(marketID string) *common.SnapshotV2
+
+func (f snapshotFetcherFunc) GetV2(marketID string) *common.SnapshotV2 {
+	return f(marketID)
+}
+
+func (s *channelTestSuit) TestMarketChannelResyncsOnGap() {
+	snapshots := make(chan *common.SnapshotV2, 2)
+	snapshots <- &common.SnapshotV2{Sequence: 12, Bids: [][2]string{{"1", "1"}}, Asks: [][2]string{{"2", "1"}}}
+	// 13 and 14 were dropped by the bus
+	snapshots <- &common.SnapshotV2{Sequence: 14, Bids: [][2]string{{"1", "3"}}, Asks: [][2]string{{"2", "1"}}}
+
+	fetcher := snapshotFetcherFunc(func(marketID string) *common.SnapshotV2 {
+		return <-snapshots
+	})
+
+	channel := NewMarketChannelCreator(fetcher)("Market#HOT-WETH").(*marketChannel)
+	go runChannel(channel)
+
+	c1, c1Connection := s.InitRecordingClient()
+	channel.AddSubscriber(c1)
+	s.IsType(&orderbookLevel2Snapshot{}, c1Connection.next())
+
+	channel.AddMessage(s.buildWesocketMessage(15, "buy", "1", "1"))
+
+	// the new snapshot and the update
+	snapshot := c1Connection.next().(*orderbookLevel2Snapshot)
+	s.Equal([][2]string{{"1", "3"}}, snapshot.Bids)
+
+	update := c1Connection.next().(*orderbookLevel2Update)
+	s.Equal("1", update.Price)
+	s.Equal("4", update.Amount)
+	s.True(c1Connection.idle())
+}
+
+func (s *channelTestSuit) TestMarketChannelCoalescesResyncs() {
+	var fetches int32
+	release := make(chan struct{})
+
+	fetcher := snapshotFetcherFunc(func(marketID string) *common.SnapshotV2 {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			return &common.SnapshotV2{Sequence: 12, Bids: [][2]string{{"1", "1"}}, Asks: [][2]string{{"2", "1"}}}
+		}
+
+		<-release
+		return &common.SnapshotV2{Sequence: 18, Bids: [][2]string{{"1", "5"}}, Asks: [][2]string{{"2", "1"}}}
+	})
+
+	channel := NewMarketChannelCreator(fetcher)("Market#HOT-WETH").(*marketChannel)
+	go runChannel(channel)
+
+	c1, c1Connection := s.InitRecordingClient()
+	channel.AddSubscriber(c1)
+	s.IsType(&orderbookLevel2Snapshot{}, c1Connection.next())
+
+	// every message has a gap, they are held back while the snapshot is fetched
+	channel.AddMessage(s.buildWesocketMessage(15, "buy", "1", "1"))
+	channel.AddMessage(s.buildWesocketMessage(17, "buy", "1", "1"))
+	channel.AddMessage(s.buildWesocketMessage(19, "buy", "1", "1"))
+	s.True(c1Connection.idle())
+
+	close(release)
+
+	// 15 and 17 are included in the snapshot
+	snapshot := c1Connection.next().(*orderbookLevel2Snapshot)
+	s.Equal([][2]string{{"1", "5"}}, snapshot.Bids)
+
+	update := c1Connection.next().(*orderbookLevel2Update)
+	s.Equal("6", update.Amount)
+	s.True(c1Connection.idle())
+
+	s.Equal(int32(2), atomic.LoadInt32(&fetches))
+}
@@ -2,7 +2,7 @@ package websocket
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"github.com/novaprotocolio/sdk-backend/common"
 	"github.com/novaprotocolio/sdk-backend/utils"
 )
@@ -18,24 +18,49 @@ func startConsumer(ctx context.Context, queue common.IQueue) {
 
 			// This method should not block this go thread all the time to make it has chance to exit gracefully
 			msg, err := queue.Pop()
-			if err != nil {
+			if err == common.EXIT {
+				continue
+			} else if err != nil {
 				utils.Errorf("read message error %v", err)
 				continue
 			}
 
 			utils.Debugf("rec msg: %s", string(msg))
 
-			var wsMsg common.WebSocketMessage
+			consumeMessage(msg)
+		}
+	}
+}
 
-			_ = json.Unmarshal(msg, &wsMsg)
+// consumeMessage dispatches one message to its channel,
+// a message which can't be decoded, is invalid or panics becomes a dead letter.
+func consumeMessage(msg []byte) {
+	var channelID string
 
-			channel := findChannel(wsMsg.ChannelID)
+	defer func() {
+		if r := recover(); r != nil {
+			addDeadLetter(DeadLetterHandle, fmt.Errorf("%v", r), channelID, msg)
+		}
+	}()
 
-			if channel == nil {
-				channel = createChannelByID(wsMsg.ChannelID)
-			}
+	wsMsg, err := common.DecodeWebSocketMessage(msg)
+	if err != nil {
+		addDeadLetter(DeadLetterDecode, err, "", msg)
+		return
+	}
 
-			channel.AddMessage(&wsMsg)
-		}
+	channelID = wsMsg.ChannelID
+
+	if wsMsg.ChannelID == "" || wsMsg.Payload == nil {
+		addDeadLetter(DeadLetterInvalid, fmt.Errorf("message without channel id or payload"), wsMsg.ChannelID, msg)
+		return
+	}
+
+	channel := findChannel(wsMsg.ChannelID)
+
+	if channel == nil {
+		channel = createChannelByID(wsMsg.ChannelID)
 	}
+
+	channel.AddMessage(wsMsg)
 }
@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"sync"
+	"time"
+)
+
+const (
+	DeadLetterDecode  = "decode"
+	DeadLetterInvalid = "invalid"
+	DeadLetterHandle  = "handle"
+)
+
+// DeadLetter is a message which failed decoding or handling, Data is the message as it was popped.
+// Reason is one of DeadLetterDecode, DeadLetterInvalid and DeadLetterHandle.
+type DeadLetter struct {
+	Reason    string `json:"reason"`
+	Error     string `json:"error"`
+	ChannelID string `json:"channelID,omitempty"`
+	Data      []byte `json:"data"`
+	FailedAt  int64  `json:"failedAt"`
+}
+
+// DeadLetterStats counts dead letters since the process started
+type DeadLetterStats struct {
+	DecodeFailures  uint64
+	InvalidMessages uint64
+	HandleFailures  uint64
+	Redriven        uint64
+}
+
+// DeadLetters counts dead letters, labeled by reason
+var DeadLetters = utils.NewCounterVec(
+	"websocket_dead_letters_total",
+	"Websocket messages which failed decoding or handling.",
+	"reason",
+)
+
+// RedrivenDeadLetters counts dead letters pushed back by RedriveDeadLetters
+var RedrivenDeadLetters = utils.NewCounterVec(
+	"websocket_dead_letters_redriven_total",
+	"Dead letters pushed back to their source queue.",
+)
+
+// deadLetterRedriveWait is how long RedriveDeadLetters waits for a letter before the queue counts as empty
+const deadLetterRedriveWait = 100 * time.Millisecond
+
+var deadLetterQueue common.IQueue
+var deadLetterQueueMutex = &sync.RWMutex{}
+
+// SetDeadLetterQueue sets the sink of dead letters, e.g. a FileQueueConfig queue.
+// Dead letters are only logged and counted if it is nil.
+func SetDeadLetterQueue(queue common.IQueue) {
+	deadLetterQueueMutex.Lock()
+	defer deadLetterQueueMutex.Unlock()
+
+	deadLetterQueue = queue
+}
+
+func GetDeadLetterStats() DeadLetterStats {
+	return DeadLetterStats{
+		DecodeFailures:  DeadLetters.Value(DeadLetterDecode),
+		InvalidMessages: DeadLetters.Value(DeadLetterInvalid),
+		HandleFailures:  DeadLetters.Value(DeadLetterHandle),
+		Redriven:        RedrivenDeadLetters.Value(),
+	}
+}
+
+func addDeadLetter(reason string, err error, channelID string, data []byte) {
+	DeadLetters.Inc(reason)
+
+	utils.Errorf("dead letter, %s error: %v, channel: %s, message: %s", reason, err, channelID, string(data))
+
+	deadLetterQueueMutex.RLock()
+	queue := deadLetterQueue
+	deadLetterQueueMutex.RUnlock()
+
+	if queue == nil {
+		return
+	}
+
+	bts, _ := json.Marshal(&DeadLetter{
+		Reason:    reason,
+		Error:     err.Error(),
+		ChannelID: channelID,
+		Data:      data,
+		FailedAt:  time.Now().Unix(),
+	})
+
+	if err = queue.Push(bts); err != nil {
+		utils.Errorf("push dead letter error: %v", err)
+	}
+}
+
+// RedriveDeadLetters pushes the messages of at most max dead letters back to target, usually the source queue of the server.
+// It stops once the dead letter queue is empty or timeout has passed, deadLetters must be a common.ITimeoutQueue.
+func RedriveDeadLetters(deadLetters common.IQueue, target common.IPusher, max int, timeout time.Duration) (int, error) {
+	queue, ok := deadLetters.(common.ITimeoutQueue)
+	if !ok {
+		return 0, fmt.Errorf("dead letter queue %T can't pop with a timeout", deadLetters)
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for i := 0; i < max; i++ {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return i, nil
+		} else if wait > deadLetterRedriveWait {
+			wait = deadLetterRedriveWait
+		}
+
+		bts, err := queue.PopTimeout(wait)
+		if err == common.EXIT || err == common.QueueTimeout {
+			return i, nil
+		} else if err != nil {
+			return i, err
+		}
+
+		var letter DeadLetter
+		if err = json.Unmarshal(bts, &letter); err != nil {
+			return i, fmt.Errorf("invalid dead letter %s: %v", string(bts), err)
+		}
+
+		if err = target.Push(letter.Data); err != nil {
+			_ = deadLetters.Push(bts)
+			return i, err
+		}
+
+		RedrivenDeadLetters.Inc()
+	}
+
+	return max, nil
+}
+
+// handleMessageSafely keeps the channel running if the message panics
+func handleMessageSafely(c IChannel, msg *common.WebSocketMessage) {
+	defer func() {
+		if r := recover(); r != nil {
+			addDeadLetter(DeadLetterHandle, fmt.Errorf("%v", r), c.GetID(), deadLetterData(msg))
+		}
+	}()
+
+	c.handleMessage(msg)
+}
+
+// deadLetterData encodes a decoded message back for a dead letter
+func deadLetterData(msg *common.WebSocketMessage) []byte {
+	data, err := common.EncodeWebSocketMessage(common.JSONCodec, msg)
+	if err != nil {
+		data = []byte(fmt.Sprintf("%+v", msg.Payload))
+	}
+
+	return data
+}
@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/novaprotocolio/sdk-backend/common"
+	"time"
+)
+
+func (s *channelTestSuit) TestDeadLetters() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	deadLetters, _ := common.InitQueue(&common.MemoryQueueConfig{Name: fmt.Sprintf("NSK_TEST_DEAD_LETTERS_%d", time.Now().UnixNano()), Ctx: ctx})
+	SetDeadLetterQueue(deadLetters)
+	defer SetDeadLetterQueue(nil)
+
+	stats := GetDeadLetterStats()
+
+	popDeadLetter := func() *DeadLetter {
+		bts, err := deadLetters.Pop()
+		s.Nil(err)
+
+		var letter DeadLetter
+		s.Nil(json.Unmarshal(bts, &letter))
+
+		return &letter
+	}
+
+	consumeMessage([]byte("not a json"))
+	letter := popDeadLetter()
+	s.Equal(DeadLetterDecode, letter.Reason)
+	s.Equal("not a json", string(letter.Data))
+
+	consumeMessage([]byte(`{"channel_id":"","payload":{"type":"lockedBalanceChange"}}`))
+	s.Equal(DeadLetterInvalid, popDeadLetter().Reason)
+
+	channel, _ := s.NewMockMarketChannel("Market#DEAD-LETTER")
+
+	c1, c1Connection := s.InitRecordingClient()
+	channel.AddSubscriber(c1)
+	s.IsType(&orderbookLevel2Snapshot{}, c1Connection.next())
+
+	// the change of a price level which doesn't exist panics, the channel rebuilds its orderbook and keeps running
+	channel.AddMessage(s.buildWesocketMessage(13, "sell", "3", "-1"))
+
+	letter = popDeadLetter()
+	s.Equal(DeadLetterHandle, letter.Reason)
+	s.Equal("Market#DEAD-LETTER", letter.ChannelID)
+	s.IsType(&orderbookLevel2Snapshot{}, c1Connection.next())
+
+	// a payload the market channel doesn't handle
+	channel.AddMessage(&common.WebSocketMessage{
+		ChannelID: "Market#DEAD-LETTER",
+		Payload:   &common.WebsocketLockedBalanceChangePayload{Type: common.WsTypeLockedBalanceChange},
+	})
+
+	letter = popDeadLetter()
+	s.Equal(DeadLetterInvalid, letter.Reason)
+	s.Equal("Market#DEAD-LETTER", letter.ChannelID)
+	s.Contains(string(letter.Data), common.WsTypeLockedBalanceChange)
+	s.True(c1Connection.idle())
+
+	current := GetDeadLetterStats()
+	s.Equal(stats.DecodeFailures+1, current.DecodeFailures)
+	s.Equal(stats.InvalidMessages+2, current.InvalidMessages)
+	s.Equal(stats.HandleFailures+1, current.HandleFailures)
+
+	// re-drive the letter after the cause is fixed
+	consumeMessage([]byte("not a json"))
+	source, _ := common.InitQueue(&common.MemoryQueueConfig{Name: fmt.Sprintf("NSK_TEST_SOURCE_%d", time.Now().UnixNano()), Ctx: ctx})
+
+	redriven, err := RedriveDeadLetters(deadLetters, source, 10, time.Second)
+	s.Nil(err)
+	s.Equal(1, redriven)
+	s.Equal(stats.Redriven+1, GetDeadLetterStats().Redriven)
+	s.Equal(stats.DecodeFailures+2, DeadLetters.Value(DeadLetterDecode))
+
+	bts, _ := source.Pop()
+	s.Equal("not a json", string(bts))
+
+	// an empty queue stops the redrive before the timeout
+	start := time.Now()
+	redriven, err = RedriveDeadLetters(deadLetters, source, 10, time.Minute)
+	s.Nil(err)
+	s.Equal(0, redriven)
+	s.True(time.Since(start) < time.Second)
+}
@@ -1,17 +1,38 @@
 package websocket
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/novaprotocolio/sdk-backend/common"
 	"github.com/novaprotocolio/sdk-backend/utils"
 	"strings"
+	"time"
 )
 
+// MarketChannelResyncInterval is the least time between two snapshot fetches of a market channel
+var MarketChannelResyncInterval = time.Second
+
+// marketChannelResyncBufferSize is the number of orderbook changes kept while a snapshot is fetched, older ones are dropped
+const marketChannelResyncBufferSize = 1024
+
 type marketChannel struct {
 	*Channel
 	MarketID  string
 	Orderbook *Orderbook
+
+	fetcher SnapshotFetcher
+
+	// number of times missed messages were found and the orderbook was rebuilt
+	Resyncs uint64
+
+	// while a snapshot is fetched, orderbook changes are buffered and applied after it arrives
+	resyncing    bool
+	resyncBuffer []*common.WebsocketMarketOrderChangePayload
+	lastResyncAt time.Time
+}
+
+// resyncSnapshot is a fetched snapshot given back to the channel goroutine through its messages
+type resyncSnapshot struct {
+	snapshot *common.SnapshotV2
 }
 
 func (c *marketChannel) handleSubscriber(client *Client) {
@@ -29,32 +50,53 @@ func (c *marketChannel) handleSubscriber(client *Client) {
 }
 
 func (c *marketChannel) handleMessage(msg *common.WebSocketMessage) {
-	var commonPayload struct {
-		Type string
-	}
-
-	bts, _ := json.Marshal(msg.Payload)
-	_ = json.Unmarshal(bts, &commonPayload)
-
 	var messageToBeSent interface{}
 
-	switch commonPayload.Type {
-	case common.WsTypeNewMarketTrade:
-		var p common.WebsocketMarketNewMarketTradePayload
-		_ = json.Unmarshal(bts, &p)
-		messageToBeSent = &p
-	default:
-		var p common.WebsocketMarketOrderChangePayload
-		_ = json.Unmarshal(bts, &p)
+	switch p := msg.Payload.(type) {
+	case *common.WebsocketMarketNewMarketTradePayload:
+		messageToBeSent = p
+	case *common.WebsocketMarketOrderChangePayload:
+		if c.resyncing {
+			c.bufferChange(p)
+			return
+		}
 
 		// if current message is already aggregated in orderbook, skip it
 		if p.Sequence <= c.Orderbook.Sequence {
 			return
 		}
 
-		res := c.Orderbook.onMessage(&p)
+		// messages of the market have consecutive sequences, some were dropped before this one
+		if p.Sequence > c.Orderbook.Sequence+1 {
+			utils.Errorf("market channel %s missed messages from %d to %d, resync orderbook", c.MarketID, c.Orderbook.Sequence+1, p.Sequence-1)
+			c.resync()
+			c.bufferChange(p)
+			return
+		}
+
+		defer func() {
+			if r := recover(); r != nil {
+				// the orderbook may be half changed
+				c.resync()
+				panic(r)
+			}
+		}()
+
+		res := c.Orderbook.onMessage(p)
 
 		messageToBeSent = newOrderbookLevel2Update(c.MarketID, res.Side, res.Price.String(), res.Amount.String())
+	case *resyncSnapshot:
+		if p.snapshot == nil {
+			c.resyncing = false
+			c.resync()
+			return
+		}
+
+		c.applySnapshot(p.snapshot)
+		return
+	default:
+		addDeadLetter(DeadLetterInvalid, fmt.Errorf("unknown payload %T of market channel", msg.Payload), c.ID, deadLetterData(msg))
+		return
 	}
 
 	for _, client := range c.Clients {
@@ -69,6 +111,71 @@ func (c *marketChannel) handleMessage(msg *common.WebSocketMessage) {
 	}
 }
 
+// resync fetches a new snapshot outside of the channel goroutine, at most once in MarketChannelResyncInterval.
+// Gaps found while a snapshot is fetched are covered by it, so they don't fetch again.
+func (c *marketChannel) resync() {
+	if c.resyncing {
+		return
+	}
+
+	c.resyncing = true
+
+	delay := MarketChannelResyncInterval - time.Since(c.lastResyncAt)
+	c.lastResyncAt = time.Now().Add(delay)
+
+	go func() {
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+
+		var snapshot *common.SnapshotV2
+
+		// a failed fetch gives back no snapshot, the channel fetches again after the interval
+		defer func() {
+			if r := recover(); r != nil {
+				utils.Errorf("market channel %s fetch snapshot error: %v", c.MarketID, r)
+			}
+
+			c.AddMessage(&common.WebSocketMessage{ChannelID: c.ID, Payload: &resyncSnapshot{snapshot: snapshot}})
+		}()
+
+		snapshot = c.fetcher.GetV2(c.MarketID)
+	}()
+}
+
+func (c *marketChannel) bufferChange(p *common.WebsocketMarketOrderChangePayload) {
+	if len(c.resyncBuffer) >= marketChannelResyncBufferSize {
+		c.resyncBuffer[0] = nil
+		c.resyncBuffer = c.resyncBuffer[1:]
+	}
+
+	c.resyncBuffer = append(c.resyncBuffer, p)
+}
+
+// applySnapshot rebuilds the orderbook, sends it to all clients and applies changes buffered after it
+func (c *marketChannel) applySnapshot(snapshot *common.SnapshotV2) {
+	c.Orderbook = initOrderbook(c.MarketID, snapshot)
+	c.Resyncs++
+	c.resyncing = false
+
+	msg := newOrderbookLevel2Snapshot(c.MarketID, snapshot.Bids, snapshot.Asks)
+
+	for _, client := range c.Clients {
+		if err := client.Send(msg); err != nil {
+			utils.Debugf("send message to client error: %v", err)
+			c.handleUnsubscriber(client.ID)
+		}
+	}
+
+	buffered := c.resyncBuffer
+	c.resyncBuffer = nil
+
+	// a gap among them starts another resync, which buffers the rest again
+	for _, p := range buffered {
+		c.handleMessage(&common.WebSocketMessage{ChannelID: c.ID, Payload: p})
+	}
+}
+
 func NewMarketChannelCreator(fetcher SnapshotFetcher) func(channelID string) IChannel {
 	return func(channelID string) IChannel {
 		marketID := strings.Replace(channelID, fmt.Sprintf("%s#", common.MarketChannelPrefix), "", -1)
@@ -76,6 +183,7 @@ func NewMarketChannelCreator(fetcher SnapshotFetcher) func(channelID string) ICh
 		channel := &marketChannel{
 			MarketID: marketID,
 			Channel:  createBaseChannel(channelID),
+			fetcher:  fetcher,
 		}
 
 		snapshot := fetcher.GetV2(marketID)
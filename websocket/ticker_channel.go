@@ -0,0 +1,140 @@
+package websocket
+
+import (
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/novaprotocolio/sdk-backend/utils"
+	"sort"
+	"strings"
+)
+
+// TickerFetcher returns the tickers sent to new subscribers, all markets if marketID is empty
+type TickerFetcher interface {
+	GetTickers(marketID string) ([]*common.Ticker, error)
+}
+
+type AggregatorTickerFetcher struct {
+	Aggregator *common.TickerAggregator
+}
+
+func (f *AggregatorTickerFetcher) GetTickers(marketID string) ([]*common.Ticker, error) {
+	if marketID == "" {
+		return f.Aggregator.Tickers(), nil
+	}
+
+	if ticker, exist := f.Aggregator.Ticker(marketID); exist {
+		return []*common.Ticker{ticker}, nil
+	}
+
+	return []*common.Ticker{}, nil
+}
+
+type tickerSnapshot struct {
+	Type    string           `json:"type"`
+	Tickers []*common.Ticker `json:"tickers"`
+}
+
+type tickerUpdate struct {
+	Type   string         `json:"type"`
+	Ticker *common.Ticker `json:"ticker"`
+}
+
+// tickerChannel is the channel of one market, or of all markets if MarketID is empty
+type tickerChannel struct {
+	*Channel
+	MarketID string
+
+	fetcher TickerFetcher
+
+	// latest tickers received, they may be newer than the fetched ones
+	latest map[string]*common.Ticker
+}
+
+func (c *tickerChannel) handleSubscriber(client *Client) {
+	c.Channel.handleSubscriber(client)
+
+	tickers, err := c.fetcher.GetTickers(c.MarketID)
+	if err != nil {
+		utils.Errorf("get tickers of channel %s error: %v", c.ID, err)
+	}
+
+	msg := &tickerSnapshot{
+		Type:    "tickerSnapshot",
+		Tickers: c.mergeLatest(tickers),
+	}
+
+	if err = client.Send(msg); err != nil {
+		utils.Debugf("send message to client error: %v", err)
+		c.handleUnsubscriber(client.ID)
+	}
+}
+
+func (c *tickerChannel) handleMessage(msg *common.WebSocketMessage) {
+	p, ok := msg.Payload.(*common.WebsocketTickerUpdatePayload)
+	if !ok || p.Ticker == nil {
+		utils.Errorf("invalid ticker update %T of channel %s", msg.Payload, c.ID)
+		return
+	}
+
+	if c.MarketID != "" && p.Ticker.MarketID != c.MarketID {
+		return
+	}
+
+	if latest, exist := c.latest[p.Ticker.MarketID]; exist && latest.UpdatedAt > p.Ticker.UpdatedAt {
+		return
+	}
+
+	c.latest[p.Ticker.MarketID] = p.Ticker
+
+	messageToBeSent := &tickerUpdate{
+		Type:   common.WsTypeTickerUpdate,
+		Ticker: p.Ticker,
+	}
+
+	for _, client := range c.Clients {
+		if err := client.Send(messageToBeSent); err != nil {
+			utils.Debugf("send message to client error: %v", err)
+			c.handleUnsubscriber(client.ID)
+		}
+	}
+}
+
+// mergeLatest replaces fetched tickers with newer ones received by the channel
+func (c *tickerChannel) mergeLatest(tickers []*common.Ticker) []*common.Ticker {
+	merged := make(map[string]*common.Ticker, len(tickers)+len(c.latest))
+
+	for _, ticker := range tickers {
+		merged[ticker.MarketID] = ticker
+	}
+
+	for marketID, ticker := range c.latest {
+		if fetched, exist := merged[marketID]; !exist || fetched.UpdatedAt < ticker.UpdatedAt {
+			merged[marketID] = ticker
+		}
+	}
+
+	res := make([]*common.Ticker, 0, len(merged))
+	for _, ticker := range merged {
+		res = append(res, ticker)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].MarketID < res[j].MarketID
+	})
+
+	return res
+}
+
+// NewTickerChannelCreator creates the channel Ticker of all markets and channels like Ticker#HOT-WETH,
+// register it with RegisterChannelCreator(common.TickerChannelPrefix, ...)
+func NewTickerChannelCreator(fetcher TickerFetcher) func(channelID string) IChannel {
+	return func(channelID string) IChannel {
+		marketID := strings.TrimPrefix(strings.TrimPrefix(channelID, common.TickerChannelPrefix), "#")
+
+		return &tickerChannel{
+			Channel:  createBaseChannel(channelID),
+			MarketID: marketID,
+			fetcher:  fetcher,
+			latest:   make(map[string]*common.Ticker),
+		}
+	}
+}
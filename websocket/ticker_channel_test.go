@@ -0,0 +1,44 @@
+package websocket
+
+import (
+	"github.com/novaprotocolio/sdk-backend/common"
+	"github.com/shopspring/decimal"
+)
+
+func (s *channelTestSuit) TestRunTickerChannel() {
+	aggregator := common.NewTickerAggregator()
+	aggregator.AddTrade("HOT-WETH", decimal.New(2, 0), decimal.New(1, 0), 100)
+	aggregator.AddTrade("ABC-WETH", decimal.New(3, 0), decimal.New(1, 0), 100)
+
+	creator := NewTickerChannelCreator(&AggregatorTickerFetcher{Aggregator: aggregator})
+
+	all := creator(common.TickerChannelPrefix).(*tickerChannel)
+	market := creator(common.GetTickerChannelID("HOT-WETH")).(*tickerChannel)
+	s.Equal("", all.MarketID)
+	s.Equal("HOT-WETH", market.MarketID)
+
+	go runChannel(all)
+	go runChannel(market)
+
+	c1, c1Connection := s.InitRecordingClient()
+	c2, c2Connection := s.InitRecordingClient()
+	all.AddSubscriber(c1)
+	market.AddSubscriber(c2)
+
+	s.Len(c1Connection.next().(*tickerSnapshot).Tickers, 2)
+	s.Len(c2Connection.next().(*tickerSnapshot).Tickers, 1)
+
+	msgs := aggregator.AddTrade("HOT-WETH", decimal.New(3, 0), decimal.New(1, 0), 200)
+	market.AddMessage(&msgs[0])
+	all.AddMessage(&msgs[1])
+
+	s.IsType(&tickerUpdate{}, c1Connection.next())
+	update := c2Connection.next().(*tickerUpdate)
+	s.Equal("3", update.Ticker.LastPrice.String())
+	s.Equal("50", update.Ticker.PriceChangePercent.String())
+
+	// an older update is dropped
+	old := common.TickerUpdateMessages(&common.Ticker{MarketID: "HOT-WETH", UpdatedAt: 150})
+	market.AddMessage(&old[0])
+	s.True(c2Connection.idle())
+}
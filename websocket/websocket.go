@@ -10,6 +10,7 @@ var channelCreators = make(map[string]func(channelID string) IChannel)
 type WSServer struct {
 	addr        string        // addr the websocket is listened on
 	sourceQueue common.IQueue // a queue to get
+	sourceBus   common.IBus   // or a bus to subscribe, so every server gets every message
 }
 
 func NewWSServer(addr string, sourceQueue common.IQueue) *WSServer {
@@ -25,11 +26,32 @@ func NewWSServer(addr string, sourceQueue common.IQueue) *WSServer {
 	return s
 }
 
+// NewWSServerWithBus returns a server consuming its own subscription of the bus,
+// several servers on the same bus all receive every message.
+func NewWSServerWithBus(addr string, sourceBus common.IBus) *WSServer {
+	s := NewWSServer(addr, nil)
+	s.sourceBus = sourceBus
+
+	return s
+}
+
 func RegisterChannelCreator(prefix string, fn func(channelID string) IChannel) {
 	channelCreators[prefix] = fn
 }
 
 func (s *WSServer) Start(ctx context.Context) {
-	go startConsumer(ctx, s.sourceQueue)
+	source := s.sourceQueue
+
+	if s.sourceBus != nil {
+		subscription, err := s.sourceBus.Subscribe()
+		if err != nil {
+			panic(err)
+		}
+
+		defer subscription.Close()
+		source = subscription
+	}
+
+	go startConsumer(ctx, source)
 	startSocketServer(ctx, s.addr)
 }